@@ -0,0 +1,324 @@
+package calc
+
+import (
+	"encoding/csv"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+* assign.go
+* 该模块用来将没有归属的实验峰自动归属到计算得到的化学位移上，并与实验值做比较
+*
+*	1. 首先将计算值划分为若干个位点：每个碳原子为一个位点，甲基上的三个氢由于快速旋转而化学等价，合并为一个位点；
+*	   已经在实验数据中手动归属过的原子不再参与自动归属
+*	2. 每一个实验峰根据其 count（该峰包含的位点数，默认为 1）展开为 count 个槽位
+*	3. 以 |delta(exp) - delta(calc)| 为代价矩阵，使用匈牙利算法求槽位到位点的最优匹配，
+*	   最后同一个实验峰的所有位点合并为这个峰的归属，峰的计算值为这些位点的化学位移的平均值
+*
+* @Author: Kimariyb
+* @Address: XiaMen University
+* @Data: 2023-09-23
+ */
+
+// shiftSite 一个计算位点，即一组化学等价的原子以及它们的平均化学位移
+type shiftSite struct {
+	Atoms []int
+	Shift float64
+}
+
+// predictedSites 返回 nucleus 核的所有计算位点，exclude 中的原子不参与
+func predictedSites(result *NMRResult, nucleus string, exclude map[int]bool) []shiftSite {
+	shifts := result.ShiftMap()
+	geometry := result.LowestConformer().Cluster
+	grouped := make(map[int]bool)
+
+	var sites []shiftSite
+	// 甲基上的氢合并为一个位点
+	if nucleus == "H" && len(geometry.Atoms) > 0 {
+		for i, atom := range geometry.Atoms {
+			if atom.Symbol != "C" {
+				continue
+			}
+			var hydrogens []int
+			for _, neighbor := range neighbors(&geometry, i) {
+				if geometry.Atoms[neighbor].Symbol == "H" {
+					hydrogens = append(hydrogens, neighbor+1)
+				}
+			}
+			if len(hydrogens) != 3 {
+				continue
+			}
+
+			site := shiftSite{}
+			for _, hydrogen := range hydrogens {
+				if hydrogenShift, ok := shifts[hydrogen]; ok && !exclude[hydrogen] {
+					site.Atoms = append(site.Atoms, hydrogen)
+					site.Shift += hydrogenShift.Shift
+				}
+				grouped[hydrogen] = true
+			}
+			if len(site.Atoms) > 0 {
+				site.Shift /= float64(len(site.Atoms))
+				sites = append(sites, site)
+			}
+		}
+	}
+
+	for _, nucleusShift := range result.Nuclei {
+		if !nucleusShift.Referenced || nucleusShift.Symbol != nucleus {
+			continue
+		}
+		if exclude[nucleusShift.Index] || grouped[nucleusShift.Index] {
+			continue
+		}
+		sites = append(sites, shiftSite{Atoms: []int{nucleusShift.Index}, Shift: nucleusShift.Shift})
+	}
+
+	sort.SliceStable(sites, func(i, j int) bool {
+		return sites[i].Atoms[0] < sites[j].Atoms[0]
+	})
+
+	return sites
+}
+
+// AssignPeaks 将 peaks 中没有归属（Atoms 为空）的实验峰自动归属到 result 的计算化学位移上
+// 返回一个新的 ExpPeak 切片，自动归属的峰 Auto 为 true，已经手动归属的峰保持不变
+func AssignPeaks(result *NMRResult, peaks []ExpPeak) ([]ExpPeak, error) {
+	assigned := make([]ExpPeak, len(peaks))
+	copy(assigned, peaks)
+
+	for _, nucleus := range []string{"C", "H"} {
+		// 手动归属过的原子不再参与自动归属
+		exclude := make(map[int]bool)
+		var unassigned []int
+		for i, peak := range assigned {
+			if peak.Nucleus != nucleus {
+				continue
+			}
+			if len(peak.Atoms) == 0 {
+				unassigned = append(unassigned, i)
+			}
+			for _, atom := range peak.Atoms {
+				exclude[atom] = true
+			}
+		}
+		if len(unassigned) == 0 {
+			continue
+		}
+
+		// 每个实验峰按照 count 展开为若干个槽位
+		var slots []int
+		for _, i := range unassigned {
+			count := assigned[i].Count
+			if count < 1 {
+				count = 1
+			}
+			for c := 0; c < count; c++ {
+				slots = append(slots, i)
+			}
+		}
+
+		sites := predictedSites(result, nucleus, exclude)
+		if len(slots) > len(sites) {
+			return nil, fmt.Errorf("%d unassigned %s peaks but only %d %s sites left to assign",
+				len(slots), nucleus, len(sites), nucleus)
+		}
+
+		cost := make([][]float64, len(slots))
+		for s, i := range slots {
+			cost[s] = make([]float64, len(sites))
+			for j, site := range sites {
+				cost[s][j] = math.Abs(assigned[i].Shift - site.Shift)
+			}
+		}
+
+		for s, j := range hungarian(cost) {
+			i := slots[s]
+			assigned[i].Atoms = append(assigned[i].Atoms, sites[j].Atoms...)
+			assigned[i].Sites = append(assigned[i].Sites, sites[j].Atoms)
+			assigned[i].Auto = true
+		}
+	}
+
+	for i := range assigned {
+		if assigned[i].Auto {
+			sort.Ints(assigned[i].Atoms)
+		}
+	}
+
+	return assigned, nil
+}
+
+// hungarian 使用匈牙利算法求解 n x m (n <= m) 的最小代价匹配，返回每一行匹配到的列
+func hungarian(cost [][]float64) []int {
+	n := len(cost)
+	if n == 0 {
+		return nil
+	}
+	m := len(cost[0])
+
+	// u、v 为行和列的势，p[j] 为第 j 列匹配到的行（从 1 开始，0 表示未匹配），way 用于回溯增广路
+	u := make([]float64, n+1)
+	v := make([]float64, m+1)
+	p := make([]int, m+1)
+	way := make([]int, m+1)
+
+	for i := 1; i <= n; i++ {
+		p[0] = i
+		j0 := 0
+		minV := make([]float64, m+1)
+		used := make([]bool, m+1)
+		for j := range minV {
+			minV[j] = math.Inf(1)
+		}
+
+		for {
+			used[j0] = true
+			i0 := p[j0]
+			delta := math.Inf(1)
+			j1 := 0
+			for j := 1; j <= m; j++ {
+				if used[j] {
+					continue
+				}
+				current := cost[i0-1][j-1] - u[i0] - v[j]
+				if current < minV[j] {
+					minV[j] = current
+					way[j] = j0
+				}
+				if minV[j] < delta {
+					delta = minV[j]
+					j1 = j
+				}
+			}
+			for j := 0; j <= m; j++ {
+				if used[j] {
+					u[p[j]] += delta
+					v[j] -= delta
+				} else {
+					minV[j] -= delta
+				}
+			}
+			j0 = j1
+			if p[j0] == 0 {
+				break
+			}
+		}
+
+		// 沿增广路更新匹配
+		for j0 != 0 {
+			j1 := way[j0]
+			p[j0] = p[j1]
+			j0 = j1
+		}
+	}
+
+	assignment := make([]int, n)
+	for j := 1; j <= m; j++ {
+		if p[j] != 0 {
+			assignment[p[j]-1] = j - 1
+		}
+	}
+
+	return assignment
+}
+
+// PeakComparison 一个实验峰与其对应的计算值的比较
+type PeakComparison struct {
+	Peak      ExpPeak
+	Predicted float64
+	Error     float64
+}
+
+// ComparePeaks 将实验峰与计算化学位移比较，没有归属的实验峰会先调用 AssignPeaks 自动归属
+// 返回每一个峰的比较结果以及每一种核的平均绝对误差 (MAE)
+func ComparePeaks(result *NMRResult, peaks []ExpPeak) ([]PeakComparison, map[string]float64, error) {
+	assigned, err := AssignPeaks(result, peaks)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var comparisons []PeakComparison
+	sums := make(map[string]float64)
+	counts := make(map[string]int)
+	for _, peak := range assigned {
+		predicted, err := result.PeakShift(peak)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s peak at %.2f ppm: %w", peak.Nucleus, peak.Shift, err)
+		}
+		comparisons = append(comparisons, PeakComparison{
+			Peak:      peak,
+			Predicted: predicted,
+			Error:     predicted - peak.Shift,
+		})
+		sums[peak.Nucleus] += math.Abs(predicted - peak.Shift)
+		counts[peak.Nucleus]++
+	}
+
+	mae := make(map[string]float64)
+	for nucleus, sum := range sums {
+		mae[nucleus] = sum / float64(counts[nucleus])
+	}
+
+	return comparisons, mae, nil
+}
+
+// formatAtoms 将原子序号列表格式化为以空格分隔的字符串
+func formatAtoms(atoms []int) string {
+	fields := make([]string, len(atoms))
+	for i, atom := range atoms {
+		fields[i] = strconv.Itoa(atom)
+	}
+	return strings.Join(fields, " ")
+}
+
+// PrintComparison 打印实验值与计算值的比较结果，自动归属的峰用 * 标记
+func PrintComparison(comparisons []PeakComparison, mae map[string]float64) {
+	fmt.Println("Comparison between experimental and calculated shifts (ppm):")
+	for _, comparison := range comparisons {
+		mark := " "
+		if comparison.Peak.Auto {
+			mark = "*"
+		}
+		fmt.Printf(" %s %-2s\texp = %9.3f\tcalc = %9.3f\terror = %8.3f\tatoms: %s\n",
+			mark, comparison.Peak.Nucleus, comparison.Peak.Shift, comparison.Predicted,
+			comparison.Error, formatAtoms(comparison.Peak.Atoms))
+	}
+	for _, nucleus := range []string{"C", "H"} {
+		if value, ok := mae[nucleus]; ok {
+			fmt.Printf("MAE(%s) = %.3f ppm\n", nucleus, value)
+		}
+	}
+	fmt.Println("(* automatically assigned)")
+	fmt.Println()
+}
+
+// WriteComparisonCSV 将比较结果写入 csv 文件
+func WriteComparisonCSV(comparisons []PeakComparison, fileName string) error {
+	file, err := os.Create(fileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	writer := csv.NewWriter(file)
+	_ = writer.Write([]string{"nucleus", "exp", "calc", "error", "atoms", "auto"})
+	for _, comparison := range comparisons {
+		_ = writer.Write([]string{
+			comparison.Peak.Nucleus,
+			strconv.FormatFloat(comparison.Peak.Shift, 'f', 4, 64),
+			strconv.FormatFloat(comparison.Predicted, 'f', 4, 64),
+			strconv.FormatFloat(comparison.Error, 'f', 4, 64),
+			formatAtoms(comparison.Peak.Atoms),
+			strconv.FormatBool(comparison.Peak.Auto),
+		})
+	}
+	writer.Flush()
+
+	return writer.Error()
+}
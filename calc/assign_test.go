@@ -0,0 +1,93 @@
+package calc
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestHungarian(t *testing.T) {
+	tests := []struct {
+		name string
+		cost [][]float64
+		// want 为 nil 时最优匹配不唯一，只检查总代价
+		want     []int
+		wantCost float64
+	}{
+		{"empty", nil, nil, 0},
+		{"single row", [][]float64{{3, 1, 2}}, []int{1}, 1},
+		{"square", [][]float64{{4, 1, 3}, {2, 0, 5}, {3, 2, 2}}, []int{1, 0, 2}, 5},
+		{"rectangular", [][]float64{{10, 1, 5, 8}, {2, 9, 4, 7}}, []int{1, 0}, 3},
+		// 贪心地为第一行选最小的列会得到 1 + 10
+		{"rectangular not greedy", [][]float64{{1, 2, 10}, {1, 10, 10}}, []int{1, 0}, 3},
+		{"ties", [][]float64{{1, 1, 1}, {1, 1, 1}}, nil, 2},
+		{"partial ties", [][]float64{{0.5, 0.5, 3}, {0.5, 2, 0.5}}, nil, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assignment := hungarian(test.cost)
+			if len(assignment) != len(test.cost) {
+				t.Fatalf("hungarian = %v, want one column per row", assignment)
+			}
+			used := make(map[int]bool)
+			total := 0.0
+			for row, column := range assignment {
+				if used[column] {
+					t.Errorf("hungarian = %v: column %d is matched twice", assignment, column)
+				}
+				used[column] = true
+				total += test.cost[row][column]
+			}
+			if !approxEqual(total, test.wantCost, 1e-12) {
+				t.Errorf("hungarian = %v: cost %g, want %g", assignment, total, test.wantCost)
+			}
+			if test.want != nil && !reflect.DeepEqual(assignment, test.want) {
+				t.Errorf("hungarian = %v, want %v", assignment, test.want)
+			}
+		})
+	}
+}
+
+// methylResult 返回 CH3-CH 片段的 NMR 结果：甲基上的氢 2-4 为 1.0 ppm，次甲基上的氢 6 为 3.0 ppm
+func methylResult() *NMRResult {
+	cluster := Cluster{Atoms: []Atom{
+		{"C", 0, 0, 0},
+		{"H", -0.36, 1.03, 0},
+		{"H", -0.36, -0.51, 0.89},
+		{"H", -0.36, -0.51, -0.89},
+		{"C", 1.54, 0, 0},
+		{"H", 2.0, 1.0, 0},
+	}}
+	return shiftResult(cluster, map[int]float64{2: 1.0, 3: 1.0, 4: 1.0, 6: 3.0})
+}
+
+func TestAssignPeaksAveragesPerSite(t *testing.T) {
+	result := methylResult()
+	peaks := []ExpPeak{{Nucleus: "H", Shift: 2.0, Count: 2}}
+
+	assigned, err := AssignPeaks(result, peaks)
+	if err != nil {
+		t.Fatalf("AssignPeaks: %v", err)
+	}
+	peak := assigned[0]
+	if !peak.Auto || !reflect.DeepEqual(peak.Atoms, []int{2, 3, 4, 6}) {
+		t.Errorf("assigned peak %+v, want atoms 2 3 4 6", peak)
+	}
+	if !reflect.DeepEqual(peak.Sites, [][]int{{2, 3, 4}, {6}}) {
+		t.Errorf("sites %v, want the methyl and the methine", peak.Sites)
+	}
+
+	// 两个位点的权重相同：(1.0 + 3.0) / 2，而不是按照原子数得到 1.5
+	comparisons, mae, err := ComparePeaks(result, peaks)
+	if err != nil {
+		t.Fatalf("ComparePeaks: %v", err)
+	}
+	if !approxEqual(comparisons[0].Predicted, 2.0, 1e-12) || !approxEqual(mae["H"], 0, 1e-12) {
+		t.Errorf("predicted %g with MAE %g, want 2 and 0", comparisons[0].Predicted, mae["H"])
+	}
+
+	// 手动归属的峰仍然按照原子平均
+	manual := ExpPeak{Nucleus: "H", Shift: 1.5, Atoms: []int{2, 3, 4, 6}}
+	if shift, err := result.PeakShift(manual); err != nil || !approxEqual(shift, 1.5, 1e-12) {
+		t.Errorf("PeakShift of a manual peak = %g, %v, want 1.5", shift, err)
+	}
+}
@@ -0,0 +1,239 @@
+package calc
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+/*
+* backend.go
+* 该模块定义了运行 DFT 任务的后端 Backend
+*
+*	RunDFTStage 生成所有的输入文件之后，交给 Backend 运行：
+*		local: 在本机上依次运行每一个任务（默认）
+*		slurm/pbs: 为每一个任务生成提交脚本，使用 sbatch/qsub 提交到作业调度系统，
+*		           并且定时使用 squeue/qstat 查询，直到所有任务结束，见 batch.go
+*	不管使用哪一个后端，out 文件都写在 thermo/<stage> 文件夹中，之后的步骤不需要区分
+*
+* @Author: Kimariyb
+* @Address: XiaMen University
+* @Data: 2023-09-26
+ */
+
+// Job 一个 DFT 任务
+//   - Index: 任务编号，从 1 开始
+//   - InputFile: 输入文件，如 thermo/opt/cluster-opt1.gjf
+//   - OutFile: 输出文件，如 thermo/opt/cluster-opt1.out
+type Job struct {
+	Index     int
+	InputFile string
+	OutFile   string
+}
+
+// 任务的状态
+const (
+	JobNormal      = "normal"
+	JobAbnormal    = "abnormal"
+	JobInterrupted = "interrupted"
+	JobNotRun      = "not run"
+)
+
+// JobResult 一个任务的运行结果，写入 report.json
+//   - Index: 任务编号，从 1 开始
+//   - Input、Output: 输入文件和 out 文件
+//   - JobID: 作业调度系统的作业号，在本机上运行时为空
+//   - Status: JobNormal、JobAbnormal、JobInterrupted 或者 JobNotRun
+//   - StartedAt: 开始运行（使用作业调度系统时为提交）的时间，RFC 3339 格式
+//   - Seconds: 运行时间，使用作业调度系统时包括排队的时间
+type JobResult struct {
+	Index     int     `json:"index"`
+	Input     string  `json:"input"`
+	Output    string  `json:"output"`
+	JobID     string  `json:"jobId,omitempty"`
+	Status    string  `json:"status"`
+	StartedAt string  `json:"startedAt,omitempty"`
+	Seconds   float64 `json:"seconds"`
+}
+
+// 任务开始和结束时的日志消息，kybnmr status 读取 kybnmr.log 中的这些记录得到每一个任务的运行时间
+const (
+	LogJobStarted   = "running job"
+	LogJobSubmitted = "submitted job"
+	LogJobCompleted = "job completed"
+	LogJobFinished  = "job finished"
+)
+
+// newJobResults 为 jobs 中的每一个任务返回一个还没有运行的 JobResult
+func newJobResults(jobs []Job) []JobResult {
+	results := make([]JobResult, len(jobs))
+	for i, job := range jobs {
+		results[i] = JobResult{Index: job.Index, Input: job.InputFile, Output: job.OutFile, Status: JobNotRun}
+	}
+	return results
+}
+
+// start 记录任务开始运行的时间
+func (r *JobResult) start(now time.Time) {
+	r.StartedAt = now.Format(time.RFC3339)
+}
+
+// finish 记录任务的状态和从 started 开始的运行时间
+func (r *JobResult) finish(status string, started time.Time) {
+	r.Status = status
+	r.Seconds = roundSeconds(time.Since(started))
+}
+
+// roundSeconds 将 duration 转换为保留两位小数的秒数
+func roundSeconds(duration time.Duration) float64 {
+	return float64(duration.Round(10*time.Millisecond)) / float64(time.Second)
+}
+
+// Backend 运行 DFT 任务的后端
+type Backend interface {
+	// Name 返回后端的名字，如 local
+	Name() string
+	// RunJobs 使用 engine 运行 stage 步骤的所有任务，所有任务都正常结束才返回 nil 错误，
+	// 不管是否出错都返回每一个任务的 JobResult
+	// ctx 被取消时结束所有还在运行的任务，并将它们标记为中断
+	// 每一个任务开始和结束时都记录到 progress 中
+	RunJobs(ctx context.Context, engine Engine, stage Stage, jobs []Job, progress *Progress) ([]JobResult, error)
+}
+
+// JobDirEngine 需要在特定文件夹中运行的 Engine 实现该接口，例如 xtb 在每个任务单独的文件夹中运行
+// 没有实现该接口的 Engine 在 KYBNMR 的运行目录中运行
+type JobDirEngine interface {
+	JobDir(inputFile string, outFile string) string
+}
+
+// LocalOnlyEngine 不能提交到作业调度系统的 Engine 实现该接口，LocalOnly 返回 true 时 BatchBackend 在本机上运行它的任务，
+// 例如 FakeEngine 不调用外部程序，没有可以写入提交脚本的命令
+type LocalOnlyEngine interface {
+	LocalOnly() bool
+}
+
+// localOnly engine 只能在本机上运行时返回 true
+func localOnly(engine Engine) bool {
+	local, ok := engine.(LocalOnlyEngine)
+	return ok && local.LocalOnly()
+}
+
+// jobDir 返回 engine 运行 job 时所在文件夹的绝对路径，以及 job 的输入文件和输出文件的绝对路径
+func jobDir(engine Engine, job Job) (string, string, string, error) {
+	inputPath, outPath, err := absPaths(job.InputFile, job.OutFile)
+	if err != nil {
+		return "", "", "", err
+	}
+
+	if dirEngine, ok := engine.(JobDirEngine); ok {
+		return dirEngine.JobDir(inputPath, outPath), inputPath, outPath, nil
+	}
+
+	currentDir, err := os.Getwd()
+	if err != nil {
+		return "", "", "", err
+	}
+	return currentDir, inputPath, outPath, nil
+}
+
+// NewBackend 根据 [batch] 中的 scheduler 创建 Backend，每个任务的最长运行时间由 [walltime] 决定
+func NewBackend(config *Config) (Backend, error) {
+	switch config.BatchConfig.Scheduler {
+	case "", "local":
+		return &LocalBackend{WallTime: config.WallTimeConfig}, nil
+	case "slurm", "pbs":
+		return NewBatchBackend(&config.BatchConfig, &config.WallTimeConfig), nil
+	default:
+		return nil, fmt.Errorf("unknown scheduler: %s (available: local, slurm, pbs)", config.BatchConfig.Scheduler)
+	}
+}
+
+// WithWallTime 返回一个最长运行 wallTime 的 ctx，wallTime 不大于 0 时不限制运行时间
+func WithWallTime(ctx context.Context, wallTime time.Duration) (context.Context, context.CancelFunc) {
+	if wallTime <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, wallTime)
+}
+
+// InterruptedSuffix 被中断的任务的 out 文件会加上这个后缀，
+// 这样之后读取 thermo 文件夹时不会把不完整的 out 文件当作结果，再次运行时这些任务会被重新计算
+const InterruptedSuffix = ".interrupted"
+
+// markInterrupted 将 job 的 out 文件重命名为 xxx.out.interrupted
+func markInterrupted(job Job) {
+	if _, err := os.Stat(job.OutFile); err != nil {
+		return
+	}
+	if err := os.Rename(job.OutFile, job.OutFile+InterruptedSuffix); err != nil {
+		slog.Error("error marking interrupted job", "conformer", job.Index, "error", err)
+		return
+	}
+	slog.Warn("job was interrupted", "conformer", job.Index, "out", job.OutFile, "renamed", job.OutFile+InterruptedSuffix)
+}
+
+// checkTermination 检查 job 是否正常结束
+func checkTermination(engine Engine, job Job) error {
+	if !engine.IsNormalTermination(job.OutFile) {
+		return fmt.Errorf("%s terminated abnormally: %s", engine.Name(), job.OutFile)
+	}
+	return nil
+}
+
+// LocalBackend 在本机上依次运行每一个任务，WallTime 为每个任务的最长运行时间
+type LocalBackend struct {
+	WallTime WallTimeConfig
+}
+
+// Name 返回后端的名字
+func (l *LocalBackend) Name() string {
+	return "local"
+}
+
+// RunJobs 依次运行每一个任务，每个任务结束后都检查程序是否正常结束
+// 超过最长运行时间或者 ctx 被取消的任务会被结束，并标记为中断
+func (l *LocalBackend) RunJobs(ctx context.Context, engine Engine, stage Stage, jobs []Job, progress *Progress) ([]JobResult, error) {
+	wallTime := l.WallTime.ForStage(stage)
+	results := newJobResults(jobs)
+	for i, job := range jobs {
+		// 输出正在运行 xxx.gjf 或者 xxx.inp
+		slog.Info(LogJobStarted, "program", engine.Name(), "conformer", job.Index, "input", filepath.Base(job.InputFile))
+
+		started := time.Now()
+		results[i].start(started)
+		progress.JobStarted(job, started)
+		finish := func(status string) {
+			results[i].finish(status, started)
+			progress.JobFinished(job, status, time.Now())
+		}
+		jobCtx, cancel := WithWallTime(ctx, wallTime)
+		err := engine.Run(jobCtx, stage, job.InputFile, job.OutFile)
+		jobErr := jobCtx.Err()
+		cancel()
+
+		if jobErr != nil {
+			finish(JobInterrupted)
+			markInterrupted(job)
+			if ctx.Err() != nil {
+				return results, fmt.Errorf("%s %s interrupted: %w", engine.Name(), stage, ctx.Err())
+			}
+			return results, fmt.Errorf("%s %w of %s: %s", engine.Name(), errWallTime, wallTime, job.InputFile)
+		}
+		if err != nil {
+			finish(JobAbnormal)
+			return results, fmt.Errorf("error executing %s: %w", engine.Name(), err)
+		}
+		if err := checkTermination(engine, job); err != nil {
+			finish(JobAbnormal)
+			return results, err
+		}
+		finish(JobNormal)
+
+		slog.Info(LogJobCompleted, "program", engine.Name(), "conformer", job.Index, "seconds", results[i].Seconds)
+	}
+
+	return results, nil
+}
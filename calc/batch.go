@@ -0,0 +1,312 @@
+package calc
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+/*
+* batch.go
+* 该模块实现了使用作业调度系统 (SLURM/PBS) 运行 DFT 任务的 Backend
+*
+*	1. 为每一个任务在 thermo/<stage> 中生成一个提交脚本 cluster-<stage>1.sh，脚本中包含作业名、
+*	   调度系统的日志文件、[batch] header 文件的内容（用来写队列、核数、内存等指令），以及运行 Engine 的命令
+*	2. 使用 submitCommand (默认为 sbatch/qsub) 提交所有脚本，提交命令输出的最后一个字段作为作业号
+*	3. 每隔 pollInterval 秒使用 statusCommand (默认为 squeue -h -j/qstat) 查询每一个作业，
+*	   输出中没有一个字段是该作业号，或者调度系统报告作业号不存在时，认为该作业已经结束；
+*	   其他的查询失败 (如调度系统暂时没有响应) 不能说明作业的状态，下一次查询时重试
+*	4. 作业结束之后检查 out 文件是否正常结束。提交脚本在 Engine 的命令结束后写入 cluster-<stage>1.exit，
+*	   没有这个文件说明作业在命令结束之前就被调度系统结束了 (如超过 [walltime] 中的最长运行时间)，
+*	   这样的作业和 Ctrl-C 一样标记为中断
+*	5. 如果 KYBNMR 被中断 (如 Ctrl-C)，使用 cancelCommand (默认为 scancel/qdel) 取消所有还没有结束的作业，
+*	   并将它们标记为中断；[walltime] 中的最长运行时间会写入提交脚本，由调度系统负责结束超时的作业
+*
+*	提交命令和查询命令都可以在配置文件中修改，例如换成模拟调度系统的 shell 脚本，用来在没有集群的机器上测试
+*
+* @Author: Kimariyb
+* @Address: XiaMen University
+* @Data: 2023-09-26
+ */
+
+// jobNumberRegex 匹配作业号开头的数字，PBS 的作业号形如 12345.server
+var jobNumberRegex = regexp.MustCompile(`^\d+`)
+
+// jobGoneRegex 匹配作业已经离开队列时 squeue/qstat 的错误输出
+var jobGoneRegex = regexp.MustCompile(`(?i)invalid job id|unknown job id|job has finished`)
+
+// ExitStatusSuffix 提交脚本将 Engine 命令的退出码写入与输入文件同名、带有这个后缀的文件
+const ExitStatusSuffix = ".exit"
+
+// batchStatusRetries 连续查询失败这么多次之后放弃等待该作业
+const batchStatusRetries = 10
+
+// BatchBackend 使用 SLURM 或者 PBS 运行任务的 Backend
+type BatchBackend struct {
+	Scheduler     string
+	SubmitCommand string
+	StatusCommand string
+	CancelCommand string
+	PollInterval  time.Duration
+	HeaderFile    string
+	WallTime      WallTimeConfig
+}
+
+// NewBatchBackend 根据 [batch] 中的配置创建 BatchBackend，没有配置的命令使用调度系统的默认命令
+func NewBatchBackend(batchConfig *BatchConfig, wallTime *WallTimeConfig) *BatchBackend {
+	backend := &BatchBackend{
+		Scheduler:     batchConfig.Scheduler,
+		SubmitCommand: batchConfig.SubmitCommand,
+		StatusCommand: batchConfig.StatusCommand,
+		CancelCommand: batchConfig.CancelCommand,
+		PollInterval:  time.Duration(batchConfig.PollInterval) * time.Second,
+		HeaderFile:    batchConfig.HeaderFile,
+		WallTime:      *wallTime,
+	}
+
+	if backend.SubmitCommand == "" {
+		backend.SubmitCommand = map[string]string{"slurm": "sbatch", "pbs": "qsub"}[backend.Scheduler]
+	}
+	if backend.StatusCommand == "" {
+		backend.StatusCommand = map[string]string{"slurm": "squeue -h -j", "pbs": "qstat"}[backend.Scheduler]
+	}
+	if backend.CancelCommand == "" {
+		backend.CancelCommand = map[string]string{"slurm": "scancel", "pbs": "qdel"}[backend.Scheduler]
+	}
+	if backend.PollInterval <= 0 {
+		backend.PollInterval = 30 * time.Second
+	}
+
+	return backend
+}
+
+// Name 返回调度系统的名字
+func (b *BatchBackend) Name() string {
+	return b.Scheduler
+}
+
+// RunJobs 提交所有任务，等待所有任务结束之后检查每一个任务是否正常结束
+func (b *BatchBackend) RunJobs(ctx context.Context, engine Engine, stage Stage, jobs []Job, progress *Progress) ([]JobResult, error) {
+	// 没有可以提交的命令的 Engine 直接在本机上运行
+	if localOnly(engine) {
+		return (&LocalBackend{WallTime: b.WallTime}).RunJobs(ctx, engine, stage, jobs, progress)
+	}
+
+	results := newJobResults(jobs)
+	header := ""
+	if b.HeaderFile != "" {
+		contents, err := ioutil.ReadFile(b.HeaderFile)
+		if err != nil {
+			return results, fmt.Errorf("error reading batch header file: %w", err)
+		}
+		header = strings.TrimRight(string(contents), "\n") + "\n"
+	}
+
+	// pending 记录还没有结束的作业号到任务在 jobs 中的位置的映射，submitted 记录每一个任务的提交时间
+	pending := make(map[string]int)
+	failures := make(map[string]int)
+	submitted := make([]time.Time, len(jobs))
+	for i, job := range jobs {
+		script, err := b.writeScript(engine, stage, job, header)
+		if err != nil {
+			return results, err
+		}
+		jobID, err := b.submit(ctx, script)
+		if err != nil {
+			b.cancelAll(jobs, results, pending, submitted, progress)
+			return results, err
+		}
+		slog.Info(LogJobSubmitted, "scheduler", b.Scheduler, "conformer", job.Index, "script", filepath.Base(script), "job", jobID)
+		submitted[i] = time.Now()
+		results[i].start(submitted[i])
+		results[i].JobID = jobID
+		pending[jobID] = i
+		progress.JobStarted(job, submitted[i])
+	}
+
+	for len(pending) > 0 {
+		select {
+		case <-ctx.Done():
+			b.cancelAll(jobs, results, pending, submitted, progress)
+			return results, fmt.Errorf("%s %s interrupted: %w", engine.Name(), stage, ctx.Err())
+		case <-time.After(b.PollInterval):
+		}
+		for jobID, i := range pending {
+			active, err := b.isActive(jobID)
+			if err != nil {
+				failures[jobID]++
+				slog.Warn("error querying job", "scheduler", b.Scheduler, "conformer", jobs[i].Index, "job", jobID,
+					"attempt", failures[jobID], "error", err)
+				if failures[jobID] >= batchStatusRetries {
+					b.cancelAll(jobs, results, pending, submitted, progress)
+					return results, fmt.Errorf("error querying %s job %s: %w", b.Scheduler, jobID, err)
+				}
+				continue
+			}
+			delete(failures, jobID)
+			if active {
+				continue
+			}
+			delete(pending, jobID)
+			status := finishedStatus(engine, jobs[i])
+			results[i].finish(status, submitted[i])
+			if status == JobInterrupted {
+				markInterrupted(jobs[i])
+			}
+			progress.JobFinished(jobs[i], status, time.Now())
+			slog.Info(LogJobFinished, "scheduler", b.Scheduler, "conformer", jobs[i].Index, "job", jobID, "left", len(pending))
+		}
+	}
+
+	var failed, killed []string
+	for i, job := range jobs {
+		switch results[i].Status {
+		case JobInterrupted:
+			killed = append(killed, job.OutFile)
+		case JobAbnormal:
+			failed = append(failed, job.OutFile)
+		}
+	}
+	if len(killed) > 0 {
+		return results, fmt.Errorf("%s jobs were killed by %s before they finished: %s", engine.Name(), b.Scheduler, strings.Join(killed, ", "))
+	}
+	if len(failed) > 0 {
+		return results, fmt.Errorf("%s terminated abnormally: %s", engine.Name(), strings.Join(failed, ", "))
+	}
+
+	return results, nil
+}
+
+// writeScript 生成 job 的提交脚本，并返回脚本的路径，如 thermo/opt/cluster-opt1.sh
+func (b *BatchBackend) writeScript(engine Engine, stage Stage, job Job, header string) (string, error) {
+	dir, inputPath, outPath, err := jobDir(engine, job)
+	if err != nil {
+		return "", err
+	}
+
+	base := strings.TrimSuffix(inputPath, filepath.Ext(inputPath))
+	jobName := fmt.Sprintf("kybnmr-%s%d", stage, job.Index)
+
+	var sb strings.Builder
+	sb.WriteString("#!/bin/bash\n")
+	wallTime := b.WallTime.ForStage(stage)
+	if b.Scheduler == "pbs" {
+		sb.WriteString(fmt.Sprintf("#PBS -N %s\n#PBS -j oe\n#PBS -o %s.log\n", jobName, base))
+		if wallTime > 0 {
+			sb.WriteString(fmt.Sprintf("#PBS -l walltime=%s\n", formatWallTime(wallTime)))
+		}
+	} else {
+		sb.WriteString(fmt.Sprintf("#SBATCH --job-name=%s\n#SBATCH --output=%s.log\n", jobName, base))
+		if wallTime > 0 {
+			sb.WriteString(fmt.Sprintf("#SBATCH --time=%s\n", formatWallTime(wallTime)))
+		}
+	}
+	sb.WriteString(header)
+	sb.WriteString(fmt.Sprintf("\nmkdir -p %s\ncd %s\n", shellQuote(dir), shellQuote(dir)))
+	// 在子 shell 中运行命令，即使 header 中有 set -e 或者命令中有 exit，退出码也会被写入文件
+	sb.WriteString(fmt.Sprintf("status=0\n(%s) || status=$?\n", engine.CommandLine(stage, inputPath, outPath)))
+	sb.WriteString(fmt.Sprintf("echo $status > %s\n", shellQuote(base+ExitStatusSuffix)))
+
+	// 删除上一次运行留下的退出码文件，否则无法判断这一次的作业是否被调度系统结束
+	if err := os.Remove(base + ExitStatusSuffix); err != nil && !os.IsNotExist(err) {
+		return "", fmt.Errorf("error removing exit status file: %w", err)
+	}
+
+	script := base + ".sh"
+	if err := ioutil.WriteFile(script, []byte(sb.String()), 0755); err != nil {
+		return "", fmt.Errorf("error writing batch script: %w", err)
+	}
+
+	return script, nil
+}
+
+// exitStatusFile 返回 job 的退出码文件的路径，如 thermo/opt/cluster-opt1.exit
+func exitStatusFile(job Job) string {
+	return strings.TrimSuffix(job.InputFile, filepath.Ext(job.InputFile)) + ExitStatusSuffix
+}
+
+// finishedStatus 返回已经离开队列的作业的状态，没有退出码文件说明作业被调度系统结束
+func finishedStatus(engine Engine, job Job) string {
+	if engine.IsNormalTermination(job.OutFile) {
+		return JobNormal
+	}
+	if _, err := os.Stat(exitStatusFile(job)); os.IsNotExist(err) {
+		return JobInterrupted
+	}
+	return JobAbnormal
+}
+
+// shellQuote 用单引号包裹 s，使其在 shell 中作为一个完整的参数，如包含空格的路径
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// formatWallTime 将 wallTime 格式化为 SLURM 和 PBS 都支持的 HH:MM:SS
+func formatWallTime(wallTime time.Duration) string {
+	seconds := int(wallTime.Round(time.Second).Seconds())
+	return fmt.Sprintf("%02d:%02d:%02d", seconds/3600, seconds/60%60, seconds%60)
+}
+
+// submit 提交 script，返回作业号
+func (b *BatchBackend) submit(ctx context.Context, script string) (string, error) {
+	output, err := commandContext(ctx, "bash", "-c", b.SubmitCommand+" "+shellQuote(script)).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("error submitting %s: %w: %s", script, err, strings.TrimSpace(string(output)))
+	}
+
+	// sbatch 输出 Submitted batch job 12345，qsub 输出 12345.server
+	fields := strings.Fields(string(output))
+	if len(fields) == 0 {
+		return "", fmt.Errorf("error submitting %s: no job id returned", script)
+	}
+
+	return fields[len(fields)-1], nil
+}
+
+// cancelAll 取消 pending 中所有的作业，并将它们标记为中断
+// 这里不使用已经被取消的 ctx，否则取消命令本身无法运行
+func (b *BatchBackend) cancelAll(jobs []Job, results []JobResult, pending map[string]int, submitted []time.Time, progress *Progress) {
+	for jobID, i := range pending {
+		job := jobs[i]
+		results[i].finish(JobInterrupted, submitted[i])
+		progress.JobFinished(job, JobInterrupted, time.Now())
+		output, err := exec.Command("bash", "-c", b.CancelCommand+" "+jobID).CombinedOutput()
+		if err != nil {
+			slog.Error("error cancelling job", "scheduler", b.Scheduler, "conformer", job.Index, "job", jobID,
+				"error", err, "output", strings.TrimSpace(string(output)))
+		} else {
+			slog.Info("cancelled job", "scheduler", b.Scheduler, "conformer", job.Index, "job", jobID)
+		}
+		markInterrupted(job)
+	}
+}
+
+// isActive 判断作业 jobID 是否还在排队或者运行，查询失败时返回错误，此时作业的状态未知
+// squeue/qstat 查询已经离开队列的作业时会失败并报告作业号不存在，这种情况认为作业已经结束
+func (b *BatchBackend) isActive(jobID string) (bool, error) {
+	output, err := exec.Command("bash", "-c", b.StatusCommand+" "+jobID).CombinedOutput()
+	if err != nil {
+		if jobGoneRegex.Match(output) {
+			return false, nil
+		}
+		return false, fmt.Errorf("%w: %s", err, strings.TrimSpace(string(output)))
+	}
+
+	number := jobNumberRegex.FindString(jobID)
+	if number == "" {
+		number = jobID
+	}
+	for _, field := range strings.Fields(string(output)) {
+		if field == jobID || field == number || strings.HasPrefix(field, number+".") {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,212 @@
+package calc
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 模拟 sbatch：分配作业号，在后台运行提交脚本，脚本结束之前 running-<id> 文件存在
+const standInSubmit = `#!/bin/bash
+dir=$(dirname "$0")
+id=$(( $(cat "$dir/next" 2>/dev/null || echo 100) + 1 ))
+echo $id > "$dir/next"
+touch "$dir/running-$id"
+( bash "$1"; rm -f "$dir/running-$id" ) > /dev/null 2>&1 &
+echo "Submitted batch job $id"
+`
+
+// 模拟 squeue -h -j：fail 文件中的数字为接下来查询失败的次数，作业离开队列后报告作业号不存在
+const standInStatus = `#!/bin/bash
+dir=$(dirname "$0")
+if [ -e "$dir/fail" ]; then
+  n=$(cat "$dir/fail")
+  if [ "$n" -gt 0 ]; then
+    echo $((n - 1)) > "$dir/fail"
+    echo "slurm_load_jobs error: Socket timed out on send/recv operation"
+    exit 1
+  fi
+fi
+if [ -e "$dir/running-$1" ]; then
+  echo "  $1 debug kybnmr R 0:01 1 node1"
+  exit 0
+fi
+echo "slurm_load_jobs error: Invalid job id specified"
+exit 1
+`
+
+// scriptEngine 使用 shell 命令生成 FakeEngine 的 out 文件，commands 中的 %[1]s、%[2]s 为输入和输出文件
+type scriptEngine struct {
+	FakeEngine
+	commands map[int]string
+}
+
+func (s *scriptEngine) LocalOnly() bool {
+	return false
+}
+
+func (s *scriptEngine) CommandLine(stage Stage, inputFile string, outFile string) string {
+	index := 0
+	fmt.Sscanf(strings.TrimPrefix(filepath.Base(inputFile), "cluster-"+string(stage)), "%d", &index)
+	return fmt.Sprintf(s.commands[index], shellQuote(inputFile), shellQuote(outFile))
+}
+
+// standInScheduler 写入模拟调度系统的脚本，返回使用这些脚本的 BatchBackend
+func standInScheduler(t *testing.T, failures int) *BatchBackend {
+	t.Helper()
+	dir := t.TempDir()
+	for name, contents := range map[string]string{"sbatch": standInSubmit, "squeue": standInStatus, "scancel": "#!/bin/bash\n"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(contents), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "fail"), []byte(fmt.Sprintf("%d\n", failures)), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	backend := NewBatchBackend(&BatchConfig{
+		Scheduler:     "slurm",
+		SubmitCommand: filepath.Join(dir, "sbatch"),
+		StatusCommand: filepath.Join(dir, "squeue"),
+		CancelCommand: filepath.Join(dir, "scancel"),
+	}, &WallTimeConfig{})
+	backend.PollInterval = 20 * time.Millisecond
+	return backend
+}
+
+// writeJobs 在 stage 的文件夹中写入 n 个输入文件
+func writeJobs(t *testing.T, stage Stage, n int) []Job {
+	t.Helper()
+	if err := os.MkdirAll(stage.Folder(), 0755); err != nil {
+		t.Fatal(err)
+	}
+	var jobs []Job
+	for i := 1; i <= n; i++ {
+		inputFile := filepath.Join(stage.Folder(), fmt.Sprintf("cluster-%s%d.gjf", stage, i))
+		if err := ioutil.WriteFile(inputFile, []byte("C 0 0 0\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		jobs = append(jobs, Job{Index: i, InputFile: inputFile, OutFile: stage.OutFile(i)})
+	}
+	return jobs
+}
+
+func TestBatchBackendStandInScheduler(t *testing.T) {
+	// 工作目录中的空格检查提交脚本中的路径是否被正确引用
+	dir := filepath.Join(chdirTemp(t), "my runs")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	// 前三次查询失败时正常的任务还在运行，不能被当作已经结束
+	backend := standInScheduler(t, 3)
+	engine := &scriptEngine{commands: map[int]string{
+		1: "sleep 0.5; echo '" + fakeTermination + "' > %[2]s",
+		2: "echo 'SCF failed' > %[2]s; exit 1",
+		3: "echo 'SCF cycle 1' > %[2]s; kill -9 $$",
+	}}
+	jobs := writeJobs(t, StageOpt, 3)
+
+	results, err := backend.RunJobs(context.Background(), engine, StageOpt, jobs, NewProgress(StageOpt, engine, len(jobs)))
+	if err == nil || !strings.Contains(err.Error(), "killed by slurm") {
+		t.Errorf("RunJobs error %v, want killed jobs", err)
+	}
+
+	for i, want := range []string{JobNormal, JobAbnormal, JobInterrupted} {
+		if results[i].Status != want {
+			t.Errorf("job %d: status %q, want %q", i+1, results[i].Status, want)
+		}
+		if results[i].JobID != fmt.Sprint(101+i) {
+			t.Errorf("job %d: job id %q, want %d", i+1, results[i].JobID, 101+i)
+		}
+	}
+	if _, err := os.Stat(jobs[2].OutFile + InterruptedSuffix); err != nil {
+		t.Errorf("killed job was not marked interrupted: %v", err)
+	}
+	if _, err := os.Stat(jobs[1].OutFile); err != nil {
+		t.Errorf("out file of the failed job was moved: %v", err)
+	}
+
+	script, err := ioutil.ReadFile(filepath.Join(StageOpt.Folder(), "cluster-opt1.sh"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "\ncd '" + dir + "'\n"; !strings.Contains(string(script), want) {
+		t.Errorf("script does not contain %q:\n%s", want, script)
+	}
+}
+
+func TestBatchBackendGivesUpAfterStatusFailures(t *testing.T) {
+	chdirTemp(t)
+	backend := standInScheduler(t, 1000)
+	engine := &scriptEngine{commands: map[int]string{1: "sleep 5; echo '" + fakeTermination + "' > %[2]s"}}
+	jobs := writeJobs(t, StageSP, 1)
+
+	results, err := backend.RunJobs(context.Background(), engine, StageSP, jobs, NewProgress(StageSP, engine, len(jobs)))
+	if err == nil || !strings.Contains(err.Error(), "Socket timed out") {
+		t.Errorf("RunJobs error %v, want the query error", err)
+	}
+	if results[0].Status != JobInterrupted {
+		t.Errorf("status %q, want %q", results[0].Status, JobInterrupted)
+	}
+}
+
+func TestBatchBackendIsActive(t *testing.T) {
+	backend := NewBatchBackend(&BatchConfig{Scheduler: "pbs", StatusCommand: `printf ' 1234 debug R\n 77.server Q\n'; :`}, &WallTimeConfig{})
+	tests := []struct {
+		jobID  string
+		active bool
+	}{
+		{"1234", true},
+		{"123", false},
+		{"234", false},
+		{"77.server", true},
+		{"7.server", false},
+	}
+	for _, test := range tests {
+		active, err := backend.isActive(test.jobID)
+		if err != nil {
+			t.Errorf("isActive(%q): %v", test.jobID, err)
+		}
+		if active != test.active {
+			t.Errorf("isActive(%q) = %v, want %v", test.jobID, active, test.active)
+		}
+	}
+
+	backend.StatusCommand = "echo 'qstat: Unknown Job Id Error 99.server'; exit 153; :"
+	if active, err := backend.isActive("99.server"); active || err != nil {
+		t.Errorf("isActive of a finished PBS job = %v, %v, want false, nil", active, err)
+	}
+	backend.StatusCommand = "echo 'cannot connect to server'; exit 1; :"
+	if _, err := backend.isActive("99.server"); err == nil {
+		t.Error("isActive did not report a failed query")
+	}
+}
+
+func TestSchedulerNameIsCaseInsensitive(t *testing.T) {
+	dir := chdirTemp(t)
+	configFile := filepath.Join(dir, "config.ini")
+	if err := ioutil.WriteFile(configFile, []byte("[batch]\nscheduler = SLURM\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	config, err := ParseConfigFile(configFile)
+	if err != nil {
+		t.Fatalf("ParseConfigFile: %v", err)
+	}
+	backend, err := NewBackend(config)
+	if err != nil {
+		t.Fatalf("NewBackend: %v", err)
+	}
+	batch, ok := backend.(*BatchBackend)
+	if !ok || batch.SubmitCommand != "sbatch" {
+		t.Errorf("backend %#v, want slurm with sbatch", backend)
+	}
+}
@@ -0,0 +1,159 @@
+package calc
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+)
+
+/*
+* breakdown.go
+* 该模块用来分析每一个构象对平均化学位移的贡献，当某个平均化学位移与实验值偏差较大时，
+* 可以从中看出是哪些构象导致的
+*
+*	1. 对每一个原子核，列出每一个构象的化学位移、Boltzmann 权重、相对自由能以及加权贡献 (权重 * 化学位移)
+*	2. 依次将每一个构象的自由能升高和降低 perturbation (kcal/mol)，重新计算 Boltzmann 分布和平均化学位移，
+*	   平均化学位移的变化量即为该原子核对这个构象能量的敏感度
+*
+* 这里的 Boltzmann 分布和加权平均与 NewNMRResult 使用的是同一套数据和同一个函数
+*
+* @Author: Kimariyb
+* @Address: XiaMen University
+* @Data: 2023-09-23
+ */
+
+// ConformerContribution 一个构象对某个原子核平均化学位移的贡献
+//   - RelativeEnergy: 相对于最稳定构象的自由能，单位为 kcal/mol
+//   - Contribution: Population * Shift
+//   - ShiftChangeMinus/ShiftChangePlus: 该构象自由能降低/升高 perturbation 时平均化学位移的变化量
+type ConformerContribution struct {
+	Conformer        string
+	RelativeEnergy   float64
+	Population       float64
+	Shift            float64
+	Contribution     float64
+	ShiftChangeMinus float64
+	ShiftChangePlus  float64
+}
+
+// NucleusBreakdown 一个原子核的平均化学位移及所有构象的贡献
+type NucleusBreakdown struct {
+	Index         int
+	Symbol        string
+	AveragedShift float64
+	Contributions []ConformerContribution
+}
+
+// NMRBreakdown 所有原子核的贡献分析结果
+//   - Perturbation: 计算敏感度时自由能的扰动大小，单位为 kcal/mol
+type NMRBreakdown struct {
+	Temperature  float64
+	Perturbation float64
+	Nuclei       []NucleusBreakdown
+}
+
+// Breakdown 计算每一个构象对每一个原子核平均化学位移的贡献，以及平均化学位移对每个构象自由能的敏感度
+// 只有有参考屏蔽常数的原子核（即有化学位移的原子核）才会被分析
+func (r *NMRResult) Breakdown(perturbation float64) (*NMRBreakdown, error) {
+	freeEnergies := make([]float64, len(r.Conformers))
+	populations := make([]float64, len(r.Conformers))
+	for k, conformer := range r.Conformers {
+		freeEnergies[k] = conformer.FreeEnergy
+		populations[k] = conformer.Population
+	}
+	minEnergy := r.LowestConformer().FreeEnergy
+
+	averages, err := averageIsotropic(r.Conformers, populations)
+	if err != nil {
+		return nil, err
+	}
+
+	// perturbed[k][0]、perturbed[k][1] 分别为第 k 个构象的自由能降低、升高 perturbation 后的平均屏蔽常数
+	perturbed := make([][2][]float64, len(r.Conformers))
+	for k := range r.Conformers {
+		for side, sign := range []float64{-1, 1} {
+			energies := make([]float64, len(freeEnergies))
+			copy(energies, freeEnergies)
+			energies[k] += sign * perturbation / HartreeToKcal
+
+			perturbed[k][side], err = averageIsotropic(r.Conformers, BoltzmannWeights(energies, r.Temperature))
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	breakdown := &NMRBreakdown{Temperature: r.Temperature, Perturbation: perturbation}
+	for i, nucleus := range r.Nuclei {
+		if !nucleus.Referenced {
+			continue
+		}
+		// 化学位移 = 参考屏蔽常数 - 屏蔽常数，因此化学位移的变化量为屏蔽常数变化量的相反数
+		reference := nucleus.Shift + nucleus.Shielding
+
+		nucleusBreakdown := NucleusBreakdown{
+			Index:         nucleus.Index,
+			Symbol:        nucleus.Symbol,
+			AveragedShift: nucleus.Shift,
+		}
+		for k, conformer := range r.Conformers {
+			shift := reference - conformer.Shieldings[i].Isotropic
+			nucleusBreakdown.Contributions = append(nucleusBreakdown.Contributions, ConformerContribution{
+				Conformer:        conformer.Name,
+				RelativeEnergy:   (conformer.FreeEnergy - minEnergy) * HartreeToKcal,
+				Population:       conformer.Population,
+				Shift:            shift,
+				Contribution:     conformer.Population * shift,
+				ShiftChangeMinus: -(perturbed[k][0][i] - averages[i]),
+				ShiftChangePlus:  -(perturbed[k][1][i] - averages[i]),
+			})
+		}
+		breakdown.Nuclei = append(breakdown.Nuclei, nucleusBreakdown)
+	}
+
+	return breakdown, nil
+}
+
+// WriteCSV 将贡献分析结果写入 csv 文件，每一行为一个原子核在一个构象中的数据
+func (b *NMRBreakdown) WriteCSV(fileName string) error {
+	file, err := os.Create(fileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	format := func(value float64) string {
+		return strconv.FormatFloat(value, 'f', 4, 64)
+	}
+
+	writer := csv.NewWriter(file)
+	_ = writer.Write([]string{"index", "element", "averagedShift", "conformer", "deltaG", "population",
+		"shift", "contribution",
+		fmt.Sprintf("dShift(-%.2f)", b.Perturbation), fmt.Sprintf("dShift(+%.2f)", b.Perturbation)})
+	for _, nucleus := range b.Nuclei {
+		for _, contribution := range nucleus.Contributions {
+			_ = writer.Write([]string{
+				strconv.Itoa(nucleus.Index), nucleus.Symbol, format(nucleus.AveragedShift),
+				contribution.Conformer, format(contribution.RelativeEnergy),
+				strconv.FormatFloat(contribution.Population, 'f', 6, 64),
+				format(contribution.Shift), format(contribution.Contribution),
+				format(contribution.ShiftChangeMinus), format(contribution.ShiftChangePlus),
+			})
+		}
+	}
+	writer.Flush()
+
+	return writer.Error()
+}
+
+// SaveJSON 将贡献分析结果保存为 json 文件
+func (b *NMRBreakdown) SaveJSON(fileName string) error {
+	contents, err := json.MarshalIndent(b, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(fileName, contents, 0644)
+}
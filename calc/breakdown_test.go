@@ -0,0 +1,60 @@
+package calc
+
+import "testing"
+
+func TestBreakdownTwoConformers(t *testing.T) {
+	// 构象 b 的自由能比 a 高 1 kcal/mol，碳的化学位移分别为 190 - 150 = 40 和 190 - 140 = 50 ppm，氧没有参考屏蔽常数
+	conformers := []ConformerNMR{
+		{Name: "a", FreeEnergy: -100, Shieldings: []NucleusShielding{{1, "C", 150}, {2, "O", 300}}},
+		{Name: "b", FreeEnergy: -100 + 1/HartreeToKcal, Shieldings: []NucleusShielding{{1, "C", 140}, {2, "O", 310}}},
+	}
+	result, err := NewNMRResult(conformers, &NMRConfig{Temperature: 298.15, RefShieldingC: 190})
+	if err != nil {
+		t.Fatalf("NewNMRResult: %v", err)
+	}
+	breakdown, err := result.Breakdown(0.5)
+	if err != nil {
+		t.Fatalf("Breakdown: %v", err)
+	}
+	if len(breakdown.Nuclei) != 1 || breakdown.Nuclei[0].Index != 1 {
+		t.Fatalf("breakdown of %d nuclei, want only the carbon", len(breakdown.Nuclei))
+	}
+	nucleus := breakdown.Nuclei[0]
+
+	// p(b) / p(a) = exp(-1 / RT)，RT = 0.592485 kcal/mol
+	const populationA, populationB = 0.843935515639, 0.156064484361
+	if !approxEqual(nucleus.AveragedShift, 40*populationA+50*populationB, 1e-9) {
+		t.Errorf("averaged shift %.9f, want %.9f", nucleus.AveragedShift, 40*populationA+50*populationB)
+	}
+
+	sum := 0.0
+	for _, contribution := range nucleus.Contributions {
+		sum += contribution.Contribution
+	}
+	if !approxEqual(sum, nucleus.AveragedShift, 1e-9) {
+		t.Errorf("contributions sum to %.9f, want the averaged shift %.9f", sum, nucleus.AveragedShift)
+	}
+
+	// 两个构象的能量差变为 0.5 和 1.5 kcal/mol 时平均化学位移的变化量
+	const closer, further = 1.446488353480, -0.823996246451
+	tests := []struct {
+		conformer                         string
+		relativeEnergy                    float64
+		population, shift                 float64
+		shiftChangeMinus, shiftChangePlus float64
+	}{
+		{"a", 0, populationA, 40, further, closer},
+		{"b", 1, populationB, 50, closer, further},
+	}
+	for i, test := range tests {
+		contribution := nucleus.Contributions[i]
+		if contribution.Conformer != test.conformer ||
+			!approxEqual(contribution.RelativeEnergy, test.relativeEnergy, 1e-6) ||
+			!approxEqual(contribution.Population, test.population, 1e-9) ||
+			!approxEqual(contribution.Shift, test.shift, 1e-9) ||
+			!approxEqual(contribution.ShiftChangeMinus, test.shiftChangeMinus, 1e-6) ||
+			!approxEqual(contribution.ShiftChangePlus, test.shiftChangePlus, 1e-6) {
+			t.Errorf("conformer %s: %+v, want %+v", test.conformer, contribution, test)
+		}
+	}
+}
@@ -76,6 +76,28 @@ func (cl ClusterList) PrintClusterInFo() {
 	fmt.Println()
 }
 
+// 去重时每一个构象的处理结果
+const (
+	// DedupNew 与已有的簇都不相似，作为一个新的簇
+	DedupNew = "new"
+	// DedupDuplicate 与已有的簇相似并且能量更高，被舍弃
+	DedupDuplicate = "duplicate"
+	// DedupReplaced 与已有的簇相似并且能量更低，代替原来的结构作为这个簇的代表
+	DedupReplaced = "replaced"
+)
+
+// DedupDecision 去重时对一个构象的处理
+//   - Conformer: 构象在输入的 ClusterList 中的序号，从 1 开始
+//   - Energy: 构象的能量，单位为 Hartree
+//   - Action: DedupNew、DedupDuplicate 或者 DedupReplaced
+//   - Cluster: 构象归入的簇在返回的（按能量排序之后的）ClusterList 中的序号，从 1 开始
+type DedupDecision struct {
+	Conformer int     `json:"conformer"`
+	Energy    float64 `json:"energy"`
+	Action    string  `json:"action"`
+	Cluster   int     `json:"cluster"`
+}
+
 // DoubleCheck 用于 KYBNMR 检查构象是否合理，以及是否存在重复结构，这是整个 KYBNMR 最核心的步骤
 // 将 clusters 中的第一个 cluster 或者当前 cluster 和 resultClusters 中的所有 cluster 都不相似
 // 那么这个 cluster 将被作为一个新的簇，此簇的能量、结构也等同于这个 cluster
@@ -88,13 +110,19 @@ func (cl ClusterList) PrintClusterInFo() {
 // @param: clusters: ClusterList，通过 ParseXyzFile() 方法得到的 ClusterList
 // @return: 返回一个 ClusterList
 func DoubleCheck(eneThreshold float64, disThreshold float64, clusters ClusterList) (ClusterList, error) {
+	resultClusters, _, err := DoubleCheckWithDecisions(eneThreshold, disThreshold, clusters)
+	return resultClusters, err
+}
+
+// DoubleCheckWithDecisions 与 DoubleCheck 相同，同时返回对 clusters 中每一个构象的处理，用于写入 report.json
+func DoubleCheckWithDecisions(eneThreshold float64, disThreshold float64, clusters ClusterList) (ClusterList, []DedupDecision, error) {
 	// 检查参数有效性
 	if eneThreshold < 0 || disThreshold < 0 {
-		return nil, errors.New("threshold values must be non-negative")
+		return nil, nil, errors.New("threshold values must be non-negative")
 	}
 
 	if len(clusters) == 0 {
-		return nil, errors.New("empty cluster list")
+		return nil, nil, errors.New("empty cluster list")
 	}
 
 	// 打印 DoubleCheck 运行标志
@@ -105,14 +133,18 @@ func DoubleCheck(eneThreshold float64, disThreshold float64, clusters ClusterLis
 	fmt.Println()
 	// 创建一个新的切片来存储结果簇
 	resultClusters := make(ClusterList, 0)
+	// decisions 中的 Cluster 先记录簇在 resultClusters 中的位置（从 0 开始），排序之后再换成最终的序号
+	decisions := make([]DedupDecision, 0, len(clusters))
 
 	// 首先，将第一个 cluster 首先加入 resultClusters 中，作为第一个簇
 	resultClusters = append(resultClusters, clusters[0])
+	decisions = append(decisions, DedupDecision{Conformer: 1, Energy: clusters[0].Energy, Action: DedupNew, Cluster: 0})
 
 	// 接着遍历 clusters 中除第一个以外的每个簇
-	for _, cluster := range clusters[1:] {
+	for k, cluster := range clusters[1:] {
 		// 标识符，默认假设当前簇与已有簇不相似
 		isSimilar := false
+		decision := DedupDecision{Conformer: k + 2, Energy: cluster.Energy, Action: DedupNew, Cluster: len(resultClusters)}
 
 		// 循环遍历 resultClusters 中的每一个簇
 		for i, resultCluster := range resultClusters {
@@ -120,9 +152,12 @@ func DoubleCheck(eneThreshold float64, disThreshold float64, clusters ClusterLis
 			if IsSimilarToCluster(&cluster, &resultCluster, eneThreshold, disThreshold) {
 				// 如果相似，则判断两个 cluster 的能量哪个更小
 				isSimilar = true
+				decision.Action = DedupDuplicate
+				decision.Cluster = i
 				// 选择能量更小的簇
 				if cluster.Energy < resultCluster.Energy {
 					resultClusters[i] = cluster
+					decision.Action = DedupReplaced
 				}
 				break
 			}
@@ -132,12 +167,29 @@ func DoubleCheck(eneThreshold float64, disThreshold float64, clusters ClusterLis
 		if !isSimilar {
 			resultClusters = append(resultClusters, cluster)
 		}
+		decisions = append(decisions, decision)
+	}
+
+	// 按照能量排序，与 SortCluster 使用相同的稳定排序，得到每一个簇排序之后的序号
+	order := make([]int, len(resultClusters))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return resultClusters[order[i]].Energy < resultClusters[order[j]].Energy
+	})
+	position := make([]int, len(order))
+	for sorted, original := range order {
+		position[original] = sorted + 1
+	}
+	for i := range decisions {
+		decisions[i].Cluster = position[decisions[i].Cluster]
 	}
 
 	// 打印 resultClusters 的信息
 	resultClusters.PrintClusterInFo()
 
-	return resultClusters, nil
+	return resultClusters, decisions, nil
 }
 
 // IsSimilarToCluster 函数用于检查两个结构是否相似
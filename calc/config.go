@@ -4,12 +4,11 @@ import (
 	"bufio"
 	"fmt"
 	"gopkg.in/ini.v1"
-	"kybnmr/utils"
+	"log/slog"
 	"os"
-	"path/filepath"
-	"regexp"
 	"strconv"
 	"strings"
+	"time"
 )
 
 /*
@@ -32,11 +31,53 @@ import (
 *	[optimized] 使用 xtb 做预优化的配置项、使用 Gaussian 和 orca 做进一步优化的配置项
 *		preOptArgs(string)：预优化的参数
 *		postOptArgs(string): 进一步优化的参数
-*		preThreshold(string): 预优化之后的阈值
-*		postThreshold(string): 进一步优化之后的阈值
+*		preThreshold(string): 预优化之后的能量和距离阈值，默认为 "0.25, 0.1"
+*		postThreshold(string): 进一步优化之后的能量和距离阈值，默认为 "0.25, 0.1"
 *		gauPath(string): gaussian 运行路径
 *		orcaPath(string): orca 运行路径
 *		shermoPath(string): shermo 运行路径
+*		psi4Path(string): psi4 运行路径，默认为 psi4
+*		nwchemPath(string): nwchem 运行路径，默认为 nwchem
+*		xtbPath(string): 使用 xtb 代替 DFT 程序 (--opt xtb/--sp xtb) 时 xtb 的运行路径，默认为 xtb
+*		xtbArgs(string): 使用 xtb 代替 DFT 程序时的方法和溶剂模型参数，默认为 --gfn2，例如 "--gfn2 --alpb chcl3"
+*		preset(string): 内置的计算方案，启动目录中没有模板文件时使用 preset 中的模板，见 preset.go
+*
+*	[nmr] NMR 计算以及 Boltzmann 平均的配置项
+*		temperature(float): 计算 Boltzmann 分布的温度，单位为 K，默认为 298.15
+*		refShieldingC(float): 同一理论水平下参考物质 (TMS) 的 13C 屏蔽常数
+*		refShieldingH(float): 同一理论水平下参考物质 (TMS) 的 1H 屏蔽常数
+*
+*	[molecule] 分子的电荷和自旋多重度，会传给 xtb、crest 以及所有的 DFT 程序
+*		charge(int): 电荷，默认为 0
+*		multiplicity(int): 自旋多重度 2S+1，默认为 1
+*
+*	[solvent] 溶剂，会翻译为每一个程序的溶剂模型关键词，见 solvent.go
+*		name(string): 溶剂名，如 chloroform 或者 chcl3，不写则使用模板和参数中的溶剂设置
+*		model(string): DFT 程序的溶剂模型，smd（默认）、pcm 或者 cpcm
+*		xtbModel(string): xtb 和 crest 的溶剂模型，alpb（默认）或者 gbsa
+*
+*	[resources] 每一个 DFT 任务使用的计算资源，通过模板中的 {{.NProcs}}、{{.Memory}} 和 {{.MaxCore}} 写入输入文件，见 template.go
+*		nprocs(int): 核数，默认为 8
+*		memory(int): 内存，单位为 MB，默认为 16000
+*
+*	[batch] 运行 DFT 任务的后端，不写则在本机上运行
+*		scheduler(string): local、slurm 或者 pbs，默认为 local
+*		submitCommand(string): 提交脚本的命令，默认为 sbatch (slurm) 或者 qsub (pbs)
+*		statusCommand(string): 查询作业的命令，作业号会追加在末尾，默认为 squeue -h -j (slurm) 或者 qstat (pbs)
+*		pollInterval(int): 查询作业的时间间隔，单位为 s，默认为 30
+*		cancelCommand(string): 取消作业的命令，作业号会追加在末尾，默认为 scancel (slurm) 或者 qdel (pbs)
+*		header(string): 写入每一个提交脚本开头的文件，用来指定队列、核数、内存等
+*
+*	[walltime] 每个步骤的最长运行时间，如 90m、12h，不写或者为 0 表示不限制
+*		md(duration): xtb 动力学模拟
+*		crest(duration): 每一次 crest 优化
+*		opt(duration)、sp(duration)、nmr(duration): 每一个 DFT 任务
+*		shermo(duration): Shermo
+*
+*	[dp4] DP4/DP4+ 分析的 t 分布参数，每一项都是 "mu, sigma, nu" 形式的字符串，不写则使用默认值
+*		scaledC(string)、scaledH(string): 经过线性标度的误差所服从的分布
+*		unscaledSp2C(string)、unscaledSp3C(string): 未标度的 sp2/sp3 碳的误差所服从的分布
+*		unscaledSp2H(string)、unscaledSp3H(string): 与 sp2/sp3 碳相连的氢的未标度误差所服从的分布
 *
 * @Author: Kimariyb
 * @Address: XiaMen University
@@ -66,264 +107,346 @@ type OptimizedConfig struct {
 	GauPath       string
 	OrcaPath      string
 	ShermoPath    string
+	Psi4Path      string
+	NWChemPath    string
+	XtbPath       string
+	XtbArgs       string
+	Preset        string
 }
 
-// Config 记录 ini 文件配置类
-type Config struct {
-	DyConfig  DynamicsConfig
-	OptConfig OptimizedConfig
+// NMRConfig ini 文件中 NMR 部分的配置文件
+type NMRConfig struct {
+	Temperature   float64
+	RefShieldingC float64
+	RefShieldingH float64
 }
 
-type ShermoResult struct {
-	FileName string
-	Energy   string
-}
-
-// ParseConfigFile 解析符合条件的 ini 文件，并且返回一个 Config 对象
-func ParseConfigFile(configFile string) *Config {
-	// 声明一个 Config 结构体
-	config := &Config{}
-	// 解析 ini 文件
-	iniFile, err := ini.Load(configFile)
-	if err != nil {
-		return nil
+// References 返回元素符号到参考屏蔽常数的映射
+func (n *NMRConfig) References() map[string]float64 {
+	return map[string]float64{
+		"C": n.RefShieldingC,
+		"H": n.RefShieldingH,
 	}
-	// 分别解析 ini 文件中的 [dynamics]、[optimized]组分别存储在
-	// DynamicsConfig、OptimizedConfig 结构体中
-	// 最后将 DynamicsConfig、OptimizedConfig 结构体存储在 Config 中
-	dynamicsSection := iniFile.Section("dynamics")
-	optimizedSection := iniFile.Section("optimized")
-
-	// 声明一个 dynamicsConfig、OptimizedConfig
-	dynamicsConfig := DynamicsConfig{}
-	optConfig := OptimizedConfig{}
+}
 
-	// 给 dynamicsConfig 赋值
-	dynamicsConfig.Temperature, _ = dynamicsSection.Key("temperature").Float64()
-	dynamicsConfig.Time, _ = dynamicsSection.Key("time").Float64()
-	dynamicsConfig.Step, _ = dynamicsSection.Key("step").Float64()
-	dynamicsConfig.Dump, _ = dynamicsSection.Key("dump").Float64()
-	dynamicsConfig.Nvt, _ = dynamicsSection.Key("nvt").Bool()
-	dynamicsConfig.Velo, _ = dynamicsSection.Key("velo").Bool()
-	dynamicsConfig.Shake, _ = dynamicsSection.Key("shake").Int()
-	dynamicsConfig.Hmass, _ = dynamicsSection.Key("hmass").Int()
-	dynamicsConfig.Sccacc, _ = dynamicsSection.Key("sccacc").Float64()
-	dynamicsConfig.DynamicsArgs = dynamicsSection.Key("dynamicsArgs").String()
+// DP4Config ini 文件中 DP4 部分的配置文件
+type DP4Config struct {
+	ScaledC      string
+	ScaledH      string
+	UnscaledSp2C string
+	UnscaledSp3C string
+	UnscaledSp2H string
+	UnscaledSp3H string
+}
 
-	// 给 optConfig 赋值
-	optConfig.PreOptArgs = optimizedSection.Key("preOptArgs").String()
-	optConfig.PostOptArgs = optimizedSection.Key("postOptArgs").String()
-	optConfig.PreThreshold = optimizedSection.Key("preThreshold").String()
-	optConfig.PostThreshold = optimizedSection.Key("postThreshold").String()
-	optConfig.GauPath = optimizedSection.Key("gauPath").String()
-	optConfig.OrcaPath = optimizedSection.Key("orcaPath").String()
-	optConfig.ShermoPath = optimizedSection.Key("shermoPath").String()
-
-	// 给 config 赋值
-	config.DyConfig = dynamicsConfig
-	config.OptConfig = optConfig
+// MoleculeConfig ini 文件中分子部分的配置文件
+//   - Charge: 电荷
+//   - Multiplicity: 自旋多重度 2S+1
+type MoleculeConfig struct {
+	Charge       int
+	Multiplicity int
+}
 
-	return config
+// UnpairedElectrons 返回未成对电子数，即 xtb 和 crest 的 --uhf
+func (m *MoleculeConfig) UnpairedElectrons() int {
+	return m.Multiplicity - 1
 }
 
-// ParseOutFile 解析 out 文件，将最后一帧的结构保存在 Cluster 中
-//   - softwareName: 使用的是 orca 还是 gaussian 程序生成的 out 文件
-//   - filePath: 需要解析的 out 文件的路径
-func ParseOutFile(softwareName string, filePath string) (Cluster, error) {
-	var cluster Cluster
-	var err error
-
-	// 首先判断 filePath 是否为一个 out 文件
-	if !utils.CheckFileType(filePath, ".out") {
-		// 如果不是 out 文件则直接退出并报错
-		return Cluster{}, fmt.Errorf("error the format of input file")
+// Validate 检查电荷和自旋多重度与 cluster 的电子数是否匹配：
+// 电子数必须为正数，未成对电子数不能超过电子数，并且电子数与未成对电子数的奇偶性必须相同
+func (m *MoleculeConfig) Validate(cluster Cluster) error {
+	if m.Multiplicity < 1 {
+		return fmt.Errorf("invalid multiplicity %d, it must be at least 1", m.Multiplicity)
 	}
 
-	// 判断 softwareName 传入的参数是 orca 还是 gaussian
-	if strings.EqualFold(softwareName, "orca") {
-		// 如果传入的是 orca 则调用 parseOrcaOutput()
-		cluster, err = parseOrcaOutput(filePath)
-		if err != nil {
-			return Cluster{}, err
-		}
-	} else if strings.EqualFold(softwareName, "gaussian") {
-		// 如果传入的是 gaussian 则调用 parseGauOutput()
-		cluster, err = parseGauOutput(filePath)
+	electrons := -m.Charge
+	for _, atom := range cluster.Atoms {
+		atomicNumber, err := getAtomicNumber(atom.Symbol)
 		if err != nil {
-			return Cluster{}, err
+			return err
 		}
+		electrons += atomicNumber
 	}
 
-	// 返回一个 Cluster 对象
-	return cluster, nil
+	if electrons <= 0 {
+		return fmt.Errorf("charge %d leaves %d electrons", m.Charge, electrons)
+	}
+	unpaired := m.UnpairedElectrons()
+	if unpaired > electrons || (electrons-unpaired)%2 != 0 {
+		return fmt.Errorf("multiplicity %d is impossible with charge %d and %d electrons", m.Multiplicity, m.Charge, electrons)
+	}
+	return nil
 }
 
-// ParseGauOutput 读取 Gaussian 生成的 out 文件
-// 在 Gaussian 生成的 out 文件的最后，都会出现一个 Standard orientation
-// 在 Standard orientation 表格中以下变量至关重要
-// Atomic Number: 原子序号，代表元素周期表中的位置，1 代表 H；2 代表 He 以此类推
-// Coordinates (Angstroms): 原子坐标（单位为埃），分为 X；Y；Z 坐标，这是一个笛卡尔坐标系的坐标
-//
-//	Standard orientation:
-//
-// ---------------------------------------------------------------------
-// Center     Atomic      Atomic             Coordinates (Angstroms)
-// Number     Number       Type             X           Y           Z
-// ---------------------------------------------------------------------
-//
-//	 1          8           0        1.169391   -0.453770   -0.882827
-//	 2          8           0       -1.184882    2.809963   -0.433427
-//	 3          8           0        0.716726    2.116662    0.491823
-//	 4          8           0        3.366765   -0.337316   -0.613653
-//	 5          6           0       -0.108179   -0.650924   -0.403350
-//	 6          6           0       -0.916481    0.439636   -0.034821
-//	 7          6           0       -0.637019   -1.942534   -0.425943
-//	 8          6           0       -2.250913    0.196603    0.327706
-//	 9          6           0       -1.961017   -2.165935   -0.050206
-//	10          6           0       -2.771332   -1.095676    0.332879
-//	11          6           0       -0.362052    1.832310    0.029385
-//	12          6           0        2.305426   -0.474834   -0.073872
-//	13          6           0        2.087999   -0.671809    1.405520
-//	14          1           0        0.000372   -2.757450   -0.754757
-//	15          1           0       -2.875364    1.028823    0.643617
-//	16          1           0       -2.359654   -3.176253   -0.063447
-//	17          1           0       -3.801283   -1.265085    0.631546
-//	18          1           0        1.568720    0.203757    1.806039
-//	19          1           0        3.063572   -0.771149    1.881978
-//	20          1           0        1.481084   -1.558556    1.612610
-//	21          1           0       -1.940041    2.410593   -0.896697
-//
-// ---------------------------------------------------------------------
-func parseGauOutput(filePath string) (Cluster, error) {
-	var nAtoms int
-	var foundLastOrientation bool
-	var atoms []Atom
-	var lastOrientationAtoms []Atom
+// ResourceConfig ini 文件中计算资源部分的配置文件
+//   - NProcs: 每一个 DFT 任务使用的核数
+//   - Memory: 每一个 DFT 任务使用的内存，单位为 MB
+type ResourceConfig struct {
+	NProcs int
+	Memory int
+}
 
-	// 首先将扫描到的文件变为绝对路径，再打开文件
-	absPath, err := filepath.Abs(filePath)
-	if err != nil {
-		return Cluster{}, err
+// MaxCore 返回每一个核的内存，单位为 MB
+func (r *ResourceConfig) MaxCore() int {
+	if r.NProcs < 1 {
+		return r.Memory
 	}
+	return r.Memory / r.NProcs
+}
 
-	file, err := os.Open(absPath)
-	if err != nil {
-		return Cluster{}, err
-	}
-	defer file.Close()
+// BatchConfig ini 文件中作业调度系统部分的配置文件
+type BatchConfig struct {
+	Scheduler     string
+	SubmitCommand string
+	StatusCommand string
+	CancelCommand string
+	PollInterval  int
+	HeaderFile    string
+}
 
-	scanner := bufio.NewScanner(file)
+// WallTimeConfig ini 文件中最长运行时间部分的配置文件，0 表示不限制
+type WallTimeConfig struct {
+	MD     time.Duration
+	Crest  time.Duration
+	Opt    time.Duration
+	SP     time.Duration
+	NMR    time.Duration
+	Shermo time.Duration
+}
 
-	// 首先扫描 out 文件，在 out 文件中找到 NAtoms= 随便读取一个后面的数字，例
-	// 如读取 NAtoms=  21 中的 21
-	// 将这个数字赋值给 nAtoms 变量
-	nAtoms, err = extractNAtomsFromFile(absPath)
-	if err != nil {
-		return Cluster{}, err
+// ForStage 返回 DFT 步骤 stage 中每一个任务的最长运行时间
+func (w *WallTimeConfig) ForStage(stage Stage) time.Duration {
+	switch stage {
+	case StageOpt:
+		return w.Opt
+	case StageSP:
+		return w.SP
+	case StageNMR:
+		return w.NMR
 	}
+	return 0
+}
 
-	for scanner.Scan() {
-		line := scanner.Text()
-		// 接着找到文件中最后一个 Standard orientation
-		// 定位到最后一个 Standard orientation 一行后，接着跳过四行。因为后面四行为表格线
-		if strings.Contains(line, "Standard orientation") {
-			// 在找到新的 "Standard orientation" 时，将上一次找到的最后一个 "Standard orientation" 对应的 atoms 清空
-			atoms = atoms[:0]
-			lastOrientationAtoms = make([]Atom, 0) // 初始化为新的空切片
-			foundLastOrientation = false
-			// 跳过四行表格线
-			for i := 0; i < 4; i++ {
-				scanner.Scan()
-			}
-		}
+// Config 记录 ini 文件配置类
+type Config struct {
+	DyConfig       DynamicsConfig
+	OptConfig      OptimizedConfig
+	NMRConfig      NMRConfig
+	DP4Config      DP4Config
+	MoleculeConfig MoleculeConfig
+	SolventConfig  SolventConfig
+	ResourceConfig ResourceConfig
+	BatchConfig    BatchConfig
+	WallTimeConfig WallTimeConfig
+
+	// lines 每一个 key 的来源（配置文件和行号、环境变量或者 --set），用于输出错误信息
+	lines *configLines
+	// resolved 每一个 key 的最终值和来源
+	resolved []ResolvedValue
+}
 
-		if strings.Contains(line, "Standard orientation") {
-			foundLastOrientation = true
-		}
+type ShermoResult struct {
+	FileName string
+	Energy   string
+}
 
-		// 到第一行时 1  8  0  1.169391   -0.453770   -0.882827
-		// 只需要关注第二个列的 8 和后三列的 x、y、z 坐标。其中 8 代表是第八个元素氧。
-		// 将第一行的原子坐标和元素保存为一个 Atom 结构体
-		if foundLastOrientation && len(atoms) < nAtoms {
-			fields := strings.Fields(line)
-			if len(fields) >= 6 {
-				atomicNumber, err := strconv.Atoi(fields[1])
-				if err != nil {
-					return Cluster{}, fmt.Errorf("unable to resolve atomic number: %s", fields[1])
-				}
-				symbol, err := getSymbol(atomicNumber)
-				if err != nil {
-					return Cluster{}, err
-				}
-				x, err := strconv.ParseFloat(fields[3], 64)
-				if err != nil {
-					return Cluster{}, fmt.Errorf("unable to resolve X-coordinate: %s", fields[3])
-				}
-				y, err := strconv.ParseFloat(fields[4], 64)
-				if err != nil {
-					return Cluster{}, fmt.Errorf("unable to resolve Y-coordinate: %s", fields[4])
-				}
-				z, err := strconv.ParseFloat(fields[5], 64)
-				if err != nil {
-					return Cluster{}, fmt.Errorf("unable to resolve Z-coordinate: %s", fields[5])
-				}
-
-				atoms = append(atoms, Atom{
-					Symbol: symbol,
-					X:      x,
-					Y:      y,
-					Z:      z,
-				})
-
-				if foundLastOrientation && len(atoms) > 0 {
-					lastOrientationAtoms = append(lastOrientationAtoms, atoms...)
-				}
-			}
-		}
-	}
+// ParseConfigFile 只解析一个 ini 文件，没有的 key 使用内置的默认值，并且返回一个 Config 对象
+// 配置文件中的类型错误、未知的 section 和 key 以及不可能的值会一次全部报告，返回的错误为 *ConfigError，见 validate.go
+// 运行 KYBNMR 时使用 LoadConfig 分层读取配置，见 layers.go
+func ParseConfigFile(configFile string) (*Config, error) {
+	return LoadConfig(ConfigLayers{ProjectFile: configFile})
+}
 
-	cluster := Cluster{
-		Atoms:  atoms,
-		Energy: 0,
-	}
+// readConfig 使用 r 读取所有的配置，没有的 key 使用 DefaultConfig 中的值
+func readConfig(r *configReader) *Config {
+	def := DefaultConfig()
 
-	if err := scanner.Err(); err != nil {
-		return Cluster{}, fmt.Errorf("error while reading file: %v", err)
-	}
+	// 分别解析 ini 文件中的 [dynamics]、[optimized] 等组，分别存储在
+	// DynamicsConfig、OptimizedConfig 等结构体中，最后存储在 Config 中
+	config := &Config{lines: r.lines}
+
+	// 给 dynamicsConfig 赋值
+	dynamicsConfig := &config.DyConfig
+	dynamicsConfig.Temperature = r.Float64("dynamics", "temperature", def.DyConfig.Temperature)
+	dynamicsConfig.Time = r.Float64("dynamics", "time", def.DyConfig.Time)
+	dynamicsConfig.Step = r.Float64("dynamics", "step", def.DyConfig.Step)
+	dynamicsConfig.Dump = r.Float64("dynamics", "dump", def.DyConfig.Dump)
+	dynamicsConfig.Nvt = r.Bool("dynamics", "nvt", def.DyConfig.Nvt)
+	dynamicsConfig.Velo = r.Bool("dynamics", "velo", def.DyConfig.Velo)
+	dynamicsConfig.Shake = r.Int("dynamics", "shake", def.DyConfig.Shake)
+	dynamicsConfig.Hmass = r.Int("dynamics", "hmass", def.DyConfig.Hmass)
+	dynamicsConfig.Sccacc = r.Float64("dynamics", "sccacc", def.DyConfig.Sccacc)
+	dynamicsConfig.DynamicsArgs = r.String("dynamics", "dynamicsArgs", def.DyConfig.DynamicsArgs)
+
+	// 给 optConfig 赋值
+	optConfig := &config.OptConfig
+	optConfig.PreOptArgs = r.String("optimized", "preOptArgs", def.OptConfig.PreOptArgs)
+	optConfig.PostOptArgs = r.String("optimized", "postOptArgs", def.OptConfig.PostOptArgs)
+	optConfig.PreThreshold = r.String("optimized", "preThreshold", def.OptConfig.PreThreshold)
+	optConfig.PostThreshold = r.String("optimized", "postThreshold", def.OptConfig.PostThreshold)
+	optConfig.GauPath = r.String("optimized", "gauPath", def.OptConfig.GauPath)
+	optConfig.OrcaPath = r.String("optimized", "orcaPath", def.OptConfig.OrcaPath)
+	optConfig.ShermoPath = r.String("optimized", "shermoPath", def.OptConfig.ShermoPath)
+	optConfig.Psi4Path = r.String("optimized", "psi4Path", def.OptConfig.Psi4Path)
+	optConfig.NWChemPath = r.String("optimized", "nwchemPath", def.OptConfig.NWChemPath)
+	optConfig.XtbPath = r.String("optimized", "xtbPath", def.OptConfig.XtbPath)
+	optConfig.XtbArgs = r.String("optimized", "xtbArgs", def.OptConfig.XtbArgs)
+	optConfig.Preset = r.String("optimized", "preset", def.OptConfig.Preset)
+
+	// 给 nmrConfig 和 dp4Config 赋值
+	nmrConfig := &config.NMRConfig
+	nmrConfig.Temperature = r.Float64("nmr", "temperature", def.NMRConfig.Temperature)
+	nmrConfig.RefShieldingC = r.Float64("nmr", "refShieldingC", def.NMRConfig.RefShieldingC)
+	nmrConfig.RefShieldingH = r.Float64("nmr", "refShieldingH", def.NMRConfig.RefShieldingH)
+
+	dp4Config := &config.DP4Config
+	dp4Config.ScaledC = r.String("dp4", "scaledC", def.DP4Config.ScaledC)
+	dp4Config.ScaledH = r.String("dp4", "scaledH", def.DP4Config.ScaledH)
+	dp4Config.UnscaledSp2C = r.String("dp4", "unscaledSp2C", def.DP4Config.UnscaledSp2C)
+	dp4Config.UnscaledSp3C = r.String("dp4", "unscaledSp3C", def.DP4Config.UnscaledSp3C)
+	dp4Config.UnscaledSp2H = r.String("dp4", "unscaledSp2H", def.DP4Config.UnscaledSp2H)
+	dp4Config.UnscaledSp3H = r.String("dp4", "unscaledSp3H", def.DP4Config.UnscaledSp3H)
+
+	moleculeConfig := &config.MoleculeConfig
+	moleculeConfig.Charge = r.Int("molecule", "charge", def.MoleculeConfig.Charge)
+	moleculeConfig.Multiplicity = r.Int("molecule", "multiplicity", def.MoleculeConfig.Multiplicity)
+
+	solventConfig := &config.SolventConfig
+	solventConfig.Name = r.String("solvent", "name", def.SolventConfig.Name)
+	solventConfig.Model = strings.ToLower(r.String("solvent", "model", def.SolventConfig.Model))
+	solventConfig.XtbModel = strings.ToLower(r.String("solvent", "xtbModel", def.SolventConfig.XtbModel))
+
+	resourceConfig := &config.ResourceConfig
+	resourceConfig.NProcs = r.Int("resources", "nprocs", def.ResourceConfig.NProcs)
+	resourceConfig.Memory = r.Int("resources", "memory", def.ResourceConfig.Memory)
+
+	batchConfig := &config.BatchConfig
+	batchConfig.Scheduler = strings.ToLower(r.String("batch", "scheduler", def.BatchConfig.Scheduler))
+	batchConfig.SubmitCommand = r.String("batch", "submitCommand", def.BatchConfig.SubmitCommand)
+	batchConfig.StatusCommand = r.String("batch", "statusCommand", def.BatchConfig.StatusCommand)
+	batchConfig.CancelCommand = r.String("batch", "cancelCommand", def.BatchConfig.CancelCommand)
+	batchConfig.PollInterval = r.Int("batch", "pollInterval", def.BatchConfig.PollInterval)
+	batchConfig.HeaderFile = r.String("batch", "header", def.BatchConfig.HeaderFile)
+
+	wallTimeConfig := &config.WallTimeConfig
+	wallTimeConfig.MD = r.Duration("walltime", "md", def.WallTimeConfig.MD)
+	wallTimeConfig.Crest = r.Duration("walltime", "crest", def.WallTimeConfig.Crest)
+	wallTimeConfig.Opt = r.Duration("walltime", "opt", def.WallTimeConfig.Opt)
+	wallTimeConfig.SP = r.Duration("walltime", "sp", def.WallTimeConfig.SP)
+	wallTimeConfig.NMR = r.Duration("walltime", "nmr", def.WallTimeConfig.NMR)
+	wallTimeConfig.Shermo = r.Duration("walltime", "shermo", def.WallTimeConfig.Shermo)
 
-	// 接下来扫描 nAtoms 行，每一行的操作都和第一行一样。将所有的 Atom 结构体都赋值给 Cluster 结构体
-	// 所有的能量都赋值为 0
-	return cluster, nil
+	return config
 }
 
-func extractNAtomsFromFile(filePath string) (int, error) {
-	file, err := os.Open(filePath)
-	if err != nil {
-		return 0, fmt.Errorf("failed to open file: %v", err)
+// DefaultConfig 返回内置的默认配置，与项目自带的 config.ini 相同，程序路径为空。
+// 它是分层配置的第一层，配置文件中没有的 key 都使用这里的值，kybnmr init 也从它开始生成配置文件
+// 请注意，refShieldingC 和 refShieldingH 是 GauNMRTemplate.gjf 的理论水平下 TMS 的屏蔽常数，换用其他方法时需要重新计算
+func DefaultConfig() *Config {
+	return &Config{
+		DyConfig: DynamicsConfig{
+			Temperature: 400, Time: 100, Dump: 50, Step: 1, Hmass: 1, Shake: 1, Velo: true, Nvt: false, Sccacc: 2,
+			DynamicsArgs: "--omd --gfn 0",
+		},
+		OptConfig: OptimizedConfig{
+			PreOptArgs:    "--gfn0 --opt normal --niceprint",
+			PostOptArgs:   "--gfn2 --opt normal --niceprint",
+			PreThreshold:  "0.25, 0.1",
+			PostThreshold: "0.25, 0.1",
+			Psi4Path:      "psi4",
+			NWChemPath:    "nwchem",
+			XtbPath:       "xtb",
+			XtbArgs:       "--gfn2",
+		},
+		NMRConfig:      NMRConfig{Temperature: 298.15, RefShieldingC: 186.97, RefShieldingH: 31.79},
+		MoleculeConfig: MoleculeConfig{Charge: 0, Multiplicity: 1},
+		SolventConfig:  SolventConfig{Model: "smd", XtbModel: "alpb"},
+		ResourceConfig: ResourceConfig{NProcs: 8, Memory: 16000},
+		BatchConfig:    BatchConfig{Scheduler: "local", PollInterval: 30},
 	}
-	defer file.Close()
+}
 
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := scanner.Text()
-		// 使用正则表达式匹配 NAtoms= 后面的数字
-		re := regexp.MustCompile(`NAtoms=\s*(\d+)`)
-		match := re.FindStringSubmatch(line)
-		if len(match) > 1 {
-			nAtomsStr := match[1]
-			nAtoms, err := strconv.Atoi(nAtomsStr)
-			if err != nil {
-				return 0, fmt.Errorf("unable to convert NAtoms to integer: %s", nAtomsStr)
-			}
-			return nAtoms, nil
+// ToIni 将 config 转化为 ini 文件，与 ParseConfigFile 相反。值为空的字符串、没有设置的最长运行时间以及没有任何 key 的 section 不会写入
+func (c *Config) ToIni() *ini.File {
+	iniFile := ini.Empty()
+	formatFloat := func(value float64) string {
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	}
+	set := func(section string, key string, value string) {
+		if value != "" {
+			iniFile.Section(section).Key(key).SetValue(value)
+		}
+	}
+	setDuration := func(section string, key string, value time.Duration) {
+		if value != 0 {
+			set(section, key, value.String())
 		}
 	}
 
-	if err := scanner.Err(); err != nil {
-		return 0, fmt.Errorf("failed to scan file: %v", err)
+	set("dynamics", "temperature", formatFloat(c.DyConfig.Temperature))
+	set("dynamics", "time", formatFloat(c.DyConfig.Time))
+	set("dynamics", "dump", formatFloat(c.DyConfig.Dump))
+	set("dynamics", "step", formatFloat(c.DyConfig.Step))
+	set("dynamics", "hmass", strconv.Itoa(c.DyConfig.Hmass))
+	set("dynamics", "shake", strconv.Itoa(c.DyConfig.Shake))
+	set("dynamics", "velo", strconv.FormatBool(c.DyConfig.Velo))
+	set("dynamics", "nvt", strconv.FormatBool(c.DyConfig.Nvt))
+	set("dynamics", "sccacc", formatFloat(c.DyConfig.Sccacc))
+	set("dynamics", "dynamicsArgs", c.DyConfig.DynamicsArgs)
+
+	set("optimized", "preOptArgs", c.OptConfig.PreOptArgs)
+	set("optimized", "postOptArgs", c.OptConfig.PostOptArgs)
+	set("optimized", "preThreshold", c.OptConfig.PreThreshold)
+	set("optimized", "postThreshold", c.OptConfig.PostThreshold)
+	set("optimized", "gauPath", c.OptConfig.GauPath)
+	set("optimized", "orcaPath", c.OptConfig.OrcaPath)
+	set("optimized", "shermoPath", c.OptConfig.ShermoPath)
+	set("optimized", "psi4Path", c.OptConfig.Psi4Path)
+	set("optimized", "nwchemPath", c.OptConfig.NWChemPath)
+	set("optimized", "xtbPath", c.OptConfig.XtbPath)
+	set("optimized", "xtbArgs", c.OptConfig.XtbArgs)
+	set("optimized", "preset", c.OptConfig.Preset)
+
+	set("molecule", "charge", strconv.Itoa(c.MoleculeConfig.Charge))
+	set("molecule", "multiplicity", strconv.Itoa(c.MoleculeConfig.Multiplicity))
+
+	set("solvent", "name", c.SolventConfig.Name)
+	if c.SolventConfig.Name != "" {
+		set("solvent", "model", c.SolventConfig.Model)
+		set("solvent", "xtbModel", c.SolventConfig.XtbModel)
 	}
 
-	return 0, fmt.Errorf("NAtoms not found in the file")
+	set("resources", "nprocs", strconv.Itoa(c.ResourceConfig.NProcs))
+	set("resources", "memory", strconv.Itoa(c.ResourceConfig.Memory))
+
+	set("nmr", "temperature", formatFloat(c.NMRConfig.Temperature))
+	set("nmr", "refShieldingC", formatFloat(c.NMRConfig.RefShieldingC))
+	set("nmr", "refShieldingH", formatFloat(c.NMRConfig.RefShieldingH))
+
+	set("dp4", "scaledC", c.DP4Config.ScaledC)
+	set("dp4", "scaledH", c.DP4Config.ScaledH)
+	set("dp4", "unscaledSp2C", c.DP4Config.UnscaledSp2C)
+	set("dp4", "unscaledSp3C", c.DP4Config.UnscaledSp3C)
+	set("dp4", "unscaledSp2H", c.DP4Config.UnscaledSp2H)
+	set("dp4", "unscaledSp3H", c.DP4Config.UnscaledSp3H)
+
+	if c.BatchConfig.Scheduler != "local" {
+		set("batch", "scheduler", c.BatchConfig.Scheduler)
+		set("batch", "submitCommand", c.BatchConfig.SubmitCommand)
+		set("batch", "statusCommand", c.BatchConfig.StatusCommand)
+		set("batch", "cancelCommand", c.BatchConfig.CancelCommand)
+		set("batch", "pollInterval", strconv.Itoa(c.BatchConfig.PollInterval))
+		set("batch", "header", c.BatchConfig.HeaderFile)
+	}
+
+	setDuration("walltime", "md", c.WallTimeConfig.MD)
+	setDuration("walltime", "crest", c.WallTimeConfig.Crest)
+	setDuration("walltime", "opt", c.WallTimeConfig.Opt)
+	setDuration("walltime", "sp", c.WallTimeConfig.SP)
+	setDuration("walltime", "nmr", c.WallTimeConfig.NMR)
+	setDuration("walltime", "shermo", c.WallTimeConfig.Shermo)
+
+	return iniFile
 }
 
 // getSymbol 根据原子序数获取元素符号
@@ -439,10 +562,15 @@ func getSymbol(atomicNumber int) (string, error) {
 	return symbol, nil
 }
 
-// parseOrcaOutput 读取 Orca 生成的 out 文件
-func parseOrcaOutput(filePath string) (Cluster, error) {
-	var cluster Cluster
-	return cluster, nil
+// getAtomicNumber 根据元素符号获取原子序数，与 getSymbol 相反
+func getAtomicNumber(symbol string) (int, error) {
+	symbol = normalizeSymbol(symbol)
+	for atomicNumber := 1; atomicNumber <= 100; atomicNumber++ {
+		if known, _ := getSymbol(atomicNumber); known == symbol {
+			return atomicNumber, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown element symbol: %s", symbol)
 }
 
 // ParseXyzFile 用来解析 xyz 文件。将 xyz 中的所有结构都保存在一个 Cluster[] 中
@@ -561,13 +689,13 @@ func ParseXyzFile(xyzFile string) (ClusterList, error) {
 }
 
 // WriteToXyzFile 向一个标准 xyz 文件中写入信息，同时格式化 xyz 文件
-// 如果 xyzFileName 是已经存在的文件，则往文件末尾追加信息
+// 如果 xyzFileName 是已经存在的文件，则覆盖其中原来的内容
 // @param clusters: []Cluster 需要写入的文件信息
 // @param xyzFileName: string 需要写入的 xyz 文件的名称
 func WriteToXyzFile(clusters ClusterList, xyzFileName string) {
-	file, err := os.OpenFile(xyzFileName, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	file, err := os.OpenFile(xyzFileName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
 	if err != nil {
-		fmt.Println("Error opening XYZ file:", err)
+		slog.Error("error opening xyz file", "file", xyzFileName, "error", err)
 		return
 	}
 	defer file.Close()
@@ -577,13 +705,13 @@ func WriteToXyzFile(clusters ClusterList, xyzFileName string) {
 		// 写入原子数
 		_, err = file.WriteString(fmt.Sprintf("  %d\n", len(cluster.Atoms)))
 		if err != nil {
-			fmt.Println("Error writing atom count to XYZ file:", err)
+			slog.Error("error writing atom count to xyz file", "file", xyzFileName, "error", err)
 			return
 		}
 		// 写入能量
 		_, err = file.WriteString(fmt.Sprintf("\t\t%.8f\n", cluster.Energy))
 		if err != nil {
-			fmt.Println("Error writing energy to XYZ file:", err)
+			slog.Error("error writing energy to xyz file", "file", xyzFileName, "error", err)
 			return
 		}
 
@@ -591,11 +719,11 @@ func WriteToXyzFile(clusters ClusterList, xyzFileName string) {
 		for _, atom := range cluster.Atoms {
 			_, err = file.WriteString(fmt.Sprintf("%2s \t\t%14.10f \t\t%14.10f \t\t%14.10f\n", atom.Symbol, atom.X, atom.Y, atom.Z))
 			if err != nil {
-				fmt.Println("Error writing atom coordinates to XYZ file:", err)
+				slog.Error("error writing atom coordinates to xyz file", "file", xyzFileName, "error", err)
 				return
 			}
 		}
 	}
 
-	fmt.Println("Hint: XYZ file written successfully.")
+	slog.Debug("xyz file written successfully", "file", xyzFileName, "conformers", len(clusters))
 }
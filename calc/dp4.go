@@ -0,0 +1,612 @@
+package calc
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+* dp4.go
+* 该模块用来根据一组实验化学位移，计算若干个候选异构体的 DP4 和 DP4+ 概率，用来确定天然产物的相对构型
+*
+*	DP4: 对每一种核，将计算值对实验值做线性标度，标度后的误差服从 t 分布，
+*		 P(i) 正比于所有原子核 (1 - T(|e|/sigma, nu)) 的乘积，最后对所有异构体归一化
+*	DP4+: 同时考虑标度后的误差 (sDP4+) 和未标度的误差 (uDP4+)，
+*		  未标度的误差根据碳原子（或与氢相连的碳原子）的 sp2/sp3 杂化使用不同的 t 分布参数
+*
+* 实验数据文件为 csv 格式，每一行为 "nucleus, shift, atoms, count"，例如：
+*	nucleus,shift,atoms,count
+*	C,170.2,1
+*	H,1.23,18 19 20
+*	C,128.5,,2
+* atoms 为对应的原子序号（从 1 开始），化学等价的原子用空格隔开，计算值取这些原子的平均值；
+* atoms 为空的峰为未归属的峰，由 AssignPeaks 自动归属，count 为该峰包含的位点数，默认为 1
+*
+* @Author: Kimariyb
+* @Address: XiaMen University
+* @Data: 2023-09-22
+ */
+
+// TDistribution Student t 分布的参数：平均值 Mu、标准差 Sigma 和自由度 Nu
+type TDistribution struct {
+	Mu    float64
+	Sigma float64
+	Nu    float64
+}
+
+// DP4Params DP4+ 所需要的全部 t 分布参数
+type DP4Params struct {
+	ScaledC      TDistribution
+	ScaledH      TDistribution
+	UnscaledSp2C TDistribution
+	UnscaledSp3C TDistribution
+	UnscaledSp2H TDistribution
+	UnscaledSp3H TDistribution
+}
+
+// 原始 DP4 (Smith & Goodman, 2010) 中的标度误差参数
+var (
+	dp4OriginalC = TDistribution{Mu: 0, Sigma: 2.306, Nu: 11.38}
+	dp4OriginalH = TDistribution{Mu: 0, Sigma: 0.185, Nu: 14.18}
+)
+
+// DefaultDP4Params DP4+ 的默认参数
+// DP4+ 的参数与计算屏蔽常数的理论水平有关，这里的默认值仅供参考，
+// 实际使用时请在配置文件的 [dp4] 中填入与所用理论水平对应的参数
+var DefaultDP4Params = DP4Params{
+	ScaledC:      TDistribution{Mu: 0, Sigma: 1.557, Nu: 6.227},
+	ScaledH:      TDistribution{Mu: 0, Sigma: 0.104, Nu: 3.649},
+	UnscaledSp2C: TDistribution{Mu: -6.719, Sigma: 2.222, Nu: 6.107},
+	UnscaledSp3C: TDistribution{Mu: -1.917, Sigma: 1.808, Nu: 5.806},
+	UnscaledSp2H: TDistribution{Mu: -0.231, Sigma: 0.150, Nu: 3.982},
+	UnscaledSp3H: TDistribution{Mu: -0.064, Sigma: 0.122, Nu: 4.062},
+}
+
+// NewDP4Params 根据 [dp4] 中的配置生成 DP4Params，没有填写的参数使用 DefaultDP4Params
+func NewDP4Params(dp4Config *DP4Config) (DP4Params, error) {
+	params := DefaultDP4Params
+	fields := []struct {
+		key   string
+		value string
+		dist  *TDistribution
+	}{
+		{"scaledC", dp4Config.ScaledC, &params.ScaledC},
+		{"scaledH", dp4Config.ScaledH, &params.ScaledH},
+		{"unscaledSp2C", dp4Config.UnscaledSp2C, &params.UnscaledSp2C},
+		{"unscaledSp3C", dp4Config.UnscaledSp3C, &params.UnscaledSp3C},
+		{"unscaledSp2H", dp4Config.UnscaledSp2H, &params.UnscaledSp2H},
+		{"unscaledSp3H", dp4Config.UnscaledSp3H, &params.UnscaledSp3H},
+	}
+
+	for _, field := range fields {
+		if strings.TrimSpace(field.value) == "" {
+			continue
+		}
+		values, err := parseFloatList(field.value, 3)
+		if err != nil {
+			return params, fmt.Errorf("invalid [dp4] %s: %q, expected \"mu, sigma, nu\": %w", field.key, field.value, err)
+		}
+		if values[1] <= 0 || values[2] <= 0 {
+			return params, fmt.Errorf("invalid [dp4] %s: %q, sigma and nu must be positive", field.key, field.value)
+		}
+		*field.dist = TDistribution{Mu: values[0], Sigma: values[1], Nu: values[2]}
+	}
+
+	return params, nil
+}
+
+// ExpPeak 实验数据中的一个峰
+//   - Nucleus: 核的种类，C 或 H
+//   - Shift: 实验化学位移，单位为 ppm
+//   - Atoms: 对应的原子序号，从 1 开始，为空时表示未归属
+//   - Count: 未归属的峰包含的位点数（例如两个对称的碳重叠为一个峰时为 2）
+//   - Auto: 是否为 AssignPeaks 自动归属的峰
+//   - Sites: 自动归属时匹配到的每一个位点的原子，为空时 Atoms 中的每一个原子为一个位点
+type ExpPeak struct {
+	Nucleus string
+	Shift   float64
+	Atoms   []int
+	Count   int
+	Auto    bool
+	Sites   [][]int
+}
+
+// ParseExperimentalFile 读取实验化学位移的 csv 文件
+// 以 # 开头的行为注释，第一行如果是 "nucleus,shift,atoms,count" 表头则跳过
+func ParseExperimentalFile(fileName string) ([]ExpPeak, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.Comment = '#'
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	var peaks []ExpPeak
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading %s: %w", fileName, err)
+		}
+		line, _ := reader.FieldPos(0)
+
+		if len(record) < 2 {
+			return nil, fmt.Errorf("%s:%d: expected at least 2 columns, got %d", fileName, line, len(record))
+		}
+		// 跳过表头
+		if strings.EqualFold(strings.TrimSpace(record[0]), "nucleus") {
+			continue
+		}
+
+		nucleus := normalizeNucleus(record[0])
+		if nucleus != "C" && nucleus != "H" {
+			return nil, fmt.Errorf("%s:%d: unsupported nucleus %q, only C and H are supported", fileName, line, record[0])
+		}
+		shift, err := strconv.ParseFloat(strings.TrimSpace(record[1]), 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid shift %q", fileName, line, record[1])
+		}
+
+		var atoms []int
+		if len(record) > 2 {
+			for _, field := range strings.Fields(record[2]) {
+				atom, err := strconv.Atoi(field)
+				if err != nil || atom < 1 {
+					return nil, fmt.Errorf("%s:%d: invalid atom index %q", fileName, line, field)
+				}
+				atoms = append(atoms, atom)
+			}
+		}
+
+		count := 1
+		if len(record) > 3 && strings.TrimSpace(record[3]) != "" {
+			count, err = strconv.Atoi(strings.TrimSpace(record[3]))
+			if err != nil || count < 1 {
+				return nil, fmt.Errorf("%s:%d: invalid count %q", fileName, line, record[3])
+			}
+		}
+
+		peaks = append(peaks, ExpPeak{Nucleus: nucleus, Shift: shift, Atoms: atoms, Count: count})
+	}
+
+	if len(peaks) == 0 {
+		return nil, fmt.Errorf("no experimental shift found in %s", fileName)
+	}
+
+	return peaks, nil
+}
+
+// normalizeNucleus 将 13C、1H、c、h 等写法统一为元素符号
+func normalizeNucleus(nucleus string) string {
+	nucleus = strings.TrimSpace(nucleus)
+	nucleus = strings.TrimLeft(nucleus, "0123456789")
+	return strings.ToUpper(nucleus)
+}
+
+// covalentRadii 常见元素的共价半径，单位为 Angstrom
+var covalentRadii = map[string]float64{
+	"H": 0.31, "B": 0.84, "C": 0.76, "N": 0.71, "O": 0.66, "F": 0.57,
+	"Si": 1.11, "P": 1.07, "S": 1.05, "Cl": 1.02, "Br": 1.20, "I": 1.39,
+}
+
+// neighbors 根据共价半径判断成键，返回与第 index 个原子（从 0 开始）成键的所有原子
+func neighbors(cluster *Cluster, index int) []int {
+	var result []int
+	atom := cluster.Atoms[index]
+	radius, ok := covalentRadii[atom.Symbol]
+	if !ok {
+		radius = 1.5
+	}
+
+	for j, other := range cluster.Atoms {
+		if j == index {
+			continue
+		}
+		otherRadius, ok := covalentRadii[other.Symbol]
+		if !ok {
+			otherRadius = 1.5
+		}
+		dx, dy, dz := atom.X-other.X, atom.Y-other.Y, atom.Z-other.Z
+		if math.Sqrt(dx*dx+dy*dy+dz*dz) < radius+otherRadius+0.4 {
+			result = append(result, j)
+		}
+	}
+
+	return result
+}
+
+// IsSp2 判断第 atomIndex 个原子（从 1 开始）是否为 sp2 杂化，用于选择 DP4+ 未标度误差的参数
+// 碳原子的成键数小于 4 即认为是 sp2（sp 杂化也按 sp2 处理）；
+// 氢原子则取决于与之相连的碳原子，与杂原子相连的氢按 sp3 处理
+func IsSp2(cluster *Cluster, atomIndex int) bool {
+	index := atomIndex - 1
+	if index < 0 || index >= len(cluster.Atoms) {
+		return false
+	}
+
+	switch cluster.Atoms[index].Symbol {
+	case "C":
+		return len(neighbors(cluster, index)) < 4
+	case "H":
+		for _, neighbor := range neighbors(cluster, index) {
+			if cluster.Atoms[neighbor].Symbol == "C" {
+				return len(neighbors(cluster, neighbor)) < 4
+			}
+		}
+	}
+
+	return false
+}
+
+// PredictedShift 返回 atoms 中所有原子的平均计算化学位移
+func (r *NMRResult) PredictedShift(atoms []int) (float64, error) {
+	if len(atoms) == 0 {
+		return 0, fmt.Errorf("no atom assigned")
+	}
+
+	shifts := r.ShiftMap()
+	sum := 0.0
+	for _, atom := range atoms {
+		nucleus, ok := shifts[atom]
+		if !ok {
+			return 0, fmt.Errorf("no calculated shift for atom %d, check the reference shielding in [nmr]", atom)
+		}
+		sum += nucleus.Shift
+	}
+
+	return sum / float64(len(atoms)), nil
+}
+
+// PeakShift 返回实验峰 peak 的计算化学位移，即它的每一个位点的平均化学位移的平均值，
+// 这样 count 为 2 的峰归属到一个甲基和一个次甲基时，两个位点的权重相同，而不是按照原子数 3:1
+func (r *NMRResult) PeakShift(peak ExpPeak) (float64, error) {
+	if len(peak.Sites) == 0 {
+		return r.PredictedShift(peak.Atoms)
+	}
+
+	sum := 0.0
+	for _, site := range peak.Sites {
+		shift, err := r.PredictedShift(site)
+		if err != nil {
+			return 0, err
+		}
+		sum += shift
+	}
+	return sum / float64(len(peak.Sites)), nil
+}
+
+// IsomerNMR 一个候选异构体的名字和 NMR 结果
+type IsomerNMR struct {
+	Name   string
+	Result *NMRResult
+}
+
+// DP4Result 一个候选异构体的 DP4 分析结果，所有的概率都在 0 ~ 1 之间
+// CountC 和 CountH 为参与计算的实验峰的个数，为 0 时对应的概率没有意义
+type DP4Result struct {
+	Name     string
+	CountC   int
+	CountH   int
+	MAEC     float64
+	MAEH     float64
+	DP4C     float64
+	DP4H     float64
+	DP4      float64
+	SDP4C    float64
+	SDP4H    float64
+	SDP4     float64
+	UDP4C    float64
+	UDP4H    float64
+	UDP4     float64
+	DP4PlusC float64
+	DP4PlusH float64
+	DP4Plus  float64
+}
+
+// dp4Terms 一个异构体对数似然的各个分量
+type dp4Terms struct {
+	dp4C, dp4H   float64
+	sdp4C, sdp4H float64
+	udp4C, udp4H float64
+}
+
+// ComputeDP4 计算每一个候选异构体的 DP4 和 DP4+ 概率，返回的结果按 DP4+ 从大到小排序
+// 未归属的实验峰会根据每一个异构体各自的计算值分别自动归属
+func ComputeDP4(isomers []IsomerNMR, peaks []ExpPeak, params DP4Params) ([]DP4Result, error) {
+	if len(isomers) == 0 {
+		return nil, fmt.Errorf("no isomer to compare")
+	}
+
+	results := make([]DP4Result, len(isomers))
+	terms := make([]dp4Terms, len(isomers))
+
+	for k, isomer := range isomers {
+		results[k].Name = isomer.Name
+		geometry := isomer.Result.LowestConformer().Cluster
+		isomerPeaks, err := AssignPeaks(isomer.Result, peaks)
+		if err != nil {
+			return nil, fmt.Errorf("isomer %s: %w", isomer.Name, err)
+		}
+
+		for _, nucleus := range []string{"C", "H"} {
+			var calcShifts, expShifts []float64
+			var sp2 []bool
+			for _, peak := range isomerPeaks {
+				if peak.Nucleus != nucleus {
+					continue
+				}
+				shift, err := isomer.Result.PeakShift(peak)
+				if err != nil {
+					return nil, fmt.Errorf("isomer %s, %s peak at %.2f ppm: %w", isomer.Name, nucleus, peak.Shift, err)
+				}
+				calcShifts = append(calcShifts, shift)
+				expShifts = append(expShifts, peak.Shift)
+				sp2 = append(sp2, IsSp2(&geometry, peak.Atoms[0]))
+			}
+			if len(calcShifts) == 0 {
+				continue
+			}
+
+			// 线性标度：calc = slope * exp + intercept
+			slope, intercept := linearFit(expShifts, calcShifts)
+
+			var original, scaled, unscaled, mae float64
+			for i := range calcShifts {
+				scaledError := (calcShifts[i]-intercept)/slope - expShifts[i]
+				unscaledError := calcShifts[i] - expShifts[i]
+				mae += math.Abs(unscaledError)
+
+				if nucleus == "C" {
+					original += logTail(scaledError, dp4OriginalC)
+					scaled += logTail(scaledError, params.ScaledC)
+					if sp2[i] {
+						unscaled += logTail(unscaledError, params.UnscaledSp2C)
+					} else {
+						unscaled += logTail(unscaledError, params.UnscaledSp3C)
+					}
+				} else {
+					original += logTail(scaledError, dp4OriginalH)
+					scaled += logTail(scaledError, params.ScaledH)
+					if sp2[i] {
+						unscaled += logTail(unscaledError, params.UnscaledSp2H)
+					} else {
+						unscaled += logTail(unscaledError, params.UnscaledSp3H)
+					}
+				}
+			}
+			mae /= float64(len(calcShifts))
+
+			if nucleus == "C" {
+				results[k].CountC, results[k].MAEC = len(calcShifts), mae
+				terms[k].dp4C, terms[k].sdp4C, terms[k].udp4C = original, scaled, unscaled
+			} else {
+				results[k].CountH, results[k].MAEH = len(calcShifts), mae
+				terms[k].dp4H, terms[k].sdp4H, terms[k].udp4H = original, scaled, unscaled
+			}
+		}
+	}
+
+	// 对每一种组合分别在所有异构体之间归一化
+	normalizeInto(results, terms, func(t dp4Terms) float64 { return t.dp4C }, func(r *DP4Result, p float64) { r.DP4C = p })
+	normalizeInto(results, terms, func(t dp4Terms) float64 { return t.dp4H }, func(r *DP4Result, p float64) { r.DP4H = p })
+	normalizeInto(results, terms, func(t dp4Terms) float64 { return t.dp4C + t.dp4H }, func(r *DP4Result, p float64) { r.DP4 = p })
+	normalizeInto(results, terms, func(t dp4Terms) float64 { return t.sdp4C }, func(r *DP4Result, p float64) { r.SDP4C = p })
+	normalizeInto(results, terms, func(t dp4Terms) float64 { return t.sdp4H }, func(r *DP4Result, p float64) { r.SDP4H = p })
+	normalizeInto(results, terms, func(t dp4Terms) float64 { return t.sdp4C + t.sdp4H }, func(r *DP4Result, p float64) { r.SDP4 = p })
+	normalizeInto(results, terms, func(t dp4Terms) float64 { return t.udp4C }, func(r *DP4Result, p float64) { r.UDP4C = p })
+	normalizeInto(results, terms, func(t dp4Terms) float64 { return t.udp4H }, func(r *DP4Result, p float64) { r.UDP4H = p })
+	normalizeInto(results, terms, func(t dp4Terms) float64 { return t.udp4C + t.udp4H }, func(r *DP4Result, p float64) { r.UDP4 = p })
+	normalizeInto(results, terms, func(t dp4Terms) float64 { return t.sdp4C + t.udp4C }, func(r *DP4Result, p float64) { r.DP4PlusC = p })
+	normalizeInto(results, terms, func(t dp4Terms) float64 { return t.sdp4H + t.udp4H }, func(r *DP4Result, p float64) { r.DP4PlusH = p })
+	normalizeInto(results, terms, func(t dp4Terms) float64 {
+		return t.sdp4C + t.sdp4H + t.udp4C + t.udp4H
+	}, func(r *DP4Result, p float64) { r.DP4Plus = p })
+
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].DP4Plus > results[j].DP4Plus
+	})
+
+	return results, nil
+}
+
+// normalizeInto 将对数似然转化为归一化的概率，并通过 set 写入 results
+func normalizeInto(results []DP4Result, terms []dp4Terms, get func(dp4Terms) float64, set func(*DP4Result, float64)) {
+	maxLog := math.Inf(-1)
+	for _, term := range terms {
+		maxLog = math.Max(maxLog, get(term))
+	}
+
+	sum := 0.0
+	probabilities := make([]float64, len(terms))
+	for i, term := range terms {
+		probabilities[i] = math.Exp(get(term) - maxLog)
+		sum += probabilities[i]
+	}
+	for i := range results {
+		set(&results[i], probabilities[i]/sum)
+	}
+}
+
+// linearFit 最小二乘拟合 y = slope * x + intercept
+// 数据点少于 2 个或者 x 没有变化时，不做标度，返回 slope = 1, intercept = 0
+func linearFit(x, y []float64) (float64, float64) {
+	n := float64(len(x))
+	if len(x) < 2 {
+		return 1, 0
+	}
+
+	var sumX, sumY, sumXY, sumXX float64
+	for i := range x {
+		sumX += x[i]
+		sumY += y[i]
+		sumXY += x[i] * y[i]
+		sumXX += x[i] * x[i]
+	}
+	denominator := n*sumXX - sumX*sumX
+	if math.Abs(denominator) < 1e-12 {
+		return 1, 0
+	}
+
+	slope := (n*sumXY - sumX*sumY) / denominator
+	if math.Abs(slope) < 1e-12 {
+		return 1, 0
+	}
+	intercept := (sumY - slope*sumX) / n
+
+	return slope, intercept
+}
+
+// logTail 返回误差 e 在 t 分布 dist 下的 ln(1 - T(|e - mu| / sigma))
+// 对于 t >= 0，1 - T(t) = I_x(nu/2, 1/2) / 2，其中 x = nu / (nu + t^2)
+func logTail(e float64, dist TDistribution) float64 {
+	t := math.Abs(e-dist.Mu) / dist.Sigma
+	x := dist.Nu / (dist.Nu + t*t)
+	return math.Log(0.5 * regularizedIncompleteBeta(x, dist.Nu/2, 0.5))
+}
+
+// regularizedIncompleteBeta 计算正则化不完全 Beta 函数 I_x(a, b)，使用连分式展开
+func regularizedIncompleteBeta(x, a, b float64) float64 {
+	if x <= 0 {
+		return 0
+	}
+	if x >= 1 {
+		return 1
+	}
+
+	lgA, _ := math.Lgamma(a)
+	lgB, _ := math.Lgamma(b)
+	lgAB, _ := math.Lgamma(a + b)
+	front := math.Exp(lgAB - lgA - lgB + a*math.Log(x) + b*math.Log(1-x))
+
+	// 根据 x 的大小选择收敛更快的形式
+	if x < (a+1)/(a+b+2) {
+		return front * betaContinuedFraction(x, a, b) / a
+	}
+	return 1 - front*betaContinuedFraction(1-x, b, a)/b
+}
+
+// betaContinuedFraction 不完全 Beta 函数的连分式 (Lentz 算法)
+func betaContinuedFraction(x, a, b float64) float64 {
+	const maxIterations = 300
+	const epsilon = 1e-14
+	const tiny = 1e-300
+
+	c := 1.0
+	d := 1 - (a+b)*x/(a+1)
+	if math.Abs(d) < tiny {
+		d = tiny
+	}
+	d = 1 / d
+	h := d
+
+	for m := 1; m <= maxIterations; m++ {
+		fm := float64(m)
+		// 偶数项
+		numerator := fm * (b - fm) * x / ((a + 2*fm - 1) * (a + 2*fm))
+		d = 1 + numerator*d
+		if math.Abs(d) < tiny {
+			d = tiny
+		}
+		c = 1 + numerator/c
+		if math.Abs(c) < tiny {
+			c = tiny
+		}
+		d = 1 / d
+		h *= d * c
+
+		// 奇数项
+		numerator = -(a + fm) * (a + b + fm) * x / ((a + 2*fm) * (a + 2*fm + 1))
+		d = 1 + numerator*d
+		if math.Abs(d) < tiny {
+			d = tiny
+		}
+		c = 1 + numerator/c
+		if math.Abs(c) < tiny {
+			c = tiny
+		}
+		d = 1 / d
+		delta := d * c
+		h *= delta
+
+		if math.Abs(delta-1) < epsilon {
+			break
+		}
+	}
+
+	return h
+}
+
+// formatProbability 将概率格式化为百分数，没有对应实验数据时输出 "-"
+func formatProbability(probability float64, count int) string {
+	if count == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.2f", probability*100)
+}
+
+// PrintDP4Results 按 DP4+ 从大到小打印所有候选异构体的 DP4 分析结果，概率以百分数表示
+func PrintDP4Results(results []DP4Result) {
+	fmt.Println()
+	fmt.Println("  =======================================")
+	fmt.Println("  |          DP4 / DP4+ Analysis        |")
+	fmt.Println("  =======================================")
+	fmt.Println()
+	fmt.Printf(" %-4s %-20s %8s %8s %8s %8s %8s %8s %8s %8s\n",
+		"Rank", "Isomer", "MAE(C)", "MAE(H)", "DP4", "sDP4+", "uDP4+", "DP4+(H)", "DP4+(C)", "DP4+")
+	for i, result := range results {
+		counts := result.CountC + result.CountH
+		fmt.Printf(" %-4d %-20s %8.3f %8.3f %8s %8s %8s %8s %8s %8s\n",
+			i+1, result.Name, result.MAEC, result.MAEH,
+			formatProbability(result.DP4, counts),
+			formatProbability(result.SDP4, counts),
+			formatProbability(result.UDP4, counts),
+			formatProbability(result.DP4PlusH, result.CountH),
+			formatProbability(result.DP4PlusC, result.CountC),
+			formatProbability(result.DP4Plus, counts))
+	}
+	fmt.Println()
+}
+
+// WriteDP4CSV 将 DP4 分析结果写入 csv 文件
+func WriteDP4CSV(results []DP4Result, fileName string) error {
+	file, err := os.Create(fileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	writer := csv.NewWriter(file)
+	_ = writer.Write([]string{"rank", "isomer", "nC", "nH", "maeC", "maeH",
+		"dp4C", "dp4H", "dp4", "sdp4C", "sdp4H", "sdp4", "udp4C", "udp4H", "udp4",
+		"dp4plusC", "dp4plusH", "dp4plus"})
+
+	format := func(value float64) string {
+		return strconv.FormatFloat(value, 'f', 6, 64)
+	}
+	for i, result := range results {
+		_ = writer.Write([]string{
+			strconv.Itoa(i + 1), result.Name,
+			strconv.Itoa(result.CountC), strconv.Itoa(result.CountH),
+			format(result.MAEC), format(result.MAEH),
+			format(result.DP4C), format(result.DP4H), format(result.DP4),
+			format(result.SDP4C), format(result.SDP4H), format(result.SDP4),
+			format(result.UDP4C), format(result.UDP4H), format(result.UDP4),
+			format(result.DP4PlusC), format(result.DP4PlusH), format(result.DP4Plus),
+		})
+	}
+	writer.Flush()
+
+	return writer.Error()
+}
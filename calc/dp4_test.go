@@ -0,0 +1,114 @@
+package calc
+
+import (
+	"math"
+	"testing"
+)
+
+// shiftResult 返回只有一个构象 cluster 的 NMR 结果，shifts 为原子序号（从 1 开始）到化学位移的映射，其它原子没有参考屏蔽常数
+func shiftResult(cluster Cluster, shifts map[int]float64) *NMRResult {
+	result := &NMRResult{Conformers: []ConformerNMR{{Cluster: cluster, Population: 1}}}
+	for i, atom := range cluster.Atoms {
+		shift, ok := shifts[i+1]
+		result.Nuclei = append(result.Nuclei, NucleusShift{Index: i + 1, Symbol: atom.Symbol, Shift: shift, Referenced: ok})
+	}
+	return result
+}
+
+func TestRegularizedIncompleteBeta(t *testing.T) {
+	tests := []struct {
+		x, a, b float64
+		want    float64
+	}{
+		{0, 2, 3, 0},
+		{1, 2, 3, 1},
+		// I_x(1, 1) = x，I_x(a, 1) = x^a，I_x(1, b) = 1 - (1 - x)^b
+		{0.3, 1, 1, 0.3},
+		{0.7, 3, 1, 0.343},
+		{0.2, 1, 4, 1 - math.Pow(0.8, 4)},
+		// I_x(1/2, 1/2) = 2 / pi * arcsin(sqrt(x))
+		{0.25, 0.5, 0.5, 2 / math.Pi * math.Asin(0.5)},
+		// I_1/2(a, a) = 1/2
+		{0.5, 5.69, 5.69, 0.5},
+		// 整数的 a、b：I_x(2, 3) = P(Binomial(4, x) >= 2)
+		{0.4, 2, 3, 0.5248},
+		{0.9, 2, 3, 1 - math.Pow(0.1, 4) - 4*0.9*math.Pow(0.1, 3)},
+		// 对称性 I_x(a, b) = 1 - I_(1-x)(b, a)
+		{0.6, 3, 2, 1 - 0.5248},
+	}
+	for _, test := range tests {
+		if got := regularizedIncompleteBeta(test.x, test.a, test.b); !approxEqual(got, test.want, 1e-12) {
+			t.Errorf("I_%g(%g, %g) = %.15f, want %.15f", test.x, test.a, test.b, got, test.want)
+		}
+	}
+}
+
+func TestLogTail(t *testing.T) {
+	tests := []struct {
+		name string
+		e    float64
+		dist TDistribution
+		want float64
+	}{
+		{"zero error", 0, dp4OriginalC, math.Log(0.5)},
+		// nu = 1 为 Cauchy 分布：1 - T(t) = 1/2 - arctan(t) / pi
+		{"cauchy", 2, TDistribution{Mu: 0, Sigma: 1, Nu: 1}, math.Log(0.5 - math.Atan(2)/math.Pi)},
+		// nu = 2：1 - T(t) = (1 - t / sqrt(t^2 + 2)) / 2
+		{"nu 2", 1.5, TDistribution{Mu: 0, Sigma: 0.5, Nu: 2}, math.Log((1 - 3/math.Sqrt(11)) / 2)},
+		// 原始 DP4 的碳参数 nu = 11.38，t = 1 和 t = 2.5 的单侧尾概率由 t 分布密度函数数值积分得到
+		{"dp4 carbon t=1", 2.306, dp4OriginalC, math.Log(0.169049837621)},
+		{"dp4 carbon t=2.5", -2.5 * 2.306, dp4OriginalC, math.Log(0.014432966743)},
+		// 误差相对于 mu 计算
+		{"shifted mean", -6.719 + 2.222, TDistribution{Mu: -6.719, Sigma: 2.222, Nu: 11.38}, math.Log(0.169049837621)},
+	}
+	for _, test := range tests {
+		if got := logTail(test.e, test.dist); !approxEqual(got, test.want, 1e-9) {
+			t.Errorf("%s: logTail(%g) = %.12f, want %.12f", test.name, test.e, got, test.want)
+		}
+	}
+}
+
+func TestComputeDP4RanksTheCloserIsomerFirst(t *testing.T) {
+	// 相距很远的原子，只用来编号
+	var cluster Cluster
+	for i, symbol := range []string{"C", "C", "C", "C", "H", "H", "H"} {
+		cluster.Atoms = append(cluster.Atoms, Atom{symbol, float64(10 * i), 0, 0})
+	}
+	peaks := []ExpPeak{
+		{Nucleus: "C", Shift: 20, Atoms: []int{1}},
+		{Nucleus: "C", Shift: 40, Atoms: []int{2}},
+		{Nucleus: "C", Shift: 60, Atoms: []int{3}},
+		{Nucleus: "C", Shift: 80, Atoms: []int{4}},
+		{Nucleus: "H", Shift: 1.0, Atoms: []int{5}},
+		{Nucleus: "H", Shift: 2.5, Atoms: []int{6}},
+		{Nucleus: "H", Shift: 3.5, Atoms: []int{7}},
+	}
+	isomers := []IsomerNMR{
+		{"far", shiftResult(cluster, map[int]float64{1: 41, 2: 19, 3: 62, 4: 79, 5: 2.6, 6: 1.1, 7: 3.4})},
+		{"close", shiftResult(cluster, map[int]float64{1: 20.5, 2: 41, 3: 59, 4: 80.5, 5: 1.1, 6: 2.4, 7: 3.6})},
+	}
+
+	results, err := ComputeDP4(isomers, peaks, DefaultDP4Params)
+	if err != nil {
+		t.Fatalf("ComputeDP4: %v", err)
+	}
+	if results[0].Name != "close" || results[0].CountC != 4 || results[0].CountH != 3 {
+		t.Errorf("first result %+v, want the close isomer with 4 C and 3 H peaks", results[0])
+	}
+
+	probabilities := map[string]func(DP4Result) float64{
+		"DP4":   func(r DP4Result) float64 { return r.DP4 },
+		"sDP4+": func(r DP4Result) float64 { return r.SDP4 },
+		"uDP4+": func(r DP4Result) float64 { return r.UDP4 },
+		"DP4+":  func(r DP4Result) float64 { return r.DP4Plus },
+	}
+	for name, probability := range probabilities {
+		first, second := probability(results[0]), probability(results[1])
+		if !approxEqual(first+second, 1, 1e-12) {
+			t.Errorf("%s: probabilities %g + %g, want a sum of 1", name, first, second)
+		}
+		if first <= second {
+			t.Errorf("%s: close isomer %g, far isomer %g", name, first, second)
+		}
+	}
+}
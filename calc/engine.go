@@ -0,0 +1,400 @@
+package calc
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"kybnmr/utils"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+/*
+* engine.go
+* 该模块定义了量子化学程序的统一接口 Engine，以及 Engine 的注册表
+*
+*	KYBNMR 的 DFT 优化、单点能和 NMR 三个步骤都只通过 Engine 调用量子化学程序：
+*		1. 根据模板文件和 Cluster 生成输入文件
+*		2. 运行输入文件，生成 out 文件
+*		3. 从 out 文件中读取结构、能量、自由能热校正量和屏蔽常数，并判断程序是否正常结束
+*	新的程序只需要实现 Engine 接口并调用 RegisterEngine 注册，就可以通过 --opt/--sp/--nmr 选择，
+*	而不需要修改 run.Run 中的流程
+*
+* @Author: Kimariyb
+* @Address: XiaMen University
+* @Data: 2023-09-24
+ */
+
+// Stage DFT 计算的步骤
+type Stage string
+
+const (
+	StageOpt Stage = "opt"
+	StageSP  Stage = "sp"
+	StageNMR Stage = "nmr"
+)
+
+// Folder 返回该步骤的输入和输出文件所在的文件夹，如 thermo/opt
+func (s Stage) Folder() string {
+	return filepath.Join("thermo", string(s))
+}
+
+// OutFile 返回该步骤中第 index 个（从 1 开始）任务的 out 文件路径，如 thermo/opt/cluster-opt1.out
+func (s Stage) OutFile(index int) string {
+	return filepath.Join(s.Folder(), fmt.Sprintf("cluster-%s%d.out", s, index))
+}
+
+// Engine 量子化学程序的统一接口
+type Engine interface {
+	// Name 返回程序的名字，如 gaussian
+	Name() string
+	// TemplateFile 返回该程序在 stage 步骤默认使用的模板文件，返回空字符串表示不需要模板，输入文件为 xyz 文件
+	TemplateFile(stage Stage) string
+	// BuildInput 根据模板内容 template 和结构 cluster 生成输入文件的内容
+	BuildInput(template string, cluster Cluster) string
+	// CommandLine 返回在 stage 步骤运行 inputFile 并将输出写入 outFile 的 shell 命令
+	CommandLine(stage Stage, inputFile string, outFile string) string
+	// Run 在 stage 步骤运行 inputFile，并将输出写入 outFile，ctx 被取消或者超时时必须结束程序的所有进程
+	Run(ctx context.Context, stage Stage, inputFile string, outFile string) error
+	// ParseGeometry 读取 out 文件中的最后一帧结构
+	ParseGeometry(outFile string) (Cluster, error)
+	// ParseEnergy 读取 out 文件中的单点能，单位为 Hartree
+	ParseEnergy(outFile string) (float64, error)
+	// ParseGibbsCorrection 读取 out 文件中的自由能热校正量，单位为 Hartree
+	ParseGibbsCorrection(outFile string) (float64, error)
+	// ParseShieldings 读取 out 文件中所有原子核的各向同性屏蔽常数
+	ParseShieldings(outFile string) ([]NucleusShielding, error)
+	// IsNormalTermination 判断 out 文件对应的任务是否正常结束
+	IsNormalTermination(outFile string) bool
+}
+
+// StageLimiter 只支持部分步骤的 Engine 实现该接口，例如 xtb 不能计算 NMR
+type StageLimiter interface {
+	Supports(stage Stage) bool
+}
+
+// SupportsStage 判断 engine 是否支持 stage 步骤，没有实现 StageLimiter 的 Engine 支持所有步骤
+func SupportsStage(engine Engine, stage Stage) bool {
+	if limiter, ok := engine.(StageLimiter); ok {
+		return limiter.Supports(stage)
+	}
+	return true
+}
+
+// EngineFactory 根据配置文件创建一个 Engine
+type EngineFactory func(config *Config) Engine
+
+var engineRegistry = make(map[string]EngineFactory)
+
+// RegisterEngine 注册一个 Engine，name 不区分大小写
+func RegisterEngine(name string, factory EngineFactory) {
+	engineRegistry[strings.ToLower(name)] = factory
+}
+
+// NewEngine 根据名字创建一个已经注册的 Engine
+func NewEngine(name string, config *Config) (Engine, error) {
+	factory, ok := engineRegistry[strings.ToLower(name)]
+	if !ok {
+		return nil, fmt.Errorf("unknown program: %s (available: %s)", name, strings.Join(EngineNames(), ", "))
+	}
+	return factory(config), nil
+}
+
+// EngineNames 返回所有已经注册的 Engine 的名字
+func EngineNames() []string {
+	var names []string
+	for name := range engineRegistry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// replaceGeometry 将模板中的 [GEOMETRY] 标记替换为 cluster 的原子坐标，并在末尾追加两行空格
+func replaceGeometry(template string, cluster Cluster) string {
+	return strings.Replace(template, "[GEOMETRY]", cluster.ToXYZString(), 1) + "\n\n"
+}
+
+// chargeLineRegex 匹配 [GEOMETRY] 前一行的电荷和自旋多重度，
+// 如 Gaussian 和 Psi4 的 "0 1"，或者 Orca 的 "* xyz 0 1"
+var chargeLineRegex = regexp.MustCompile(`(?m)^([ \t]*(?:\*[ \t]*xyz[ \t]+)?)-?\d+[ \t]+\d+([ \t]*\r?\n[ \t]*\[GEOMETRY\])`)
+
+// replaceChargeLine 将模板中 [GEOMETRY] 前一行的电荷和自旋多重度替换为 molecule 中的值
+func replaceChargeLine(template string, molecule MoleculeConfig) string {
+	return chargeLineRegex.ReplaceAllString(template, fmt.Sprintf("${1}%d %d${2}", molecule.Charge, molecule.Multiplicity))
+}
+
+// findLastFloat 返回 filePath 文件中 regex 最后一个匹配项的第一个分组，并转化为 float64
+func findLastFloat(filePath string, regex *regexp.Regexp) (float64, error) {
+	contents, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return 0, err
+	}
+
+	matches := regex.FindAllStringSubmatch(string(contents), -1)
+	if len(matches) == 0 {
+		return 0, fmt.Errorf("no match of %q found in %s", regex.String(), filePath)
+	}
+
+	return strconv.ParseFloat(matches[len(matches)-1][1], 64)
+}
+
+// processWaitDelay 取消外部程序之后，等待其输出关闭的最长时间
+const processWaitDelay = 10 * time.Second
+
+// JobLogFile 返回任务 outFile 对应的 log 文件，如 thermo/opt/cluster-opt1.out 对应 thermo/opt/cluster-opt1.log，
+// 程序没有重定向到 out 文件的标准输出和标准错误输出都写入这个文件
+func JobLogFile(outFile string) string {
+	return strings.TrimSuffix(outFile, filepath.Ext(outFile)) + ".log"
+}
+
+// runShellCommand 通过 bash -c 运行 commandLine，程序的标准输出和标准错误输出写入 logFile，
+// 使用 --verbose 时同时显示在屏幕上
+func runShellCommand(ctx context.Context, commandLine string, logFile string) error {
+	return runShellCommandIn(ctx, "", commandLine, logFile)
+}
+
+// runShellCommandIn 在 dir 文件夹中运行 commandLine，dir 为空时在当前目录中运行
+// 会在运行目录中生成临时文件的程序（如 xtb、Psi4、NWChem）使用这个函数，commandLine 中的路径需要是绝对路径
+func runShellCommandIn(ctx context.Context, dir string, commandLine string, logFile string) error {
+	cmd := commandContext(ctx, "bash", "-c", commandLine)
+	cmd.Dir = dir
+	return runLogged(cmd, logFile)
+}
+
+// runLogged 运行 cmd，cmd 的标准输出和标准错误输出写入 logFile（已经存在时覆盖），
+// 使用 --verbose 时同时显示在屏幕上
+func runLogged(cmd *exec.Cmd, logFile string) error {
+	file, err := os.Create(logFile)
+	if err != nil {
+		return fmt.Errorf("error creating log file: %w", err)
+	}
+	defer file.Close()
+
+	output := utils.ProgramOutput(file)
+	cmd.Stdout = output
+	cmd.Stderr = output
+	return cmd.Run()
+}
+
+// absPaths 返回 inputFile 和 outFile 的绝对路径
+func absPaths(inputFile string, outFile string) (string, string, error) {
+	inputPath, err := filepath.Abs(inputFile)
+	if err != nil {
+		return "", "", err
+	}
+	outPath, err := filepath.Abs(outFile)
+	if err != nil {
+		return "", "", err
+	}
+	return inputPath, outPath, nil
+}
+
+// RunDFTStage 调用 engine 对 clusters 中的每一个结构执行 stage 步骤的计算
+// 运算的原理：首先读取模板文件 templateFile，用 data 渲染模板中的占位符，由 engine 将结构写入模板，在 thermo/<stage> 文件夹中
+// 生成 cluster-<stage>1.gjf 等输入文件，接着交给 backend 运行这些输入文件，在同一个文件夹中生成 out 文件，
+// backend 负责检查每个任务是否正常结束，返回的 JobResult 记录每一个任务的状态和运行时间
+// 上一次运行留下的输入文件与这一次相同、并且 out 文件正常结束的任务不再运行，直接当作正常结束；
+// out 文件不存在或者被标记为中断的任务重新运行，多出来的编号的文件会被删除
+func RunDFTStage(ctx context.Context, engine Engine, backend Backend, stage Stage, templateFile string, data TemplateData, clusters ClusterList) ([]JobResult, error) {
+	if !SupportsStage(engine, stage) {
+		return nil, fmt.Errorf("%s does not support the %s step", engine.Name(), stage)
+	}
+
+	// 读取并解析模板文件，没有模板文件的 Engine 直接使用 xyz 文件作为输入文件
+	var tmpl *template.Template
+	inputExt := InputExt(templateFile)
+	if templateFile != "" {
+		content, err := ioutil.ReadFile(templateFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading template file: %w", err)
+		}
+		tmpl, err = parseTemplate(filepath.Base(templateFile), string(content))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// 创建 thermo/<stage> 文件夹（如果不存在）
+	if err := os.MkdirAll(stage.Folder(), 0755); err != nil {
+		return nil, fmt.Errorf("error creating %s folder: %w", stage, err)
+	}
+
+	// 删除上一次运行留下的、编号超出这一次结构数量的文件，否则读取 out 文件时会把它们当作结果
+	if err := removeStaleJobs(stage, len(clusters)); err != nil {
+		return nil, err
+	}
+
+	var jobs []Job
+	var finished []JobResult
+	for i, cluster := range clusters {
+		// 生成新的输入文件名和输出文件名
+		inputFileName := fmt.Sprintf("cluster-%s%d%s", stage, i+1, inputExt)
+		job := Job{
+			Index:     i + 1,
+			InputFile: filepath.Join(stage.Folder(), inputFileName),
+			OutFile:   stage.OutFile(i + 1),
+		}
+
+		// 渲染模板，并将新的输入文件写入磁盘
+		var templateContent string
+		if tmpl != nil {
+			rendered, err := renderTemplate(tmpl, data.ForJob(stage, job.Index))
+			if err != nil {
+				return nil, err
+			}
+			templateContent = rendered
+		}
+		inputContent := engine.BuildInput(templateContent, cluster)
+		if isFinishedJob(engine, job, inputContent) {
+			slog.Info("skipped job that already finished", "stage", stage, "conformer", job.Index, "out", job.OutFile)
+			finished = append(finished, JobResult{Index: job.Index, Input: job.InputFile, Output: job.OutFile, Status: JobNormal})
+			continue
+		}
+		if err := ioutil.WriteFile(job.InputFile, []byte(inputContent), 0644); err != nil {
+			return nil, fmt.Errorf("error writing input file: %w", err)
+		}
+		// 重新运行的任务不能留下上一次的 out 文件
+		for _, file := range []string{job.OutFile, job.OutFile + InterruptedSuffix} {
+			if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+				return nil, fmt.Errorf("error removing the out file of the previous run: %w", err)
+			}
+		}
+		jobs = append(jobs, job)
+	}
+
+	progress := NewProgress(stage, engine, len(jobs))
+	progress.Start()
+	results, err := backend.RunJobs(ctx, engine, stage, jobs, progress)
+	progress.Stop()
+	results = append(finished, results...)
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Index < results[j].Index
+	})
+	if err != nil {
+		return results, err
+	}
+	slog.Info("calculation completed", "program", engine.Name(), "jobs", len(jobs), "skipped", len(finished))
+
+	return results, nil
+}
+
+// isFinishedJob 上一次运行已经用同样的输入文件 inputContent 正常完成了 job 时返回 true
+func isFinishedJob(engine Engine, job Job, inputContent string) bool {
+	previous, err := ioutil.ReadFile(job.InputFile)
+	if err != nil || string(previous) != inputContent {
+		return false
+	}
+	if _, err := os.Stat(job.OutFile); err != nil {
+		return false
+	}
+	return engine.IsNormalTermination(job.OutFile)
+}
+
+// removeStaleJobs 删除 stage 文件夹中编号大于 n 的 cluster-<stage>N.* 文件和任务文件夹
+func removeStaleJobs(stage Stage, n int) error {
+	indexes, err := stageJobIndexes(stage.Folder(), stage)
+	if err != nil {
+		return err
+	}
+	for _, index := range indexes {
+		if index <= n {
+			continue
+		}
+		// 在单独的文件夹中运行的任务（如 xtb）的文件夹名没有扩展名
+		name := filepath.Join(stage.Folder(), fmt.Sprintf("cluster-%s%d", stage, index))
+		files, err := filepath.Glob(name + ".*")
+		if err != nil {
+			return err
+		}
+		for _, file := range append(files, name) {
+			if err := os.RemoveAll(file); err != nil {
+				return fmt.Errorf("error removing the files of the previous run: %w", err)
+			}
+		}
+		slog.Debug("removed job of the previous run", "stage", stage, "conformer", index)
+	}
+	return nil
+}
+
+// InputExt 返回使用模板文件 templateFile 的步骤的输入文件的扩展名，没有模板文件时输入文件为 xyz 文件
+func InputExt(templateFile string) string {
+	if templateFile == "" {
+		return ".xyz"
+	}
+	return filepath.Ext(templateFile)
+}
+
+// listOutFiles 按照文件名的顺序返回 folder 文件夹中所有的 out 文件的完整路径
+func listOutFiles(folder string) ([]string, error) {
+	files, err := ioutil.ReadDir(folder)
+	if err != nil {
+		return nil, err
+	}
+
+	var outFiles []string
+	for _, file := range files {
+		if !file.IsDir() && strings.HasSuffix(file.Name(), ".out") {
+			outFiles = append(outFiles, filepath.Join(folder, file.Name()))
+		}
+	}
+
+	return outFiles, nil
+}
+
+// ReadClusterListFromOut 扫描 thermo/opt 文件夹下的所有的 out 文件，
+// 调用 engine 读取所有 out 文件中的最后一帧结构，并且返回成 ClusterList
+// ClusterList 的顺序即为之后单点能和 NMR 任务的编号顺序
+func ReadClusterListFromOut(engine Engine) (ClusterList, error) {
+	var clusterList ClusterList
+
+	outFiles, err := listOutFiles(StageOpt.Folder())
+	if err != nil {
+		return clusterList, err
+	}
+
+	for _, outFile := range outFiles {
+		cluster, err := engine.ParseGeometry(outFile)
+		if err != nil {
+			return clusterList, err
+		}
+		clusterList = append(clusterList, cluster)
+	}
+
+	return clusterList, nil
+}
+
+// CollectSinglePointEnergies 按照 thermo/opt 中 out 文件的顺序，读取 thermo/sp 中对应的单点能
+// 返回的 ShermoResult 中 FileName 为优化和振动分析的 out 文件，Energy 为对应的单点能
+func CollectSinglePointEnergies(engine Engine) ([]ShermoResult, error) {
+	var resultsCollection []ShermoResult
+
+	optFiles, err := listOutFiles(StageOpt.Folder())
+	if err != nil {
+		return nil, err
+	}
+
+	for i, optFile := range optFiles {
+		spFile := StageSP.OutFile(i + 1)
+		energy, err := engine.ParseEnergy(spFile)
+		if err != nil {
+			return nil, err
+		}
+		slog.Info("single point energy", "conformer", i+1, "file", filepath.Base(spFile), "energy", energy)
+
+		resultsCollection = append(resultsCollection, ShermoResult{
+			FileName: optFile,
+			Energy:   fmt.Sprintf("%.10f", energy),
+		})
+	}
+
+	return resultsCollection, nil
+}
@@ -0,0 +1,235 @@
+package calc
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+/*
+* fake.go
+* 该模块实现了一个不调用任何量子化学程序的 Engine，用来在没有 Gaussian/Orca 的机器上离线测试整个流程
+*
+*	FakeEngine 读取输入文件中的原子坐标，根据原子间距离生成确定的能量、自由能热校正量和屏蔽常数，
+*	并写成一个它自己能够读取的 out 文件。同样的结构总是得到同样的结果，不同的构象得到不同的结果，
+*	因此 Boltzmann 分布、平均化学位移和 DP4 等后续步骤都可以正常运行，但结果没有任何化学意义
+*
+* @Author: Kimariyb
+* @Address: XiaMen University
+* @Data: 2023-09-24
+ */
+
+func init() {
+	RegisterEngine("fake", func(config *Config) Engine {
+		return &FakeEngine{}
+	})
+}
+
+// fakeTermination FakeEngine 的 out 文件的结束标记
+const fakeTermination = "FAKE ENGINE TERMINATED NORMALLY"
+
+// fakeElementEnergy、fakeElementShielding 每种元素的原子能量 (Hartree) 和基础屏蔽常数 (ppm)，其他元素使用 X
+var (
+	fakeElementEnergy    = map[string]float64{"H": -0.5, "C": -37.8, "N": -54.5, "O": -75.0, "X": -100.0}
+	fakeElementShielding = map[string]float64{"H": 31.0, "C": 180.0, "N": 220.0, "O": 300.0, "X": 400.0}
+)
+
+// fakeSymbolRegex 匹配元素符号
+var fakeSymbolRegex = regexp.MustCompile(`^[A-Z][a-z]?$`)
+
+// FakeEngine 生成合成数据的 Engine，使用与 Gaussian 相同的模板文件
+type FakeEngine struct{}
+
+// Name 返回程序的名字
+func (f *FakeEngine) Name() string {
+	return "fake"
+}
+
+// TemplateFile 与 Gaussian 使用相同的模板文件，模板中除了 [GEOMETRY] 之外的内容都会被忽略
+func (f *FakeEngine) TemplateFile(stage Stage) string {
+	return (&GaussianEngine{}).TemplateFile(stage)
+}
+
+// PresetEngine 使用 preset 中 Gaussian 的模板
+func (f *FakeEngine) PresetEngine() string {
+	return "gaussian"
+}
+
+// CheckSolvent FakeEngine 不使用溶剂，支持任何溶剂
+func (f *FakeEngine) CheckSolvent(solvent *SolventConfig) error {
+	return nil
+}
+
+// LocalOnly FakeEngine 不调用外部程序，使用作业调度系统时也在本机上运行
+func (f *FakeEngine) LocalOnly() bool {
+	return true
+}
+
+// BuildInput 将模板中的 [GEOMETRY] 替换为实际的原子坐标
+func (f *FakeEngine) BuildInput(template string, cluster Cluster) string {
+	return replaceGeometry(template, cluster)
+}
+
+// CommandLine FakeEngine 不调用外部程序，这里只返回一个说明
+func (f *FakeEngine) CommandLine(stage Stage, inputFile string, outFile string) string {
+	return fmt.Sprintf("fake %s > %s", inputFile, outFile)
+}
+
+// Run 读取输入文件中的原子坐标，生成合成的 out 文件
+func (f *FakeEngine) Run(ctx context.Context, stage Stage, inputFile string, outFile string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	cluster, err := readFakeGeometry(inputFile)
+	if err != nil {
+		return err
+	}
+	if len(cluster.Atoms) == 0 {
+		return fmt.Errorf("no atom found in %s", inputFile)
+	}
+
+	// inverse[i] 为第 i 个原子到其他所有原子的距离倒数之和
+	inverse := make([]float64, len(cluster.Atoms))
+	for i := range cluster.Atoms {
+		for j := range cluster.Atoms {
+			if i == j {
+				continue
+			}
+			a, b := cluster.Atoms[i], cluster.Atoms[j]
+			distance := math.Sqrt((a.X-b.X)*(a.X-b.X) + (a.Y-b.Y)*(a.Y-b.Y) + (a.Z-b.Z)*(a.Z-b.Z))
+			inverse[i] += 1 / math.Max(distance, 0.1)
+		}
+	}
+
+	var sb strings.Builder
+	sb.WriteString("FAKE ENGINE OUTPUT\n")
+	sb.WriteString("Geometry:\n")
+	sb.WriteString(cluster.ToXYZString())
+
+	energy := 0.0
+	for i, atom := range cluster.Atoms {
+		energy += fakeValue(fakeElementEnergy, atom.Symbol) - 0.001*inverse[i]
+	}
+	sb.WriteString(fmt.Sprintf("Total Energy: %.10f\n", energy))
+	sb.WriteString(fmt.Sprintf("Gibbs Correction: %.10f\n", 0.01*float64(len(cluster.Atoms))))
+
+	sb.WriteString("Shielding:\n")
+	for i, atom := range cluster.Atoms {
+		sb.WriteString(fmt.Sprintf("%d %s %.4f\n", i+1, atom.Symbol,
+			fakeValue(fakeElementShielding, atom.Symbol)-2*inverse[i]))
+	}
+	sb.WriteString(fakeTermination + "\n")
+
+	return ioutil.WriteFile(outFile, []byte(sb.String()), 0644)
+}
+
+// ParseGeometry 读取 out 文件中 Geometry: 之后的原子坐标
+func (f *FakeEngine) ParseGeometry(outFile string) (Cluster, error) {
+	cluster, err := readFakeGeometry(outFile)
+	if err != nil {
+		return cluster, err
+	}
+	cluster.Energy, err = f.ParseEnergy(outFile)
+	return cluster, err
+}
+
+// ParseEnergy 读取 Total Energy: 之后的能量
+func (f *FakeEngine) ParseEnergy(outFile string) (float64, error) {
+	return findLastFloat(outFile, regexp.MustCompile(`Total Energy:\s*(-?\d+\.\d+)`))
+}
+
+// ParseGibbsCorrection 读取 Gibbs Correction: 之后的自由能热校正量
+func (f *FakeEngine) ParseGibbsCorrection(outFile string) (float64, error) {
+	return findLastFloat(outFile, regexp.MustCompile(`Gibbs Correction:\s*(-?\d+\.\d+)`))
+}
+
+// ParseShieldings 读取 Shielding: 之后每一行的原子序号、元素符号和屏蔽常数
+func (f *FakeEngine) ParseShieldings(outFile string) ([]NucleusShielding, error) {
+	contents, err := ioutil.ReadFile(outFile)
+	if err != nil {
+		return nil, err
+	}
+
+	var shieldings []NucleusShielding
+	inBlock := false
+	for _, line := range strings.Split(string(contents), "\n") {
+		if strings.HasPrefix(line, "Shielding:") {
+			inBlock = true
+			continue
+		}
+		fields := strings.Fields(line)
+		if !inBlock || len(fields) != 3 {
+			continue
+		}
+		index, err := strconv.Atoi(fields[0])
+		if err != nil {
+			continue
+		}
+		isotropic, err := strconv.ParseFloat(fields[2], 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", outFile, err)
+		}
+		shieldings = append(shieldings, NucleusShielding{Index: index, Symbol: fields[1], Isotropic: isotropic})
+	}
+	if len(shieldings) == 0 {
+		return nil, fmt.Errorf("no shielding found in %s", outFile)
+	}
+
+	return shieldings, nil
+}
+
+// IsNormalTermination 判断 out 文件中是否有结束标记
+func (f *FakeEngine) IsNormalTermination(outFile string) bool {
+	contents, err := ioutil.ReadFile(outFile)
+	if err != nil {
+		return false
+	}
+	return strings.Contains(string(contents), fakeTermination)
+}
+
+// fakeValue 返回 values 中 symbol 对应的值，没有的元素使用 X 的值
+func fakeValue(values map[string]float64, symbol string) float64 {
+	if value, ok := values[symbol]; ok {
+		return value
+	}
+	return values["X"]
+}
+
+// readFakeGeometry 读取文件中所有形如 "C  0.0  0.0  0.0" 的行作为原子坐标
+func readFakeGeometry(filePath string) (Cluster, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return Cluster{}, err
+	}
+	defer file.Close()
+
+	var cluster Cluster
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 4 || !fakeSymbolRegex.MatchString(fields[0]) {
+			continue
+		}
+		var coordinates [3]float64
+		valid := true
+		for i := range coordinates {
+			if coordinates[i], err = strconv.ParseFloat(fields[i+1], 64); err != nil {
+				valid = false
+				break
+			}
+		}
+		if valid {
+			cluster.Atoms = append(cluster.Atoms, Atom{
+				Symbol: fields[0], X: coordinates[0], Y: coordinates[1], Z: coordinates[2],
+			})
+		}
+	}
+
+	return cluster, scanner.Err()
+}
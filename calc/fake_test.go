@@ -0,0 +1,215 @@
+package calc
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// chdirTemp 切换到一个临时文件夹，测试结束后切换回原来的目录
+func chdirTemp(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	current, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := os.Chdir(current); err != nil {
+			t.Fatal(err)
+		}
+	})
+	return dir
+}
+
+func TestFakeEnginePipeline(t *testing.T) {
+	dir := chdirTemp(t)
+	templateFile := filepath.Join(dir, "fake.gjf")
+	if err := ioutil.WriteFile(templateFile, []byte("#p fake\n\n{{.Title}}\n\n0 1\n[GEOMETRY]\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	clusters := ClusterList{
+		{Atoms: []Atom{{"C", 0, 0, 0}, {"H", 0, 0, 1.09}, {"H", 1.03, 0, -0.36}, {"O", -0.7, 1.2, -0.4}}},
+		{Atoms: []Atom{{"C", 0, 0, 0}, {"H", 0, 0, 1.12}, {"H", 1.05, 0, -0.30}, {"O", -0.6, 1.3, -0.5}}},
+		{Atoms: []Atom{{"C", 0, 0, 0}, {"H", 0, 0, 1.05}, {"H", 1.00, 0, -0.40}, {"O", -0.8, 1.1, -0.3}}},
+	}
+	engine := &FakeEngine{}
+	backend := &LocalBackend{}
+	config := DefaultConfig()
+	data := NewTemplateData(config, "test")
+
+	ctx := context.Background()
+	for _, stage := range []Stage{StageOpt, StageSP, StageNMR} {
+		stageClusters := clusters
+		if stage != StageOpt {
+			var err error
+			if stageClusters, err = ReadClusterListFromOut(engine); err != nil {
+				t.Fatalf("ReadClusterListFromOut: %v", err)
+			}
+			if len(stageClusters) != len(clusters) {
+				t.Fatalf("ReadClusterListFromOut returned %d clusters, want %d", len(stageClusters), len(clusters))
+			}
+		}
+		results, err := RunDFTStage(ctx, engine, backend, stage, templateFile, data, stageClusters)
+		if err != nil {
+			t.Fatalf("RunDFTStage(%s): %v", stage, err)
+		}
+		for _, result := range results {
+			if result.Status != JobNormal {
+				t.Errorf("%s job %d: status %q, want %q", stage, result.Index, result.Status, JobNormal)
+			}
+		}
+	}
+
+	nmrConfig := &NMRConfig{Temperature: 298.15, RefShieldingC: 190, RefShieldingH: 31.5}
+	result, err := CollectNMRResult(engine, engine, engine, nmrConfig)
+	if err != nil {
+		t.Fatalf("CollectNMRResult: %v", err)
+	}
+	if len(result.Conformers) != len(clusters) {
+		t.Fatalf("got %d conformers, want %d", len(result.Conformers), len(clusters))
+	}
+	total := 0.0
+	for i, conformer := range result.Conformers {
+		total += conformer.Population
+		if len(conformer.Shieldings) != len(clusters[i].Atoms) {
+			t.Errorf("conformer %d: got %d shieldings, want %d", i+1, len(conformer.Shieldings), len(clusters[i].Atoms))
+		}
+		if conformer.FreeEnergy != conformer.Energy+conformer.GibbsCorrection {
+			t.Errorf("conformer %d: free energy %f != %f + %f", i+1, conformer.FreeEnergy, conformer.Energy, conformer.GibbsCorrection)
+		}
+	}
+	if total < 0.999999 || total > 1.000001 {
+		t.Errorf("populations sum to %f, want 1", total)
+	}
+	referenced := 0
+	for _, nucleus := range result.Nuclei {
+		if nucleus.Referenced {
+			referenced++
+		}
+	}
+	// 每一个构象有一个 C 和两个 H 有参考屏蔽常数
+	if referenced != 3 {
+		t.Errorf("got %d referenced nuclei, want 3", referenced)
+	}
+
+	// 同样的结构总是得到同样的结果
+	again, err := CollectNMRResult(engine, engine, engine, nmrConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range result.Nuclei {
+		if result.Nuclei[i].Shift != again.Nuclei[i].Shift {
+			t.Errorf("nucleus %d: shift %f changed to %f", result.Nuclei[i].Index, result.Nuclei[i].Shift, again.Nuclei[i].Shift)
+		}
+	}
+}
+
+func TestBatchBackendRunsLocalOnlyEnginesLocally(t *testing.T) {
+	chdirTemp(t)
+	if err := os.MkdirAll(StageSP.Folder(), 0755); err != nil {
+		t.Fatal(err)
+	}
+	inputFile := filepath.Join(StageSP.Folder(), "cluster-sp1.gjf")
+	if err := ioutil.WriteFile(inputFile, []byte("C 0 0 0\nH 0 0 1.09\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// 提交命令不存在，FakeEngine 的任务不应该被提交
+	backend := NewBatchBackend(&BatchConfig{Scheduler: "slurm", SubmitCommand: "/nonexistent/sbatch"}, &WallTimeConfig{})
+	engine := &FakeEngine{}
+	jobs := []Job{{Index: 1, InputFile: inputFile, OutFile: StageSP.OutFile(1)}}
+	results, err := backend.RunJobs(context.Background(), engine, StageSP, jobs, NewProgress(StageSP, engine, 1))
+	if err != nil {
+		t.Fatalf("RunJobs: %v", err)
+	}
+	if results[0].Status != JobNormal {
+		t.Errorf("status %q, want %q", results[0].Status, JobNormal)
+	}
+}
+
+func TestRunDFTStageResumesFinishedJobs(t *testing.T) {
+	dir := chdirTemp(t)
+	templateFile := filepath.Join(dir, "fake.gjf")
+	if err := ioutil.WriteFile(templateFile, []byte("#p fake\n\n{{.Title}}\n\n0 1\n[GEOMETRY]\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	clusters := ClusterList{
+		{Atoms: []Atom{{"C", 0, 0, 0}, {"H", 0, 0, 1.09}}},
+		{Atoms: []Atom{{"C", 0, 0, 0}, {"H", 0, 0, 1.12}}},
+		{Atoms: []Atom{{"C", 0, 0, 0}, {"H", 0, 0, 1.05}}},
+		{Atoms: []Atom{{"C", 0, 0, 0}, {"H", 0, 0, 1.07}}},
+	}
+	engine := &FakeEngine{}
+	data := NewTemplateData(DefaultConfig(), "test")
+	if _, err := RunDFTStage(context.Background(), engine, &LocalBackend{}, StageSP, templateFile, data, clusters); err != nil {
+		t.Fatalf("RunDFTStage: %v", err)
+	}
+
+	// 任务 1 已经完成，任务 2 被中断，任务 3 的 out 文件不存在，任务 4 的结构变了
+	const marker = "\nfinished by the previous run\n"
+	appendFile(t, StageSP.OutFile(1), marker)
+	if err := os.Rename(StageSP.OutFile(2), StageSP.OutFile(2)+InterruptedSuffix); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(StageSP.OutFile(3)); err != nil {
+		t.Fatal(err)
+	}
+	appendFile(t, StageSP.OutFile(4), marker)
+	rerun := append(ClusterList{}, clusters...)
+	rerun[3] = Cluster{Atoms: []Atom{{"C", 0, 0, 0}, {"H", 0, 0, 1.10}}}
+
+	results, err := RunDFTStage(context.Background(), engine, &LocalBackend{}, StageSP, templateFile, data, rerun)
+	if err != nil {
+		t.Fatalf("RunDFTStage: %v", err)
+	}
+	for i, result := range results {
+		if result.Index != i+1 || result.Status != JobNormal {
+			t.Errorf("job %d: %+v", i+1, result)
+		}
+	}
+	for index, skipped := range map[int]bool{1: true, 2: false, 3: false, 4: false} {
+		contents, err := ioutil.ReadFile(StageSP.OutFile(index))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.HasSuffix(string(contents), marker); got != skipped {
+			t.Errorf("job %d: skipped %v, want %v", index, got, skipped)
+		}
+	}
+	if _, err := os.Stat(StageSP.OutFile(2) + InterruptedSuffix); !os.IsNotExist(err) {
+		t.Errorf("the interrupted out file of the rerun job was kept: %v", err)
+	}
+
+	// 构象数变少时多出来的任务的文件被删除
+	if _, err := RunDFTStage(context.Background(), engine, &LocalBackend{}, StageSP, templateFile, data, rerun[:2]); err != nil {
+		t.Fatalf("RunDFTStage: %v", err)
+	}
+	outFiles, err := listOutFiles(StageSP.Folder())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(outFiles) != 2 {
+		t.Errorf("out files %v, want 2", outFiles)
+	}
+}
+
+// appendFile 在 file 的末尾写入 text
+func appendFile(t *testing.T, file string, text string) {
+	t.Helper()
+	f, err := os.OpenFile(file, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(text); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,366 @@
+package calc
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"gopkg.in/ini.v1"
+	"gopkg.in/yaml.v3"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+/*
+* formats.go
+* 该模块用来读取和写入 ini、TOML 和 YAML 三种格式的配置文件，格式由扩展名决定：
+*	.toml 为 TOML，.yaml 和 .yml 为 YAML，其他为 ini
+*
+* 三种格式的 section 和 key 完全相同，TOML 中的 section 为表，YAML 中的 section 为第一层的映射，例如：
+*	[optimized]                          optimized:
+*	preThreshold = [0.25, 0.1]             preThreshold: [0.25, 0.1]
+*	gauPath = "/opt/g16/g16"               gauPath: /opt/g16/g16
+* 阈值和 DP4 参数在 TOML 和 YAML 中写成数字的列表，ini 中仍然是逗号隔开的字符串（也都可以写成字符串）。
+* 读取时 TOML 和 YAML 都被转化为 ini.File，因此检查、分层和 --set 对三种格式都是一样的；
+* 写入时按照每一个 key 默认值的类型写成数字、布尔值、列表或者字符串，key 的注释会保留
+*
+*	kybnmr config convert config.ini config.yaml 在三种格式之间转换配置文件
+*
+* @Author: Kimariyb
+* @Address: XiaMen University
+* @Data: 2023-09-26
+ */
+
+// ConfigFormat 配置文件的格式
+type ConfigFormat string
+
+const (
+	FormatINI  ConfigFormat = "ini"
+	FormatTOML ConfigFormat = "toml"
+	FormatYAML ConfigFormat = "yaml"
+)
+
+// ConfigFileNames 启动目录和用户配置目录中依次查找的配置文件名
+var ConfigFileNames = []string{"config.ini", "config.toml", "config.yaml", "config.yml"}
+
+// configListKeys 在 TOML 和 YAML 中写成数字列表的 key，以及列表的长度
+var configListKeys = map[string]int{
+	"optimized.preThreshold":  2,
+	"optimized.postThreshold": 2,
+	"dp4.scaledC":             3,
+	"dp4.scaledH":             3,
+	"dp4.unscaledSp2C":        3,
+	"dp4.unscaledSp3C":        3,
+	"dp4.unscaledSp2H":        3,
+	"dp4.unscaledSp3H":        3,
+}
+
+// ConfigFormatOf 根据扩展名返回配置文件的格式
+func ConfigFormatOf(configFile string) ConfigFormat {
+	switch strings.ToLower(filepath.Ext(configFile)) {
+	case ".toml":
+		return FormatTOML
+	case ".yaml", ".yml":
+		return FormatYAML
+	}
+	return FormatINI
+}
+
+// loadConfigDocument 读取任意格式的配置文件，返回对应的 ini.File 以及每一个 section 和 key 所在的行号
+func loadConfigDocument(configFile string) (*ini.File, *configLines, error) {
+	switch ConfigFormatOf(configFile) {
+	case FormatTOML:
+		return loadTOMLConfig(configFile)
+	case FormatYAML:
+		return loadYAMLConfig(configFile)
+	}
+
+	iniFile, err := ini.Load(configFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error parsing config file %s: %w", configFile, err)
+	}
+	lines, err := scanConfigLines(configFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading config file %s: %w", configFile, err)
+	}
+	return iniFile, lines, nil
+}
+
+// formatConfigValue 将 TOML 中的值转化为 ini 中的字符串，列表转化为逗号隔开的字符串
+func formatConfigValue(value interface{}) (string, error) {
+	switch value := value.(type) {
+	case string:
+		return value, nil
+	case int64:
+		return strconv.FormatInt(value, 10), nil
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64), nil
+	case bool:
+		return strconv.FormatBool(value), nil
+	case []interface{}:
+		items := make([]string, len(value))
+		for i, item := range value {
+			text, err := formatConfigValue(item)
+			if err != nil {
+				return "", err
+			}
+			items[i] = text
+		}
+		return strings.Join(items, ", "), nil
+	case map[string]interface{}:
+		return "", fmt.Errorf("nested tables are not supported")
+	}
+	return fmt.Sprint(value), nil
+}
+
+// loadTOMLConfig 读取 TOML 格式的配置文件，TOML 的表和 key 的写法与 ini 相同，因此行号由 scanConfigLines 得到
+func loadTOMLConfig(configFile string) (*ini.File, *configLines, error) {
+	var document map[string]interface{}
+	metaData, err := toml.DecodeFile(configFile, &document)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error parsing config file %s: %w", configFile, err)
+	}
+	lines, err := scanConfigLines(configFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading config file %s: %w", configFile, err)
+	}
+
+	iniFile := ini.Empty()
+	for _, key := range metaData.Keys() {
+		var section, name string
+		switch len(key) {
+		case 1:
+			if _, ok := document[key[0]].(map[string]interface{}); ok {
+				iniFile.Section(key[0])
+				continue
+			}
+			section, name = ini.DefaultSection, key[0]
+		case 2:
+			section, name = key[0], key[1]
+		default:
+			continue
+		}
+
+		value := document[name]
+		if section != ini.DefaultSection {
+			value = document[section].(map[string]interface{})[name]
+		}
+		text, err := formatConfigValue(value)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s:%d: [%s] %s: %w", configFile, lines.keys[lineKey(section, name)].Line, section, name, err)
+		}
+		iniFile.Section(section).Key(name).SetValue(text)
+	}
+	return iniFile, lines, nil
+}
+
+// yamlScalar 将 YAML 中的标量或者标量的列表转化为 ini 中的字符串
+func yamlScalar(node *yaml.Node) (string, error) {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		if node.Tag == "!!null" {
+			return "", nil
+		}
+		return node.Value, nil
+	case yaml.SequenceNode:
+		items := make([]string, len(node.Content))
+		for i, item := range node.Content {
+			if item.Kind != yaml.ScalarNode {
+				return "", fmt.Errorf("expected a list of numbers")
+			}
+			items[i] = item.Value
+		}
+		return strings.Join(items, ", "), nil
+	}
+	return "", fmt.Errorf("nested mappings are not supported")
+}
+
+// loadYAMLConfig 读取 YAML 格式的配置文件，第一层的映射为 section
+func loadYAMLConfig(configFile string) (*ini.File, *configLines, error) {
+	contents, err := os.ReadFile(configFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading config file %s: %w", configFile, err)
+	}
+	var document yaml.Node
+	if err := yaml.Unmarshal(contents, &document); err != nil {
+		return nil, nil, fmt.Errorf("error parsing config file %s: %w", configFile, err)
+	}
+
+	iniFile := ini.Empty()
+	lines := newConfigLines(configFile)
+	if len(document.Content) == 0 {
+		return iniFile, lines, nil
+	}
+	root := document.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, nil, fmt.Errorf("%s:%d: expected a mapping of sections", configFile, root.Line)
+	}
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		sectionNode, valueNode := root.Content[i], root.Content[i+1]
+		section := sectionNode.Value
+		if valueNode.Kind != yaml.MappingNode {
+			// 第一层的标量不属于任何 section
+			text, err := yamlScalar(valueNode)
+			if err != nil {
+				return nil, nil, fmt.Errorf("%s:%d: %s: %w", configFile, sectionNode.Line, section, err)
+			}
+			iniFile.Section(ini.DefaultSection).Key(section).SetValue(text)
+			lines.keys[lineKey(ini.DefaultSection, section)] = configSource{File: configFile, Line: sectionNode.Line}
+			continue
+		}
+
+		iniFile.Section(section)
+		lines.sections[section] = configSource{File: configFile, Line: sectionNode.Line}
+		for j := 0; j+1 < len(valueNode.Content); j += 2 {
+			keyNode := valueNode.Content[j]
+			text, err := yamlScalar(valueNode.Content[j+1])
+			if err != nil {
+				return nil, nil, fmt.Errorf("%s:%d: [%s] %s: %w", configFile, keyNode.Line, section, keyNode.Value, err)
+			}
+			iniFile.Section(section).Key(keyNode.Value).SetValue(text)
+			lines.keys[lineKey(section, keyNode.Value)] = configSource{File: configFile, Line: keyNode.Line}
+		}
+	}
+	return iniFile, lines, nil
+}
+
+// typedConfigValue 按照 [section] key 默认值的类型转化 value，转化失败或者未知的 key 返回原来的字符串
+func typedConfigValue(schema map[string]interface{}, section string, key string, value string) interface{} {
+	name := lineKey(section, key)
+	if count, ok := configListKeys[name]; ok {
+		if values, err := parseFloatList(value, count); err == nil {
+			return values
+		}
+		return value
+	}
+	switch schema[name].(type) {
+	case float64:
+		if number, err := strconv.ParseFloat(value, 64); err == nil {
+			return number
+		}
+	case int:
+		if number, err := strconv.Atoi(value); err == nil {
+			return number
+		}
+	case bool:
+		if boolean, err := strconv.ParseBool(value); err == nil {
+			return boolean
+		}
+	}
+	return value
+}
+
+// commentLines 将 ini 的注释转化为以 # 开头的注释行
+func commentLines(comment string) []string {
+	if comment == "" {
+		return nil
+	}
+	var lines []string
+	for _, line := range strings.Split(comment, "\n") {
+		line = strings.TrimSpace(strings.TrimLeft(strings.TrimSpace(line), ";#"))
+		lines = append(lines, "# "+line)
+	}
+	return lines
+}
+
+// encodeTOML 将 iniFile 写成 TOML
+func encodeTOML(iniFile *ini.File, schema map[string]interface{}) ([]byte, error) {
+	var buffer bytes.Buffer
+	for _, section := range iniFile.Sections() {
+		if len(section.Keys()) == 0 {
+			continue
+		}
+		if buffer.Len() > 0 {
+			buffer.WriteString("\n")
+		}
+		for _, line := range commentLines(section.Comment) {
+			buffer.WriteString(line + "\n")
+		}
+		if section.Name() != ini.DefaultSection {
+			buffer.WriteString("[" + section.Name() + "]\n")
+		}
+		for _, key := range section.Keys() {
+			for _, line := range commentLines(key.Comment) {
+				buffer.WriteString(line + "\n")
+			}
+			value := typedConfigValue(schema, section.Name(), key.Name(), key.Value())
+			line, err := toml.Marshal(map[string]interface{}{key.Name(): value})
+			if err != nil {
+				return nil, err
+			}
+			buffer.Write(line)
+		}
+	}
+	return buffer.Bytes(), nil
+}
+
+// encodeYAML 将 iniFile 写成 YAML，列表写成 [0.25, 0.1] 的形式
+func encodeYAML(iniFile *ini.File, schema map[string]interface{}) ([]byte, error) {
+	root := &yaml.Node{Kind: yaml.MappingNode}
+	for _, section := range iniFile.Sections() {
+		if len(section.Keys()) == 0 {
+			continue
+		}
+		mapping := root
+		if section.Name() != ini.DefaultSection {
+			mapping = &yaml.Node{Kind: yaml.MappingNode}
+			sectionNode := &yaml.Node{Kind: yaml.ScalarNode, Value: section.Name()}
+			sectionNode.HeadComment = strings.Join(commentLines(section.Comment), "\n")
+			root.Content = append(root.Content, sectionNode, mapping)
+		}
+		for _, key := range section.Keys() {
+			valueNode := &yaml.Node{}
+			if err := valueNode.Encode(typedConfigValue(schema, section.Name(), key.Name(), key.Value())); err != nil {
+				return nil, err
+			}
+			if valueNode.Kind == yaml.SequenceNode {
+				valueNode.Style = yaml.FlowStyle
+			}
+			keyNode := &yaml.Node{Kind: yaml.ScalarNode, Value: key.Name()}
+			keyNode.HeadComment = strings.Join(commentLines(key.Comment), "\n")
+			mapping.Content = append(mapping.Content, keyNode, valueNode)
+		}
+	}
+
+	var buffer bytes.Buffer
+	encoder := yaml.NewEncoder(&buffer)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(root); err != nil {
+		return nil, err
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// SaveConfigDocument 按照 target 的扩展名将 iniFile 写成 ini、TOML 或者 YAML
+func SaveConfigDocument(iniFile *ini.File, target string) error {
+	var contents []byte
+	var err error
+	switch ConfigFormatOf(target) {
+	case FormatTOML:
+		contents, err = encodeTOML(iniFile, configSchema())
+	case FormatYAML:
+		contents, err = encodeYAML(iniFile, configSchema())
+	default:
+		return iniFile.SaveTo(target)
+	}
+	if err != nil {
+		return fmt.Errorf("error writing %s: %w", target, err)
+	}
+	return os.WriteFile(target, contents, 0644)
+}
+
+// ConvertConfigFile 检查配置文件 source，并将它转换为 target 的格式写入 target
+func ConvertConfigFile(source string, target string) error {
+	if _, err := ParseConfigFile(source); err != nil {
+		return err
+	}
+	iniFile, _, err := loadConfigDocument(source)
+	if err != nil {
+		return err
+	}
+	return SaveConfigDocument(iniFile, target)
+}
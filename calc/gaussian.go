@@ -0,0 +1,396 @@
+package calc
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"kybnmr/utils"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+/*
+* gaussian.go
+* 该模块实现了 Gaussian 程序的 Engine，包括生成输入文件、运行 Gaussian，
+* 以及读取 Gaussian out 文件中的结构、能量、自由能热校正量和 NMR 屏蔽常数
+*
+* @Version:
+* 	Gaussian: A.03/C.01
+*
+* @Author: Kimariyb
+* @Address: XiaMen University
+* @Data: 2023-09-24
+ */
+
+func init() {
+	RegisterEngine("gaussian", func(config *Config) Engine {
+		return &GaussianEngine{Path: config.OptConfig.GauPath, Molecule: config.MoleculeConfig, Solvent: config.SolventConfig}
+	})
+}
+
+// GaussianEngine 调用 Gaussian 的 Engine，Path 为 Gaussian 的运行路径，即配置文件中的 gauPath，Molecule 为 [molecule] 中的电荷和自旋多重度，Solvent 为 [solvent] 中的溶剂
+type GaussianEngine struct {
+	Path     string
+	Molecule MoleculeConfig
+	Solvent  SolventConfig
+}
+
+// Name 返回程序的名字
+func (g *GaussianEngine) Name() string {
+	return "gaussian"
+}
+
+// TemplateFile 优化和单点能都使用 GauTemplate.gjf，NMR 使用 GauNMRTemplate.gjf
+func (g *GaussianEngine) TemplateFile(stage Stage) string {
+	if stage == StageNMR {
+		return "GauNMRTemplate.gjf"
+	}
+	return "GauTemplate.gjf"
+}
+
+// BuildInput 将模板中的 [GEOMETRY] 替换为实际的原子坐标，并将电荷和自旋多重度以及溶剂替换为 Molecule 和 Solvent 中的值
+// 请注意，Gaussian 的输入文件一定要在末尾追加两行空格
+func (g *GaussianEngine) BuildInput(template string, cluster Cluster) string {
+	return replaceGeometry(g.Solvent.applyGaussianSolvent(replaceChargeLine(template, g.Molecule)), cluster)
+}
+
+// CheckSolvent 检查 Gaussian 是否支持 solvent 中的溶剂
+func (g *GaussianEngine) CheckSolvent(solvent *SolventConfig) error {
+	_, err := solvent.gaussianKeyword()
+	return err
+}
+
+// CommandLine 返回 g16 < input.gjf > output.out
+func (g *GaussianEngine) CommandLine(stage Stage, inputFile string, outFile string) string {
+	return fmt.Sprintf("%s < %s > %s", g.Path, inputFile, outFile)
+}
+
+// Run 运行 Gaussian
+func (g *GaussianEngine) Run(ctx context.Context, stage Stage, inputFile string, outFile string) error {
+	return runShellCommand(ctx, g.CommandLine(stage, inputFile, outFile), JobLogFile(outFile))
+}
+
+// ParseGeometry 读取 Gaussian out 文件中最后一个 Standard orientation 的结构
+func (g *GaussianEngine) ParseGeometry(outFile string) (Cluster, error) {
+	// 首先判断 filePath 是否为一个 out 文件
+	if !utils.CheckFileType(outFile, ".out") {
+		// 如果不是 out 文件则直接退出并报错
+		return Cluster{}, fmt.Errorf("error the format of input file")
+	}
+	return parseGauOutput(outFile)
+}
+
+// ParseEnergy 读取 Gaussian out 文件中的单点能
+func (g *GaussianEngine) ParseEnergy(outFile string) (float64, error) {
+	contents, err := ioutil.ReadFile(outFile)
+	if err != nil {
+		return 0, err
+	}
+	energy, _, err := parseGauSinglePoint(string(contents))
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", outFile, err)
+	}
+	return strconv.ParseFloat(energy, 64)
+}
+
+// ParseGibbsCorrection 读取 Thermal correction to Gibbs Free Energy=         0.123456
+func (g *GaussianEngine) ParseGibbsCorrection(outFile string) (float64, error) {
+	return findLastFloat(outFile, regexp.MustCompile(`Thermal correction to Gibbs Free Energy=\s*(-?\d+\.\d+)`))
+}
+
+// ParseShieldings 读取 Gaussian out 文件中最后一个屏蔽张量表格
+func (g *GaussianEngine) ParseShieldings(outFile string) ([]NucleusShielding, error) {
+	return parseGauShielding(outFile)
+}
+
+// IsNormalTermination 判断最后一个 Link1 任务是否以 Normal termination 结束
+func (g *GaussianEngine) IsNormalTermination(outFile string) bool {
+	contents, err := ioutil.ReadFile(outFile)
+	if err != nil {
+		return false
+	}
+	normal := strings.LastIndex(string(contents), "Normal termination of Gaussian")
+	errorTermination := strings.LastIndex(string(contents), "Error termination")
+	return normal >= 0 && normal > errorTermination
+}
+
+// Gaussian out 文件中的优化步数和 SCF 循环
+var (
+	gauStepRegex  = regexp.MustCompile(`Step number\s+(\d+) out of a maximum of\s+(\d+)`)
+	gauCycleRegex = regexp.MustCompile(`Cycle\s+(\d+)\s+Pass`)
+	gauSCFRegex   = regexp.MustCompile(`SCF Done:\s+E\(\S+\)\s+=\s+(-?\d+\.\d+)`)
+)
+
+// JobProgress 读取正在运行的 Gaussian out 文件的末尾，返回当前的优化步数和 SCF 循环数，如 step 7/100, SCF cycle 12
+func (g *GaussianEngine) JobProgress(outFile string) string {
+	contents := tailFile(outFile, progressTail)
+	var parts []string
+	if step := lastSubmatches(contents, gauStepRegex); step != nil {
+		parts = append(parts, fmt.Sprintf("step %s/%s", step[1], step[2]))
+	}
+	if cycle := lastSubmatches(contents, gauCycleRegex); cycle != nil {
+		parts = append(parts, "SCF cycle "+cycle[1])
+	}
+	return strings.Join(parts, ", ")
+}
+
+// LatestEnergy 读取正在运行的 Gaussian out 文件中最后一个 SCF Done 的能量
+func (g *GaussianEngine) LatestEnergy(outFile string) (float64, error) {
+	energy := lastSubmatches(tailFile(outFile, progressTail), gauSCFRegex)
+	if energy == nil {
+		return 0, fmt.Errorf("no SCF energy found in %s", outFile)
+	}
+	return strconv.ParseFloat(energy[1], 64)
+}
+
+// parseGauSinglePoint 从 Gaussian 的 out 文件内容中读取单点能
+// 依次查找 CCSD(T)、MP2 和 HF 的能量，返回找到的第一个能量以及对应的方法名
+func parseGauSinglePoint(contents string) (string, string, error) {
+	// 替换空格
+	re := regexp.MustCompile(`\s+`)
+	contents = re.ReplaceAllString(contents, "")
+
+	// 使用正则表达式搜索 gaussian 单点能
+	methodRegexes := []struct {
+		method string
+		regex  *regexp.Regexp
+	}{
+		{"CCSD(T)", regexp.MustCompile(`CCSD\(T\)=\s*(-?\d+\.\d+)`)},
+		{"MP2", regexp.MustCompile(`MP2=\s*(-?\d+\.\d+)`)},
+		{"HF", regexp.MustCompile(`HF=\s*(-?\d+\.\d+)`)},
+	}
+
+	for _, methodRegex := range methodRegexes {
+		energy, err := FindLastMatch(contents, methodRegex.regex, 1)
+		if err == nil {
+			return energy, methodRegex.method, nil
+		}
+	}
+
+	return "", "", fmt.Errorf("no energy found")
+}
+
+// parseGauOutput 读取 Gaussian 生成的 out 文件
+// 在 Gaussian 生成的 out 文件的最后，都会出现一个 Standard orientation
+// 在 Standard orientation 表格中以下变量至关重要
+// Atomic Number: 原子序号，代表元素周期表中的位置，1 代表 H；2 代表 He 以此类推
+// Coordinates (Angstroms): 原子坐标（单位为埃），分为 X；Y；Z 坐标，这是一个笛卡尔坐标系的坐标
+//
+//	Standard orientation:
+//
+// ---------------------------------------------------------------------
+// Center     Atomic      Atomic             Coordinates (Angstroms)
+// Number     Number       Type             X           Y           Z
+// ---------------------------------------------------------------------
+//
+//	 1          8           0        1.169391   -0.453770   -0.882827
+//	 2          8           0       -1.184882    2.809963   -0.433427
+//	 3          8           0        0.716726    2.116662    0.491823
+//	 4          8           0        3.366765   -0.337316   -0.613653
+//	 5          6           0       -0.108179   -0.650924   -0.403350
+//	 6          6           0       -0.916481    0.439636   -0.034821
+//	 7          6           0       -0.637019   -1.942534   -0.425943
+//	 8          6           0       -2.250913    0.196603    0.327706
+//	 9          6           0       -1.961017   -2.165935   -0.050206
+//	10          6           0       -2.771332   -1.095676    0.332879
+//	11          6           0       -0.362052    1.832310    0.029385
+//	12          6           0        2.305426   -0.474834   -0.073872
+//	13          6           0        2.087999   -0.671809    1.405520
+//	14          1           0        0.000372   -2.757450   -0.754757
+//	15          1           0       -2.875364    1.028823    0.643617
+//	16          1           0       -2.359654   -3.176253   -0.063447
+//	17          1           0       -3.801283   -1.265085    0.631546
+//	18          1           0        1.568720    0.203757    1.806039
+//	19          1           0        3.063572   -0.771149    1.881978
+//	20          1           0        1.481084   -1.558556    1.612610
+//	21          1           0       -1.940041    2.410593   -0.896697
+//
+// ---------------------------------------------------------------------
+func parseGauOutput(filePath string) (Cluster, error) {
+	var nAtoms int
+	var foundLastOrientation bool
+	var atoms []Atom
+	var lastOrientationAtoms []Atom
+
+	// 首先将扫描到的文件变为绝对路径，再打开文件
+	absPath, err := filepath.Abs(filePath)
+	if err != nil {
+		return Cluster{}, err
+	}
+
+	file, err := os.Open(absPath)
+	if err != nil {
+		return Cluster{}, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+
+	// 首先扫描 out 文件，在 out 文件中找到 NAtoms= 随便读取一个后面的数字，例
+	// 如读取 NAtoms=  21 中的 21
+	// 将这个数字赋值给 nAtoms 变量
+	nAtoms, err = extractNAtomsFromFile(absPath)
+	if err != nil {
+		return Cluster{}, err
+	}
+
+	for scanner.Scan() {
+		line := scanner.Text()
+		// 接着找到文件中最后一个 Standard orientation
+		// 定位到最后一个 Standard orientation 一行后，接着跳过四行。因为后面四行为表格线
+		if strings.Contains(line, "Standard orientation") {
+			// 在找到新的 "Standard orientation" 时，将上一次找到的最后一个 "Standard orientation" 对应的 atoms 清空
+			atoms = atoms[:0]
+			lastOrientationAtoms = make([]Atom, 0) // 初始化为新的空切片
+			foundLastOrientation = false
+			// 跳过四行表格线
+			for i := 0; i < 4; i++ {
+				scanner.Scan()
+			}
+		}
+
+		if strings.Contains(line, "Standard orientation") {
+			foundLastOrientation = true
+		}
+
+		// 到第一行时 1  8  0  1.169391   -0.453770   -0.882827
+		// 只需要关注第二个列的 8 和后三列的 x、y、z 坐标。其中 8 代表是第八个元素氧。
+		// 将第一行的原子坐标和元素保存为一个 Atom 结构体
+		if foundLastOrientation && len(atoms) < nAtoms {
+			fields := strings.Fields(line)
+			if len(fields) >= 6 {
+				atomicNumber, err := strconv.Atoi(fields[1])
+				if err != nil {
+					return Cluster{}, fmt.Errorf("unable to resolve atomic number: %s", fields[1])
+				}
+				symbol, err := getSymbol(atomicNumber)
+				if err != nil {
+					return Cluster{}, err
+				}
+				x, err := strconv.ParseFloat(fields[3], 64)
+				if err != nil {
+					return Cluster{}, fmt.Errorf("unable to resolve X-coordinate: %s", fields[3])
+				}
+				y, err := strconv.ParseFloat(fields[4], 64)
+				if err != nil {
+					return Cluster{}, fmt.Errorf("unable to resolve Y-coordinate: %s", fields[4])
+				}
+				z, err := strconv.ParseFloat(fields[5], 64)
+				if err != nil {
+					return Cluster{}, fmt.Errorf("unable to resolve Z-coordinate: %s", fields[5])
+				}
+
+				atoms = append(atoms, Atom{
+					Symbol: symbol,
+					X:      x,
+					Y:      y,
+					Z:      z,
+				})
+
+				if foundLastOrientation && len(atoms) > 0 {
+					lastOrientationAtoms = append(lastOrientationAtoms, atoms...)
+				}
+			}
+		}
+	}
+
+	cluster := Cluster{
+		Atoms:  atoms,
+		Energy: 0,
+	}
+
+	if err := scanner.Err(); err != nil {
+		return Cluster{}, fmt.Errorf("error while reading file: %v", err)
+	}
+
+	// 接下来扫描 nAtoms 行，每一行的操作都和第一行一样。将所有的 Atom 结构体都赋值给 Cluster 结构体
+	// 所有的能量都赋值为 0
+	return cluster, nil
+}
+
+func extractNAtomsFromFile(filePath string) (int, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open file: %v", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		// 使用正则表达式匹配 NAtoms= 后面的数字
+		re := regexp.MustCompile(`NAtoms=\s*(\d+)`)
+		match := re.FindStringSubmatch(line)
+		if len(match) > 1 {
+			nAtomsStr := match[1]
+			nAtoms, err := strconv.Atoi(nAtomsStr)
+			if err != nil {
+				return 0, fmt.Errorf("unable to convert NAtoms to integer: %s", nAtomsStr)
+			}
+			return nAtoms, nil
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return 0, fmt.Errorf("failed to scan file: %v", err)
+	}
+
+	return 0, fmt.Errorf("NAtoms not found in the file")
+}
+
+// parseGauShielding 读取 Gaussian 的 NMR 输出，格式如下：
+//
+//	SCF GIAO Magnetic shielding tensor (ppm):
+//	     1  C    Isotropic =    31.7766   Anisotropy =    13.1498
+//	  XX=    36.8624   YX=    -2.2453   ZX=     1.1050
+//
+// 如果文件中存在多个屏蔽张量的表格，则只读取最后一个
+func parseGauShielding(filePath string) ([]NucleusShielding, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	isotropicRegex := regexp.MustCompile(`^\s*(\d+)\s+([A-Za-z]+)\s+Isotropic\s*=\s*(-?\d+\.\d+)`)
+
+	var shieldings []NucleusShielding
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		// 遇到新的屏蔽张量表格时，清空之前读到的结果
+		if strings.Contains(line, "Magnetic shielding tensor") {
+			shieldings = shieldings[:0]
+			continue
+		}
+
+		match := isotropicRegex.FindStringSubmatch(line)
+		if match == nil {
+			continue
+		}
+		index, _ := strconv.Atoi(match[1])
+		isotropic, err := strconv.ParseFloat(match[3], 64)
+		if err != nil {
+			return nil, fmt.Errorf("unable to resolve isotropic shielding: %s", match[3])
+		}
+		shieldings = append(shieldings, NucleusShielding{
+			Index:     index,
+			Symbol:    match[2],
+			Isotropic: isotropic,
+		})
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error while reading file: %v", err)
+	}
+
+	if len(shieldings) == 0 {
+		return nil, fmt.Errorf("no shielding tensor found in %s", filePath)
+	}
+
+	return shieldings, nil
+}
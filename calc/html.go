@@ -0,0 +1,627 @@
+package calc
+
+import (
+	"fmt"
+	"html/template"
+	"math"
+	"os"
+	"sort"
+	"strings"
+)
+
+/*
+* html.go
+* 该模块用来生成 kybnmr report --html 的 HTML 报告，只读取一次运行已经记录的 report.json 和 nmr_result.json，
+* 不重新运行任何计算。报告是一个单独的 HTML 文件，所有的图都是内嵌的 SVG，3D 结构查看器是内嵌的 JavaScript，
+* 不需要联网，可以直接用浏览器打开或者通过邮件发送
+*
+*	1. 运行的概况：状态、程序、每一个步骤的构象数和运行时间
+*	2. 每一个步骤的构象能量分布直方图：pre 和 post 为 crest 得到的构象（区分去重之后保留和舍弃的构象），
+*	   DFT 为最终构象的相对自由能
+*	3. 每一个构象的 Boltzmann 分布柱状图
+*	4. 给出实验数据时，每一种核的计算值与实验值的散点图
+*	5. 由平均化学位移模拟的 1H 和 13C 谱图，每一个原子核为一个 Lorentz 峰
+*	6. Boltzmann 权重最高的几个构象的 3D 结构
+*
+* @Author: Kimariyb
+* @Address: XiaMen University
+* @Data: 2023-09-26
+ */
+
+// spectrumLineWidth 模拟谱图中每一种核的 Lorentz 峰的半高宽，单位为 ppm
+var spectrumLineWidth = map[string]float64{"H": 0.02, "C": 0.5}
+
+// spectrumPoints 模拟谱图的采样点数
+const spectrumPoints = 2000
+
+// SVG 图的大小和边距
+const (
+	plotWidth        = 640
+	plotHeight       = 300
+	plotMarginLeft   = 64
+	plotMarginRight  = 20
+	plotMarginTop    = 16
+	plotMarginBottom = 46
+)
+
+// HTMLReport kybnmr report --html 的内容
+//   - Report: report.json，较早的运行没有时为 nil
+//   - Result: nmr_result.json，没有完成的运行没有时为 nil
+//   - Comparisons、MAE: 与实验数据的比较，没有实验数据时为 nil
+//   - Top: 3D 结构查看器中显示的构象数
+type HTMLReport struct {
+	Report      *Report
+	Result      *NMRResult
+	Comparisons []PeakComparison
+	MAE         map[string]float64
+	Top         int
+}
+
+// htmlFigure 报告中的一张图
+type htmlFigure struct {
+	Title   string
+	Caption string
+	SVG     template.HTML
+}
+
+// viewerAtom、viewerConformer 3D 结构查看器使用的数据
+type viewerAtom struct {
+	Symbol string  `json:"s"`
+	X      float64 `json:"x"`
+	Y      float64 `json:"y"`
+	Z      float64 `json:"z"`
+}
+
+type viewerConformer struct {
+	Name       string       `json:"name"`
+	Population float64      `json:"population"`
+	Atoms      []viewerAtom `json:"atoms"`
+}
+
+// svgPlot 一张带坐标轴的 SVG 图，坐标都是数据坐标，reverseX 为 true 时 x 轴从右到左（NMR 谱图的习惯）
+type svgPlot struct {
+	xMin, xMax, yMin, yMax float64
+	reverseX               bool
+	xLabel, yLabel         string
+	body                   strings.Builder
+}
+
+// newSVGPlot 返回 x 轴范围为 [xMin, xMax]、y 轴范围为 [yMin, yMax] 的 svgPlot
+func newSVGPlot(xMin, xMax, yMin, yMax float64, xLabel string, yLabel string) *svgPlot {
+	if xMax <= xMin {
+		xMin, xMax = xMin-1, xMin+1
+	}
+	if yMax <= yMin {
+		yMin, yMax = yMin-1, yMin+1
+	}
+	return &svgPlot{xMin: xMin, xMax: xMax, yMin: yMin, yMax: yMax, xLabel: xLabel, yLabel: yLabel}
+}
+
+// x、y 将数据坐标转换为 SVG 坐标
+func (p *svgPlot) x(value float64) float64 {
+	fraction := (value - p.xMin) / (p.xMax - p.xMin)
+	if p.reverseX {
+		fraction = 1 - fraction
+	}
+	return plotMarginLeft + fraction*(plotWidth-plotMarginLeft-plotMarginRight)
+}
+
+func (p *svgPlot) y(value float64) float64 {
+	fraction := (value - p.yMin) / (p.yMax - p.yMin)
+	return plotHeight - plotMarginBottom - fraction*(plotHeight-plotMarginTop-plotMarginBottom)
+}
+
+// svgTitle 返回鼠标悬停时显示的提示
+func svgTitle(title string) string {
+	if title == "" {
+		return ""
+	}
+	return "<title>" + template.HTMLEscapeString(title) + "</title>"
+}
+
+// rect 画一个从 (x0, y0) 到 (x1, y1) 的矩形
+func (p *svgPlot) rect(x0, y0, x1, y1 float64, class string, title string) {
+	left, right := math.Min(p.x(x0), p.x(x1)), math.Max(p.x(x0), p.x(x1))
+	top, bottom := math.Min(p.y(y0), p.y(y1)), math.Max(p.y(y0), p.y(y1))
+	fmt.Fprintf(&p.body, `<rect class="%s" x="%.1f" y="%.1f" width="%.1f" height="%.1f">%s</rect>`,
+		class, left, top, math.Max(right-left, 0.5), bottom-top, svgTitle(title))
+}
+
+// line 画一条从 (x0, y0) 到 (x1, y1) 的直线
+func (p *svgPlot) line(x0, y0, x1, y1 float64, class string) {
+	fmt.Fprintf(&p.body, `<line class="%s" x1="%.1f" y1="%.1f" x2="%.1f" y2="%.1f"/>`, class, p.x(x0), p.y(y0), p.x(x1), p.y(y1))
+}
+
+// circle 在 (x, y) 处画一个点
+func (p *svgPlot) circle(x, y float64, class string, title string) {
+	fmt.Fprintf(&p.body, `<circle class="%s" cx="%.1f" cy="%.1f" r="4">%s</circle>`, class, p.x(x), p.y(y), svgTitle(title))
+}
+
+// polyline 依次连接所有的点
+func (p *svgPlot) polyline(xs []float64, ys []float64, class string) {
+	points := make([]string, len(xs))
+	for i := range xs {
+		points[i] = fmt.Sprintf("%.1f,%.1f", p.x(xs[i]), p.y(ys[i]))
+	}
+	fmt.Fprintf(&p.body, `<polyline class="%s" points="%s"/>`, class, strings.Join(points, " "))
+}
+
+// niceTicks 返回 [min, max] 中大约 count 个间隔为 1、2、5 乘以 10 的幂的刻度
+func niceTicks(min float64, max float64, count int) []float64 {
+	step := (max - min) / float64(count)
+	magnitude := math.Pow(10, math.Floor(math.Log10(step)))
+	for _, factor := range []float64{1, 2, 5, 10} {
+		if factor*magnitude >= step {
+			step = factor * magnitude
+			break
+		}
+	}
+	var ticks []float64
+	for tick := math.Ceil(min/step) * step; tick <= max+step*1e-9; tick += step {
+		ticks = append(ticks, math.Round(tick/step)*step)
+	}
+	return ticks
+}
+
+// formatTick 去掉刻度值末尾多余的 0
+func formatTick(value float64) string {
+	return strings.TrimSuffix(strings.TrimRight(fmt.Sprintf("%.3f", value), "0"), ".")
+}
+
+// svg 返回带有坐标轴、刻度和标签的完整 SVG
+func (p *svgPlot) svg() template.HTML {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, `<svg viewBox="0 0 %d %d" width="%d" height="%d" xmlns="http://www.w3.org/2000/svg">`, plotWidth, plotHeight, plotWidth, plotHeight)
+	left, right := float64(plotMarginLeft), float64(plotWidth-plotMarginRight)
+	top, bottom := float64(plotMarginTop), float64(plotHeight-plotMarginBottom)
+	for _, tick := range niceTicks(p.xMin, p.xMax, 8) {
+		fmt.Fprintf(&sb, `<line class="grid" x1="%.1f" y1="%.1f" x2="%.1f" y2="%.1f"/><text class="tick" x="%.1f" y="%.1f" text-anchor="middle">%s</text>`,
+			p.x(tick), top, p.x(tick), bottom, p.x(tick), bottom+16, formatTick(tick))
+	}
+	for _, tick := range niceTicks(p.yMin, p.yMax, 5) {
+		fmt.Fprintf(&sb, `<line class="grid" x1="%.1f" y1="%.1f" x2="%.1f" y2="%.1f"/><text class="tick" x="%.1f" y="%.1f" text-anchor="end">%s</text>`,
+			left, p.y(tick), right, p.y(tick), left-6, p.y(tick)+4, formatTick(tick))
+	}
+	fmt.Fprintf(&sb, `<rect class="frame" x="%.1f" y="%.1f" width="%.1f" height="%.1f"/>`, left, top, right-left, bottom-top)
+	sb.WriteString(p.body.String())
+	fmt.Fprintf(&sb, `<text class="label" x="%.1f" y="%d" text-anchor="middle">%s</text>`, (left+right)/2, plotHeight-8, template.HTMLEscapeString(p.xLabel))
+	fmt.Fprintf(&sb, `<text class="label" transform="translate(16 %.1f) rotate(-90)" text-anchor="middle">%s</text>`, (top+bottom)/2, template.HTMLEscapeString(p.yLabel))
+	sb.WriteString(`</svg>`)
+	return template.HTML(sb.String())
+}
+
+// energyHistogram 画相对能量 (kcal/mol) 的直方图，kept 为 nil 时所有的构象都画成保留的构象
+func energyHistogram(energies []float64, kept []bool) template.HTML {
+	relative := make([]float64, len(energies))
+	lowest := math.Inf(1)
+	for _, energy := range energies {
+		lowest = math.Min(lowest, energy)
+	}
+	highest := 0.0
+	for i, energy := range energies {
+		relative[i] = (energy - lowest) * HartreeToKcal
+		highest = math.Max(highest, relative[i])
+	}
+
+	bins := 20
+	width := math.Max(highest/float64(bins), 0.05)
+	keptCounts := make([]int, bins)
+	droppedCounts := make([]int, bins)
+	for i, value := range relative {
+		bin := int(value / width)
+		if bin >= bins {
+			bin = bins - 1
+		}
+		if kept == nil || kept[i] {
+			keptCounts[bin]++
+		} else {
+			droppedCounts[bin]++
+		}
+	}
+	maxCount := 1
+	for i := range keptCounts {
+		if keptCounts[i]+droppedCounts[i] > maxCount {
+			maxCount = keptCounts[i] + droppedCounts[i]
+		}
+	}
+
+	plot := newSVGPlot(0, width*float64(bins), 0, float64(maxCount)*1.1, "relative energy (kcal/mol)", "conformers")
+	for i := range keptCounts {
+		x0, x1 := width*float64(i), width*float64(i+1)
+		kept, dropped := float64(keptCounts[i]), float64(droppedCounts[i])
+		if keptCounts[i] > 0 {
+			plot.rect(x0, 0, x1, kept, "bar", fmt.Sprintf("%.2f-%.2f kcal/mol: %d kept", x0, x1, keptCounts[i]))
+		}
+		if droppedCounts[i] > 0 {
+			plot.rect(x0, kept, x1, kept+dropped, "bar dropped", fmt.Sprintf("%.2f-%.2f kcal/mol: %d removed as duplicates", x0, x1, droppedCounts[i]))
+		}
+	}
+	return plot.svg()
+}
+
+// dedupKept 根据去重结果判断每一个构象是否被保留：每一个簇最后一个 new 或者 replaced 的构象为这个簇的代表
+func dedupKept(decisions []DedupDecision) []bool {
+	representative := make(map[int]int)
+	for i, decision := range decisions {
+		if decision.Action != DedupDuplicate {
+			representative[decision.Cluster] = i
+		}
+	}
+	kept := make([]bool, len(decisions))
+	for _, i := range representative {
+		kept[i] = true
+	}
+	return kept
+}
+
+// energyFigures 返回每一个步骤的构象能量分布图
+func (h HTMLReport) energyFigures() []htmlFigure {
+	var figures []htmlFigure
+	if h.Report != nil {
+		for _, stage := range h.Report.Stages {
+			if stage.Dedup == nil || len(stage.Dedup.Decisions) == 0 {
+				continue
+			}
+			energies := make([]float64, len(stage.Dedup.Decisions))
+			for i, decision := range stage.Dedup.Decisions {
+				energies[i] = decision.Energy
+			}
+			figures = append(figures, htmlFigure{
+				Title: fmt.Sprintf("%s (%s)", stage.Name, stage.Program),
+				Caption: fmt.Sprintf("%d conformers, %d kept after removing duplicates (%.2f kcal/mol, %.2f Angstrom)",
+					stage.Input, stage.Output, stage.Dedup.EnergyThreshold, stage.Dedup.DistanceThreshold),
+				SVG: energyHistogram(energies, dedupKept(stage.Dedup.Decisions)),
+			})
+		}
+	}
+	if h.Result != nil {
+		energies := make([]float64, len(h.Result.Conformers))
+		for i, conformer := range h.Result.Conformers {
+			energies[i] = conformer.FreeEnergy
+		}
+		figures = append(figures, htmlFigure{
+			Title:   "DFT",
+			Caption: fmt.Sprintf("free energies of the %d DFT optimized conformers", len(energies)),
+			SVG:     energyHistogram(energies, nil),
+		})
+	}
+	return figures
+}
+
+// sortedConformers 返回按照自由能从低到高排序的构象
+func sortedConformers(result *NMRResult) []ConformerNMR {
+	conformers := make([]ConformerNMR, len(result.Conformers))
+	copy(conformers, result.Conformers)
+	sort.SliceStable(conformers, func(i, j int) bool {
+		return conformers[i].FreeEnergy < conformers[j].FreeEnergy
+	})
+	return conformers
+}
+
+// populationFigure 返回 Boltzmann 分布的柱状图，构象按照自由能排序
+func (h HTMLReport) populationFigure() htmlFigure {
+	conformers := sortedConformers(h.Result)
+	lowest := conformers[0].FreeEnergy
+	plot := newSVGPlot(0.5, float64(len(conformers))+0.5, 0, 100, "conformer (sorted by free energy)", "population (%)")
+	for i, conformer := range conformers {
+		plot.rect(float64(i)+0.6, 0, float64(i)+1.4, conformer.Population*100, "bar",
+			fmt.Sprintf("%s: %.1f%%, %.2f kcal/mol", conformer.Name, conformer.Population*100, (conformer.FreeEnergy-lowest)*HartreeToKcal))
+	}
+	return htmlFigure{
+		Title:   "Boltzmann populations",
+		Caption: fmt.Sprintf("%d conformers at %.2f K", len(conformers), h.Result.Temperature),
+		SVG:     plot.svg(),
+	}
+}
+
+// scatterFigures 返回每一种核的计算值与实验值的散点图
+func (h HTMLReport) scatterFigures() []htmlFigure {
+	byNucleus := make(map[string][]PeakComparison)
+	var nuclei []string
+	for _, comparison := range h.Comparisons {
+		nucleus := comparison.Peak.Nucleus
+		if _, ok := byNucleus[nucleus]; !ok {
+			nuclei = append(nuclei, nucleus)
+		}
+		byNucleus[nucleus] = append(byNucleus[nucleus], comparison)
+	}
+	sort.Strings(nuclei)
+
+	var figures []htmlFigure
+	for _, nucleus := range nuclei {
+		comparisons := byNucleus[nucleus]
+		low, high := math.Inf(1), math.Inf(-1)
+		for _, comparison := range comparisons {
+			low = math.Min(low, math.Min(comparison.Peak.Shift, comparison.Predicted))
+			high = math.Max(high, math.Max(comparison.Peak.Shift, comparison.Predicted))
+		}
+		padding := math.Max((high-low)*0.05, 0.1)
+		low, high = low-padding, high+padding
+
+		plot := newSVGPlot(low, high, low, high, "experimental shift (ppm)", "calculated shift (ppm)")
+		plot.line(low, low, high, high, "diagonal")
+		for _, comparison := range comparisons {
+			class := "point"
+			if comparison.Peak.Auto {
+				class = "point auto"
+			}
+			plot.circle(comparison.Peak.Shift, comparison.Predicted, class,
+				fmt.Sprintf("atoms %s: exp %.2f, calc %.2f, error %.2f ppm", formatAtoms(comparison.Peak.Atoms),
+					comparison.Peak.Shift, comparison.Predicted, comparison.Error))
+		}
+		figures = append(figures, htmlFigure{
+			Title:   nucleus + " calculated vs experimental",
+			Caption: fmt.Sprintf("%d peaks, MAE = %.3f ppm (open circles: assigned automatically)", len(comparisons), h.MAE[nucleus]),
+			SVG:     plot.svg(),
+		})
+	}
+	return figures
+}
+
+// spectrumFigures 返回由平均化学位移模拟的 1H 和 13C 谱图
+func (h HTMLReport) spectrumFigures() []htmlFigure {
+	var figures []htmlFigure
+	for _, nucleus := range []string{"H", "C"} {
+		var shifts []float64
+		for _, shift := range h.Result.Nuclei {
+			if shift.Symbol == nucleus && shift.Referenced {
+				shifts = append(shifts, shift.Shift)
+			}
+		}
+		if len(shifts) == 0 {
+			continue
+		}
+		lineWidth := spectrumLineWidth[nucleus]
+		low, high := shifts[0], shifts[0]
+		for _, shift := range shifts {
+			low, high = math.Min(low, shift), math.Max(high, shift)
+		}
+		padding := math.Max((high-low)*0.1, 20*lineWidth)
+		low, high = low-padding, high+padding
+
+		// 每一个原子核为一个峰高为 1 的 Lorentz 峰
+		xs := make([]float64, spectrumPoints)
+		ys := make([]float64, spectrumPoints)
+		highest := 0.0
+		halfWidth := lineWidth / 2
+		for i := range xs {
+			xs[i] = low + (high-low)*float64(i)/float64(spectrumPoints-1)
+			for _, shift := range shifts {
+				ys[i] += halfWidth * halfWidth / ((xs[i]-shift)*(xs[i]-shift) + halfWidth*halfWidth)
+			}
+			highest = math.Max(highest, ys[i])
+		}
+
+		plot := newSVGPlot(low, high, 0, highest*1.1, "chemical shift (ppm)", "intensity")
+		plot.reverseX = true
+		plot.polyline(xs, ys, "spectrum")
+		label := map[string]string{"H": "1H", "C": "13C"}[nucleus]
+		figures = append(figures, htmlFigure{
+			Title:   "Simulated " + label + " spectrum",
+			Caption: fmt.Sprintf("%d nuclei, Lorentzian lines with %.2f ppm full width at half maximum", len(shifts), lineWidth),
+			SVG:     plot.svg(),
+		})
+	}
+	return figures
+}
+
+// viewerConformers 返回 Boltzmann 权重最高的 top 个构象的结构
+func (h HTMLReport) viewerConformers() []viewerConformer {
+	conformers := make([]ConformerNMR, len(h.Result.Conformers))
+	copy(conformers, h.Result.Conformers)
+	sort.SliceStable(conformers, func(i, j int) bool {
+		return conformers[i].Population > conformers[j].Population
+	})
+	if h.Top < len(conformers) {
+		conformers = conformers[:h.Top]
+	}
+
+	viewers := []viewerConformer{}
+	for _, conformer := range conformers {
+		viewer := viewerConformer{Name: conformer.Name, Population: conformer.Population}
+		for _, atom := range conformer.Cluster.Atoms {
+			viewer.Atoms = append(viewer.Atoms, viewerAtom{Symbol: atom.Symbol, X: atom.X, Y: atom.Y, Z: atom.Z})
+		}
+		viewers = append(viewers, viewer)
+	}
+	return viewers
+}
+
+// WriteHTMLReport 将报告写入 fileName，Report 和 Result 至少要有一个
+func WriteHTMLReport(fileName string, h HTMLReport) error {
+	if h.Report == nil && h.Result == nil {
+		return fmt.Errorf("no run report or NMR result to write")
+	}
+
+	data := struct {
+		Title       string
+		Report      *Report
+		Result      *NMRResult
+		Energies    []htmlFigure
+		Populations []htmlFigure
+		Scatters    []htmlFigure
+		Spectra     []htmlFigure
+		Viewer      []viewerConformer
+		Shifts      []NucleusShift
+	}{Report: h.Report, Result: h.Result, Energies: h.energyFigures(), Viewer: []viewerConformer{}}
+
+	data.Title = "KYBNMR report"
+	if h.Report != nil {
+		data.Title += ": " + h.Report.Molecule
+	}
+	if h.Result != nil {
+		data.Populations = []htmlFigure{h.populationFigure()}
+		data.Scatters = h.scatterFigures()
+		data.Spectra = h.spectrumFigures()
+		data.Viewer = h.viewerConformers()
+		for _, nucleus := range h.Result.Nuclei {
+			if nucleus.Referenced {
+				data.Shifts = append(data.Shifts, nucleus)
+			}
+		}
+	}
+
+	tmpl, err := template.New("report").Funcs(template.FuncMap{
+		"percent": func(value float64) string { return fmt.Sprintf("%.1f", value*100) },
+		"fixed":   func(value float64, digits int) string { return fmt.Sprintf("%.*f", digits, value) },
+	}).Parse(htmlReportTemplate)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Create(fileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return tmpl.Execute(file, data)
+}
+
+// htmlReportTemplate HTML 报告的模板，样式和 3D 结构查看器都内嵌在文件中
+const htmlReportTemplate = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { font-family: -apple-system, "Segoe UI", Helvetica, Arial, sans-serif; margin: 2em auto; max-width: 1340px; color: #222; padding: 0 1em; }
+h1 { font-size: 1.6em; } h2 { font-size: 1.25em; border-bottom: 1px solid #ddd; padding-bottom: .2em; margin-top: 1.8em; }
+table { border-collapse: collapse; margin: .5em 0; font-size: .9em; }
+th, td { border: 1px solid #ddd; padding: .25em .6em; text-align: left; }
+th { background: #f4f4f4; }
+td.num { text-align: right; font-variant-numeric: tabular-nums; }
+.figures { display: flex; flex-wrap: wrap; gap: 1.5em; }
+figure { margin: 0; } figcaption { font-size: .85em; color: #555; max-width: 640px; }
+figure h3 { font-size: 1em; margin: .3em 0; }
+svg { font-size: 11px; }
+svg .frame { fill: none; stroke: #888; } svg .grid { stroke: #eee; }
+svg .tick { fill: #555; } svg .label { fill: #222; font-size: 12px; }
+svg .bar { fill: #4c78a8; } svg .bar.dropped { fill: #e0a458; }
+svg .point { fill: #4c78a8; } svg .point.auto { fill: #fff; stroke: #4c78a8; stroke-width: 1.5; }
+svg .diagonal { stroke: #bbb; stroke-dasharray: 4 3; }
+svg .spectrum { fill: none; stroke: #4c78a8; stroke-width: 1.2; }
+.status-completed { color: #2a7a2a; } .status-failed, .status-interrupted { color: #b22; }
+canvas { border: 1px solid #ddd; cursor: grab; background: #fff; }
+.note { color: #777; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+{{with .Report}}
+<table>
+<tr><th>Status</th><td class="status-{{.Status}}">{{.Status}}{{if .Error}}: {{.Error}}{{end}}</td></tr>
+<tr><th>Input</th><td>{{.Input}} (charge {{.Charge}}, multiplicity {{.Multiplicity}})</td></tr>
+<tr><th>Started</th><td>{{.StartedAt}}{{if .FinishedAt}}, finished {{.FinishedAt}} ({{fixed .Seconds 0}} s){{end}}</td></tr>
+<tr><th>Programs</th><td>opt {{index .Engines "opt"}}, sp {{index .Engines "sp"}}, nmr {{index .Engines "nmr"}} on {{.Backend}}{{range .Programs}}<br>{{.Name}} {{.Version}} <span class="note">{{.Path}}</span>{{end}}</td></tr>
+<tr><th>KYBNMR</th><td>{{.KybnmrVersion}}, report schema {{.SchemaVersion}}</td></tr>
+</table>
+<h2>Steps</h2>
+<table>
+<tr><th>Step</th><th>Program</th><th>Status</th><th>Conformers in</th><th>Conformers out</th><th>Jobs</th><th>Time (s)</th></tr>
+{{range .Stages}}<tr><td>{{.Name}}</td><td>{{.Program}}</td><td class="status-{{.Status}}">{{.Status}}</td><td class="num">{{.Input}}</td><td class="num">{{.Output}}</td><td class="num">{{len .Jobs}}</td><td class="num">{{fixed .Seconds 1}}</td></tr>
+{{end}}</table>
+{{end}}
+
+<h2>Conformer energies</h2>
+{{if .Energies}}<div class="figures">{{range .Energies}}<figure><h3>{{.Title}}</h3>{{.SVG}}<figcaption>{{.Caption}}</figcaption></figure>{{end}}</div>
+<p class="note">Blue: kept conformers, orange: removed as duplicates of a lower conformer.</p>
+{{else}}<p class="note">No conformer energies recorded.</p>{{end}}
+
+{{if .Result}}
+<h2>Boltzmann populations</h2>
+<div class="figures">{{range .Populations}}<figure><h3>{{.Title}}</h3>{{.SVG}}<figcaption>{{.Caption}}</figcaption></figure>{{end}}</div>
+
+<h2>Calculated vs experimental shifts</h2>
+{{if .Scatters}}<div class="figures">{{range .Scatters}}<figure><h3>{{.Title}}</h3>{{.SVG}}<figcaption>{{.Caption}}</figcaption></figure>{{end}}</div>
+{{else}}<p class="note">No experimental data, use kybnmr report --html --exp exp.csv.</p>{{end}}
+
+<h2>Simulated spectra</h2>
+{{if .Spectra}}<div class="figures">{{range .Spectra}}<figure><h3>{{.Title}}</h3>{{.SVG}}<figcaption>{{.Caption}}</figcaption></figure>{{end}}</div>
+{{else}}<p class="note">No referenced 1H or 13C shifts, set refShieldingH and refShieldingC in [nmr].</p>{{end}}
+
+<h2>Top conformers</h2>
+<p class="note">Drag to rotate, scroll to zoom.</p>
+<div class="figures" id="viewers"></div>
+
+<h2>Averaged shifts</h2>
+<table>
+<tr><th>Atom</th><th>Element</th><th>Shielding (ppm)</th><th>Shift (ppm)</th></tr>
+{{range .Shifts}}<tr><td class="num">{{.Index}}</td><td>{{.Symbol}}</td><td class="num">{{fixed .Shielding 3}}</td><td class="num">{{fixed .Shift 3}}</td></tr>
+{{end}}</table>
+{{else}}
+<p class="note">This run has no NMR result yet.</p>
+{{end}}
+
+<script>
+(function () {
+  var conformers = {{.Viewer}};
+  var colors = { H: "#dddddd", C: "#505050", N: "#3050f8", O: "#ff0d0d", F: "#90e050", S: "#e0c030", P: "#ff8000", Cl: "#1ff01f", Br: "#a62929", I: "#940094" };
+  var radii = { H: 0.31, C: 0.76, N: 0.71, O: 0.66, F: 0.57, S: 1.05, P: 1.07, Cl: 1.02, Br: 1.20, I: 1.39 };
+  var container = document.getElementById("viewers");
+  if (!container) { return; }
+  conformers.forEach(function (conformer) {
+    var figure = document.createElement("figure");
+    var title = document.createElement("h3");
+    title.textContent = conformer.name + " (" + (conformer.population * 100).toFixed(1) + "%)";
+    var canvas = document.createElement("canvas");
+    canvas.width = 320; canvas.height = 320;
+    figure.appendChild(title); figure.appendChild(canvas); container.appendChild(figure);
+
+    var atoms = conformer.atoms || [];
+    var cx = 0, cy = 0, cz = 0;
+    atoms.forEach(function (a) { cx += a.x; cy += a.y; cz += a.z; });
+    cx /= atoms.length || 1; cy /= atoms.length || 1; cz /= atoms.length || 1;
+    var size = 1;
+    atoms.forEach(function (a) { a.x -= cx; a.y -= cy; a.z -= cz; size = Math.max(size, Math.sqrt(a.x * a.x + a.y * a.y + a.z * a.z)); });
+    var bonds = [];
+    for (var i = 0; i < atoms.length; i++) {
+      for (var j = i + 1; j < atoms.length; j++) {
+        var a = atoms[i], b = atoms[j];
+        var d = Math.sqrt(Math.pow(a.x - b.x, 2) + Math.pow(a.y - b.y, 2) + Math.pow(a.z - b.z, 2));
+        if (d < 1.2 * ((radii[a.s] || 0.8) + (radii[b.s] || 0.8))) { bonds.push([i, j]); }
+      }
+    }
+
+    var rotX = 0.3, rotY = 0.5, zoom = 1, ctx = canvas.getContext("2d");
+    function project(a) {
+      var x = a.x * Math.cos(rotY) + a.z * Math.sin(rotY);
+      var z = -a.x * Math.sin(rotY) + a.z * Math.cos(rotY);
+      var y = a.y * Math.cos(rotX) - z * Math.sin(rotX);
+      z = a.y * Math.sin(rotX) + z * Math.cos(rotX);
+      var scale = zoom * 140 / size;
+      return { x: 160 + x * scale, y: 160 - y * scale, z: z, scale: scale };
+    }
+    function draw() {
+      ctx.clearRect(0, 0, canvas.width, canvas.height);
+      var points = atoms.map(project);
+      ctx.strokeStyle = "#888"; ctx.lineWidth = 2;
+      bonds.forEach(function (bond) {
+        ctx.beginPath(); ctx.moveTo(points[bond[0]].x, points[bond[0]].y); ctx.lineTo(points[bond[1]].x, points[bond[1]].y); ctx.stroke();
+      });
+      var order = points.map(function (p, i) { return i; }).sort(function (i, j) { return points[i].z - points[j].z; });
+      order.forEach(function (i) {
+        var p = points[i], r = Math.max(3, (radii[atoms[i].s] || 0.8) * p.scale * 0.35);
+        ctx.beginPath(); ctx.arc(p.x, p.y, r, 0, 2 * Math.PI);
+        ctx.fillStyle = colors[atoms[i].s] || "#ff1493"; ctx.fill();
+        ctx.strokeStyle = "#333"; ctx.lineWidth = 0.8; ctx.stroke();
+      });
+    }
+    var dragging = null;
+    canvas.addEventListener("mousedown", function (e) { dragging = { x: e.clientX, y: e.clientY }; });
+    window.addEventListener("mouseup", function () { dragging = null; });
+    window.addEventListener("mousemove", function (e) {
+      if (!dragging) { return; }
+      rotY += (e.clientX - dragging.x) * 0.01; rotX += (e.clientY - dragging.y) * 0.01;
+      dragging = { x: e.clientX, y: e.clientY }; draw();
+    });
+    canvas.addEventListener("wheel", function (e) {
+      e.preventDefault(); zoom = Math.min(5, Math.max(0.3, zoom * (e.deltaY < 0 ? 1.1 : 0.9))); draw();
+    });
+    draw();
+  });
+})();
+</script>
+</body>
+</html>
+`
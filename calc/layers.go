@@ -0,0 +1,175 @@
+package calc
+
+import (
+	"gopkg.in/ini.v1"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+/*
+* layers.go
+* 该模块用来分层读取配置，后面的层覆盖前面的层：
+*
+*	1. 内置的默认值，即 DefaultConfig
+*	2. 用户配置文件 ~/.config/kybnmr/config.ini（设置了 $XDG_CONFIG_HOME 时为 $XDG_CONFIG_HOME/kybnmr/config.ini），
+*	   也可以是同一目录中的 config.toml 或者 config.yaml，适合写程序路径这类与项目无关的配置，不存在时跳过
+*	3. 项目配置文件，即 --config 指定的文件，默认为启动目录中的 config.ini（没有时依次查找 config.toml 和 config.yaml），
+*	   三种格式见 formats.go
+*	4. 环境变量 KYBNMR_<SECTION>_<KEY>，不区分大小写，例如 KYBNMR_OPTIMIZED_GAUPATH=/opt/g16/g16
+*	5. 命令行中的 --set section.key=value，可以使用多次
+*
+* 所有的层合并之后作为一个配置严格检查，每一个问题都报告在提供这个值的文件和行、环境变量或者 --set 上，
+* Config.Resolved 返回每一个 key 的最终值和来源，kybnmr config show --resolved 输出它们
+*
+* @Author: Kimariyb
+* @Address: XiaMen University
+* @Data: 2023-09-26
+ */
+
+// ConfigEnvPrefix 配置环境变量的前缀
+const ConfigEnvPrefix = "KYBNMR_"
+
+// ConfigLayers 分层配置中除默认值以外的每一层
+//   - UserFile: 用户配置文件，为空或者不存在时跳过
+//   - ProjectFile: 项目配置文件，为空时跳过
+//   - Env: KEY=VALUE 形式的环境变量，通常为 os.Environ()，只使用以 KYBNMR_ 开头的变量
+//   - Overrides: 命令行中的 --set
+//   - Programs: 本次运行用到的程序（engine 名或者 shermo），它们的路径与其它的配置一起检查，为空时不检查
+type ConfigLayers struct {
+	UserFile    string
+	ProjectFile string
+	Env         []string
+	Overrides   []ConfigOverride
+	Programs    []string
+}
+
+// UserConfigFile 返回用户配置文件的路径，依次使用用户配置目录中存在的 ConfigFileNames，
+// 都不存在时返回其中的 config.ini，找不到用户目录时返回空字符串
+func UserConfigFile() string {
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		dir = filepath.Join(home, ".config")
+	}
+	for _, name := range ConfigFileNames {
+		file := filepath.Join(dir, "kybnmr", name)
+		if info, err := os.Stat(file); err == nil && !info.IsDir() {
+			return file
+		}
+	}
+	return filepath.Join(dir, "kybnmr", ConfigFileNames[0])
+}
+
+// configSchema 返回所有已知的 section.key 以及它们的默认值，默认值的类型即为值的类型
+func configSchema() map[string]interface{} {
+	r := newConfigReader(ini.Empty(), newConfigLines(""))
+	readConfig(r)
+	return r.defaults
+}
+
+// mergeConfigFile 将任意格式的配置文件 configFile 中的所有值以及它们的行号合并到 merged 和 lines 中
+func mergeConfigFile(merged *ini.File, lines *configLines, configFile string) error {
+	iniFile, fileLines, err := loadConfigDocument(configFile)
+	if err != nil {
+		return err
+	}
+
+	for _, section := range iniFile.Sections() {
+		target := merged.Section(section.Name())
+		for _, key := range section.Keys() {
+			target.Key(key.Name()).SetValue(key.Value())
+		}
+	}
+	lines.merge(fileLines)
+	return nil
+}
+
+// lookupEnvKey 返回环境变量名 name（去掉前缀之后）对应的 section 和 key
+func lookupEnvKey(name string, known map[string]interface{}) (string, string, bool) {
+	for knownKey := range known {
+		section, key, _ := strings.Cut(knownKey, ".")
+		if strings.EqualFold(section+"_"+key, name) {
+			return section, key, true
+		}
+	}
+	return "", "", false
+}
+
+// LoadConfig 依次合并默认值和 layers 中的每一层，严格检查之后返回 Config，返回的错误为 *ConfigError
+func LoadConfig(layers ConfigLayers) (*Config, error) {
+	merged := ini.Empty()
+	lines := newConfigLines(layers.ProjectFile)
+	if layers.ProjectFile == "" {
+		lines.file = "config"
+	}
+
+	if layers.UserFile != "" {
+		if info, err := os.Stat(layers.UserFile); err == nil && !info.IsDir() {
+			if err := mergeConfigFile(merged, lines, layers.UserFile); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if layers.ProjectFile != "" {
+		if err := mergeConfigFile(merged, lines, layers.ProjectFile); err != nil {
+			return nil, err
+		}
+	}
+
+	// 环境变量，不认识的 KYBNMR_ 变量也是配置中的问题
+	var issues []ConfigIssue
+	known := configSchema()
+	envNames := make([]string, 0, len(known))
+	for knownKey := range known {
+		envNames = append(envNames, ConfigEnvPrefix+strings.ToUpper(strings.Replace(knownKey, ".", "_", 1)))
+	}
+	sort.Strings(envNames)
+	for _, variable := range layers.Env {
+		name, value, _ := strings.Cut(variable, "=")
+		if !strings.HasPrefix(name, ConfigEnvPrefix) {
+			continue
+		}
+		section, key, ok := lookupEnvKey(strings.TrimPrefix(name, ConfigEnvPrefix), known)
+		if !ok {
+			issues = append(issues, ConfigIssue{File: name, Message: "unknown environment variable" + suggestion(name, envNames)})
+			continue
+		}
+		merged.Section(section).Key(key).SetValue(value)
+		lines.keys[lineKey(section, key)] = configSource{File: name}
+	}
+
+	// 命令行中的 --set
+	for _, override := range layers.Overrides {
+		merged.Section(override.Section).Key(override.Key).SetValue(override.Value)
+		source := configSource{File: "--set " + override.Section + "." + override.Key}
+		lines.keys[lineKey(override.Section, override.Key)] = source
+		if _, ok := lines.sections[override.Section]; !ok {
+			lines.sections[override.Section] = source
+		}
+	}
+
+	r := newConfigReader(merged, lines)
+	r.issues = issues
+	config := readConfig(r)
+
+	// 检查未知的 key、不可能的值以及程序的路径
+	r.checkUnknownKeys()
+	config.validate(r)
+	r.issues = append(r.issues, config.programIssues(layers.Programs)...)
+	if len(r.issues) > 0 {
+		return nil, newConfigError(r.issues)
+	}
+	config.resolved = r.resolved
+
+	return config, nil
+}
+
+// Resolved 返回每一个 key 的最终值和来源，按照读取的顺序
+func (c *Config) Resolved() []ResolvedValue {
+	return c.resolved
+}
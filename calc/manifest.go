@@ -0,0 +1,183 @@
+package calc
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+/*
+* manifest.go
+* 该模块用来读取 kybnmr batch 的清单文件，以及将 section.key=value 形式的配置覆盖写入配置文件
+*
+* 清单文件为 csv 格式，每一行为一个分子 "input, charge, multiplicity, solvent, overrides"，例如：
+*	input,charge,multiplicity,solvent,overrides
+*	mol-a.xyz,0,1,chcl3,
+*	mol-b.xyz,1,1,methanol,nmr.temperature=300;optimized.postOptArgs=--gfn2 --opt tight
+*	mol-c.xyz
+* 只有 input 是必须的，相对路径是相对于清单文件所在的文件夹而言的；
+* charge、multiplicity 和 solvent 为空时使用配置文件中的值，它们分别写入配置文件的
+* [molecule] charge、[molecule] multiplicity 和 [solvent] name；
+* overrides 为用分号隔开的若干个 section.key=value，覆盖配置文件中对应的值
+*
+* @Author: Kimariyb
+* @Address: XiaMen University
+* @Data: 2023-09-26
+ */
+
+// ManifestEntry 清单文件中的一个分子
+//   - Line: 在清单文件中的行号，用于输出错误信息
+//   - Input: xyz 文件的路径
+//   - Charge、Multiplicity、Solvent: 为空时使用配置文件中的值
+//   - Overrides: 其他的配置覆盖
+type ManifestEntry struct {
+	Line         int
+	Input        string
+	Charge       string
+	Multiplicity string
+	Solvent      string
+	Overrides    []ConfigOverride
+}
+
+// ConfigOverride 一个 section.key=value 形式的配置覆盖
+type ConfigOverride struct {
+	Section string
+	Key     string
+	Value   string
+}
+
+// String 返回 section.key=value
+func (o ConfigOverride) String() string {
+	return fmt.Sprintf("%s.%s=%s", o.Section, o.Key, o.Value)
+}
+
+// ParseConfigOverride 解析 section.key=value，section 和 key 都不能为空，value 可以为空
+func ParseConfigOverride(text string) (ConfigOverride, error) {
+	name, value, found := strings.Cut(text, "=")
+	if !found {
+		return ConfigOverride{}, fmt.Errorf("invalid override %q, expected section.key=value", text)
+	}
+	section, key, found := strings.Cut(strings.TrimSpace(name), ".")
+	if !found || section == "" || key == "" {
+		return ConfigOverride{}, fmt.Errorf("invalid override %q, expected section.key=value", text)
+	}
+
+	return ConfigOverride{Section: section, Key: key, Value: strings.TrimSpace(value)}, nil
+}
+
+// AllOverrides 返回该分子所有的配置覆盖，charge、multiplicity 和 solvent 在最前面，
+// 因此 overrides 一列中的同名配置会覆盖它们
+func (e *ManifestEntry) AllOverrides() []ConfigOverride {
+	var overrides []ConfigOverride
+	if e.Charge != "" {
+		overrides = append(overrides, ConfigOverride{Section: "molecule", Key: "charge", Value: e.Charge})
+	}
+	if e.Multiplicity != "" {
+		overrides = append(overrides, ConfigOverride{Section: "molecule", Key: "multiplicity", Value: e.Multiplicity})
+	}
+	if e.Solvent != "" {
+		overrides = append(overrides, ConfigOverride{Section: "solvent", Key: "name", Value: e.Solvent})
+	}
+	return append(overrides, e.Overrides...)
+}
+
+// ParseManifest 读取清单文件 fileName，返回所有的分子
+func ParseManifest(fileName string) ([]ManifestEntry, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.Comment = '#'
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	var entries []ManifestEntry
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading %s: %w", fileName, err)
+		}
+		line, _ := reader.FieldPos(0)
+
+		// 跳过表头
+		if strings.EqualFold(strings.TrimSpace(record[0]), "input") {
+			continue
+		}
+		if len(record) > 5 {
+			return nil, fmt.Errorf("%s:%d: expected at most 5 columns, got %d", fileName, line, len(record))
+		}
+
+		fields := make([]string, 5)
+		for i, field := range record {
+			fields[i] = strings.TrimSpace(field)
+		}
+		entry := ManifestEntry{Line: line, Input: fields[0], Charge: fields[1], Multiplicity: fields[2], Solvent: fields[3]}
+		if entry.Input == "" {
+			return nil, fmt.Errorf("%s:%d: missing input file", fileName, line)
+		}
+		if entry.Charge != "" {
+			if _, err := strconv.Atoi(entry.Charge); err != nil {
+				return nil, fmt.Errorf("%s:%d: invalid charge %q", fileName, line, entry.Charge)
+			}
+		}
+		if entry.Multiplicity != "" {
+			if multiplicity, err := strconv.Atoi(entry.Multiplicity); err != nil || multiplicity < 1 {
+				return nil, fmt.Errorf("%s:%d: invalid multiplicity %q", fileName, line, entry.Multiplicity)
+			}
+		}
+		for _, text := range strings.Split(fields[4], ";") {
+			if strings.TrimSpace(text) == "" {
+				continue
+			}
+			override, err := ParseConfigOverride(text)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %w", fileName, line, err)
+			}
+			entry.Overrides = append(entry.Overrides, override)
+		}
+
+		entries = append(entries, entry)
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("no molecule found in %s", fileName)
+	}
+
+	return entries, nil
+}
+
+// ConfigFileValues 读取任意格式的配置文件 configFile，返回其中所有的 section.key=value
+func ConfigFileValues(configFile string) ([]ConfigOverride, error) {
+	iniFile, _, err := loadConfigDocument(configFile)
+	if err != nil {
+		return nil, err
+	}
+	var values []ConfigOverride
+	for _, section := range iniFile.Sections() {
+		for _, key := range section.Keys() {
+			values = append(values, ConfigOverride{Section: section.Name(), Key: key.Name(), Value: key.String()})
+		}
+	}
+	return values, nil
+}
+
+// WriteConfigWithOverrides 读取任意格式的配置文件 configFile，应用 overrides 之后按照 target 的扩展名写入 target
+func WriteConfigWithOverrides(configFile string, overrides []ConfigOverride, target string) error {
+	iniFile, _, err := loadConfigDocument(configFile)
+	if err != nil {
+		return err
+	}
+	for _, override := range overrides {
+		iniFile.Section(override.Section).Key(override.Key).SetValue(override.Value)
+	}
+
+	return SaveConfigDocument(iniFile, target)
+}
@@ -0,0 +1,315 @@
+package calc
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+* nmr.go
+* 该模块用来读取 Gaussian/Orca 的 NMR 输出文件，并根据各个构象的自由能计算 Boltzmann 分布，
+* 最后得到 Boltzmann 加权平均后的屏蔽常数和化学位移
+*
+*	化学位移由参考物质（一般为同一理论水平下的 TMS）的屏蔽常数减去体系的屏蔽常数得到：
+*		delta = sigma(ref) - sigma
+*
+* @Author: Kimariyb
+* @Address: XiaMen University
+* @Data: 2023-09-22
+ */
+
+// HartreeToKcal Hartree 到 kcal/mol 的换算系数
+const HartreeToKcal = 627.5095
+
+// GasConstantKcal 气体常数，单位为 kcal/(mol*K)
+const GasConstantKcal = 1.987204e-3
+
+// NucleusShielding 记录一个原子核的各向同性屏蔽常数
+//   - Index: 原子序号，从 1 开始，与 xyz 文件中的顺序一致
+//   - Symbol: 元素符号
+//   - Isotropic: 各向同性屏蔽常数，单位为 ppm
+type NucleusShielding struct {
+	Index     int
+	Symbol    string
+	Isotropic float64
+}
+
+// NucleusShift 记录 Boltzmann 平均之后的一个原子核的屏蔽常数和化学位移
+// 只有在配置文件中给出了参考屏蔽常数的元素，Referenced 才为 true，Shift 才有意义
+type NucleusShift struct {
+	Index      int
+	Symbol     string
+	Shielding  float64
+	Shift      float64
+	Referenced bool
+}
+
+// ConformerNMR 记录一个构象的能量、结构以及 NMR 计算结果
+//   - Name: 构象的名字，即 thermo/opt 中 out 文件的文件名（不含后缀）
+//   - Energy: 单点能，单位为 Hartree
+//   - GibbsCorrection: 自由能热校正量，单位为 Hartree
+//   - FreeEnergy: Energy + GibbsCorrection
+//   - Population: 该构象的 Boltzmann 权重
+type ConformerNMR struct {
+	Name            string
+	Energy          float64
+	GibbsCorrection float64
+	FreeEnergy      float64
+	Population      float64
+	Cluster         Cluster
+	Shieldings      []NucleusShielding
+}
+
+// NMRResult 一次 KYBNMR 运行最终得到的 NMR 结果
+type NMRResult struct {
+	Temperature float64
+	Conformers  []ConformerNMR
+	Nuclei      []NucleusShift
+}
+
+// BoltzmannWeights 根据自由能（Hartree）计算温度 temperature（K）下每一个构象的 Boltzmann 权重
+func BoltzmannWeights(freeEnergies []float64, temperature float64) []float64 {
+	weights := make([]float64, len(freeEnergies))
+	if len(freeEnergies) == 0 {
+		return weights
+	}
+
+	// 以最低的自由能为零点，避免指数溢出
+	minEnergy := freeEnergies[0]
+	for _, energy := range freeEnergies {
+		minEnergy = math.Min(minEnergy, energy)
+	}
+
+	sum := 0.0
+	for i, energy := range freeEnergies {
+		deltaG := (energy - minEnergy) * HartreeToKcal
+		weights[i] = math.Exp(-deltaG / (GasConstantKcal * temperature))
+		sum += weights[i]
+	}
+	for i := range weights {
+		weights[i] /= sum
+	}
+
+	return weights
+}
+
+// averageIsotropic 以 weights 为权重计算所有原子核的加权平均屏蔽常数
+// AverageShielding 和 Breakdown 都通过这个函数做加权平均，保证二者的结果一致
+func averageIsotropic(conformers []ConformerNMR, weights []float64) ([]float64, error) {
+	if len(conformers) == 0 {
+		return nil, fmt.Errorf("empty conformer list")
+	}
+
+	averages := make([]float64, len(conformers[0].Shieldings))
+	for k, conformer := range conformers {
+		if len(conformer.Shieldings) != len(averages) {
+			return nil, fmt.Errorf("conformer %s has %d nuclei, expected %d",
+				conformer.Name, len(conformer.Shieldings), len(averages))
+		}
+		for i, shielding := range conformer.Shieldings {
+			averages[i] += weights[k] * shielding.Isotropic
+		}
+	}
+
+	return averages, nil
+}
+
+// AverageShielding 根据每个构象的 Population 计算所有原子核的加权平均屏蔽常数，
+// 并根据 references 中每种元素的参考屏蔽常数将其转化为化学位移
+func AverageShielding(conformers []ConformerNMR, references map[string]float64) ([]NucleusShift, error) {
+	populations := make([]float64, len(conformers))
+	for i, conformer := range conformers {
+		populations[i] = conformer.Population
+	}
+	averages, err := averageIsotropic(conformers, populations)
+	if err != nil {
+		return nil, err
+	}
+
+	nuclei := make([]NucleusShift, len(averages))
+	for i, shielding := range conformers[0].Shieldings {
+		nuclei[i] = NucleusShift{Index: shielding.Index, Symbol: shielding.Symbol, Shielding: averages[i]}
+		reference, ok := references[shielding.Symbol]
+		if ok && reference != 0 {
+			nuclei[i].Shift = reference - averages[i]
+			nuclei[i].Referenced = true
+		}
+	}
+
+	return nuclei, nil
+}
+
+// CollectNMRResult 读取 thermo/opt、thermo/sp 和 thermo/nmr 中的 out 文件，组合成 NMRResult
+// thermo/sp 和 thermo/nmr 中的第 i 个任务都是由 thermo/opt 中按文件名排序的第 i 个 out 文件生成的，
+// 这与 ReadClusterListFromOut 的顺序保持一致
+//   - optEngine: 优化和振动分析使用的程序
+//   - spEngine: 单点能使用的程序
+//   - nmrEngine: NMR 计算使用的程序
+//   - nmrConfig: [nmr] 中的配置
+func CollectNMRResult(optEngine, spEngine, nmrEngine Engine, nmrConfig *NMRConfig) (*NMRResult, error) {
+	optFiles, err := listOutFiles(StageOpt.Folder())
+	if err != nil {
+		return nil, err
+	}
+
+	var conformers []ConformerNMR
+	for i, optFile := range optFiles {
+		cluster, err := optEngine.ParseGeometry(optFile)
+		if err != nil {
+			return nil, err
+		}
+		correction, err := optEngine.ParseGibbsCorrection(optFile)
+		if err != nil {
+			return nil, err
+		}
+		energy, err := spEngine.ParseEnergy(StageSP.OutFile(i + 1))
+		if err != nil {
+			return nil, err
+		}
+		shieldings, err := nmrEngine.ParseShieldings(StageNMR.OutFile(i + 1))
+		if err != nil {
+			return nil, err
+		}
+
+		conformers = append(conformers, ConformerNMR{
+			Name:            strings.TrimSuffix(filepath.Base(optFile), ".out"),
+			Energy:          energy,
+			GibbsCorrection: correction,
+			FreeEnergy:      energy + correction,
+			Cluster:         cluster,
+			Shieldings:      shieldings,
+		})
+	}
+
+	return NewNMRResult(conformers, nmrConfig)
+}
+
+// NewNMRResult 根据构象的自由能计算 Boltzmann 分布，并得到平均化学位移
+func NewNMRResult(conformers []ConformerNMR, nmrConfig *NMRConfig) (*NMRResult, error) {
+	freeEnergies := make([]float64, len(conformers))
+	for i, conformer := range conformers {
+		freeEnergies[i] = conformer.FreeEnergy
+	}
+	for i, weight := range BoltzmannWeights(freeEnergies, nmrConfig.Temperature) {
+		conformers[i].Population = weight
+	}
+
+	nuclei, err := AverageShielding(conformers, nmrConfig.References())
+	if err != nil {
+		return nil, err
+	}
+
+	return &NMRResult{
+		Temperature: nmrConfig.Temperature,
+		Conformers:  conformers,
+		Nuclei:      nuclei,
+	}, nil
+}
+
+// LowestConformer 返回自由能最低的构象
+func (r *NMRResult) LowestConformer() ConformerNMR {
+	lowest := r.Conformers[0]
+	for _, conformer := range r.Conformers[1:] {
+		if conformer.FreeEnergy < lowest.FreeEnergy {
+			lowest = conformer
+		}
+	}
+	return lowest
+}
+
+// ShiftMap 返回原子序号到平均化学位移的映射，只包含有参考屏蔽常数的原子核
+func (r *NMRResult) ShiftMap() map[int]NucleusShift {
+	shifts := make(map[int]NucleusShift)
+	for _, nucleus := range r.Nuclei {
+		if nucleus.Referenced {
+			shifts[nucleus.Index] = nucleus
+		}
+	}
+	return shifts
+}
+
+// WriteShiftsCSV 将平均之后的屏蔽常数和化学位移写入 csv 文件
+func (r *NMRResult) WriteShiftsCSV(fileName string) error {
+	file, err := os.Create(fileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	writer := csv.NewWriter(file)
+	_ = writer.Write([]string{"index", "element", "shielding", "shift"})
+	for _, nucleus := range r.Nuclei {
+		shift := ""
+		if nucleus.Referenced {
+			shift = strconv.FormatFloat(nucleus.Shift, 'f', 4, 64)
+		}
+		_ = writer.Write([]string{
+			strconv.Itoa(nucleus.Index),
+			nucleus.Symbol,
+			strconv.FormatFloat(nucleus.Shielding, 'f', 4, 64),
+			shift,
+		})
+	}
+	writer.Flush()
+
+	return writer.Error()
+}
+
+// SaveJSON 将 NMRResult 保存为 json 文件，方便之后的 DP4 等分析直接读取而不需要重新计算
+func (r *NMRResult) SaveJSON(fileName string) error {
+	contents, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(fileName, contents, 0644)
+}
+
+// LoadNMRResult 读取由 SaveJSON 保存的 NMRResult
+func LoadNMRResult(fileName string) (*NMRResult, error) {
+	contents, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &NMRResult{}
+	if err := json.Unmarshal(contents, result); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %w", fileName, err)
+	}
+	if len(result.Conformers) == 0 {
+		return nil, fmt.Errorf("no conformer found in %s", fileName)
+	}
+
+	return result, nil
+}
+
+// PrintNMRResult 打印每个构象的 Boltzmann 权重以及平均后的化学位移
+func (r *NMRResult) PrintNMRResult() {
+	conformers := make([]ConformerNMR, len(r.Conformers))
+	copy(conformers, r.Conformers)
+	sort.SliceStable(conformers, func(i, j int) bool {
+		return conformers[i].FreeEnergy < conformers[j].FreeEnergy
+	})
+
+	fmt.Printf("Boltzmann distribution at %.2f K:\n", r.Temperature)
+	for _, conformer := range conformers {
+		fmt.Printf(" # %s\tG = %.6f a.u.\tPopulation = %6.2f %%\n",
+			conformer.Name, conformer.FreeEnergy, conformer.Population*100)
+	}
+	fmt.Println()
+	fmt.Println("Boltzmann averaged chemical shifts (ppm):")
+	for _, nucleus := range r.Nuclei {
+		if nucleus.Referenced {
+			fmt.Printf(" # %4d %-2s\tsigma = %9.4f\tdelta = %9.4f\n",
+				nucleus.Index, nucleus.Symbol, nucleus.Shielding, nucleus.Shift)
+		}
+	}
+	fmt.Println()
+}
@@ -0,0 +1,235 @@
+package calc
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"kybnmr/utils"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+/*
+* nwchem.go
+* 该模块实现了 NWChem 程序的 Engine，可以用于 DFT 优化、振动分析、单点能以及 NMR 计算
+*
+*	1. 优化和单点能使用 NWTemplate.nw，NMR 使用 NWNMRTemplate.nw (property; shielding; end)，
+*	   模板中 geometry 块里的 [GEOMETRY] 会被替换为原子坐标
+*	2. 从 out 文件中读取最后一个 Output coordinates 的结构以及最后一个 Total DFT energy
+*	3. NWChem 不直接输出自由能热校正量，这里用 Thermal correction to Enthalpy - T * Total Entropy 计算
+*	4. 屏蔽常数从 Chemical Shielding Tensors 中每个原子的 isotropic 读取
+*
+* @Version:
+* 	NWChem: 7.2.0
+*
+* @Author: Kimariyb
+* @Address: XiaMen University
+* @Data: 2023-09-25
+ */
+
+func init() {
+	RegisterEngine("nwchem", func(config *Config) Engine {
+		return &NWChemEngine{Path: config.OptConfig.NWChemPath, Molecule: config.MoleculeConfig}
+	})
+}
+
+var (
+	nwchemEnergyRegex      = regexp.MustCompile(`Total DFT energy =\s+(-?\d+\.\d+)`)
+	nwchemEnthalpyRegex    = regexp.MustCompile(`Thermal correction to Enthalpy\s+=\s+-?\d+\.\d+ kcal/mol\s+\(\s*(-?\d+\.\d+) au\)`)
+	nwchemEntropyRegex     = regexp.MustCompile(`Total Entropy\s+=\s+(-?\d+\.\d+) cal/mol-K`)
+	nwchemTemperatureRegex = regexp.MustCompile(`Temperature\s+=\s+(\d+\.\d+)K`)
+	nwchemShieldAtomRegex  = regexp.MustCompile(`Atom:\s+(\d+)\s+([A-Za-z]+)`)
+	nwchemIsotropicRegex   = regexp.MustCompile(`isotropic\s+=\s+(-?\d+\.\d+)`)
+	nwchemGeometryRegex    = regexp.MustCompile(`(?m)^(geometry\b.*)$`)
+	nwchemDFTRegex         = regexp.MustCompile(`(?m)^(dft[ \t]*)$`)
+	nwchemChargeRegex      = regexp.MustCompile(`(?m)^([ \t]*)charge[ \t]+-?\d+`)
+	nwchemMultRegex        = regexp.MustCompile(`(?m)^([ \t]*)mult[ \t]+\d+`)
+)
+
+// NWChemEngine 调用 NWChem 的 Engine，Path 为 NWChem 的运行路径，即配置文件中的 nwchemPath，Molecule 为 [molecule] 中的电荷和自旋多重度
+type NWChemEngine struct {
+	Path     string
+	Molecule MoleculeConfig
+}
+
+// Name 返回程序的名字
+func (n *NWChemEngine) Name() string {
+	return "nwchem"
+}
+
+// TemplateFile 优化和单点能都使用 NWTemplate.nw，NMR 使用 NWNMRTemplate.nw
+func (n *NWChemEngine) TemplateFile(stage Stage) string {
+	if stage == StageNMR {
+		return "NWNMRTemplate.nw"
+	}
+	return "NWTemplate.nw"
+}
+
+// BuildInput 将模板中的 [GEOMETRY] 替换为实际的原子坐标，并设置电荷和自旋多重度：
+// 模板中已有的 charge 和 mult 会被替换，没有时在 geometry 块之前加上 charge，在 dft 块中加上 mult
+func (n *NWChemEngine) BuildInput(template string, cluster Cluster) string {
+	charge := fmt.Sprintf("charge %d", n.Molecule.Charge)
+	if nwchemChargeRegex.MatchString(template) {
+		template = nwchemChargeRegex.ReplaceAllString(template, "${1}"+charge)
+	} else {
+		template = nwchemGeometryRegex.ReplaceAllString(template, charge+"\n\n$1")
+	}
+
+	mult := fmt.Sprintf("mult %d", n.Molecule.Multiplicity)
+	if nwchemMultRegex.MatchString(template) {
+		template = nwchemMultRegex.ReplaceAllString(template, "${1}"+mult)
+	} else {
+		template = nwchemDFTRegex.ReplaceAllString(template, "$1\n  "+mult)
+	}
+
+	return replaceGeometry(template, cluster)
+}
+
+// CommandLine 返回 nwchem input.nw > output.out
+func (n *NWChemEngine) CommandLine(stage Stage, inputFile string, outFile string) string {
+	return fmt.Sprintf("%s %s > %s", n.Path, inputFile, outFile)
+}
+
+// Run 在输入文件所在的文件夹中运行 NWChem，NWChem 生成的 db、movecs 等文件也会留在这个文件夹中
+func (n *NWChemEngine) Run(ctx context.Context, stage Stage, inputFile string, outFile string) error {
+	inputPath, outPath, err := absPaths(inputFile, outFile)
+	if err != nil {
+		return err
+	}
+	return runShellCommandIn(ctx, n.JobDir(inputPath, outPath), n.CommandLine(stage, inputPath, outPath), JobLogFile(outPath))
+}
+
+// JobDir 在输入文件所在的文件夹中运行
+func (n *NWChemEngine) JobDir(inputFile string, outFile string) string {
+	return filepath.Dir(inputFile)
+}
+
+// ParseGeometry 读取 NWChem out 文件中最后一个 Output coordinates in angstroms 块
+//
+//	 No.       Tag          Charge          X              Y              Z
+//	---- ---------------- ---------- -------------- -------------- --------------
+//	   1 O                    8.0000     0.00000000     0.00000000     0.11726921
+func (n *NWChemEngine) ParseGeometry(outFile string) (Cluster, error) {
+	if !utils.CheckFileType(outFile, ".out") {
+		return Cluster{}, fmt.Errorf("error the format of input file")
+	}
+
+	contents, err := ioutil.ReadFile(outFile)
+	if err != nil {
+		return Cluster{}, err
+	}
+	lines := strings.Split(string(contents), "\n")
+
+	start := -1
+	for i, line := range lines {
+		if strings.Contains(line, "Output coordinates in angstroms") {
+			start = i
+		}
+	}
+	if start < 0 {
+		return Cluster{}, fmt.Errorf("no geometry found in %s", outFile)
+	}
+
+	var cluster Cluster
+	dashes := false
+	for _, line := range lines[start+1:] {
+		fields := strings.Fields(line)
+		if !dashes {
+			dashes = strings.HasPrefix(strings.TrimSpace(line), "----")
+			continue
+		}
+		if len(fields) != 6 {
+			break
+		}
+		atom, err := parseAtomFields(fields[1], fields[3:6])
+		if err != nil {
+			return Cluster{}, fmt.Errorf("%s: %w", outFile, err)
+		}
+		cluster.Atoms = append(cluster.Atoms, atom)
+	}
+	if len(cluster.Atoms) == 0 {
+		return Cluster{}, fmt.Errorf("no atom found in the last geometry of %s", outFile)
+	}
+
+	cluster.Energy, err = n.ParseEnergy(outFile)
+	return cluster, err
+}
+
+// ParseEnergy 读取最后一个 Total DFT energy =     -76.419737927049
+func (n *NWChemEngine) ParseEnergy(outFile string) (float64, error) {
+	return findLastFloat(outFile, nwchemEnergyRegex)
+}
+
+// ParseGibbsCorrection 根据振动分析的结果计算自由能热校正量 G = H - TS，单位为 Hartree
+//
+//	Temperature                      =   298.15K
+//	Thermal correction to Enthalpy   =   15.844 kcal/mol  (  0.025248 au)
+//	Total Entropy                    =   44.911 cal/mol-K
+func (n *NWChemEngine) ParseGibbsCorrection(outFile string) (float64, error) {
+	enthalpy, err := findLastFloat(outFile, nwchemEnthalpyRegex)
+	if err != nil {
+		return 0, err
+	}
+	entropy, err := findLastFloat(outFile, nwchemEntropyRegex)
+	if err != nil {
+		return 0, err
+	}
+	temperature, err := findLastFloat(outFile, nwchemTemperatureRegex)
+	if err != nil {
+		return 0, err
+	}
+
+	return enthalpy - temperature*entropy/1000/HartreeToKcal, nil
+}
+
+// ParseShieldings 读取最后一个 Chemical Shielding Tensors 块中每个原子的各向同性屏蔽常数
+//
+//	Atom:    1  C
+//	...
+//	isotropic =     52.2453
+func (n *NWChemEngine) ParseShieldings(outFile string) ([]NucleusShielding, error) {
+	contents, err := ioutil.ReadFile(outFile)
+	if err != nil {
+		return nil, err
+	}
+
+	var shieldings []NucleusShielding
+	var current *NucleusShielding
+	for _, line := range strings.Split(string(contents), "\n") {
+		if strings.Contains(line, "Chemical Shielding Tensors") {
+			// 只保留最后一个 property 任务的结果
+			shieldings = nil
+			current = nil
+			continue
+		}
+		if match := nwchemShieldAtomRegex.FindStringSubmatch(line); match != nil {
+			index, _ := strconv.Atoi(match[1])
+			current = &NucleusShielding{Index: index, Symbol: normalizeSymbol(match[2])}
+			continue
+		}
+		if match := nwchemIsotropicRegex.FindStringSubmatch(line); match != nil && current != nil {
+			current.Isotropic, err = strconv.ParseFloat(match[1], 64)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", outFile, err)
+			}
+			shieldings = append(shieldings, *current)
+			current = nil
+		}
+	}
+	if len(shieldings) == 0 {
+		return nil, fmt.Errorf("no shielding found in %s", outFile)
+	}
+
+	return shieldings, nil
+}
+
+// IsNormalTermination 判断 out 文件中是否有 Total times 的统计，NWChem 只有正常结束时才会输出这一行
+func (n *NWChemEngine) IsNormalTermination(outFile string) bool {
+	contents, err := ioutil.ReadFile(outFile)
+	if err != nil {
+		return false
+	}
+	return strings.Contains(string(contents), "Total times  cpu:")
+}
@@ -0,0 +1,142 @@
+package calc
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestNWChemParseEnergy(t *testing.T) {
+	tests := []struct {
+		file    string
+		want    float64
+		wantErr bool
+	}{
+		// 优化中有多个 Total DFT energy，使用最后一个
+		{"nwchem-optfreq.out", -76.419737927049, false},
+		{"nwchem-nmr.out", -114.508342213961, false},
+		{"nwchem-failed.out", 0, true},
+	}
+	engine := &NWChemEngine{}
+	for _, test := range tests {
+		t.Run(test.file, func(t *testing.T) {
+			energy, err := engine.ParseEnergy(filepath.Join("testdata", test.file))
+			if (err != nil) != test.wantErr {
+				t.Fatalf("ParseEnergy error = %v, wantErr %v", err, test.wantErr)
+			}
+			if !test.wantErr && !approxEqual(energy, test.want, 1e-10) {
+				t.Errorf("ParseEnergy = %.10f, want %.10f", energy, test.want)
+			}
+		})
+	}
+}
+
+func TestNWChemParseGeometry(t *testing.T) {
+	tests := []struct {
+		file       string
+		want       []Atom
+		wantEnergy float64
+		wantErr    bool
+	}{
+		// 优化之后的最后一个结构
+		{"nwchem-optfreq.out", []Atom{
+			{"O", 0, 0, 0.11726921},
+			{"H", 0.75933254, 0, -0.46907685},
+			{"H", -0.75933254, 0, -0.46907685},
+		}, -76.419737927049, false},
+		{"nwchem-nmr.out", []Atom{
+			{"C", 0, 0, -0.53037823},
+			{"O", 0, 0, 0.67514462},
+			{"H", 0.94088232, 0, -1.11237829},
+			{"H", -0.94088232, 0, -1.11237829},
+		}, -114.508342213961, false},
+		// 有结构但是没有能量
+		{"nwchem-failed.out", nil, 0, true},
+	}
+	engine := &NWChemEngine{}
+	for _, test := range tests {
+		t.Run(test.file, func(t *testing.T) {
+			cluster, err := engine.ParseGeometry(filepath.Join("testdata", test.file))
+			if (err != nil) != test.wantErr {
+				t.Fatalf("ParseGeometry error = %v, wantErr %v", err, test.wantErr)
+			}
+			if test.wantErr {
+				return
+			}
+			checkAtoms(t, cluster, test.want)
+			if !approxEqual(cluster.Energy, test.wantEnergy, 1e-10) {
+				t.Errorf("energy = %.10f, want %.10f", cluster.Energy, test.wantEnergy)
+			}
+		})
+	}
+}
+
+func TestNWChemParseGibbsCorrection(t *testing.T) {
+	tests := []struct {
+		file    string
+		want    float64
+		wantErr bool
+	}{
+		// G = H - TS = 0.025263 - 298.15 * 45.115 / 1000 / 627.5095
+		{"nwchem-optfreq.out", 0.0038274086, false},
+		{"nwchem-nmr.out", 0, true},
+	}
+	engine := &NWChemEngine{}
+	for _, test := range tests {
+		t.Run(test.file, func(t *testing.T) {
+			correction, err := engine.ParseGibbsCorrection(filepath.Join("testdata", test.file))
+			if (err != nil) != test.wantErr {
+				t.Fatalf("ParseGibbsCorrection error = %v, wantErr %v", err, test.wantErr)
+			}
+			if !test.wantErr && !approxEqual(correction, test.want, 1e-9) {
+				t.Errorf("ParseGibbsCorrection = %.10f, want %.10f", correction, test.want)
+			}
+		})
+	}
+}
+
+func TestNWChemParseShieldings(t *testing.T) {
+	tests := []struct {
+		file    string
+		want    []NucleusShielding
+		wantErr bool
+	}{
+		{"nwchem-nmr.out", []NucleusShielding{
+			{Index: 1, Symbol: "C", Isotropic: 68.8364},
+			{Index: 2, Symbol: "O", Isotropic: -159.1918},
+			{Index: 3, Symbol: "H", Isotropic: 23.7230},
+			{Index: 4, Symbol: "H", Isotropic: 23.7230},
+		}, false},
+		{"nwchem-optfreq.out", nil, true},
+	}
+	engine := &NWChemEngine{}
+	for _, test := range tests {
+		t.Run(test.file, func(t *testing.T) {
+			shieldings, err := engine.ParseShieldings(filepath.Join("testdata", test.file))
+			if (err != nil) != test.wantErr {
+				t.Fatalf("ParseShieldings error = %v, wantErr %v", err, test.wantErr)
+			}
+			if len(shieldings) != len(test.want) {
+				t.Fatalf("got %d shieldings, want %d", len(shieldings), len(test.want))
+			}
+			for i, shielding := range shieldings {
+				if shielding != test.want[i] {
+					t.Errorf("shielding %d: got %+v, want %+v", i+1, shielding, test.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestNWChemIsNormalTermination(t *testing.T) {
+	tests := map[string]bool{
+		"nwchem-optfreq.out": true,
+		"nwchem-nmr.out":     true,
+		"nwchem-failed.out":  false,
+	}
+	engine := &NWChemEngine{}
+	for file, want := range tests {
+		if got := engine.IsNormalTermination(filepath.Join("testdata", file)); got != want {
+			t.Errorf("IsNormalTermination(%s) = %v, want %v", file, got, want)
+		}
+	}
+}
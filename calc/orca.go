@@ -0,0 +1,273 @@
+package calc
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"kybnmr/utils"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+/*
+* orca.go
+* 该模块实现了 Orca 程序的 Engine，包括生成输入文件、运行 Orca，
+* 以及读取 Orca out 文件中的结构、能量、自由能热校正量和 NMR 屏蔽常数
+*
+* @Version:
+*	Orca: 5.0.4
+*
+* @Author: Kimariyb
+* @Address: XiaMen University
+* @Data: 2023-09-24
+ */
+
+func init() {
+	RegisterEngine("orca", func(config *Config) Engine {
+		return &OrcaEngine{Path: config.OptConfig.OrcaPath, Molecule: config.MoleculeConfig, Solvent: config.SolventConfig}
+	})
+}
+
+// OrcaEngine 调用 Orca 的 Engine，Path 为 Orca 的运行路径，即配置文件中的 orcaPath，Molecule 为 [molecule] 中的电荷和自旋多重度，Solvent 为 [solvent] 中的溶剂
+// 并行运行 Orca 时必须使用完整的路径
+type OrcaEngine struct {
+	Path     string
+	Molecule MoleculeConfig
+	Solvent  SolventConfig
+}
+
+// Name 返回程序的名字
+func (o *OrcaEngine) Name() string {
+	return "orca"
+}
+
+// TemplateFile 优化和单点能都使用 OrcaTemplate.inp，NMR 使用 OrcaNMRTemplate.inp
+func (o *OrcaEngine) TemplateFile(stage Stage) string {
+	if stage == StageNMR {
+		return "OrcaNMRTemplate.inp"
+	}
+	return "OrcaTemplate.inp"
+}
+
+// BuildInput 将模板中的 [GEOMETRY] 替换为实际的原子坐标，并将电荷和自旋多重度以及溶剂替换为 Molecule 和 Solvent 中的值
+func (o *OrcaEngine) BuildInput(template string, cluster Cluster) string {
+	return replaceGeometry(o.Solvent.applyOrcaSolvent(replaceChargeLine(template, o.Molecule)), cluster)
+}
+
+// CheckSolvent 检查 Orca 是否支持 solvent 中的溶剂和溶剂模型
+func (o *OrcaEngine) CheckSolvent(solvent *SolventConfig) error {
+	_, _, err := solvent.orcaSolventInput()
+	return err
+}
+
+// CommandLine 返回 orca input.inp > output.out
+func (o *OrcaEngine) CommandLine(stage Stage, inputFile string, outFile string) string {
+	return fmt.Sprintf("%s %s > %s", o.Path, inputFile, outFile)
+}
+
+// Run 运行 Orca
+func (o *OrcaEngine) Run(ctx context.Context, stage Stage, inputFile string, outFile string) error {
+	return runShellCommand(ctx, o.CommandLine(stage, inputFile, outFile), JobLogFile(outFile))
+}
+
+// ParseGeometry 读取 Orca out 文件中最后一个 CARTESIAN COORDINATES (ANGSTROEM) 的结构
+//
+//	---------------------------------
+//	CARTESIAN COORDINATES (ANGSTROEM)
+//	---------------------------------
+//	  C     -0.709011    0.000000    0.000000
+//	  H     -1.290150    0.924871    0.000000
+func (o *OrcaEngine) ParseGeometry(outFile string) (Cluster, error) {
+	if !utils.CheckFileType(outFile, ".out") {
+		return Cluster{}, fmt.Errorf("error the format of input file")
+	}
+
+	file, err := os.Open(outFile)
+	if err != nil {
+		return Cluster{}, err
+	}
+	defer file.Close()
+
+	var atoms []Atom
+	inBlock := false
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.Contains(line, "CARTESIAN COORDINATES (ANGSTROEM)") {
+			// 跳过表格线，并清空上一帧的结构
+			scanner.Scan()
+			atoms = nil
+			inBlock = true
+			continue
+		}
+		if !inBlock {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 4 {
+			inBlock = false
+			continue
+		}
+		x, errX := strconv.ParseFloat(fields[1], 64)
+		y, errY := strconv.ParseFloat(fields[2], 64)
+		z, errZ := strconv.ParseFloat(fields[3], 64)
+		if errX != nil || errY != nil || errZ != nil {
+			return Cluster{}, fmt.Errorf("unable to resolve coordinates: %s", line)
+		}
+		atoms = append(atoms, Atom{Symbol: fields[0], X: x, Y: y, Z: z})
+	}
+
+	if err := scanner.Err(); err != nil {
+		return Cluster{}, fmt.Errorf("error while reading file: %v", err)
+	}
+	if len(atoms) == 0 {
+		return Cluster{}, fmt.Errorf("no cartesian coordinates found in %s", outFile)
+	}
+
+	return Cluster{Atoms: atoms, Energy: 0}, nil
+}
+
+// ParseEnergy 读取 Orca out 文件中最后一个 FINAL SINGLE POINT ENERGY
+func (o *OrcaEngine) ParseEnergy(outFile string) (float64, error) {
+	contents, err := ioutil.ReadFile(outFile)
+	if err != nil {
+		return 0, err
+	}
+	energy, err := parseOrcaSinglePoint(string(contents))
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", outFile, err)
+	}
+	return strconv.ParseFloat(energy, 64)
+}
+
+// ParseGibbsCorrection 读取 G-E(el)                           ...      0.12345678 Eh     77.47 kcal/mol
+func (o *OrcaEngine) ParseGibbsCorrection(outFile string) (float64, error) {
+	return findLastFloat(outFile, regexp.MustCompile(`G-E\(el\)\s+\.*\s+(-?\d+\.\d+)\s+Eh`))
+}
+
+// ParseShieldings 读取 Orca out 文件中的 CHEMICAL SHIELDING SUMMARY
+func (o *OrcaEngine) ParseShieldings(outFile string) ([]NucleusShielding, error) {
+	return parseOrcaShielding(outFile)
+}
+
+// IsNormalTermination 判断 out 文件中是否存在 ****ORCA TERMINATED NORMALLY****
+func (o *OrcaEngine) IsNormalTermination(outFile string) bool {
+	contents, err := ioutil.ReadFile(outFile)
+	if err != nil {
+		return false
+	}
+	return strings.Contains(string(contents), "ORCA TERMINATED NORMALLY")
+}
+
+// ORCA out 文件中的优化步数和 SCF 迭代，SCF 迭代为 SCF ITERATIONS 之后以迭代数和能量开头的行
+var (
+	orcaCycleRegex = regexp.MustCompile(`GEOMETRY OPTIMIZATION CYCLE\s+(\d+)`)
+	orcaIterRegex  = regexp.MustCompile(`(?m)^\s*(\d+)\s+-\d+\.\d+\s`)
+	orcaFinalRegex = regexp.MustCompile(`FINAL SINGLE POINT ENERGY\s+(-?\d+\.\d+)`)
+)
+
+// JobProgress 读取正在运行的 ORCA out 文件的末尾，返回当前的优化步数和 SCF 迭代数，如 step 7, SCF cycle 12
+func (o *OrcaEngine) JobProgress(outFile string) string {
+	contents := tailFile(outFile, progressTail)
+	var parts []string
+	if cycle := lastSubmatches(contents, orcaCycleRegex); cycle != nil {
+		parts = append(parts, "step "+cycle[1])
+	}
+	if start := strings.LastIndex(contents, "SCF ITERATIONS"); start >= 0 {
+		if iteration := lastSubmatches(contents[start:], orcaIterRegex); iteration != nil {
+			parts = append(parts, "SCF cycle "+iteration[1])
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// LatestEnergy 读取正在运行的 ORCA out 文件中最后一个 FINAL SINGLE POINT ENERGY，优化中每一步都会输出
+func (o *OrcaEngine) LatestEnergy(outFile string) (float64, error) {
+	energy := lastSubmatches(tailFile(outFile, progressTail), orcaFinalRegex)
+	if energy == nil {
+		return 0, fmt.Errorf("no single point energy found in %s", outFile)
+	}
+	return strconv.ParseFloat(energy[1], 64)
+}
+
+// parseOrcaSinglePoint 从 Orca 的 out 文件内容中读取最后一个 FINAL SINGLE POINT ENERGY
+func parseOrcaSinglePoint(contents string) (string, error) {
+	// 使用正则表达式搜索 orca 单点能
+	energyRegex := regexp.MustCompile(`FINAL SINGLE POINT ENERGY\s+(-?\d+\.\d+)`)
+
+	// 查找文件中最后一个匹配项的能量值
+	matches := energyRegex.FindAllStringSubmatch(contents, -1)
+	if len(matches) == 0 {
+		return "", fmt.Errorf("no energy found")
+	}
+
+	return matches[len(matches)-1][1], nil
+}
+
+// parseOrcaShielding 读取 Orca 的 NMR 输出，格式如下：
+//
+//	CHEMICAL SHIELDING SUMMARY (ppm)
+//	--------------------------
+//
+//	  Nucleus  Element    Isotropic     Anisotropy
+//	  -------  -------  ------------   ------------
+//	      0       C          52.885        123.005
+//
+// Orca 的原子序号从 0 开始，这里统一转化为从 1 开始
+func parseOrcaShielding(filePath string) ([]NucleusShielding, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	rowRegex := regexp.MustCompile(`^\s*(\d+)\s+([A-Za-z]+)\s+(-?\d+\.\d+)\s+(-?\d+\.\d+)`)
+
+	var shieldings []NucleusShielding
+	inSummary := false
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.Contains(line, "CHEMICAL SHIELDING SUMMARY") {
+			shieldings = shieldings[:0]
+			inSummary = true
+			continue
+		}
+		if !inSummary {
+			continue
+		}
+
+		match := rowRegex.FindStringSubmatch(line)
+		if match == nil {
+			// 表格结束之后遇到的第一行非数据行即退出表格
+			if len(shieldings) > 0 && strings.TrimSpace(line) == "" {
+				inSummary = false
+			}
+			continue
+		}
+		index, _ := strconv.Atoi(match[1])
+		isotropic, err := strconv.ParseFloat(match[3], 64)
+		if err != nil {
+			return nil, fmt.Errorf("unable to resolve isotropic shielding: %s", match[3])
+		}
+		shieldings = append(shieldings, NucleusShielding{
+			Index:     index + 1,
+			Symbol:    match[2],
+			Isotropic: isotropic,
+		})
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error while reading file: %v", err)
+	}
+
+	if len(shieldings) == 0 {
+		return nil, fmt.Errorf("no shielding summary found in %s", filePath)
+	}
+
+	return shieldings, nil
+}
@@ -0,0 +1,194 @@
+package calc
+
+import (
+	"fmt"
+	"kybnmr/utils"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+/*
+* preset.go
+* 该模块定义了常用 NMR 计算方案的内置模板 (preset)
+*
+*	每一个 preset 为 Gaussian 和 Orca 提供优化、单点能和 NMR 三个步骤的模板，
+*	在配置文件的 [optimized] preset 中写上 preset 的名字即可使用，不需要再复制模板文件：
+*		1. 启动目录中存在 <preset>-<stage>.<后缀> 文件（如 kybnmr init 写入的 b3lyp-mpw1pw91-nmr.gjf）时，使用该文件
+*		2. 启动目录中存在某一步骤的模板文件（如 GauTemplate.gjf）时，仍然使用该模板文件
+*		3. 否则使用 preset 中该程序在该步骤的模板，写入工作目录中的 <preset>-<stage>.<后缀> 文件
+*	preset 的模板使用 template.go 中的占位符，电荷、自旋多重度、核数和内存都来自配置文件，
+*	溶剂由 [solvent] 加上。有些方法某一个程序没有（如 Gaussian 没有 r2SCAN-3c），
+*	该程序在对应的步骤中不能使用这个 preset，需要自己提供模板文件
+*
+*	kybnmr templates list 列出所有的 preset，kybnmr templates show <preset> 输出 preset 的模板
+*
+* @Author: Kimariyb
+* @Address: XiaMen University
+* @Data: 2023-09-26
+ */
+
+// Preset 一个内置的计算方案
+//   - Name: 名字，即 [optimized] preset 中的值
+//   - Description: 每一个步骤使用的方法
+//   - Templates: 程序名到每一个步骤的模板内容的映射
+type Preset struct {
+	Name        string
+	Description string
+	Templates   map[string]map[Stage]string
+}
+
+// gaussianPreset 返回路由行为 route 的 Gaussian 模板
+func gaussianPreset(route string) string {
+	return "%nprocshared={{.NProcs}}\n%mem={{.Memory}}MB\n" + route +
+		"\n\n{{.Title}}\n\n{{.Charge}} {{.Multiplicity}}\n[GEOMETRY]\n"
+}
+
+// orcaPreset 返回关键词行为 keywords 的 Orca 模板
+func orcaPreset(keywords string) string {
+	return keywords + " noautostart miniprint nopop\n%maxcore {{.MaxCore}}\n%pal nprocs {{.NProcs}} end\n" +
+		"* xyz {{.Charge}} {{.Multiplicity}}\n[GEOMETRY]\n*\n"
+}
+
+// builtinPresets 所有内置的 preset
+var builtinPresets = []Preset{
+	{
+		Name:        "r2scan3c-wb97xd",
+		Description: "r2SCAN-3c opt + wB97X-D/def2-TZVP SP + wB97X-D/def2-SVP GIAO NMR",
+		Templates: map[string]map[Stage]string{
+			"orca": {
+				StageOpt: orcaPreset("! r2SCAN-3c Opt Freq tightSCF"),
+				StageSP:  orcaPreset("! wB97X-D3 def2-TZVP def2/J RIJCOSX tightSCF"),
+				StageNMR: orcaPreset("! wB97X-D3 def2-SVP def2/J RIJCOSX tightSCF NMR"),
+			},
+			"gaussian": {
+				StageSP:  gaussianPreset("# wb97xd/def2tzvp int=fine"),
+				StageNMR: gaussianPreset("# nmr=giao wb97xd/def2svp int=fine"),
+			},
+		},
+	},
+	{
+		Name:        "b3lyp-mpw1pw91",
+		Description: "B3LYP-D3/6-31G(d) opt + B3LYP-D3/6-311+G(2d,p) SP + mPW1PW91/6-311+G(2d,p) GIAO NMR",
+		Templates: map[string]map[Stage]string{
+			"gaussian": {
+				StageOpt: gaussianPreset("# opt freq b3lyp/6-31g(d) em=gd3 int=fine"),
+				StageSP:  gaussianPreset("# b3lyp/6-311+g(2d,p) em=gd3 int=fine"),
+				StageNMR: gaussianPreset("# nmr=giao mpw1pw91/6-311+g(2d,p)"),
+			},
+			"orca": {
+				StageOpt: orcaPreset("! B3LYP D3ZERO 6-31G(d) Opt Freq tightSCF"),
+				StageSP:  orcaPreset("! B3LYP D3ZERO 6-311+G(2d,p) tightSCF"),
+				StageNMR: orcaPreset("! mPW1PW 6-311+G(2d,p) tightSCF NMR"),
+			},
+		},
+	},
+	{
+		Name:        "pwpb95",
+		Description: "B3LYP-D3(BJ)/def2-SVP opt + PWPB95-D3/def2-TZVPP SP + PBE0/def2-TZVP NMR, SP and NMR as in the shipped ORCA templates",
+		Templates: map[string]map[Stage]string{
+			"orca": {
+				StageOpt: orcaPreset("! B3LYP D3BJ def2-SVP def2/J RIJCOSX Opt Freq tightSCF"),
+				StageSP:  orcaPreset("! PWPB95 D3 def2-TZVPP def2/J def2-TZVPP/C RIJCOSX tightSCF"),
+				StageNMR: orcaPreset("! PBE0 def2-TZVP def2/J RIJCOSX tightSCF NMR"),
+			},
+			"gaussian": {
+				StageOpt: gaussianPreset("# opt freq b3lyp/def2svp em=gd3bj int=fine"),
+				StageNMR: gaussianPreset("# nmr=giao pbe1pbe/def2tzvp"),
+			},
+		},
+	},
+}
+
+// Presets 返回所有内置的 preset，按照名字排序
+func Presets() []Preset {
+	presets := append([]Preset(nil), builtinPresets...)
+	sort.Slice(presets, func(i, j int) bool { return presets[i].Name < presets[j].Name })
+	return presets
+}
+
+// PresetNames 返回所有内置的 preset 的名字
+func PresetNames() []string {
+	var names []string
+	for _, preset := range Presets() {
+		names = append(names, preset.Name)
+	}
+	return names
+}
+
+// LookupPreset 根据名字返回内置的 preset，name 不区分大小写
+func LookupPreset(name string) (*Preset, error) {
+	for i := range builtinPresets {
+		if strings.EqualFold(builtinPresets[i].Name, name) {
+			return &builtinPresets[i], nil
+		}
+	}
+	return nil, fmt.Errorf("unknown preset: %s (available: %s)", name, strings.Join(PresetNames(), ", "))
+}
+
+// Engines 返回 preset 提供模板的所有程序名
+func (p *Preset) Engines() []string {
+	var engines []string
+	for engine := range p.Templates {
+		engines = append(engines, engine)
+	}
+	sort.Strings(engines)
+	return engines
+}
+
+// Template 返回 preset 中程序 engine 在 stage 步骤的模板
+func (p *Preset) Template(engine string, stage Stage) (string, bool) {
+	template, ok := p.Templates[strings.ToLower(engine)][stage]
+	return template, ok
+}
+
+// presetAlias 使用其他程序的模板的 Engine 实现该接口，例如 FakeEngine 使用 Gaussian 的模板
+type presetAlias interface {
+	PresetEngine() string
+}
+
+// StageTemplate 一个步骤使用的模板
+//   - File: 模板文件名
+//   - Content: 不为空时为 preset 中的模板内容，需要先写入 File
+type StageTemplate struct {
+	File    string
+	Content string
+}
+
+// PresetTemplateFile 返回 preset 在 stage 步骤的模板文件名 <preset>-<stage>.<后缀>，ext 为程序模板文件的后缀
+func PresetTemplateFile(preset string, stage Stage, ext string) string {
+	return fmt.Sprintf("%s-%s%s", preset, stage, ext)
+}
+
+// ResolveTemplate 返回 engine 在 stage 步骤使用的模板：没有设置 preset 时使用 engine 的模板文件，
+// 否则依次使用启动目录中的 <preset>-<stage>.<后缀>、engine 的模板文件和 preset 中的模板。不需要模板的 Engine 返回空的 StageTemplate
+func ResolveTemplate(engine Engine, stage Stage, presetName string) (StageTemplate, error) {
+	templateFile := engine.TemplateFile(stage)
+	if templateFile == "" {
+		return StageTemplate{}, nil
+	}
+	if presetName == "" {
+		return StageTemplate{File: templateFile}, nil
+	}
+	preset, err := LookupPreset(presetName)
+	if err != nil {
+		return StageTemplate{}, err
+	}
+	presetFile := PresetTemplateFile(preset.Name, stage, filepath.Ext(templateFile))
+	for _, file := range []string{presetFile, templateFile} {
+		if exist, _ := utils.CheckFileCurrentExist(file); exist {
+			return StageTemplate{File: file}, nil
+		}
+	}
+
+	engineName := engine.Name()
+	if alias, ok := engine.(presetAlias); ok {
+		engineName = alias.PresetEngine()
+	}
+	content, ok := preset.Template(engineName, stage)
+	if !ok {
+		return StageTemplate{}, fmt.Errorf("preset %s has no %s template for the %s step, please provide %s", preset.Name, engineName, stage, templateFile)
+	}
+
+	return StageTemplate{File: presetFile, Content: content}, nil
+}
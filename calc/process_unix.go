@@ -0,0 +1,31 @@
+//go:build !windows
+
+package calc
+
+import (
+	"context"
+	"os/exec"
+	"syscall"
+)
+
+/*
+* process_unix.go
+* 在 Linux/macOS 上，外部程序运行在单独的进程组中，取消时杀死整个进程组，
+* 这样 bash -c 启动的 Gaussian/Orca 以及它们的子进程 (如 l502.exe、orca_scf_mpi) 都会被一起结束
+*
+* @Author: Kimariyb
+* @Address: XiaMen University
+* @Data: 2023-09-26
+ */
+
+// commandContext 创建一个在 ctx 被取消或者超时时杀死整个进程组的命令
+func commandContext(ctx context.Context, name string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		// 进程组号等于组长的进程号，负数表示向整个进程组发送信号
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	cmd.WaitDelay = processWaitDelay
+	return cmd
+}
@@ -0,0 +1,24 @@
+//go:build windows
+
+package calc
+
+import (
+	"context"
+	"os/exec"
+)
+
+/*
+* process_windows.go
+* Windows 上没有进程组，取消时只能结束直接启动的进程
+*
+* @Author: Kimariyb
+* @Address: XiaMen University
+* @Data: 2023-09-26
+ */
+
+// commandContext 创建一个在 ctx 被取消或者超时时结束的命令
+func commandContext(ctx context.Context, name string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.WaitDelay = processWaitDelay
+	return cmd
+}
@@ -0,0 +1,154 @@
+package calc
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+/*
+* programs.go
+* 该模块用来查找 KYBNMR 用到的外部程序，并读取它们的版本号
+*
+*	xtb、crest: 运行 --version，读取 "xtb version 6.6.1" 或者 "Version 2.12"
+*	gaussian: 没有输出版本号的参数，从同一目录下 l1.exe 中的 "G16RevC.01" 读取修订版本 C.01
+*	orca: 没有输出版本号的参数，从安装路径（如 orca-5.0.4/orca 或者 orca_5_0_4）读取版本号
+*	shermo、multiwfn: 运行时会输出 "Version 2.6" 的标题
+*	mpirun: ORCA 并行计算需要的 MPI，运行 --version
+*	读取版本号失败时版本号为空，不影响程序的查找
+*
+*	SupportedVersions 为 README 中列出的经过测试的版本，kybnmr doctor 用它检查找到的版本
+*
+* @Author: Kimariyb
+* @Address: XiaMen University
+* @Data: 2023-09-26
+ */
+
+// versionTimeout 读取版本号时外部程序的最长运行时间
+const versionTimeout = 10 * time.Second
+
+// programSpec 一个外部程序的查找方式
+//   - Name: 程序名
+//   - Commands: 在 PATH 中依次查找的命令名
+//   - VersionArgs: 输出版本号的参数，为 nil 时不运行程序
+//   - VersionFile: 不为空时从可执行文件所在目录中的该文件读取版本号
+//   - VersionRegex: 从程序输出（VersionArgs 为 nil 时从 VersionFile 或者路径）中读取版本号的正则表达式
+type programSpec struct {
+	Name         string
+	Commands     []string
+	VersionArgs  []string
+	VersionFile  string
+	VersionRegex *regexp.Regexp
+}
+
+// programSpecs KYBNMR 用到的所有外部程序
+var programSpecs = []programSpec{
+	{Name: "xtb", Commands: []string{"xtb"}, VersionArgs: []string{"--version"}, VersionRegex: regexp.MustCompile(`xtb version (\d[\w.]*)`)},
+	{Name: "crest", Commands: []string{"crest"}, VersionArgs: []string{"--version"}, VersionRegex: regexp.MustCompile(`(?i)version (\d[\w.]*)`)},
+	{Name: "gaussian", Commands: []string{"g16", "g09"}, VersionFile: "l1.exe", VersionRegex: regexp.MustCompile(`G\d\dRev([A-Z]\.\d\d)`)},
+	{Name: "orca", Commands: []string{"orca"}, VersionRegex: regexp.MustCompile(`orca[-_](\d+[._]\d+[._]\d+)`)},
+	{Name: "shermo", Commands: []string{"Shermo", "shermo"}, VersionArgs: []string{}, VersionRegex: regexp.MustCompile(`(?i)version (\d[\w.]*)`)},
+	{Name: "multiwfn", Commands: []string{"Multiwfn", "multiwfn"}, VersionArgs: []string{}, VersionRegex: regexp.MustCompile(`(?i)version (\d+\.\d+)`)},
+	{Name: "mpirun", Commands: []string{"mpirun"}, VersionArgs: []string{"--version"}, VersionRegex: regexp.MustCompile(`(\d+\.\d+[\d.]*)`)},
+}
+
+// SupportedVersions README 中列出的经过测试的版本
+var SupportedVersions = map[string][]string{
+	"xtb":      {"6.6.0"},
+	"crest":    {"2.12"},
+	"gaussian": {"C.01", "A.03"},
+	"orca":     {"5.0.4"},
+	"shermo":   {"2.4.0"},
+	"multiwfn": {"3.8"},
+}
+
+// ProgramInfo 找到的外部程序
+//   - Name: 程序名，如 xtb
+//   - Path: 可执行文件的路径，没有找到时为空
+//   - Version: 版本号，读取失败时为空
+type ProgramInfo struct {
+	Name    string `json:"name"`
+	Path    string `json:"path"`
+	Version string `json:"version"`
+}
+
+// Found 判断程序是否找到
+func (p ProgramInfo) Found() bool {
+	return p.Path != ""
+}
+
+// Supported 判断程序的版本是否在 SupportedVersions 中，没有列出版本的程序总是返回 true
+func (p ProgramInfo) Supported() bool {
+	versions, ok := SupportedVersions[p.Name]
+	if !ok {
+		return true
+	}
+	for _, version := range versions {
+		if p.Version == version {
+			return true
+		}
+	}
+	return false
+}
+
+// lookupProgramSpec 根据程序名返回 programSpec
+func lookupProgramSpec(name string) (programSpec, bool) {
+	for _, spec := range programSpecs {
+		if spec.Name == name {
+			return spec, true
+		}
+	}
+	return programSpec{}, false
+}
+
+// FindProgram 在 PATH 中查找程序 name，并读取版本号
+func FindProgram(ctx context.Context, name string) ProgramInfo {
+	info := ProgramInfo{Name: name}
+	spec, ok := lookupProgramSpec(name)
+	if !ok {
+		return info
+	}
+	for _, command := range spec.Commands {
+		if path, err := exec.LookPath(command); err == nil {
+			return InspectProgram(ctx, name, path)
+		}
+	}
+	return info
+}
+
+// InspectProgram 检查程序 name 在 path 处是否可以执行，并读取版本号，path 可以是 PATH 中的命令名
+func InspectProgram(ctx context.Context, name string, path string) ProgramInfo {
+	info := ProgramInfo{Name: name}
+	resolved, err := exec.LookPath(path)
+	if err != nil {
+		return info
+	}
+	info.Path = resolved
+
+	spec, ok := lookupProgramSpec(name)
+	if !ok {
+		return info
+	}
+	text := resolved
+	if realPath, err := filepath.EvalSymlinks(resolved); err == nil {
+		text = realPath
+	}
+	if spec.VersionFile != "" {
+		contents, _ := os.ReadFile(filepath.Join(filepath.Dir(text), spec.VersionFile))
+		text = string(contents)
+	} else if spec.VersionArgs != nil {
+		versionCtx, cancel := context.WithTimeout(ctx, versionTimeout)
+		defer cancel()
+		// 没有标准输入，等待输入的程序（如 Shermo）会直接结束
+		output, _ := commandContext(versionCtx, resolved, spec.VersionArgs...).CombinedOutput()
+		text = string(output)
+	}
+	if match := spec.VersionRegex.FindStringSubmatch(text); match != nil {
+		info.Version = strings.ReplaceAll(match[1], "_", ".")
+	}
+	return info
+}
@@ -0,0 +1,273 @@
+package calc
+
+import (
+	"fmt"
+	"io"
+	"kybnmr/utils"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+* progress.go
+* 该模块用来显示 DFT 步骤 (opt、sp、nmr) 的进度
+*
+*	Progress 记录一个步骤中已经完成、正在运行和失败的任务数，正在运行的任务的运行时间，
+*	并根据已经完成的任务的平均运行时间估计剩余时间 (ETA)：
+*		1. 标准输出为终端时，每秒刷新一次终端最后一行的状态行，如
+*		   opt 5/12 done, 1 running, 0 failed, ETA 15m40s | cluster-opt6 2m13s (step 7/100, SCF cycle 12)
+*		2. 否则（如输出被重定向到文件、batch 中的每一个分子）每隔 ProgressLogInterval 输出一条 progress 日志
+*
+*	实现了 JobProgressReader 的 Engine（Gaussian、ORCA）会读取正在运行的任务的 out 文件的末尾，
+*	显示当前的优化步数和 SCF 循环数
+*
+* @Author: Kimariyb
+* @Address: XiaMen University
+* @Data: 2023-09-26
+ */
+
+// ProgressLogInterval 标准输出不是终端时，输出 progress 日志的间隔
+const ProgressLogInterval = time.Minute
+
+// progressRefresh 状态行的刷新间隔
+const progressRefresh = time.Second
+
+// progressTail 读取正在运行的任务的 out 文件末尾的字节数
+const progressTail = 64 * 1024
+
+// JobProgressReader 可以从正在运行的任务的 out 文件中读取进度的 Engine 实现该接口
+// JobProgress 返回如 "step 7/100, SCF cycle 12" 的描述，读取不到时返回空字符串
+type JobProgressReader interface {
+	JobProgress(outFile string) string
+}
+
+// runningJob 一个正在运行的任务
+type runningJob struct {
+	job     Job
+	started time.Time
+}
+
+// Progress 一个 DFT 步骤的进度
+//   - total: 任务总数
+//   - completed: 正常结束的任务数
+//   - failed: 异常结束或者被中断的任务数
+//   - durations: 正常结束的任务的运行时间，用来估计剩余时间
+type Progress struct {
+	mu        sync.Mutex
+	stage     Stage
+	reader    JobProgressReader
+	total     int
+	completed int
+	failed    int
+	running   map[int]runningJob
+	durations []time.Duration
+	done      chan struct{}
+	stopped   sync.WaitGroup
+}
+
+// NewProgress 返回 engine 运行 stage 步骤的 total 个任务的 Progress
+func NewProgress(stage Stage, engine Engine, total int) *Progress {
+	reader, _ := engine.(JobProgressReader)
+	return &Progress{
+		stage:   stage,
+		reader:  reader,
+		total:   total,
+		running: make(map[int]runningJob),
+		done:    make(chan struct{}),
+	}
+}
+
+// Start 开始显示进度，直到调用 Stop
+func (p *Progress) Start() {
+	statusLine := utils.StatusLineEnabled()
+	interval := ProgressLogInterval
+	if statusLine {
+		interval = progressRefresh
+	}
+
+	p.stopped.Add(1)
+	go func() {
+		defer p.stopped.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			if statusLine {
+				utils.SetStatusLine(p.Line(time.Now()))
+			}
+			select {
+			case <-p.done:
+				if statusLine {
+					utils.ClearStatusLine()
+				}
+				return
+			case <-ticker.C:
+			}
+			if !statusLine {
+				p.log(time.Now())
+			}
+		}
+	}()
+}
+
+// Stop 停止显示进度，并清除状态行
+func (p *Progress) Stop() {
+	close(p.done)
+	p.stopped.Wait()
+}
+
+// JobStarted 记录任务 job 开始运行（或者被提交到作业调度系统）
+func (p *Progress) JobStarted(job Job, started time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.running[job.Index] = runningJob{job: job, started: started}
+}
+
+// JobFinished 记录任务 job 结束，status 为 JobNormal 时计入完成的任务，否则计入失败的任务
+func (p *Progress) JobFinished(job Job, status string, finished time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	running, ok := p.running[job.Index]
+	if !ok {
+		return
+	}
+	delete(p.running, job.Index)
+	if status == JobNormal {
+		p.completed++
+		p.durations = append(p.durations, finished.Sub(running.started))
+	} else {
+		p.failed++
+	}
+}
+
+// runningJobs 按照任务编号的顺序返回正在运行的任务
+func (p *Progress) runningJobs() []runningJob {
+	jobs := make([]runningJob, 0, len(p.running))
+	for _, job := range p.running {
+		jobs = append(jobs, job)
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].job.Index < jobs[j].job.Index })
+	return jobs
+}
+
+// eta 根据已经完成的任务的平均运行时间估计剩余时间：正在运行的任务还需要的时间加上还没有开始的任务的时间，
+// 再除以同时运行的任务数，还没有完成的任务时返回 false
+func (p *Progress) eta(now time.Time) (time.Duration, bool) {
+	if len(p.durations) == 0 {
+		return 0, false
+	}
+	var sum time.Duration
+	for _, duration := range p.durations {
+		sum += duration
+	}
+	mean := sum / time.Duration(len(p.durations))
+
+	var remaining time.Duration
+	for _, running := range p.running {
+		if left := mean - now.Sub(running.started); left > 0 {
+			remaining += left
+		}
+	}
+	pending := p.total - p.completed - p.failed - len(p.running)
+	remaining += time.Duration(pending) * mean
+	if parallel := len(p.running); parallel > 1 {
+		remaining /= time.Duration(parallel)
+	}
+	return remaining, true
+}
+
+// Line 返回状态行，剩余时间在正在运行的任务之前，终端较窄时只截断任务的部分，正在运行的任务最多显示两个
+func (p *Progress) Line(now time.Time) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("%s %d/%d done, %d running, %d failed, ETA ", p.stage, p.completed, p.total, len(p.running), p.failed))
+	if eta, ok := p.eta(now); ok {
+		sb.WriteString(formatProgressDuration(eta))
+	} else {
+		sb.WriteString("--")
+	}
+	running := p.runningJobs()
+	for i, job := range running {
+		if i == 2 {
+			sb.WriteString(fmt.Sprintf(" | +%d more", len(running)-i))
+			break
+		}
+		sb.WriteString(" | " + p.describe(job, now))
+	}
+	return sb.String()
+}
+
+// describe 返回正在运行的任务的名字、运行时间以及 out 文件中的进度，如 cluster-opt6 2m13s (step 7/100, SCF cycle 12)
+func (p *Progress) describe(running runningJob, now time.Time) string {
+	name := strings.TrimSuffix(filepath.Base(running.job.InputFile), filepath.Ext(running.job.InputFile))
+	description := name + " " + formatProgressDuration(now.Sub(running.started))
+	if p.reader != nil {
+		if detail := p.reader.JobProgress(running.job.OutFile); detail != "" {
+			description += " (" + detail + ")"
+		}
+	}
+	return description
+}
+
+// log 输出一条 progress 日志
+func (p *Progress) log(now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	attrs := []any{"completed", p.completed, "total", p.total, "running", len(p.running), "failed", p.failed}
+	var jobs []string
+	for _, job := range p.runningJobs() {
+		jobs = append(jobs, p.describe(job, now))
+	}
+	if len(jobs) > 0 {
+		attrs = append(attrs, "jobs", strings.Join(jobs, "; "))
+	}
+	if eta, ok := p.eta(now); ok {
+		attrs = append(attrs, "eta", formatProgressDuration(eta))
+	}
+	slog.Info("progress", attrs...)
+}
+
+// formatProgressDuration 将 d 格式化为精确到秒的字符串，如 2m13s
+func formatProgressDuration(d time.Duration) string {
+	return d.Round(time.Second).String()
+}
+
+// tailFile 返回 fileName 最后 size 个字节的内容，文件不存在或者读取失败时返回空字符串
+func tailFile(fileName string, size int64) string {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return ""
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return ""
+	}
+	offset := info.Size() - size
+	if offset < 0 {
+		offset = 0
+	}
+	contents, err := io.ReadAll(io.NewSectionReader(file, offset, info.Size()-offset))
+	if err != nil {
+		return ""
+	}
+	return string(contents)
+}
+
+// lastSubmatches 返回 contents 中 regex 的最后一个匹配的子匹配，没有匹配时返回 nil
+func lastSubmatches(contents string, regex *regexp.Regexp) []string {
+	matches := regex.FindAllStringSubmatch(contents, -1)
+	if len(matches) == 0 {
+		return nil
+	}
+	return matches[len(matches)-1]
+}
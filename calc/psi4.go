@@ -0,0 +1,185 @@
+package calc
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"kybnmr/utils"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+/*
+* psi4.go
+* 该模块实现了 Psi4 程序的 Engine，用于 DFT 优化、振动分析和单点能计算
+*
+*	1. 输入文件由 PsiTemplate.dat 生成，模板中 molecule 块里的 [GEOMETRY] 会被替换为原子坐标
+*	2. 从 out 文件中读取最后一个 Geometry (in Angstrom) 的结构、最后一个 Total Energy 以及 Correction G
+*	3. Psi4 没有 GIAO NMR 计算，因此不能用于 NMR 步骤
+*
+* @Version:
+* 	Psi4: 1.8
+*
+* @Author: Kimariyb
+* @Address: XiaMen University
+* @Data: 2023-09-25
+ */
+
+func init() {
+	RegisterEngine("psi4", func(config *Config) Engine {
+		return &Psi4Engine{Path: config.OptConfig.Psi4Path, Molecule: config.MoleculeConfig}
+	})
+}
+
+var (
+	psi4EnergyRegex = regexp.MustCompile(`Total Energy =\s+(-?\d+\.\d+)`)
+	// Correction G    3.928 [kcal/mol]    16.434 [kJ/mol]    0.00625947 [Eh]
+	psi4GibbsRegex = regexp.MustCompile(`Correction G\s+-?\d+\.\d+ \[kcal/mol\]\s+-?\d+\.\d+ \[kJ/mol\]\s+(-?\d+\.\d+) \[Eh\]`)
+)
+
+// Psi4Engine 调用 Psi4 的 Engine，Path 为 Psi4 的运行路径，即配置文件中的 psi4Path，Molecule 为 [molecule] 中的电荷和自旋多重度
+type Psi4Engine struct {
+	Path     string
+	Molecule MoleculeConfig
+}
+
+// Name 返回程序的名字
+func (p *Psi4Engine) Name() string {
+	return "psi4"
+}
+
+// TemplateFile 优化和单点能都使用 PsiTemplate.dat
+func (p *Psi4Engine) TemplateFile(stage Stage) string {
+	return "PsiTemplate.dat"
+}
+
+// Supports Psi4 只能用于优化和单点能步骤
+func (p *Psi4Engine) Supports(stage Stage) bool {
+	return stage == StageOpt || stage == StageSP
+}
+
+// BuildInput 将模板中的 [GEOMETRY] 替换为实际的原子坐标，并将电荷和自旋多重度替换为 Molecule 中的值
+func (p *Psi4Engine) BuildInput(template string, cluster Cluster) string {
+	return replaceGeometry(replaceChargeLine(template, p.Molecule), cluster)
+}
+
+// CommandLine 返回 psi4 input.dat output.out
+func (p *Psi4Engine) CommandLine(stage Stage, inputFile string, outFile string) string {
+	return fmt.Sprintf("%s %s %s", p.Path, inputFile, outFile)
+}
+
+// Run 在输入文件所在的文件夹中运行 Psi4，Psi4 生成的 timer.dat 等文件也会留在这个文件夹中
+func (p *Psi4Engine) Run(ctx context.Context, stage Stage, inputFile string, outFile string) error {
+	inputPath, outPath, err := absPaths(inputFile, outFile)
+	if err != nil {
+		return err
+	}
+	return runShellCommandIn(ctx, p.JobDir(inputPath, outPath), p.CommandLine(stage, inputPath, outPath), JobLogFile(outPath))
+}
+
+// JobDir 在输入文件所在的文件夹中运行
+func (p *Psi4Engine) JobDir(inputFile string, outFile string) string {
+	return filepath.Dir(inputFile)
+}
+
+// ParseGeometry 读取 Psi4 out 文件中最后一个 Geometry (in Angstrom) 块
+//
+//	Geometry (in Angstrom), charge = 0, multiplicity = 1:
+//
+//	   Center              X                  Y                   Z               Mass
+//	------------   -----------------  -----------------  -----------------  -----------------
+//	         O            0.000000000000     0.000000000000    -0.065775570547    15.994914619570
+func (p *Psi4Engine) ParseGeometry(outFile string) (Cluster, error) {
+	if !utils.CheckFileType(outFile, ".out") {
+		return Cluster{}, fmt.Errorf("error the format of input file")
+	}
+
+	contents, err := ioutil.ReadFile(outFile)
+	if err != nil {
+		return Cluster{}, err
+	}
+	lines := strings.Split(string(contents), "\n")
+
+	start := -1
+	for i, line := range lines {
+		if strings.Contains(line, "Geometry (in Angstrom)") {
+			start = i
+		}
+	}
+	if start < 0 {
+		return Cluster{}, fmt.Errorf("no geometry found in %s", outFile)
+	}
+
+	var cluster Cluster
+	dashes := false
+	for _, line := range lines[start+1:] {
+		fields := strings.Fields(line)
+		if !dashes {
+			dashes = strings.HasPrefix(strings.TrimSpace(line), "------------")
+			continue
+		}
+		if len(fields) < 4 {
+			break
+		}
+		atom, err := parseAtomFields(fields[0], fields[1:4])
+		if err != nil {
+			return Cluster{}, fmt.Errorf("%s: %w", outFile, err)
+		}
+		cluster.Atoms = append(cluster.Atoms, atom)
+	}
+	if len(cluster.Atoms) == 0 {
+		return Cluster{}, fmt.Errorf("no atom found in the last geometry of %s", outFile)
+	}
+
+	cluster.Energy, err = p.ParseEnergy(outFile)
+	return cluster, err
+}
+
+// ParseEnergy 读取最后一个 Total Energy =   -76.0266327341674428
+func (p *Psi4Engine) ParseEnergy(outFile string) (float64, error) {
+	return findLastFloat(outFile, psi4EnergyRegex)
+}
+
+// ParseGibbsCorrection 读取振动分析中 Correction G 的 [Eh] 一列
+func (p *Psi4Engine) ParseGibbsCorrection(outFile string) (float64, error) {
+	return findLastFloat(outFile, psi4GibbsRegex)
+}
+
+// ParseShieldings Psi4 不能计算 NMR 屏蔽常数
+func (p *Psi4Engine) ParseShieldings(outFile string) ([]NucleusShielding, error) {
+	return nil, fmt.Errorf("psi4 does not support NMR shielding calculations: %s", outFile)
+}
+
+// IsNormalTermination 判断 out 文件中是否有 Psi4 exiting successfully
+func (p *Psi4Engine) IsNormalTermination(outFile string) bool {
+	contents, err := ioutil.ReadFile(outFile)
+	if err != nil {
+		return false
+	}
+	return strings.Contains(string(contents), "Psi4 exiting successfully")
+}
+
+// parseAtomFields 将元素标记和三个坐标转化为 Atom，元素标记中的数字后缀会被去掉，如 C1 -> C
+func parseAtomFields(label string, coordinates []string) (Atom, error) {
+	var values [3]float64
+	for i := range values {
+		value, err := strconv.ParseFloat(coordinates[i], 64)
+		if err != nil {
+			return Atom{}, fmt.Errorf("invalid coordinate: %s", coordinates[i])
+		}
+		values[i] = value
+	}
+
+	return Atom{Symbol: normalizeSymbol(label), X: values[0], Y: values[1], Z: values[2]}, nil
+}
+
+// normalizeSymbol 去掉元素标记中的数字后缀，并统一大小写，如 C1 -> C，CL -> Cl
+func normalizeSymbol(label string) string {
+	symbol := strings.TrimRight(label, "0123456789")
+	if len(symbol) > 1 {
+		return strings.ToUpper(symbol[:1]) + strings.ToLower(symbol[1:])
+	}
+	return strings.ToUpper(symbol)
+}
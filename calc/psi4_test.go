@@ -0,0 +1,134 @@
+package calc
+
+import (
+	"math"
+	"path/filepath"
+	"testing"
+)
+
+// approxEqual a 和 b 的差不超过 tolerance 时返回 true
+func approxEqual(a, b, tolerance float64) bool {
+	return math.Abs(a-b) <= tolerance
+}
+
+// checkAtoms 检查 cluster 中的原子和 want 一致
+func checkAtoms(t *testing.T, cluster Cluster, want []Atom) {
+	t.Helper()
+	if len(cluster.Atoms) != len(want) {
+		t.Fatalf("got %d atoms, want %d", len(cluster.Atoms), len(want))
+	}
+	for i, atom := range cluster.Atoms {
+		if atom.Symbol != want[i].Symbol || !approxEqual(atom.X, want[i].X, 1e-8) ||
+			!approxEqual(atom.Y, want[i].Y, 1e-8) || !approxEqual(atom.Z, want[i].Z, 1e-8) {
+			t.Errorf("atom %d: got %+v, want %+v", i+1, atom, want[i])
+		}
+	}
+}
+
+func TestPsi4ParseEnergy(t *testing.T) {
+	tests := []struct {
+		file    string
+		want    float64
+		wantErr bool
+	}{
+		// opt+freq 中有多个 Total Energy，使用最后一个
+		{"psi4-optfreq.out", -76.4088026132153525, false},
+		{"psi4-sp.out", -76.4586302212701928, false},
+		{"psi4-failed.out", 0, true},
+	}
+	engine := &Psi4Engine{}
+	for _, test := range tests {
+		t.Run(test.file, func(t *testing.T) {
+			energy, err := engine.ParseEnergy(filepath.Join("testdata", test.file))
+			if (err != nil) != test.wantErr {
+				t.Fatalf("ParseEnergy error = %v, wantErr %v", err, test.wantErr)
+			}
+			if !test.wantErr && !approxEqual(energy, test.want, 1e-10) {
+				t.Errorf("ParseEnergy = %.10f, want %.10f", energy, test.want)
+			}
+		})
+	}
+}
+
+func TestPsi4ParseGeometry(t *testing.T) {
+	// 优化之后的最后一个结构
+	optimized := []Atom{
+		{"O", 0, 0, -0.065775570547},
+		{"H", 0, -0.759061990794, 0.521953018286},
+		{"H", 0, 0.759061990794, 0.521953018286},
+	}
+	tests := []struct {
+		file       string
+		want       []Atom
+		wantEnergy float64
+		wantErr    bool
+	}{
+		{"psi4-optfreq.out", optimized, -76.4088026132153525, false},
+		{"psi4-sp.out", optimized, -76.4586302212701928, false},
+		// 有结构但是没有能量
+		{"psi4-failed.out", nil, 0, true},
+	}
+	engine := &Psi4Engine{}
+	for _, test := range tests {
+		t.Run(test.file, func(t *testing.T) {
+			cluster, err := engine.ParseGeometry(filepath.Join("testdata", test.file))
+			if (err != nil) != test.wantErr {
+				t.Fatalf("ParseGeometry error = %v, wantErr %v", err, test.wantErr)
+			}
+			if test.wantErr {
+				return
+			}
+			checkAtoms(t, cluster, test.want)
+			if !approxEqual(cluster.Energy, test.wantEnergy, 1e-10) {
+				t.Errorf("energy = %.10f, want %.10f", cluster.Energy, test.wantEnergy)
+			}
+		})
+	}
+}
+
+func TestPsi4ParseGibbsCorrection(t *testing.T) {
+	tests := []struct {
+		file    string
+		want    float64
+		wantErr bool
+	}{
+		{"psi4-optfreq.out", 0.00351527, false},
+		{"psi4-sp.out", 0, true},
+	}
+	engine := &Psi4Engine{}
+	for _, test := range tests {
+		t.Run(test.file, func(t *testing.T) {
+			correction, err := engine.ParseGibbsCorrection(filepath.Join("testdata", test.file))
+			if (err != nil) != test.wantErr {
+				t.Fatalf("ParseGibbsCorrection error = %v, wantErr %v", err, test.wantErr)
+			}
+			if !test.wantErr && !approxEqual(correction, test.want, 1e-10) {
+				t.Errorf("ParseGibbsCorrection = %.8f, want %.8f", correction, test.want)
+			}
+		})
+	}
+}
+
+func TestPsi4ParseShieldings(t *testing.T) {
+	// Psi4 不能计算 NMR 屏蔽常数，任何 out 文件都返回错误
+	engine := &Psi4Engine{}
+	for _, file := range []string{"psi4-optfreq.out", "psi4-sp.out"} {
+		if _, err := engine.ParseShieldings(filepath.Join("testdata", file)); err == nil {
+			t.Errorf("ParseShieldings(%s): expected an error", file)
+		}
+	}
+}
+
+func TestPsi4IsNormalTermination(t *testing.T) {
+	tests := map[string]bool{
+		"psi4-optfreq.out": true,
+		"psi4-sp.out":      true,
+		"psi4-failed.out":  false,
+	}
+	engine := &Psi4Engine{}
+	for file, want := range tests {
+		if got := engine.IsNormalTermination(filepath.Join("testdata", file)); got != want {
+			t.Errorf("IsNormalTermination(%s) = %v, want %v", file, got, want)
+		}
+	}
+}
@@ -0,0 +1,246 @@
+package calc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+/*
+* report.go
+* 该模块用来生成每一次运行的机器可读报告 report.json，写在运行的工作目录中，供之后的脚本和 LIMS 读取，
+* 不需要再解析屏幕输出
+*
+*	report.json 包括：
+*		1. 运行的状态、起止时间、输入文件、使用的程序和后端
+*		2. 分层读取之后的配置快照，每一个 key 的最终值和来源
+*		3. 用到的外部程序的路径和版本号
+*		4. 每一个步骤 (md、pre、post、opt、sp、nmr、shermo) 的状态、运行时间、输入和输出的构象数，
+*		   pre 和 post 的去重结果，opt、sp 和 nmr 的每一个任务的状态和运行时间
+*		5. 每一个构象的能量和 Boltzmann 分布，以及平均之后的屏蔽常数和化学位移
+*
+*	字段的含义和单位见 README 中的 Run report，ReportSchemaVersion 只在删除字段或者改变字段的含义时增加，
+*	增加新的字段不改变版本号
+*
+* @Author: Kimariyb
+* @Address: XiaMen University
+* @Data: 2023-09-26
+ */
+
+// ReportFile 每一次运行在工作目录中写入的报告文件
+const ReportFile = "report.json"
+
+// ReportSchemaVersion report.json 的格式版本
+const ReportSchemaVersion = 1
+
+// 运行和步骤的状态
+const (
+	ReportRunning     = "running"
+	ReportCompleted   = "completed"
+	ReportFailed      = "failed"
+	ReportInterrupted = "interrupted"
+	ReportSkipped     = "skipped"
+)
+
+// Report 一次运行的报告，所有的时间都是 RFC 3339 格式，能量的单位为 Hartree
+type Report struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	KybnmrVersion string            `json:"kybnmrVersion"`
+	Input         string            `json:"input"`
+	Molecule      string            `json:"molecule"`
+	Charge        int               `json:"charge"`
+	Multiplicity  int               `json:"multiplicity"`
+	Status        string            `json:"status"`
+	Error         string            `json:"error,omitempty"`
+	StartedAt     string            `json:"startedAt"`
+	FinishedAt    string            `json:"finishedAt,omitempty"`
+	Seconds       float64           `json:"seconds"`
+	Engines       map[string]string `json:"engines"`
+	Backend       string            `json:"backend"`
+	Config        []ResolvedValue   `json:"config"`
+	Programs      []ProgramInfo     `json:"programs"`
+	Stages        []*StageReport    `json:"stages"`
+	Temperature   float64           `json:"temperature,omitempty"`
+	Conformers    []ReportConformer `json:"conformers"`
+	Shifts        []ReportShift     `json:"shifts"`
+
+	started time.Time
+}
+
+// StageReport 一个步骤的报告
+//   - Name: md、pre、post、opt、sp、nmr 或者 shermo
+//   - Program: 使用的程序，如 xtb、crest、gaussian
+//   - Input、Output: 输入和输出的构象数，md 的输出为轨迹中的结构数
+//   - Dedup: pre 和 post 的去重结果
+//   - Jobs: opt、sp 和 nmr 的每一个任务
+type StageReport struct {
+	Name      string       `json:"name"`
+	Program   string       `json:"program,omitempty"`
+	Status    string       `json:"status"`
+	Error     string       `json:"error,omitempty"`
+	StartedAt string       `json:"startedAt,omitempty"`
+	Seconds   float64      `json:"seconds"`
+	Input     int          `json:"input"`
+	Output    int          `json:"output"`
+	Dedup     *DedupReport `json:"dedup,omitempty"`
+	Jobs      []JobResult  `json:"jobs,omitempty"`
+
+	started time.Time
+}
+
+// DedupReport 一次 DoubleCheck 的阈值和对每一个构象的处理
+//   - EnergyThreshold: 能量阈值，单位为 kcal/mol
+//   - DistanceThreshold: 结构阈值，单位为 Angstrom
+type DedupReport struct {
+	EnergyThreshold   float64         `json:"energyThreshold"`
+	DistanceThreshold float64         `json:"distanceThreshold"`
+	Decisions         []DedupDecision `json:"decisions"`
+}
+
+// ReportConformer 一个构象的能量和 Boltzmann 权重
+//   - Energy: 单点能
+//   - GibbsCorrection: 自由能热校正量
+//   - FreeEnergy: Energy + GibbsCorrection
+//   - RelativeFreeEnergy: 相对于最低自由能的自由能，单位为 kcal/mol
+type ReportConformer struct {
+	Name               string  `json:"name"`
+	Energy             float64 `json:"energy"`
+	GibbsCorrection    float64 `json:"gibbsCorrection"`
+	FreeEnergy         float64 `json:"freeEnergy"`
+	RelativeFreeEnergy float64 `json:"relativeFreeEnergy"`
+	Population         float64 `json:"population"`
+}
+
+// ReportShift 一个原子核平均之后的屏蔽常数和化学位移，单位为 ppm，没有参考屏蔽常数的元素 Shift 为 null
+type ReportShift struct {
+	Index     int      `json:"index"`
+	Element   string   `json:"element"`
+	Shielding float64  `json:"shielding"`
+	Shift     *float64 `json:"shift"`
+}
+
+// NewReport 返回一个正在运行的 Report
+func NewReport(version string, input string, molecule string) *Report {
+	now := time.Now()
+	return &Report{
+		SchemaVersion: ReportSchemaVersion,
+		KybnmrVersion: version,
+		Input:         input,
+		Molecule:      molecule,
+		Status:        ReportRunning,
+		StartedAt:     now.Format(time.RFC3339),
+		Engines:       make(map[string]string),
+		Config:        []ResolvedValue{},
+		Programs:      []ProgramInfo{},
+		Stages:        []*StageReport{},
+		Conformers:    []ReportConformer{},
+		Shifts:        []ReportShift{},
+		started:       now,
+	}
+}
+
+// reportStatus 根据步骤或者运行返回的错误得到状态，被 Ctrl-C 取消的为 ReportInterrupted
+func reportStatus(err error) string {
+	switch {
+	case err == nil:
+		return ReportCompleted
+	case errors.Is(err, context.Canceled):
+		return ReportInterrupted
+	default:
+		return ReportFailed
+	}
+}
+
+// StartStage 开始记录步骤 name，program 为使用的程序
+func (r *Report) StartStage(name string, program string) *StageReport {
+	now := time.Now()
+	stage := &StageReport{Name: name, Program: program, Status: ReportRunning, StartedAt: now.Format(time.RFC3339), started: now}
+	r.Stages = append(r.Stages, stage)
+	return stage
+}
+
+// SkipStage 记录被跳过的步骤 name
+func (r *Report) SkipStage(name string) {
+	r.Stages = append(r.Stages, &StageReport{Name: name, Status: ReportSkipped})
+}
+
+// Finish 记录步骤的状态和运行时间，err 为步骤返回的错误
+func (s *StageReport) Finish(err error) {
+	s.Status = reportStatus(err)
+	if err != nil {
+		s.Error = err.Error()
+	}
+	s.Seconds = roundSeconds(time.Since(s.started))
+}
+
+// SetNMRResult 记录每一个构象的能量和 Boltzmann 权重，以及平均之后的化学位移
+func (r *Report) SetNMRResult(result *NMRResult) {
+	r.Temperature = result.Temperature
+	lowest := result.LowestConformer().FreeEnergy
+	r.Conformers = make([]ReportConformer, len(result.Conformers))
+	for i, conformer := range result.Conformers {
+		r.Conformers[i] = ReportConformer{
+			Name:               conformer.Name,
+			Energy:             conformer.Energy,
+			GibbsCorrection:    conformer.GibbsCorrection,
+			FreeEnergy:         conformer.FreeEnergy,
+			RelativeFreeEnergy: (conformer.FreeEnergy - lowest) * HartreeToKcal,
+			Population:         conformer.Population,
+		}
+	}
+	r.Shifts = make([]ReportShift, len(result.Nuclei))
+	for i, nucleus := range result.Nuclei {
+		r.Shifts[i] = ReportShift{Index: nucleus.Index, Element: nucleus.Symbol, Shielding: nucleus.Shielding}
+		if nucleus.Referenced {
+			shift := nucleus.Shift
+			r.Shifts[i].Shift = &shift
+		}
+	}
+}
+
+// Finish 记录运行的状态和运行时间，err 为运行返回的错误
+func (r *Report) Finish(err error) {
+	now := time.Now()
+	r.Status = reportStatus(err)
+	if err != nil {
+		r.Error = err.Error()
+	}
+	r.FinishedAt = now.Format(time.RFC3339)
+	r.Seconds = roundSeconds(now.Sub(r.started))
+}
+
+// LoadReport 读取由 Save 保存的 Report
+func LoadReport(fileName string) (*Report, error) {
+	contents, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &Report{}
+	if err := json.Unmarshal(contents, report); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %w", fileName, err)
+	}
+	if report.SchemaVersion > ReportSchemaVersion {
+		return nil, fmt.Errorf("%s has schema version %d, this KYBNMR reads up to version %d", fileName, report.SchemaVersion, ReportSchemaVersion)
+	}
+
+	return report, nil
+}
+
+// Save 将 Report 保存为 json 文件，先写入临时文件再重命名，
+// 这样运行中读取 report.json 的程序（如 kybnmr status）不会读到写了一半的文件
+func (r *Report) Save(fileName string) error {
+	contents, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	tempFile := fileName + ".tmp"
+	if err := ioutil.WriteFile(tempFile, append(contents, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tempFile, fileName)
+}
@@ -0,0 +1,106 @@
+package calc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+/*
+* smoke.go
+* 该模块用来对外部程序做一次很小的试算 (smoke test)，确认程序不只是存在，而且能够完成计算
+*
+*	xtb: 氢分子的 GFN2-xTB 单点能，输出中需要有 "normal termination of xtb"
+*	gaussian: 氢分子的 HF/STO-3G 单点能，log 文件中需要有 "Normal termination"
+*	orca: 氢分子的 HF/STO-3G 单点能，输出中需要有 "ORCA TERMINATED NORMALLY"
+*	试算在临时目录中进行，结束之后删除，其他程序没有试算
+*
+* @Author: Kimariyb
+* @Address: XiaMen University
+* @Data: 2023-09-26
+ */
+
+// smokeTimeout 一次试算的最长运行时间
+const smokeTimeout = 2 * time.Minute
+
+// ErrNoSmokeTest 程序没有试算
+var ErrNoSmokeTest = errors.New("no smoke test")
+
+// smokeGeometry 试算使用的氢分子坐标
+const smokeGeometry = "H 0.0 0.0 0.0\nH 0.0 0.0 0.74\n"
+
+// smokeTest 一个程序的试算
+//   - File: 输入文件名
+//   - Input: 输入文件内容
+//   - Args: 运行参数，输入文件名写在第一个
+//   - Output: 不为空时从该文件读取输出，否则使用程序的标准输出
+//   - Success: 正常结束时输出中的文字
+type smokeTest struct {
+	File    string
+	Input   string
+	Args    []string
+	Output  string
+	Success string
+}
+
+// smokeTests 每一个程序的试算
+var smokeTests = map[string]smokeTest{
+	"xtb": {
+		File:    "smoke.xyz",
+		Input:   "2\nkybnmr smoke test\n" + smokeGeometry,
+		Args:    []string{"--sp", "--gfn2"},
+		Success: "normal termination of xtb",
+	},
+	"gaussian": {
+		File:    "smoke.gjf",
+		Input:   "%nprocshared=1\n#p hf/sto-3g\n\nkybnmr smoke test\n\n0 1\n" + smokeGeometry + "\n",
+		Output:  "smoke.log",
+		Success: "Normal termination",
+	},
+	"orca": {
+		File:    "smoke.inp",
+		Input:   "! HF STO-3G\n* xyz 0 1\n" + smokeGeometry + "*\n",
+		Success: "ORCA TERMINATED NORMALLY",
+	},
+}
+
+// SmokeTest 使用 path 处的程序 name 做一次试算，没有试算的程序返回 ErrNoSmokeTest
+func SmokeTest(ctx context.Context, name string, path string) error {
+	test, ok := smokeTests[name]
+	if !ok {
+		return ErrNoSmokeTest
+	}
+
+	dir, err := os.MkdirTemp("", "kybnmr-smoke-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	if err := os.WriteFile(filepath.Join(dir, test.File), []byte(test.Input), 0644); err != nil {
+		return err
+	}
+
+	smokeCtx, cancel := context.WithTimeout(ctx, smokeTimeout)
+	defer cancel()
+	cmd := commandContext(smokeCtx, path, append([]string{test.File}, test.Args...)...)
+	cmd.Dir = dir
+	output, runErr := cmd.CombinedOutput()
+	if smokeCtx.Err() != nil {
+		return fmt.Errorf("%s did not finish within %s", name, smokeTimeout)
+	}
+	if test.Output != "" {
+		output, _ = os.ReadFile(filepath.Join(dir, test.Output))
+	}
+	if !strings.Contains(string(output), test.Success) {
+		if runErr != nil {
+			return fmt.Errorf("%s failed: %w", name, runErr)
+		}
+		return fmt.Errorf("%s did not terminate normally", name)
+	}
+
+	return nil
+}
@@ -0,0 +1,310 @@
+package calc
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+/*
+* solvent.go
+* 该模块将 [solvent] 中的溶剂名翻译为每一个程序的溶剂模型关键词
+*
+*	xtb/crest: --alpb <溶剂> 或者 --gbsa <溶剂>，由 xtbModel 决定，原有参数中的 --alpb/--gbsa 会被去掉
+*	Gaussian: 路由行中的 scrf=(smd,solvent=<溶剂>)，model 可以为 smd、pcm 或者 cpcm，原有的 scrf 会被替换
+*	Orca: ! CPCM(<溶剂>)，model 为 smd 时再加上 %cpcm smd true SMDsolvent "<SMD 溶剂名>" end，原有的溶剂设置会被去掉。
+*	      ! 行中的溶剂名必须是一个不含空格和逗号的词，如 diethylether，SMDsolvent 中使用带引号的全名，如 "diethyl ether"
+*	其他程序没有溶剂名的对照表，使用 [solvent] 时会报错，请直接在模板中设置溶剂
+*
+*	name 为空时不做任何修改，仍然使用模板和参数中的溶剂设置
+*
+* @Author: Kimariyb
+* @Address: XiaMen University
+* @Data: 2023-09-26
+ */
+
+// solventNames 一种溶剂在每一个程序中的名字，空字符串表示该程序不支持这种溶剂
+// Orca 为 ! CPCM(...) 中的名字，OrcaSMD 为 SMDsolvent 中的名字，为空时与 Orca 相同
+type solventNames struct {
+	ALPB     string
+	GBSA     string
+	Gaussian string
+	Orca     string
+	OrcaSMD  string
+}
+
+// solventTable 以规范名为键的溶剂对照表
+var solventTable = map[string]solventNames{
+	"water":           {ALPB: "water", GBSA: "water", Gaussian: "Water", Orca: "water"},
+	"acetonitrile":    {ALPB: "acetonitrile", GBSA: "acetonitrile", Gaussian: "Acetonitrile", Orca: "acetonitrile"},
+	"methanol":        {ALPB: "methanol", GBSA: "methanol", Gaussian: "Methanol", Orca: "methanol"},
+	"ethanol":         {Gaussian: "Ethanol", Orca: "ethanol"},
+	"chloroform":      {ALPB: "chcl3", GBSA: "chcl3", Gaussian: "Chloroform", Orca: "chloroform"},
+	"dichloromethane": {ALPB: "ch2cl2", GBSA: "ch2cl2", Gaussian: "Dichloromethane", Orca: "dichloromethane"},
+	"dmso":            {ALPB: "dmso", GBSA: "dmso", Gaussian: "DiMethylSulfoxide", Orca: "dmso"},
+	"acetone":         {ALPB: "acetone", GBSA: "acetone", Gaussian: "Acetone", Orca: "acetone"},
+	"benzene":         {ALPB: "benzene", Gaussian: "Benzene", Orca: "benzene"},
+	"toluene":         {ALPB: "toluene", GBSA: "toluene", Gaussian: "Toluene", Orca: "toluene"},
+	"thf":             {ALPB: "thf", GBSA: "thf", Gaussian: "TetraHydroFuran", Orca: "thf"},
+	"hexane":          {ALPB: "hexane", GBSA: "hexane", Gaussian: "n-Hexane", Orca: "hexane"},
+	"diethylether":    {ALPB: "ether", GBSA: "ether", Gaussian: "DiethylEther", Orca: "diethylether", OrcaSMD: "diethyl ether"},
+	"dmf":             {ALPB: "dmf", GBSA: "dmf", Gaussian: "N,N-DiMethylFormamide", Orca: "dmf", OrcaSMD: "n,n-dimethylformamide"},
+	"cs2":             {ALPB: "cs2", GBSA: "cs2", Gaussian: "CarbonDiSulfide", Orca: "carbondisulfide", OrcaSMD: "carbon disulfide"},
+	"dioxane":         {ALPB: "dioxane", Gaussian: "1,4-Dioxane", Orca: "dioxane", OrcaSMD: "1,4-dioxane"},
+	"ethylacetate":    {ALPB: "ethylacetate", Gaussian: "EthylEthanoate", Orca: "ethylacetate", OrcaSMD: "ethyl acetate"},
+	"nitromethane":    {ALPB: "nitromethane", Gaussian: "NitroMethane", Orca: "nitromethane"},
+	"pyridine":        {Gaussian: "Pyridine", Orca: "pyridine"},
+}
+
+// solventAliases 溶剂的常用别名
+var solventAliases = map[string]string{
+	"h2o": "water", "mecn": "acetonitrile", "ch3cn": "acetonitrile", "meoh": "methanol", "etoh": "ethanol",
+	"chcl3": "chloroform", "cdcl3": "chloroform", "ch2cl2": "dichloromethane", "dcm": "dichloromethane",
+	"dimethylsulfoxide": "dmso", "tetrahydrofuran": "thf", "n-hexane": "hexane",
+	"ether": "diethylether", "diethyl ether": "diethylether", "n,n-dimethylformamide": "dmf",
+	"carbondisulfide": "cs2", "carbon disulfide": "cs2", "1,4-dioxane": "dioxane",
+	"ethyl acetate": "ethylacetate", "etoac": "ethylacetate", "d2o": "water", "dmso-d6": "dmso", "methanol-d4": "methanol",
+}
+
+var (
+	// gaussianScrfRegex 匹配 Gaussian 路由行中已有的 scrf 关键词，如 scrf(solvent=CHCl3) 或者 scrf=(smd,solvent=water)
+	gaussianScrfRegex = regexp.MustCompile(`(?i)\s*scrf\s*(=\s*)?(\([^)]*\)|\S+)`)
+	// orcaSolventKeywordRegex 匹配 Orca 关键词行中已有的溶剂模型，如 CPCM(chloroform)
+	orcaSolventKeywordRegex = regexp.MustCompile(`(?i)\s*\b(cpcm|smd)\([^)]*\)`)
+	// orcaCpcmBlockRegex 匹配 Orca 中已有的 %cpcm ... end 块
+	orcaCpcmBlockRegex = regexp.MustCompile(`(?ims)^%cpcm\b.*?^\s*end[ \t]*\r?\n?`)
+)
+
+// SolventConfig ini 文件中溶剂部分的配置文件
+//   - Name: 溶剂名，如 chloroform、chcl3，为空时不修改模板和参数中的溶剂设置
+//   - Model: DFT 程序的溶剂模型，smd（默认）、pcm 或者 cpcm
+//   - XtbModel: xtb 和 crest 的溶剂模型，alpb（默认）或者 gbsa
+type SolventConfig struct {
+	Name     string
+	Model    string
+	XtbModel string
+}
+
+// lookupSolvent 返回溶剂的规范名和在每一个程序中的名字
+func lookupSolvent(name string) (string, solventNames, error) {
+	canonical := strings.ToLower(strings.TrimSpace(name))
+	if alias, ok := solventAliases[canonical]; ok {
+		canonical = alias
+	}
+	names, ok := solventTable[canonical]
+	if !ok {
+		known := make([]string, 0, len(solventTable))
+		for solvent := range solventTable {
+			known = append(known, solvent)
+		}
+		sort.Strings(known)
+		return "", solventNames{}, fmt.Errorf("unknown solvent %q (available: %s)", name, strings.Join(known, ", "))
+	}
+	return canonical, names, nil
+}
+
+// Validate 检查溶剂名和溶剂模型，每一个程序是否支持该溶剂由 CheckXtb 和 CheckEngineSolvent 检查
+func (s *SolventConfig) Validate() error {
+	if s.Name == "" {
+		return nil
+	}
+	if _, _, err := lookupSolvent(s.Name); err != nil {
+		return err
+	}
+	if err := checkSolventModel(s.Model); err != nil {
+		return err
+	}
+	return checkXtbSolventModel(s.XtbModel)
+}
+
+// checkSolventModel 检查 DFT 程序的溶剂模型
+func checkSolventModel(model string) error {
+	switch model {
+	case "smd", "pcm", "cpcm":
+		return nil
+	}
+	return fmt.Errorf("unknown solvent model %q (available: smd, pcm, cpcm)", model)
+}
+
+// checkXtbSolventModel 检查 xtb 和 crest 的溶剂模型
+func checkXtbSolventModel(model string) error {
+	switch model {
+	case "alpb", "gbsa":
+		return nil
+	}
+	return fmt.Errorf("unknown xtb solvent model %q (available: alpb, gbsa)", model)
+}
+
+// CheckXtb 检查动力学模拟和 crest 使用的 xtb 是否支持该溶剂
+func (s *SolventConfig) CheckXtb() error {
+	if s.Name == "" {
+		return nil
+	}
+	_, err := s.xtbSolvent()
+	return err
+}
+
+// xtbSolvent 返回 xtb 的溶剂参数，如 --alpb chcl3
+func (s *SolventConfig) xtbSolvent() ([]string, error) {
+	canonical, names, err := lookupSolvent(s.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	var solvent string
+	switch s.XtbModel {
+	case "alpb":
+		solvent = names.ALPB
+	case "gbsa":
+		solvent = names.GBSA
+	default:
+		return nil, fmt.Errorf("unknown xtb solvent model %q (available: alpb, gbsa)", s.XtbModel)
+	}
+	if solvent == "" {
+		return nil, fmt.Errorf("solvent %s is not supported by the %s model of xtb", canonical, s.XtbModel)
+	}
+	return []string{"--" + s.XtbModel, solvent}, nil
+}
+
+// applyXtbSolvent 去掉 args 中已有的 --alpb/--gbsa，并加上 [solvent] 中的溶剂，name 为空时不做修改
+func (s *SolventConfig) applyXtbSolvent(args []string) []string {
+	if s.Name == "" {
+		return args
+	}
+	solvent, err := s.xtbSolvent()
+	if err != nil {
+		return args
+	}
+
+	var result []string
+	for i := 0; i < len(args); i++ {
+		if args[i] == "--alpb" || args[i] == "--gbsa" {
+			// 同时跳过溶剂名
+			i++
+			continue
+		}
+		result = append(result, args[i])
+	}
+	return append(result, solvent...)
+}
+
+// gaussianKeyword 返回 Gaussian 的溶剂关键词，如 scrf=(smd,solvent=Chloroform)
+func (s *SolventConfig) gaussianKeyword() (string, error) {
+	canonical, names, err := lookupSolvent(s.Name)
+	if err != nil {
+		return "", err
+	}
+	if names.Gaussian == "" {
+		return "", fmt.Errorf("solvent %s is not supported by gaussian", canonical)
+	}
+	model := s.Model
+	if model == "pcm" {
+		model = "iefpcm"
+	}
+	return fmt.Sprintf("scrf=(%s,solvent=%s)", model, names.Gaussian), nil
+}
+
+// applyGaussianSolvent 将 Gaussian 模板路由行中的 scrf 替换为 [solvent] 中的溶剂，没有 scrf 时加在第一个路由行的末尾
+func (s *SolventConfig) applyGaussianSolvent(template string) string {
+	if s.Name == "" {
+		return template
+	}
+	keyword, err := s.gaussianKeyword()
+	if err != nil {
+		return template
+	}
+
+	lines := strings.Split(template, "\n")
+	routeLine := -1
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if routeLine < 0 {
+			// 跳过 %chk、%mem 等 Link 0 命令
+			if !strings.HasPrefix(trimmed, "#") {
+				continue
+			}
+			routeLine = i
+		} else if trimmed == "" {
+			// 路由部分以空行结束
+			break
+		}
+		lines[i] = gaussianScrfRegex.ReplaceAllString(line, "")
+	}
+	if routeLine < 0 {
+		return template
+	}
+	lines[routeLine] = strings.TrimRight(lines[routeLine], " \t\r") + " " + keyword
+	return strings.Join(lines, "\n")
+}
+
+// orcaSolventInput 返回 Orca 的溶剂关键词行和 %cpcm 块
+func (s *SolventConfig) orcaSolventInput() (string, string, error) {
+	canonical, names, err := lookupSolvent(s.Name)
+	if err != nil {
+		return "", "", err
+	}
+	if names.Orca == "" {
+		return "", "", fmt.Errorf("solvent %s is not supported by orca", canonical)
+	}
+	if s.Model == "pcm" {
+		return "", "", fmt.Errorf("solvent model pcm is not supported by orca, use cpcm or smd")
+	}
+
+	keyword := fmt.Sprintf("! CPCM(%s)", names.Orca)
+	if s.Model == "smd" {
+		smdName := names.OrcaSMD
+		if smdName == "" {
+			smdName = names.Orca
+		}
+		return keyword, fmt.Sprintf("%%cpcm\nsmd true\nSMDsolvent \"%s\"\nend\n", smdName), nil
+	}
+	return keyword, "", nil
+}
+
+// applyOrcaSolvent 去掉 Orca 模板中已有的 CPCM(...)、SMD(...) 和 %cpcm 块，
+// 并在最后一个关键词行之后加上 [solvent] 中的溶剂
+func (s *SolventConfig) applyOrcaSolvent(template string) string {
+	if s.Name == "" {
+		return template
+	}
+	keyword, block, err := s.orcaSolventInput()
+	if err != nil {
+		return template
+	}
+
+	template = orcaCpcmBlockRegex.ReplaceAllString(template, "")
+	lines := strings.Split(template, "\n")
+	lastKeyword := -1
+	for i, line := range lines {
+		if strings.HasPrefix(strings.TrimSpace(line), "!") {
+			lines[i] = orcaSolventKeywordRegex.ReplaceAllString(line, "")
+			lastKeyword = i
+		}
+	}
+
+	insert := keyword + "\n" + block
+	if lastKeyword < 0 {
+		return insert + strings.Join(lines, "\n")
+	}
+	insert = strings.TrimRight(insert, "\n")
+	lines = append(lines[:lastKeyword+1], append([]string{insert}, lines[lastKeyword+1:]...)...)
+	return strings.Join(lines, "\n")
+}
+
+// SolventEngine 支持 [solvent] 的 Engine 实现该接口，返回该 Engine 是否支持 solvent 中的溶剂和溶剂模型
+type SolventEngine interface {
+	CheckSolvent(solvent *SolventConfig) error
+}
+
+// CheckEngineSolvent 检查 engine 是否支持 [solvent] 中的溶剂，没有设置溶剂时总是返回 nil
+func CheckEngineSolvent(engine Engine, solvent *SolventConfig) error {
+	if solvent.Name == "" {
+		return nil
+	}
+	solventEngine, ok := engine.(SolventEngine)
+	if !ok {
+		return fmt.Errorf("%s does not support the [solvent] section, please set the solvent in its template", engine.Name())
+	}
+	return solventEngine.CheckSolvent(solvent)
+}
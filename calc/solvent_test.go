@@ -0,0 +1,40 @@
+package calc
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestOrcaSolventInput(t *testing.T) {
+	tests := []struct {
+		name    string
+		model   string
+		keyword string
+		block   string
+	}{
+		{"methanol", "cpcm", "! CPCM(methanol)", ""},
+		{"methanol", "smd", "! CPCM(methanol)", "%cpcm\nsmd true\nSMDsolvent \"methanol\"\nend\n"},
+		{"diethyl ether", "smd", "! CPCM(diethylether)", "%cpcm\nsmd true\nSMDsolvent \"diethyl ether\"\nend\n"},
+		{"cs2", "cpcm", "! CPCM(carbondisulfide)", ""},
+		{"etoac", "smd", "! CPCM(ethylacetate)", "%cpcm\nsmd true\nSMDsolvent \"ethyl acetate\"\nend\n"},
+	}
+	for _, test := range tests {
+		solvent := &SolventConfig{Name: test.name, Model: test.model}
+		keyword, block, err := solvent.orcaSolventInput()
+		if err != nil {
+			t.Errorf("%s/%s: %v", test.name, test.model, err)
+			continue
+		}
+		if keyword != test.keyword || block != test.block {
+			t.Errorf("%s/%s: got %q %q, want %q %q", test.name, test.model, keyword, block, test.keyword, test.block)
+		}
+	}
+}
+
+func TestOrcaKeywordSolventNamesAreSingleWords(t *testing.T) {
+	for canonical, names := range solventTable {
+		if strings.ContainsAny(names.Orca, " ,()") {
+			t.Errorf("%s: orca keyword name %q is not a single word", canonical, names.Orca)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package calc
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+* status.go
+* 该模块用来读取一个正在运行或者已经结束的运行的工作目录，得到每一个 DFT 任务的状态，供 kybnmr status 使用
+*
+*	只读取文件，不修改工作目录中的任何文件，因此可以在运行的同时使用：
+*		1. thermo/<stage> 中的 cluster-<stage>N.* 文件决定了任务的编号
+*		2. out 文件决定了任务的状态：没有 out 文件为 pending，正常结束为 done，
+*		   没有正常结束时，如果这个步骤正在运行为 running，否则为 failed，被中断的 out.interrupted 文件也为 failed
+*		3. kybnmr.log 中每一个任务开始和结束的记录决定了任务的运行时间
+*		4. 能量：正常结束的任务使用 Engine 读取单点能，正在运行的任务使用 PartialEnergyReader 读取最近一次 SCF 能量，
+*		   优化步数和 SCF 循环数使用 JobProgressReader 读取
+*
+* @Author: Kimariyb
+* @Address: XiaMen University
+* @Data: 2023-09-26
+ */
+
+// 任务在 kybnmr status 中的状态
+const (
+	JobPending = "pending"
+	JobRunning = "running"
+	JobDone    = "done"
+	JobFailed  = "failed"
+)
+
+// PartialEnergyReader 可以从正在运行的任务的 out 文件中读取最近一次 SCF 能量的 Engine 实现该接口
+type PartialEnergyReader interface {
+	LatestEnergy(outFile string) (float64, error)
+}
+
+// JobStatus 一个 DFT 任务的状态
+//   - Name: 任务的名字，如 cluster-opt1
+//   - State: JobPending、JobRunning、JobDone 或者 JobFailed
+//   - Energy: 正常结束的任务的单点能或者正在运行的任务最近一次的 SCF 能量，单位为 Hartree，读取不到时为 nil
+//   - Progress: 正在运行的任务的优化步数和 SCF 循环数，如 step 7/100, SCF cycle 12
+//   - Seconds: 任务的运行时间，正在运行的任务为到现在为止的时间，kybnmr.log 中没有记录时为 0
+type JobStatus struct {
+	Index    int      `json:"index"`
+	Name     string   `json:"name"`
+	State    string   `json:"state"`
+	Energy   *float64 `json:"energy"`
+	Progress string   `json:"progress,omitempty"`
+	Seconds  float64  `json:"seconds"`
+}
+
+// JobTimes kybnmr.log 中记录的一个任务最近一次开始和结束的时间，还没有结束时 Finished 为零值
+type JobTimes struct {
+	Started  time.Time
+	Finished time.Time
+}
+
+// logRecord kybnmr.log 中的一条记录中 kybnmr status 需要的字段
+type logRecord struct {
+	Time      time.Time `json:"time"`
+	Msg       string    `json:"msg"`
+	Stage     string    `json:"stage"`
+	Conformer *int      `json:"conformer"`
+}
+
+// ReadJobTimes 读取 kybnmr.log，返回每一个步骤的每一个任务最近一次开始和结束的时间，以及最后一条记录的时间
+// kybnmr.log 不存在时返回空的结果，无法解析的行（如正在写入的最后一行）被跳过
+func ReadJobTimes(logFile string) (map[Stage]map[int]JobTimes, time.Time, error) {
+	times := make(map[Stage]map[int]JobTimes)
+	var last time.Time
+
+	file, err := os.Open(logFile)
+	if os.IsNotExist(err) {
+		return times, last, nil
+	}
+	if err != nil {
+		return nil, last, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var record logRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			continue
+		}
+		last = record.Time
+		if record.Conformer == nil {
+			continue
+		}
+		stage := Stage(record.Stage)
+		if times[stage] == nil {
+			times[stage] = make(map[int]JobTimes)
+		}
+		jobTimes := times[stage][*record.Conformer]
+		switch record.Msg {
+		case LogJobStarted, LogJobSubmitted:
+			jobTimes = JobTimes{Started: record.Time}
+		case LogJobCompleted, LogJobFinished:
+			jobTimes.Finished = record.Time
+		default:
+			continue
+		}
+		times[stage][*record.Conformer] = jobTimes
+	}
+
+	return times, last, scanner.Err()
+}
+
+// stageJobIndexes 返回 folder 中所有 cluster-<stage>N.* 文件的编号 N，从小到大排列
+func stageJobIndexes(folder string, stage Stage) ([]int, error) {
+	files, err := ioutil.ReadDir(folder)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	regex := regexp.MustCompile(`^cluster-` + regexp.QuoteMeta(string(stage)) + `(\d+)\.`)
+	seen := make(map[int]bool)
+	var indexes []int
+	for _, file := range files {
+		match := regex.FindStringSubmatch(file.Name())
+		if match == nil {
+			continue
+		}
+		index, _ := strconv.Atoi(match[1])
+		if !seen[index] {
+			seen[index] = true
+			indexes = append(indexes, index)
+		}
+	}
+	sort.Ints(indexes)
+	return indexes, nil
+}
+
+// ScanStageJobs 读取工作目录 workDir 中 stage 步骤的所有任务的状态，engine 为这个步骤使用的程序，
+// active 为 true 时这个步骤正在运行，times 为 ReadJobTimes 读取的这个步骤的任务的运行时间
+func ScanStageJobs(workDir string, stage Stage, engine Engine, active bool, times map[int]JobTimes, now time.Time) ([]JobStatus, error) {
+	indexes, err := stageJobIndexes(filepath.Join(workDir, stage.Folder()), stage)
+	if err != nil {
+		return nil, err
+	}
+
+	jobs := make([]JobStatus, 0, len(indexes))
+	for _, index := range indexes {
+		outFile := filepath.Join(workDir, stage.OutFile(index))
+		job := JobStatus{
+			Index: index,
+			Name:  strings.TrimSuffix(filepath.Base(outFile), filepath.Ext(outFile)),
+			State: JobPending,
+		}
+
+		if _, err := os.Stat(outFile); err == nil {
+			switch {
+			case engine.IsNormalTermination(outFile):
+				job.State = JobDone
+				if energy, err := engine.ParseEnergy(outFile); err == nil {
+					job.Energy = &energy
+				}
+			case active:
+				job.State = JobRunning
+				if reader, ok := engine.(JobProgressReader); ok {
+					job.Progress = reader.JobProgress(outFile)
+				}
+			default:
+				job.State = JobFailed
+			}
+			if reader, ok := engine.(PartialEnergyReader); ok && job.Energy == nil {
+				if energy, err := reader.LatestEnergy(outFile); err == nil {
+					job.Energy = &energy
+				}
+			}
+		} else if _, err := os.Stat(outFile + InterruptedSuffix); err == nil {
+			job.State = JobFailed
+		}
+
+		// 被 kill 的任务没有结束的记录，运行时间未知
+		if jobTimes, ok := times[index]; ok {
+			switch {
+			case job.State == JobRunning && !jobTimes.Finished.After(jobTimes.Started):
+				job.Seconds = roundSeconds(now.Sub(jobTimes.Started))
+			case job.State != JobPending && jobTimes.Finished.After(jobTimes.Started):
+				job.Seconds = roundSeconds(jobTimes.Finished.Sub(jobTimes.Started))
+			}
+		}
+		jobs = append(jobs, job)
+	}
+
+	return jobs, nil
+}
+
+// CountJobStates 返回 jobs 中每一种状态的任务数
+func CountJobStates(jobs []JobStatus) map[string]int {
+	counts := make(map[string]int)
+	for _, job := range jobs {
+		counts[job.State]++
+	}
+	return counts
+}
@@ -0,0 +1,116 @@
+package calc
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+/*
+* template.go
+* 该模块用来渲染 DFT 程序的模板文件
+*
+*	模板文件按照 Go 的 text/template 语法渲染，可以使用以下的占位符：
+*		{{.Charge}}、{{.Multiplicity}}: [molecule] 中的电荷和自旋多重度
+*		{{.NProcs}}: [resources] 中每一个任务使用的核数
+*		{{.Memory}}: [resources] 中每一个任务使用的内存，单位为 MB
+*		{{.MaxCore}}: 每一个核的内存，即 Memory/NProcs，单位为 MB，用于 Orca 的 %maxcore
+*		{{.Solvent}}: [solvent] 中溶剂的规范名，如 chloroform，没有设置溶剂时为空
+*		{{.Stage}}: 步骤名，opt、sp 或者 nmr
+*		{{.Index}}: 构象的编号，从 1 开始
+*		{{.Name}}: 任务名，如 cluster-opt1
+*		{{.Checkpoint}}: 任务的 checkpoint 文件名，如 cluster-opt1.chk
+*		{{.Title}}: 任务的标题，如 "mol opt conformer 1"
+*		{{.Geometry}}: 与 [GEOMETRY] 相同，会被替换为原子坐标
+*	没有占位符的模板渲染之后保持不变，因此原来只使用 [GEOMETRY] 的模板仍然可以使用
+*
+* @Author: Kimariyb
+* @Address: XiaMen University
+* @Data: 2023-09-26
+ */
+
+// TemplateData 渲染模板文件时可以使用的变量
+type TemplateData struct {
+	Charge       int
+	Multiplicity int
+	NProcs       int
+	Memory       int
+	MaxCore      int
+	Solvent      string
+	Molecule     string
+	Stage        Stage
+	Index        int
+	Name         string
+	Checkpoint   string
+	Title        string
+	Geometry     string
+}
+
+// NewTemplateData 根据配置文件返回所有任务共用的模板变量，molecule 为分子名，用于任务的标题
+func NewTemplateData(config *Config, molecule string) TemplateData {
+	data := TemplateData{
+		Charge:       config.MoleculeConfig.Charge,
+		Multiplicity: config.MoleculeConfig.Multiplicity,
+		NProcs:       config.ResourceConfig.NProcs,
+		Memory:       config.ResourceConfig.Memory,
+		MaxCore:      config.ResourceConfig.MaxCore(),
+		Molecule:     molecule,
+		Geometry:     "[GEOMETRY]",
+	}
+	if config.SolventConfig.Name != "" {
+		if canonical, _, err := lookupSolvent(config.SolventConfig.Name); err == nil {
+			data.Solvent = canonical
+		}
+	}
+	return data
+}
+
+// ForJob 返回 stage 步骤中第 index 个（从 1 开始）任务的模板变量
+func (d TemplateData) ForJob(stage Stage, index int) TemplateData {
+	d.Stage = stage
+	d.Index = index
+	d.Name = fmt.Sprintf("cluster-%s%d", stage, index)
+	d.Checkpoint = d.Name + ".chk"
+	d.Title = strings.TrimSpace(fmt.Sprintf("%s %s conformer %d", d.Molecule, stage, index))
+	return d
+}
+
+// parseTemplate 解析模板文件的内容，name 用于错误信息
+func parseTemplate(name string, content string) (*template.Template, error) {
+	tmpl, err := template.New(name).Option("missingkey=error").Parse(content)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing template: %w", err)
+	}
+	return tmpl, nil
+}
+
+// renderTemplate 用 data 渲染模板
+func renderTemplate(tmpl *template.Template, data TemplateData) (string, error) {
+	var buffer bytes.Buffer
+	if err := tmpl.Execute(&buffer, data); err != nil {
+		return "", fmt.Errorf("error rendering template: %w", err)
+	}
+	return buffer.String(), nil
+}
+
+// CheckTemplate 在运行任何计算之前检查 stage 步骤的模板 stageTemplate 能否用 data 渲染，
+// 避免模板写错时白白跑完动力学模拟
+func CheckTemplate(stage Stage, stageTemplate StageTemplate, data TemplateData) error {
+	content := stageTemplate.Content
+	if content == "" {
+		fileContent, err := ioutil.ReadFile(stageTemplate.File)
+		if err != nil {
+			return fmt.Errorf("error reading template file: %w", err)
+		}
+		content = string(fileContent)
+	}
+	tmpl, err := parseTemplate(filepath.Base(stageTemplate.File), content)
+	if err != nil {
+		return err
+	}
+	_, err = renderTemplate(tmpl, data.ForJob(stage, 1))
+	return err
+}
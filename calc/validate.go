@@ -0,0 +1,582 @@
+package calc
+
+import (
+	"bufio"
+	"fmt"
+	"gopkg.in/ini.v1"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+* validate.go
+* 该模块用来严格检查配置文件，一次报告配置文件中所有的问题，每一个问题都带有行号、section 和 key，例如：
+*	config.ini:14: [dynamics] dump: 10 fs is shorter than the time step 20 fs
+*	config.ini:27: [optimized] preThreshold: got 1 number(s) instead of 2, expected "energy, distance" such as "0.25, 0.1"
+*	config.ini:31: [optimized] gauPath: /kimariyb/g16/g16 is not an executable file
+*
+*	1. configReader 读取每一个 key 时检查值的类型，并记录读取过的 key，没有被读取过的 key 和 section 都是未知的
+*	2. Config.validate 检查不可能的物理量，如负的温度、dump 小于 step、阈值的个数等
+*	3. Config.programIssues 检查本次运行用到的程序（ConfigLayers.Programs）是否都填写了路径，并且是可以执行的文件，
+*	   与配置文件中的其它问题一起报告
+*
+* @Author: Kimariyb
+* @Address: XiaMen University
+* @Data: 2023-09-26
+ */
+
+// ConfigIssue 配置文件中的一个问题，Line 为 0 表示配置文件中没有对应的行（例如缺少的 key）
+type ConfigIssue struct {
+	File    string
+	Line    int
+	Section string
+	Key     string
+	Message string
+}
+
+// String 返回 file:line: [section] key: message
+func (i ConfigIssue) String() string {
+	location := i.File
+	if i.Line > 0 {
+		location = fmt.Sprintf("%s:%d", i.File, i.Line)
+	}
+	if i.Section == "" {
+		return fmt.Sprintf("%s: %s", location, i.Message)
+	}
+	if i.Key == "" {
+		return fmt.Sprintf("%s: [%s] %s", location, i.Section, i.Message)
+	}
+	return fmt.Sprintf("%s: [%s] %s: %s", location, i.Section, i.Key, i.Message)
+}
+
+// ConfigError 配置文件中所有的问题
+type ConfigError struct {
+	Issues []ConfigIssue
+}
+
+// newConfigError 返回 issues 的 ConfigError，问题按照行号排序
+func newConfigError(issues []ConfigIssue) *ConfigError {
+	sort.SliceStable(issues, func(i, j int) bool { return issues[i].Line < issues[j].Line })
+	return &ConfigError{Issues: issues}
+}
+
+// Error 每一行输出一个问题
+func (e *ConfigError) Error() string {
+	lines := []string{fmt.Sprintf("%d problem(s) found in the config file:", len(e.Issues))}
+	for _, issue := range e.Issues {
+		lines = append(lines, "  "+issue.String())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// configSource 配置中一个值的来源：配置文件和行号，或者环境变量名、--set 等没有行号的来源
+type configSource struct {
+	File string
+	Line int
+}
+
+// String 返回 file:line，没有行号时只返回 File
+func (s configSource) String() string {
+	if s.Line > 0 {
+		return fmt.Sprintf("%s:%d", s.File, s.Line)
+	}
+	return s.File
+}
+
+// configLines 配置中每一个 section 和 key 的来源，分层读取时后面的来源覆盖前面的
+//   - file: 没有来源的问题（例如缺少的 key）报告在这个文件中
+type configLines struct {
+	file     string
+	sections map[string]configSource
+	keys     map[string]configSource
+}
+
+// newConfigLines 返回没有任何来源的 configLines
+func newConfigLines(file string) *configLines {
+	return &configLines{file: file, sections: make(map[string]configSource), keys: make(map[string]configSource)}
+}
+
+// source 返回 [section] key 的来源，key 为空时返回 section 的来源
+func (l *configLines) source(section string, key string) configSource {
+	source := l.sections[section]
+	if key != "" {
+		source = l.keys[lineKey(section, key)]
+	}
+	if source.File == "" {
+		source = configSource{File: l.file}
+	}
+	return source
+}
+
+// merge 用 other 中的来源覆盖 l 中的来源
+func (l *configLines) merge(other *configLines) {
+	for section, source := range other.sections {
+		l.sections[section] = source
+	}
+	for key, source := range other.keys {
+		l.keys[key] = source
+	}
+}
+
+// lineKey 返回 configLines.keys 的键
+func lineKey(section string, key string) string {
+	return section + "." + key
+}
+
+// scanConfigLines 扫描配置文件，记录每一个 section 和 key 第一次出现的行号
+func scanConfigLines(configFile string) (*configLines, error) {
+	file, err := os.Open(configFile)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	lines := newConfigLines(configFile)
+	section := ini.DefaultSection
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "" || strings.HasPrefix(line, ";") || strings.HasPrefix(line, "#"):
+		case strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]"):
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			if _, ok := lines.sections[section]; !ok {
+				lines.sections[section] = configSource{File: configFile, Line: lineNumber}
+			}
+		default:
+			end := strings.IndexAny(line, "=:")
+			if end < 0 {
+				continue
+			}
+			key := lineKey(section, strings.TrimSpace(line[:end]))
+			if _, ok := lines.keys[key]; !ok {
+				lines.keys[key] = configSource{File: configFile, Line: lineNumber}
+			}
+		}
+	}
+
+	return lines, scanner.Err()
+}
+
+// ResolvedValue 配置中一个 key 的最终值和来源，Source 为 "default" 时是内置的默认值
+type ResolvedValue struct {
+	Section string `json:"section"`
+	Key     string `json:"key"`
+	Value   string `json:"value"`
+	Source  string `json:"source"`
+}
+
+// configReader 按照类型读取配置文件中的值，并记录所有的问题、读取过的 key、它们的默认值以及最终值
+type configReader struct {
+	iniFile  *ini.File
+	lines    *configLines
+	known    map[string]bool
+	defaults map[string]interface{}
+	issues   []ConfigIssue
+	resolved []ResolvedValue
+}
+
+// newConfigReader 返回读取 iniFile 的 configReader，lines 用于输出行号
+func newConfigReader(iniFile *ini.File, lines *configLines) *configReader {
+	return &configReader{iniFile: iniFile, lines: lines, known: make(map[string]bool), defaults: make(map[string]interface{})}
+}
+
+// addIssue 记录 [section] key 的一个问题，key 为空表示整个 section 的问题
+func (r *configReader) addIssue(section string, key string, format string, args ...interface{}) {
+	source := r.lines.source(section, key)
+	r.issues = append(r.issues, ConfigIssue{
+		File:    source.File,
+		Line:    source.Line,
+		Section: section,
+		Key:     key,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+// value 返回 [section] key 的值以及配置中是否有这个 key，将 key 记录为已知的 key，
+// 并记录它的最终值和来源，没有这个 key 时最终值为默认值 def
+func (r *configReader) value(section string, key string, def interface{}) (string, bool) {
+	r.known[lineKey(section, key)] = true
+	r.defaults[lineKey(section, key)] = def
+	iniSection, err := r.iniFile.GetSection(section)
+	if err != nil || !iniSection.HasKey(key) {
+		r.resolved = append(r.resolved, ResolvedValue{Section: section, Key: key, Value: fmt.Sprint(def), Source: "default"})
+		return "", false
+	}
+	value := strings.TrimSpace(iniSection.Key(key).String())
+	r.resolved = append(r.resolved, ResolvedValue{Section: section, Key: key, Value: value, Source: r.lines.source(section, key).String()})
+	return value, true
+}
+
+// String 读取字符串，没有这个 key 时返回 def
+func (r *configReader) String(section string, key string, def string) string {
+	value, ok := r.value(section, key, def)
+	if !ok {
+		return def
+	}
+	return value
+}
+
+// Float64 读取浮点数，没有这个 key 或者值有误时返回 def
+func (r *configReader) Float64(section string, key string, def float64) float64 {
+	value, ok := r.value(section, key, def)
+	if !ok {
+		return def
+	}
+	number, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		r.addIssue(section, key, "expected a number, got %q", value)
+		return def
+	}
+	return number
+}
+
+// Int 读取整数，没有这个 key 或者值有误时返回 def
+func (r *configReader) Int(section string, key string, def int) int {
+	value, ok := r.value(section, key, def)
+	if !ok {
+		return def
+	}
+	number, err := strconv.Atoi(value)
+	if err != nil {
+		r.addIssue(section, key, "expected an integer, got %q", value)
+		return def
+	}
+	return number
+}
+
+// Bool 读取布尔值，没有这个 key 或者值有误时返回 def
+func (r *configReader) Bool(section string, key string, def bool) bool {
+	value, ok := r.value(section, key, def)
+	if !ok {
+		return def
+	}
+	switch strings.ToLower(value) {
+	case "true", "yes", "on", "1":
+		return true
+	case "false", "no", "off", "0":
+		return false
+	}
+	r.addIssue(section, key, "expected true or false, got %q", value)
+	return def
+}
+
+// Duration 读取时间长度，如 90m、12h，没有这个 key 或者值有误时返回 def
+func (r *configReader) Duration(section string, key string, def time.Duration) time.Duration {
+	value, ok := r.value(section, key, def)
+	if !ok {
+		return def
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		r.addIssue(section, key, "expected a duration such as 90m or 12h, got %q", value)
+		return def
+	}
+	if duration < 0 {
+		r.addIssue(section, key, "must not be negative, got %s", value)
+		return def
+	}
+	return duration
+}
+
+// checkUnknownKeys 记录所有没有被读取过的 section 和 key，并给出拼写相近的已知 key
+func (r *configReader) checkUnknownKeys() {
+	knownSections := make(map[string]bool)
+	for name := range r.known {
+		section, _, _ := strings.Cut(name, ".")
+		knownSections[section] = true
+	}
+
+	for _, section := range r.iniFile.Sections() {
+		name := section.Name()
+		if name != ini.DefaultSection && !knownSections[name] {
+			r.addIssue(name, "", "unknown section%s", suggestion(name, sortedKeys(knownSections)))
+			continue
+		}
+		for _, key := range section.KeyStrings() {
+			if r.known[lineKey(name, key)] {
+				continue
+			}
+			if name == ini.DefaultSection {
+				r.addIssue(name, key, "key outside of any section")
+				continue
+			}
+			var candidates []string
+			for known := range r.known {
+				if section, knownKey, _ := strings.Cut(known, "."); section == name {
+					candidates = append(candidates, knownKey)
+				}
+			}
+			sort.Strings(candidates)
+			r.addIssue(name, key, "unknown key%s", suggestion(key, candidates))
+		}
+	}
+}
+
+// sortedKeys 返回 set 中所有的键，按照字母顺序排序
+func sortedKeys(set map[string]bool) []string {
+	var keys []string
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// suggestion 返回 candidates 中与 name 拼写最相近的一个，用于提示 ", did you mean xxx?"，没有相近的时返回空字符串
+func suggestion(name string, candidates []string) string {
+	best, bestDistance := "", 3
+	for _, candidate := range candidates {
+		distance := editDistance(strings.ToLower(name), strings.ToLower(candidate))
+		if distance < bestDistance {
+			best, bestDistance = candidate, distance
+		}
+	}
+	if best == "" {
+		return ""
+	}
+	return fmt.Sprintf(", did you mean %s?", best)
+}
+
+// editDistance 返回 a 和 b 之间的编辑距离
+func editDistance(a string, b string) int {
+	previous := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current := make([]int, len(b)+1)
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = minInt(previous[j]+1, minInt(current[j-1]+1, previous[j-1]+cost))
+		}
+		previous = current
+	}
+	return previous[len(b)]
+}
+
+// minInt 返回 a 和 b 中较小的一个
+func minInt(a int, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// parseFloatList 严格解析用逗号隔开的 count 个数字，与 utils.SplitStringByComma 不同，任何一项有误都会返回错误
+func parseFloatList(text string, count int) ([]float64, error) {
+	fields := strings.Split(text, ",")
+	if len(fields) != count {
+		return nil, fmt.Errorf("got %d number(s) instead of %d", len(fields), count)
+	}
+	values := make([]float64, count)
+	for i, field := range fields {
+		value, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a number", strings.TrimSpace(field))
+		}
+		values[i] = value
+	}
+	return values, nil
+}
+
+// validate 检查配置中不可能的值，问题记录在 r 中
+func (c *Config) validate(r *configReader) {
+	positive := func(section string, key string, value float64) {
+		if value <= 0 {
+			r.addIssue(section, key, "must be positive, got %g", value)
+		}
+	}
+
+	// [dynamics]
+	dynamics := &c.DyConfig
+	positive("dynamics", "temperature", dynamics.Temperature)
+	positive("dynamics", "time", dynamics.Time)
+	positive("dynamics", "dump", dynamics.Dump)
+	positive("dynamics", "step", dynamics.Step)
+	positive("dynamics", "sccacc", dynamics.Sccacc)
+	if dynamics.Dump > 0 && dynamics.Step > 0 && dynamics.Dump < dynamics.Step {
+		r.addIssue("dynamics", "dump", "%g fs is shorter than the time step %g fs", dynamics.Dump, dynamics.Step)
+	}
+	if dynamics.Time > 0 && dynamics.Dump > 0 && dynamics.Time*1000 < dynamics.Dump {
+		r.addIssue("dynamics", "time", "%g ps is shorter than the dump interval %g fs", dynamics.Time, dynamics.Dump)
+	}
+	if dynamics.Hmass < 1 {
+		r.addIssue("dynamics", "hmass", "must be at least 1, got %d", dynamics.Hmass)
+	}
+	if dynamics.Shake < 0 || dynamics.Shake > 2 {
+		r.addIssue("dynamics", "shake", "must be 0, 1 or 2, got %d", dynamics.Shake)
+	}
+
+	// [optimized]
+	for _, threshold := range []struct {
+		key   string
+		value string
+	}{{"preThreshold", c.OptConfig.PreThreshold}, {"postThreshold", c.OptConfig.PostThreshold}} {
+		values, err := parseFloatList(threshold.value, 2)
+		if err != nil {
+			r.addIssue("optimized", threshold.key, "%v, expected \"energy, distance\" such as \"0.25, 0.1\"", err)
+		} else if values[0] < 0 || values[1] < 0 {
+			r.addIssue("optimized", threshold.key, "thresholds must not be negative, got %q", threshold.value)
+		}
+	}
+	if c.OptConfig.Preset != "" {
+		if _, err := LookupPreset(c.OptConfig.Preset); err != nil {
+			r.addIssue("optimized", "preset", "%v", err)
+		}
+	}
+
+	// [nmr]
+	positive("nmr", "temperature", c.NMRConfig.Temperature)
+
+	// [dp4]
+	for _, field := range []struct {
+		key   string
+		value string
+	}{
+		{"scaledC", c.DP4Config.ScaledC}, {"scaledH", c.DP4Config.ScaledH},
+		{"unscaledSp2C", c.DP4Config.UnscaledSp2C}, {"unscaledSp3C", c.DP4Config.UnscaledSp3C},
+		{"unscaledSp2H", c.DP4Config.UnscaledSp2H}, {"unscaledSp3H", c.DP4Config.UnscaledSp3H},
+	} {
+		if field.value == "" {
+			continue
+		}
+		values, err := parseFloatList(field.value, 3)
+		if err != nil {
+			r.addIssue("dp4", field.key, "%v, expected \"mu, sigma, nu\"", err)
+		} else if values[1] <= 0 || values[2] <= 0 {
+			r.addIssue("dp4", field.key, "sigma and nu must be positive, got %q", field.value)
+		}
+	}
+
+	// [molecule]
+	if c.MoleculeConfig.Multiplicity < 1 {
+		r.addIssue("molecule", "multiplicity", "must be at least 1, got %d", c.MoleculeConfig.Multiplicity)
+	}
+
+	// [solvent]
+	if c.SolventConfig.Name != "" {
+		if _, _, err := lookupSolvent(c.SolventConfig.Name); err != nil {
+			r.addIssue("solvent", "name", "%v", err)
+		}
+	}
+	if err := checkSolventModel(c.SolventConfig.Model); err != nil {
+		r.addIssue("solvent", "model", "%v", err)
+	}
+	if err := checkXtbSolventModel(c.SolventConfig.XtbModel); err != nil {
+		r.addIssue("solvent", "xtbModel", "%v", err)
+	}
+
+	// [resources]
+	if c.ResourceConfig.NProcs < 1 {
+		r.addIssue("resources", "nprocs", "must be at least 1, got %d", c.ResourceConfig.NProcs)
+	}
+	if c.ResourceConfig.Memory < 1 {
+		r.addIssue("resources", "memory", "must be at least 1 MB, got %d", c.ResourceConfig.Memory)
+	}
+
+	// [batch]
+	switch c.BatchConfig.Scheduler {
+	case "local", "slurm", "pbs":
+	default:
+		r.addIssue("batch", "scheduler", "unknown scheduler %q (available: local, slurm, pbs)", c.BatchConfig.Scheduler)
+	}
+	if c.BatchConfig.PollInterval < 1 {
+		r.addIssue("batch", "pollInterval", "must be at least 1 s, got %d", c.BatchConfig.PollInterval)
+	}
+	if c.BatchConfig.HeaderFile != "" {
+		if _, err := os.Stat(c.BatchConfig.HeaderFile); err != nil {
+			r.addIssue("batch", "header", "%v", err)
+		}
+	}
+}
+
+// programPathKeys 每一个程序在 [optimized] 中的路径 key
+var programPathKeys = map[string]string{
+	"gaussian": "gauPath",
+	"orca":     "orcaPath",
+	"psi4":     "psi4Path",
+	"nwchem":   "nwchemPath",
+	"xtb":      "xtbPath",
+	"shermo":   "shermoPath",
+}
+
+// ProgramPathKey 返回程序 name 在 [optimized] 中的路径 key，没有路径 key 的程序返回空字符串
+func ProgramPathKey(name string) string {
+	return programPathKeys[name]
+}
+
+// ProgramPath 返回程序 name 在 [optimized] 中的路径，没有路径 key 的程序返回空字符串
+func (c *Config) ProgramPath(name string) string {
+	switch name {
+	case "gaussian":
+		return c.OptConfig.GauPath
+	case "orca":
+		return c.OptConfig.OrcaPath
+	case "psi4":
+		return c.OptConfig.Psi4Path
+	case "nwchem":
+		return c.OptConfig.NWChemPath
+	case "xtb":
+		return c.OptConfig.XtbPath
+	case "shermo":
+		return c.OptConfig.ShermoPath
+	}
+	return ""
+}
+
+// SetProgramPath 将程序 name 在 [optimized] 中的路径设置为 path，没有路径 key 的程序不做任何事
+func (c *Config) SetProgramPath(name string, path string) {
+	switch name {
+	case "gaussian":
+		c.OptConfig.GauPath = path
+	case "orca":
+		c.OptConfig.OrcaPath = path
+	case "psi4":
+		c.OptConfig.Psi4Path = path
+	case "nwchem":
+		c.OptConfig.NWChemPath = path
+	case "xtb":
+		c.OptConfig.XtbPath = path
+	case "shermo":
+		c.OptConfig.ShermoPath = path
+	}
+}
+
+// programIssues 检查 programs 中每一个程序（engine 名或者 shermo）是否都填写了路径，并且是可以执行的文件，
+// 返回所有的问题，不需要外部程序的 Engine（如 fake）会被跳过
+func (c *Config) programIssues(programs []string) []ConfigIssue {
+	var issues []ConfigIssue
+	checked := make(map[string]bool)
+	for _, program := range programs {
+		key, ok := programPathKeys[program]
+		if !ok || checked[program] {
+			continue
+		}
+		checked[program] = true
+
+		issue := ConfigIssue{Section: "optimized", Key: key}
+		if c.lines != nil {
+			source := c.lines.source("optimized", key)
+			issue.File, issue.Line = source.File, source.Line
+		}
+		path := c.ProgramPath(program)
+		if path == "" {
+			issue.Message = fmt.Sprintf("missing path of %s", program)
+		} else if _, err := exec.LookPath(path); err != nil {
+			issue.Message = fmt.Sprintf("%s is not an executable file: %v", path, err)
+		} else {
+			continue
+		}
+		issues = append(issues, issue)
+	}
+	return issues
+}
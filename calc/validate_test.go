@@ -0,0 +1,96 @@
+package calc
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// loadTestConfig 将 contents 写入临时文件夹中的 config.ini，并使用 programs 读取它，返回 *ConfigError 中的所有问题
+func loadTestConfig(t *testing.T, contents string, programs ...string) []string {
+	t.Helper()
+	configFile := filepath.Join(t.TempDir(), "config.ini")
+	if err := ioutil.WriteFile(configFile, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, err := LoadConfig(ConfigLayers{ProjectFile: configFile, Programs: programs})
+	if err == nil {
+		return nil
+	}
+	var configErr *ConfigError
+	if !errors.As(err, &configErr) {
+		t.Fatalf("LoadConfig error %v, want a *ConfigError", err)
+	}
+	var issues []string
+	for _, issue := range configErr.Issues {
+		issues = append(issues, strings.TrimPrefix(issue.String(), configFile))
+	}
+	return issues
+}
+
+func TestLoadConfigReportsEveryIssue(t *testing.T) {
+	tests := []struct {
+		name     string
+		contents string
+		programs []string
+		want     []string
+	}{
+		{
+			name:     "valid",
+			contents: "[dynamics]\ntime = 10\nstep = 1\ndump = 50\n",
+			want:     nil,
+		},
+		{
+			name:     "unknown keys",
+			contents: "[dynamics]\ntemprature = 300\n[optimised]\nxtbPath = xtb\n",
+			want: []string{
+				`:2: [dynamics] temprature: unknown key, did you mean temperature?`,
+				`:3: [optimised] unknown section, did you mean optimized?`,
+			},
+		},
+		{
+			name:     "type errors",
+			contents: "[dynamics]\ntemperature = hot\nhmass = 1.5\nvelo = maybe\n[walltime]\nopt = soon\n",
+			want: []string{
+				`:2: [dynamics] temperature: expected a number, got "hot"`,
+				`:3: [dynamics] hmass: expected an integer, got "1.5"`,
+				`:4: [dynamics] velo: expected true or false, got "maybe"`,
+				`:6: [walltime] opt: expected a duration such as 90m or 12h, got "soon"`,
+			},
+		},
+		{
+			name:     "threshold arity",
+			contents: "[optimized]\npreThreshold = \"0.25\"\npostThreshold = \"0.25, 0.1, 3\"\n",
+			want: []string{
+				`:2: [optimized] preThreshold: got 1 number(s) instead of 2, expected "energy, distance" such as "0.25, 0.1"`,
+				`:3: [optimized] postThreshold: got 3 number(s) instead of 2, expected "energy, distance" such as "0.25, 0.1"`,
+			},
+		},
+		{
+			name:     "dump shorter than step",
+			contents: "[dynamics]\nstep = 20\ndump = 10\n",
+			want:     []string{`:3: [dynamics] dump: 10 fs is shorter than the time step 20 fs`},
+		},
+		{
+			// 程序的路径与其它问题在同一个错误中报告，并且按照行号排序
+			name:     "program paths",
+			contents: "[optimized]\ngauPath = /nonexistent/g16\nshermoPath = \"\"\n[dynamics]\nstep = 20\ndump = 10\n",
+			programs: []string{"gaussian", "fake", "shermo"},
+			want: []string{
+				`:2: [optimized] gauPath: /nonexistent/g16 is not an executable file: exec: "/nonexistent/g16": stat /nonexistent/g16: no such file or directory`,
+				`:3: [optimized] shermoPath: missing path of shermo`,
+				`:6: [dynamics] dump: 10 fs is shorter than the time step 20 fs`,
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := loadTestConfig(t, test.contents, test.programs...)
+			if strings.Join(got, "\n") != strings.Join(test.want, "\n") {
+				t.Errorf("issues:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(test.want, "\n"))
+			}
+		})
+	}
+}
@@ -0,0 +1,161 @@
+package calc
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"kybnmr/utils"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+/*
+* xtb.go
+* 该模块实现了 xtb 程序的 Engine，用 GFN-xTB 代替 DFT 做优化和单点能计算，
+* 可以在几分钟内跑通整个流程，检查输入和配置，之后再用 Gaussian/Orca 计算
+*
+*	1. 优化步骤运行 xtb cluster-opt1.xyz --ohess <xtbArgs> --chrg <charge> --uhf <未成对电子数>，即优化之后再做振动分析 (--opt + --hess)，
+*	   从 xtbopt.xyz 中读取优化后的结构，从 out 文件中读取 G(RRHO) contrib. 作为自由能热校正量
+*	2. 单点能步骤运行 xtb cluster-sp1.xyz <xtbArgs> --chrg <charge> --uhf <未成对电子数>，从 out 文件中读取 TOTAL ENERGY
+*	3. xtb 不能计算 NMR 屏蔽常数，因此不能用于 NMR 步骤
+*
+*	溶剂模型直接写在 xtbArgs 中，例如 --gbsa chcl3 或者 --alpb chcl3，设置了 [solvent] 时会被替换为其中的溶剂
+*	每一个任务都在 out 文件同名的文件夹 (如 thermo/opt/cluster-opt1) 中运行，xtb 生成的文件都保存在这个文件夹中
+*
+* @Version:
+* 	xtb: 6.6.0 (8843059)
+*
+* @Author: Kimariyb
+* @Address: XiaMen University
+* @Data: 2023-09-25
+ */
+
+func init() {
+	RegisterEngine("xtb", func(config *Config) Engine {
+		return &XtbEngine{Path: config.OptConfig.XtbPath, Args: config.OptConfig.XtbArgs, Molecule: config.MoleculeConfig, Solvent: config.SolventConfig}
+	})
+}
+
+var (
+	xtbEnergyRegex = regexp.MustCompile(`TOTAL ENERGY\s+(-?\d+\.\d+)\s+Eh`)
+	xtbGibbsRegex  = regexp.MustCompile(`G\(RRHO\) contrib\.\s+(-?\d+\.\d+)\s+Eh`)
+)
+
+// XtbEngine 调用 xtb 的 Engine
+//   - Path: xtb 的运行路径，即配置文件中的 xtbPath
+//   - Args: 方法和溶剂模型等参数，即配置文件中的 xtbArgs
+//   - Molecule: 电荷和自旋多重度，以 --chrg 和 --uhf 传给 xtb
+//   - Solvent: [solvent] 中的溶剂，设置之后替换 Args 中的 --alpb/--gbsa
+type XtbEngine struct {
+	Path     string
+	Args     string
+	Molecule MoleculeConfig
+	Solvent  SolventConfig
+}
+
+// Name 返回程序的名字
+func (x *XtbEngine) Name() string {
+	return "xtb"
+}
+
+// TemplateFile xtb 不需要模板文件，直接使用 xyz 文件作为输入
+func (x *XtbEngine) TemplateFile(stage Stage) string {
+	return ""
+}
+
+// Supports xtb 只能用于优化和单点能步骤
+func (x *XtbEngine) Supports(stage Stage) bool {
+	return stage == StageOpt || stage == StageSP
+}
+
+// BuildInput 将 cluster 写成 xyz 文件的内容
+func (x *XtbEngine) BuildInput(template string, cluster Cluster) string {
+	return fmt.Sprintf("%d\n\n%s", len(cluster.Atoms), cluster.ToXYZString())
+}
+
+// CommandLine 返回 xtb input.xyz --ohess <xtbArgs> --chrg 0 --uhf 0 > output.out 2>&1
+// xtb 会把 normal termination of xtb 写入标准错误输出，因此这里同时重定向标准错误输出
+func (x *XtbEngine) CommandLine(stage Stage, inputFile string, outFile string) string {
+	var args []string
+	if stage == StageOpt {
+		args = append(args, "--ohess")
+	}
+	args = xtbCommonArgs(append(args, utils.SplitStringBySpace(x.Args)...), &x.Molecule, &x.Solvent)
+	return fmt.Sprintf("%s %s %s > %s 2>&1", x.Path, inputFile, strings.Join(args, " "), outFile)
+}
+
+// Run 在 out 文件同名的文件夹中运行 xtb
+func (x *XtbEngine) Run(ctx context.Context, stage Stage, inputFile string, outFile string) error {
+	inputPath, outPath, err := absPaths(inputFile, outFile)
+	if err != nil {
+		return err
+	}
+
+	workDir := x.JobDir(inputPath, outPath)
+	if err := os.MkdirAll(workDir, 0755); err != nil {
+		return err
+	}
+
+	return runShellCommandIn(ctx, workDir, x.CommandLine(stage, inputPath, outPath), JobLogFile(outPath))
+}
+
+// CheckSolvent 检查 xtb 是否支持 solvent 中的溶剂
+func (x *XtbEngine) CheckSolvent(solvent *SolventConfig) error {
+	_, err := solvent.xtbSolvent()
+	return err
+}
+
+// JobDir 每一个 xtb 任务都在 out 文件同名的文件夹中运行
+func (x *XtbEngine) JobDir(inputFile string, outFile string) string {
+	return xtbWorkDir(outFile)
+}
+
+// ParseGeometry 读取任务文件夹中 xtbopt.xyz 的结构，能量为 out 文件中的 TOTAL ENERGY
+func (x *XtbEngine) ParseGeometry(outFile string) (Cluster, error) {
+	if !utils.CheckFileType(outFile, ".out") {
+		return Cluster{}, fmt.Errorf("error the format of input file")
+	}
+
+	clusters, err := ParseXyzFile(filepath.Join(xtbWorkDir(outFile), "xtbopt.xyz"))
+	if err != nil {
+		return Cluster{}, err
+	}
+	if len(clusters) == 0 {
+		return Cluster{}, fmt.Errorf("no structure found in xtbopt.xyz of %s", outFile)
+	}
+
+	cluster := clusters[len(clusters)-1]
+	cluster.Energy, err = x.ParseEnergy(outFile)
+	return cluster, err
+}
+
+// ParseEnergy 读取 | TOTAL ENERGY              -5.070544440612 Eh   |
+func (x *XtbEngine) ParseEnergy(outFile string) (float64, error) {
+	return findLastFloat(outFile, xtbEnergyRegex)
+}
+
+// ParseGibbsCorrection 读取 :: G(RRHO) contrib.           0.002119934345 Eh   ::
+func (x *XtbEngine) ParseGibbsCorrection(outFile string) (float64, error) {
+	return findLastFloat(outFile, xtbGibbsRegex)
+}
+
+// ParseShieldings xtb 不能计算 NMR 屏蔽常数
+func (x *XtbEngine) ParseShieldings(outFile string) ([]NucleusShielding, error) {
+	return nil, fmt.Errorf("xtb does not support NMR shielding calculations: %s", outFile)
+}
+
+// IsNormalTermination 判断 out 文件中是否有 normal termination of xtb
+func (x *XtbEngine) IsNormalTermination(outFile string) bool {
+	contents, err := ioutil.ReadFile(outFile)
+	if err != nil {
+		return false
+	}
+	return strings.Contains(string(contents), "normal termination of xtb")
+}
+
+// xtbWorkDir 返回 out 文件对应的任务文件夹，如 thermo/opt/cluster-opt1.out 对应 thermo/opt/cluster-opt1
+func xtbWorkDir(outFile string) string {
+	return strings.TrimSuffix(outFile, filepath.Ext(outFile))
+}
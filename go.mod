@@ -1,13 +1,17 @@
 module kybnmr
 
-go 1.20
+go 1.21
 
-require gopkg.in/ini.v1 v1.67.0
+require (
+	github.com/BurntSushi/toml v1.5.0
+	github.com/urfave/cli/v2 v2.25.7
+	gopkg.in/ini.v1 v1.67.0
+	gopkg.in/yaml.v3 v3.0.1
+)
 
 require (
 	github.com/cpuguy83/go-md2man/v2 v2.0.2 // indirect
 	github.com/russross/blackfriday/v2 v2.1.0 // indirect
 	github.com/stretchr/testify v1.8.4 // indirect
-	github.com/urfave/cli/v2 v2.25.7 // indirect
 	github.com/xrash/smetrics v0.0.0-20201216005158-039620a65673 // indirect
 )
@@ -0,0 +1,294 @@
+package run
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"kybnmr/calc"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*
+* batch.go
+* 该模块用来处理 kybnmr batch 子命令：对清单文件中的每一个分子运行完整的 KYBNMR 流程
+*
+*	1. 每一个分子的工作目录为 runs/<分子名>（使用 --workdir 时为 <workdir>/<分子名>），
+*	   命令行中的 --set、--charge、--multiplicity 和清单中的 charge、multiplicity、solvent、overrides 依次写入
+*	   工作目录中的配置文件（与 --config 的格式相同），因此清单中的配置覆盖命令行中的值
+*	2. 每一个分子都在单独的 KYBNMR 进程中运行，命令行中的 --opt、--sp、--nmr、--md、--verbose 等参数会传给每一个进程，
+*	   进程的输出写入工作目录中的 kybnmr.out，同时运行的进程数不超过 --jobs
+*	3. 所有分子结束之后，输出汇总表，并写入 batch_summary.csv
+*
+* @Author: Kimariyb
+* @Address: XiaMen University
+* @Data: 2023-09-26
+ */
+
+// batchStatus 一个分子在 batch 中的运行结果
+type batchStatus struct {
+	Entry   calc.ManifestEntry
+	Name    string
+	WorkDir string
+	Elapsed time.Duration
+	Err     error
+	Result  *calc.NMRResult
+}
+
+// runBatch 并行运行 manifestFile 中的所有分子，同时运行的分子数不超过 jobs
+func (k *KYBNMR) runBatch(ctx context.Context, manifestFile string, jobs int) error {
+	if jobs < 1 {
+		return fmt.Errorf("error: --jobs must be at least 1")
+	}
+
+	entries, err := calc.ParseManifest(manifestFile)
+	if err != nil {
+		return err
+	}
+	if err := k.checkConfigFile(); err != nil {
+		return err
+	}
+	// 每一个分子的配置文件在子进程中还会再检查一次，这里先检查共用的部分，避免每一个分子都因为同一个问题失败
+	if _, err := k.loadConfig(); err != nil {
+		return err
+	}
+	executable, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("error locating the kybnmr executable: %w", err)
+	}
+
+	baseDir := k.workdir
+	if baseDir == "" {
+		baseDir = "runs"
+	}
+
+	// 分子名不能重复，否则工作目录会互相覆盖
+	statuses := make([]*batchStatus, len(entries))
+	names := make(map[string]int)
+	for i, entry := range entries {
+		if !filepath.IsAbs(entry.Input) {
+			entry.Input = filepath.Join(filepath.Dir(manifestFile), entry.Input)
+		}
+		name := moleculeName(entry.Input)
+		if line, ok := names[name]; ok {
+			return fmt.Errorf("%s:%d: duplicate molecule name %s (first used on line %d)", manifestFile, entry.Line, name, line)
+		}
+		names[name] = entry.Line
+		statuses[i] = &batchStatus{Entry: entry, Name: name, WorkDir: filepath.Join(baseDir, name)}
+	}
+
+	slog.Info("running batch", "molecules", len(statuses), "manifest", manifestFile, "jobs", jobs)
+	semaphore := make(chan struct{}, jobs)
+	var wg sync.WaitGroup
+	for _, status := range statuses {
+		wg.Add(1)
+		go func(status *batchStatus) {
+			defer wg.Done()
+			semaphore <- struct{}{}
+			defer func() { <-semaphore }()
+
+			if ctx.Err() != nil {
+				status.Err = ctx.Err()
+				return
+			}
+			slog.Info("started molecule", "molecule", status.Name, "dir", status.WorkDir)
+			start := time.Now()
+			status.Err = k.runBatchEntry(ctx, executable, status)
+			status.Elapsed = time.Since(start)
+			if status.Err != nil {
+				slog.Error("molecule failed", "molecule", status.Name, "elapsed", status.Elapsed.Round(time.Second), "error", status.Err)
+			} else {
+				slog.Info("finished molecule", "molecule", status.Name, "elapsed", status.Elapsed.Round(time.Second))
+			}
+		}(status)
+	}
+	wg.Wait()
+
+	printBatchSummary(statuses)
+	summaryFile := filepath.Join(baseDir, "batch_summary.csv")
+	if err := writeBatchSummary(statuses, summaryFile); err != nil {
+		return err
+	}
+	slog.Info("batch summary written", "file", summaryFile)
+
+	failed := 0
+	for _, status := range statuses {
+		if status.Err != nil {
+			failed++
+		}
+	}
+	if ctx.Err() != nil {
+		return fmt.Errorf("batch interrupted: %w", ctx.Err())
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d molecules failed", failed, len(statuses))
+	}
+	return nil
+}
+
+// runBatchEntry 为 status 准备工作目录和配置文件，并在单独的 KYBNMR 进程中运行
+func (k *KYBNMR) runBatchEntry(ctx context.Context, executable string, status *batchStatus) error {
+	if err := os.MkdirAll(status.WorkDir, 0755); err != nil {
+		return fmt.Errorf("error creating work directory: %w", err)
+	}
+	// --set 和命令行中的 --charge、--multiplicity 先写入配置文件，之后再应用 manifest 中的配置，因此每一个分子自己的配置优先
+	overrides, err := k.setOverrides()
+	if err != nil {
+		return err
+	}
+	overrides = append(overrides, k.moleculeOverrides()...)
+	overrides = append(overrides, status.Entry.AllOverrides()...)
+	configFile := filepath.Join(status.WorkDir, "config"+filepath.Ext(k.config))
+	if err := calc.WriteConfigWithOverrides(k.config, overrides, configFile); err != nil {
+		return err
+	}
+
+	logFile, err := os.Create(filepath.Join(status.WorkDir, "kybnmr.out"))
+	if err != nil {
+		return err
+	}
+	defer logFile.Close()
+
+	cmd := childCommand(ctx, executable, k.childArgs(configFile, status.WorkDir, status.Entry.Input), logFile)
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%w, see %s", err, logFile.Name())
+	}
+
+	status.Result, err = calc.LoadNMRResult(filepath.Join(status.WorkDir, "nmr_result.json"))
+	return err
+}
+
+// moleculeOverrides 返回命令行中的 --charge 和 --multiplicity 对应的 [molecule] 配置，它们是每一个分子的默认值
+func (k *KYBNMR) moleculeOverrides() []calc.ConfigOverride {
+	var overrides []calc.ConfigOverride
+	if k.chargeSet {
+		overrides = append(overrides, calc.ConfigOverride{Section: "molecule", Key: "charge", Value: strconv.Itoa(k.charge)})
+	}
+	if k.multiplicitySet {
+		overrides = append(overrides, calc.ConfigOverride{Section: "molecule", Key: "multiplicity", Value: strconv.Itoa(k.multiplicity)})
+	}
+	return overrides
+}
+
+// childArgs 返回在单独的 KYBNMR 进程中使用配置文件 configFile 和工作目录 workDir 运行 input 的命令行参数，
+// 命令行中的 --opt、--sp、--nmr、--md、--pre、--post、--verbose 和 --quiet 都传给子进程。
+// --set、--charge 和 --multiplicity 不传给子进程，而是已经写入了 configFile，否则它们会覆盖 configFile 中每一个分子自己的配置
+func (k *KYBNMR) childArgs(configFile string, workDir string, input string) []string {
+	args := []string{
+		"--config", configFile,
+		"--workdir", workDir,
+		"--opt", k.opt, "--sp", k.sp, "--nmr", k.nmr,
+		"--md", strconv.Itoa(int(k.md)), "--pre", strconv.Itoa(int(k.pre)), "--post", strconv.Itoa(int(k.post)),
+	}
+	if k.verbose {
+		args = append(args, "--verbose")
+	}
+	if k.quiet {
+		args = append(args, "--quiet")
+	}
+	return append(args, input)
+}
+
+// childCommand 返回运行 KYBNMR 子进程的命令，子进程的输出写入 output
+// 中断时先让子进程自己结束正在运行的程序并标记中断的任务，超时之后再强制结束
+func childCommand(ctx context.Context, executable string, args []string, output io.Writer) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, executable, args...)
+	cmd.Stdout = output
+	cmd.Stderr = output
+	cmd.Cancel = func() error {
+		return cmd.Process.Signal(os.Interrupt)
+	}
+	cmd.WaitDelay = 30 * time.Second
+	return cmd
+}
+
+// bestConformer 返回 result 中 Boltzmann 权重最大的构象
+func bestConformer(result *calc.NMRResult) *calc.ConformerNMR {
+	var best *calc.ConformerNMR
+	for i := range result.Conformers {
+		if best == nil || result.Conformers[i].Population > best.Population {
+			best = &result.Conformers[i]
+		}
+	}
+	return best
+}
+
+// printBatchSummary 输出每一个分子的运行结果
+func printBatchSummary(statuses []*batchStatus) {
+	sorted := append([]*batchStatus(nil), statuses...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Name < sorted[j].Name })
+
+	fmt.Println()
+	fmt.Println("  =======================================")
+	fmt.Println("  |            Batch Summary            |")
+	fmt.Println("  =======================================")
+	fmt.Println()
+	fmt.Printf(" %-20s %-8s %6s %4s %-10s %10s %-20s %10s\n",
+		"Molecule", "Status", "Charge", "Mult", "Solvent", "Conformers", "Major conformer", "Time")
+	for _, status := range sorted {
+		state, conformers, major := "ok", "-", "-"
+		if status.Err != nil {
+			state = "failed"
+		} else if best := bestConformer(status.Result); best != nil {
+			conformers = strconv.Itoa(len(status.Result.Conformers))
+			major = fmt.Sprintf("%s (%.1f%%)", best.Name, best.Population*100)
+		}
+		fmt.Printf(" %-20s %-8s %6s %4s %-10s %10s %-20s %10s\n",
+			status.Name, state, orDash(status.Entry.Charge), orDash(status.Entry.Multiplicity), orDash(status.Entry.Solvent),
+			conformers, major, status.Elapsed.Round(time.Second))
+	}
+	fmt.Println()
+}
+
+// writeBatchSummary 将每一个分子的运行结果写入 csv 文件
+func writeBatchSummary(statuses []*batchStatus, fileName string) error {
+	if err := os.MkdirAll(filepath.Dir(fileName), 0755); err != nil {
+		return err
+	}
+	file, err := os.Create(fileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	writer := csv.NewWriter(file)
+	_ = writer.Write([]string{
+		"molecule", "input", "charge", "multiplicity", "solvent", "status",
+		"conformers", "major_conformer", "major_population", "free_energy", "seconds", "workdir", "error",
+	})
+	for _, status := range statuses {
+		state, conformers, major, population, freeEnergy, message := "ok", "", "", "", "", ""
+		if status.Err != nil {
+			state = "failed"
+			message = status.Err.Error()
+		} else if best := bestConformer(status.Result); best != nil {
+			conformers = strconv.Itoa(len(status.Result.Conformers))
+			major = best.Name
+			population = strconv.FormatFloat(best.Population, 'f', 4, 64)
+			freeEnergy = strconv.FormatFloat(best.FreeEnergy, 'f', 8, 64)
+		}
+		_ = writer.Write([]string{
+			status.Name, status.Entry.Input, status.Entry.Charge, status.Entry.Multiplicity, status.Entry.Solvent, state,
+			conformers, major, population, freeEnergy,
+			strconv.FormatFloat(status.Elapsed.Seconds(), 'f', 0, 64), status.WorkDir, message,
+		})
+	}
+	writer.Flush()
+
+	return writer.Error()
+}
+
+// orDash 空字符串输出为 -
+func orDash(text string) string {
+	if text == "" {
+		return "-"
+	}
+	return text
+}
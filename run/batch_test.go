@@ -0,0 +1,46 @@
+package run
+
+import (
+	"io/ioutil"
+	"kybnmr/calc"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBatchForwardsGlobalOptions(t *testing.T) {
+	k := &KYBNMR{opt: "fake", sp: "fake", nmr: "fake", verbose: true, charge: 1, chargeSet: true, multiplicity: 2, multiplicitySet: true}
+	args := strings.Join(k.childArgs("config.ini", "runs/a", "a.xyz"), " ")
+	if !strings.Contains(args, " --verbose ") || strings.Contains(args, "--quiet") || strings.Contains(args, "--charge") {
+		t.Errorf("child arguments %q", args)
+	}
+
+	// 命令行中的电荷和自旋多重度是清单中没有填写它们的分子的默认值
+	dir := t.TempDir()
+	source := filepath.Join(dir, "source.ini")
+	if err := ioutil.WriteFile(source, []byte("[molecule]\ncharge = 0\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		entry        calc.ManifestEntry
+		charge, mult int
+	}{
+		{calc.ManifestEntry{}, 1, 2},
+		{calc.ManifestEntry{Charge: "-1"}, -1, 2},
+		{calc.ManifestEntry{Charge: "0", Multiplicity: "1"}, 0, 1},
+	}
+	for _, test := range tests {
+		configFile := filepath.Join(dir, "config.ini")
+		overrides := append(k.moleculeOverrides(), test.entry.AllOverrides()...)
+		if err := calc.WriteConfigWithOverrides(source, overrides, configFile); err != nil {
+			t.Fatal(err)
+		}
+		config, err := calc.ParseConfigFile(configFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := config.MoleculeConfig; got.Charge != test.charge || got.Multiplicity != test.mult {
+			t.Errorf("entry %+v: charge %d, multiplicity %d, want %d and %d", test.entry, got.Charge, got.Multiplicity, test.charge, test.mult)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package run
+
+import (
+	"fmt"
+	"kybnmr/calc"
+	"log/slog"
+	"os"
+	"path/filepath"
+)
+
+/*
+* breakdown.go
+* 该模块用来处理 kybnmr breakdown 子命令：读取一次运行得到的 NMR 结果，
+* 输出每个构象对每个原子核平均化学位移的贡献，以及平均化学位移对构象自由能的敏感度，
+* 并写入 nmr_result.json 所在文件夹中的 nmr_breakdown.csv 和 nmr_breakdown.json
+*
+* @Author: Kimariyb
+* @Address: XiaMen University
+* @Data: 2023-09-23
+ */
+
+// defaultPerturbation 计算敏感度时默认的自由能扰动，单位为 kcal/mol
+const defaultPerturbation = 0.5
+
+// resultFileOf 返回 path 对应的 NMR 结果文件，path 为文件夹（如一次运行的工作目录）时返回其中的 nmr_result.json
+func resultFileOf(path string) string {
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		return filepath.Join(path, "nmr_result.json")
+	}
+	return path
+}
+
+// writeBreakdown 计算 result 的贡献分析，并写入 dir 中的 nmr_breakdown.csv 和 nmr_breakdown.json
+func writeBreakdown(result *calc.NMRResult, perturbation float64, dir string) (*calc.NMRBreakdown, error) {
+	breakdown, err := result.Breakdown(perturbation)
+	if err != nil {
+		return nil, fmt.Errorf("error calculating NMR breakdown: %w", err)
+	}
+	csvFile := filepath.Join(dir, "nmr_breakdown.csv")
+	jsonFile := filepath.Join(dir, "nmr_breakdown.json")
+	if err := breakdown.WriteCSV(csvFile); err != nil {
+		return nil, err
+	}
+	if err := breakdown.SaveJSON(jsonFile); err != nil {
+		return nil, err
+	}
+	slog.Info("per-conformer contributions written", "csv", csvFile, "json", jsonFile)
+
+	return breakdown, nil
+}
+
+// printBreakdown 输出每一个原子核的平均化学位移，以及每一个构象的贡献和敏感度
+func printBreakdown(breakdown *calc.NMRBreakdown) {
+	fmt.Println()
+	fmt.Println("  =======================================")
+	fmt.Println("  |     Per-conformer Contributions     |")
+	fmt.Println("  =======================================")
+	fmt.Println()
+	fmt.Printf(" Temperature: %.2f K, free energy perturbation: %.2f kcal/mol\n", breakdown.Temperature, breakdown.Perturbation)
+	for _, nucleus := range breakdown.Nuclei {
+		fmt.Println()
+		fmt.Printf(" %s%d  averaged shift: %.4f ppm\n", nucleus.Symbol, nucleus.Index, nucleus.AveragedShift)
+		fmt.Printf(" %-20s %10s %10s %10s %12s %10s %10s\n", "Conformer", "dG", "Pop (%)", "Shift", "Contribution",
+			fmt.Sprintf("-%.2f", breakdown.Perturbation), fmt.Sprintf("+%.2f", breakdown.Perturbation))
+		for _, c := range nucleus.Contributions {
+			fmt.Printf(" %-20s %10.4f %10.2f %10.4f %12.4f %10.4f %10.4f\n", c.Conformer, c.RelativeEnergy,
+				c.Population*100, c.Shift, c.Contribution, c.ShiftChangeMinus, c.ShiftChangePlus)
+		}
+	}
+	fmt.Println()
+}
+
+// runBreakdown 读取 resultFile（或者工作目录 resultFile 中的 nmr_result.json）中的 NMR 结果，
+// 输出贡献分析，并写入 NMR 结果所在的文件夹
+func (k *KYBNMR) runBreakdown(resultFile string, perturbation float64) error {
+	if perturbation <= 0 {
+		return fmt.Errorf("error: the perturbation must be positive")
+	}
+	resultFile = resultFileOf(resultFile)
+	result, err := calc.LoadNMRResult(resultFile)
+	if err != nil {
+		return err
+	}
+
+	breakdown, err := writeBreakdown(result, perturbation, filepath.Dir(resultFile))
+	if err != nil {
+		return err
+	}
+	printBreakdown(breakdown)
+	return nil
+}
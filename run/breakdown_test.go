@@ -0,0 +1,34 @@
+package run
+
+import (
+	"kybnmr/calc"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBreakdownReadsWorkDir(t *testing.T) {
+	workDir := t.TempDir()
+	conformers := []calc.ConformerNMR{
+		{Name: "a", FreeEnergy: -100, Shieldings: []calc.NucleusShielding{{Index: 1, Symbol: "C", Isotropic: 150}}},
+		{Name: "b", FreeEnergy: -99.999, Shieldings: []calc.NucleusShielding{{Index: 1, Symbol: "C", Isotropic: 140}}},
+	}
+	result, err := calc.NewNMRResult(conformers, &calc.NMRConfig{Temperature: 298.15, RefShieldingC: 190})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := result.SaveJSON(filepath.Join(workDir, "nmr_result.json")); err != nil {
+		t.Fatal(err)
+	}
+
+	k := &KYBNMR{}
+	for _, arg := range []string{workDir, filepath.Join(workDir, "nmr_result.json")} {
+		os.Remove(filepath.Join(workDir, "nmr_breakdown.csv"))
+		if err := k.runBreakdown(arg, defaultPerturbation); err != nil {
+			t.Fatalf("runBreakdown(%s): %v", arg, err)
+		}
+		if _, err := os.Stat(filepath.Join(workDir, "nmr_breakdown.csv")); err != nil {
+			t.Errorf("runBreakdown(%s) did not write nmr_breakdown.csv in the work directory: %v", arg, err)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package run
+
+import (
+	"kybnmr/calc"
+	"log/slog"
+)
+
+/*
+* compare.go
+* 该模块用来处理 kybnmr compare 子命令：将一次运行得到的 NMR 结果与实验化学位移比较，
+* 没有归属的实验峰会被自动归属，最后输出每个峰的误差和平均绝对误差
+*
+* @Author: Kimariyb
+* @Address: XiaMen University
+* @Data: 2023-09-23
+ */
+
+// runCompare 读取 resultFile（或者工作目录 resultFile 中的 nmr_result.json）中的 NMR 结果，并与 expFile 中的实验数据比较
+func (k *KYBNMR) runCompare(expFile string, resultFile string) error {
+	peaks, err := calc.ParseExperimentalFile(expFile)
+	if err != nil {
+		return err
+	}
+	result, err := calc.LoadNMRResult(resultFileOf(resultFile))
+	if err != nil {
+		return err
+	}
+
+	comparisons, mae, err := calc.ComparePeaks(result, peaks)
+	if err != nil {
+		return err
+	}
+	calc.PrintComparison(comparisons, mae)
+	if err := calc.WriteComparisonCSV(comparisons, "nmr_compare.csv"); err != nil {
+		return err
+	}
+	slog.Info("comparison written", "file", "nmr_compare.csv")
+
+	return nil
+}
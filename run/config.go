@@ -0,0 +1,85 @@
+package run
+
+import (
+	"fmt"
+	"kybnmr/calc"
+	"kybnmr/utils"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+/*
+* config.go
+* 该模块用来处理 kybnmr config 子命令
+*
+*	kybnmr config show  输出默认值以外的每一个配置以及它的来源（配置文件和行号、环境变量或者 --set）
+*	kybnmr config show --resolved  输出所有的配置，包括内置的默认值，即运行时实际使用的配置
+*	kybnmr config convert [--force] <input> <output>  在 ini、TOML 和 YAML 之间转换配置文件，格式由扩展名决定
+*
+* 输出的格式与配置文件相同，来源写在每一行的注释中，可以直接复制到配置文件中
+*
+* @Author: Kimariyb
+* @Address: XiaMen University
+* @Data: 2023-09-26
+ */
+
+// runConfigShow 输出分层读取之后的配置，resolved 为 true 时也输出默认值
+func (k *KYBNMR) runConfigShow(resolved bool) error {
+	// 项目配置文件不存在时只使用其他的层
+	projectFile := k.config
+	if exist, _ := utils.CheckFileCurrentExist(projectFile); !exist {
+		projectFile = ""
+	}
+	config, err := k.loadConfigWith(projectFile)
+	if err != nil {
+		return err
+	}
+
+	userFile := calc.UserConfigFile()
+	if exist, _ := utils.CheckFileCurrentExist(userFile); !exist {
+		userFile += " (not found)"
+	}
+	if projectFile == "" {
+		projectFile = k.config + " (not found)"
+	}
+	envCount := 0
+	for _, variable := range os.Environ() {
+		if strings.HasPrefix(variable, calc.ConfigEnvPrefix) {
+			envCount++
+		}
+	}
+	fmt.Println("; layers, later ones override earlier ones:")
+	fmt.Println(";   1. built-in defaults")
+	fmt.Println(";   2. user config " + userFile)
+	fmt.Println(";   3. project config " + projectFile)
+	fmt.Printf(";   4. %d %s* environment variable(s)\n", envCount, calc.ConfigEnvPrefix)
+	fmt.Printf(";   5. %d --set override(s)\n", len(k.sets))
+
+	section := ""
+	for _, value := range config.Resolved() {
+		if !resolved && value.Source == "default" {
+			continue
+		}
+		if value.Section != section {
+			section = value.Section
+			fmt.Printf("\n[%s]\n", section)
+		}
+		fmt.Printf("%-14s = %-34s ; %s\n", value.Key, value.Value, value.Source)
+	}
+
+	return nil
+}
+
+// runConfigConvert 检查配置文件 input，并转换为 output 的格式，output 已经存在时只有 force 为 true 才会覆盖
+func runConfigConvert(input string, output string, force bool) error {
+	if exist, _ := utils.CheckFileCurrentExist(output); exist && !force {
+		return fmt.Errorf("error: %s already exists, use --force to overwrite it", output)
+	}
+	if err := calc.ConvertConfigFile(input, output); err != nil {
+		return err
+	}
+
+	slog.Info("converted config file", "input", input, "from", calc.ConfigFormatOf(input), "output", output, "to", calc.ConfigFormatOf(output))
+	return nil
+}
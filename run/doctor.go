@@ -0,0 +1,271 @@
+package run
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"kybnmr/calc"
+	"kybnmr/utils"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+/*
+* doctor.go
+* 该模块用来处理 kybnmr doctor 子命令：检查运行 KYBNMR 需要的外部程序和环境
+*
+*	1. 分层读取配置（没有项目配置文件时使用其他层和 PATH 中的程序），检查配置中的 xtb、Gaussian、ORCA 和 Shermo 路径，
+*	   crest 为 bin/crest，Multiwfn 在 PATH 中查找
+*	2. 读取每一个程序的版本号，和 README 中列出的版本 (calc.SupportedVersions) 比较
+*	3. Gaussian 还检查 GAUSS_SCRDIR，ORCA 在 nprocs 大于 1 时还检查 MPI (mpirun)
+*	4. 使用 --smoke 时对 xtb、Gaussian 和 ORCA 做一次很小的试算
+*	5. 输出 PASS/WARN/FAIL 表，使用 --json 时输出 json。--opt、--sp、--nmr、--pre、--post 选择的程序
+*	   找不到或者试算失败时为 FAIL，其他程序为 WARN，有 FAIL 时返回错误
+*
+* @Author: Kimariyb
+* @Address: XiaMen University
+* @Data: 2023-09-26
+ */
+
+// 检查的结果
+const (
+	doctorPass = "pass"
+	doctorWarn = "warn"
+	doctorFail = "fail"
+)
+
+// doctorCheck 一项检查的结果
+//   - Name: 检查的名字，如 xtb、GAUSS_SCRDIR
+//   - Status: pass、warn 或者 fail
+//   - Required: 本次运行是否需要
+//   - Path: 程序的路径
+//   - Version: 读取到的版本号
+//   - Supported: README 中列出的版本
+//   - Smoke: 试算的结果，没有试算时为空
+//   - Detail: 说明
+type doctorCheck struct {
+	Name      string   `json:"name"`
+	Status    string   `json:"status"`
+	Required  bool     `json:"required"`
+	Path      string   `json:"path,omitempty"`
+	Version   string   `json:"version,omitempty"`
+	Supported []string `json:"supported,omitempty"`
+	Smoke     string   `json:"smoke,omitempty"`
+	Detail    string   `json:"detail,omitempty"`
+}
+
+// doctorReport kybnmr doctor --json 的输出
+type doctorReport struct {
+	Passed bool          `json:"passed"`
+	Checks []doctorCheck `json:"checks"`
+}
+
+// fail 找不到或者出错时，需要的检查为 fail，不需要的为 warn
+func (c *doctorCheck) fail(detail string) {
+	c.Status = doctorWarn
+	if c.Required {
+		c.Status = doctorFail
+	}
+	c.Detail = detail
+}
+
+// warn 将 pass 降为 warn，不改变 fail
+func (c *doctorCheck) warn(detail string) {
+	if c.Status == doctorPass {
+		c.Status = doctorWarn
+	}
+	if c.Detail != "" {
+		detail = c.Detail + "; " + detail
+	}
+	c.Detail = detail
+}
+
+// selectedEngines 返回 --opt、--sp、--nmr 选择的程序名
+func (k *KYBNMR) selectedEngines() map[string]bool {
+	engines := make(map[string]bool)
+	for _, option := range []string{k.opt, k.sp, k.nmr} {
+		if name, ok := legacyEngineNames[option]; ok {
+			option = name
+		}
+		engines[strings.ToLower(option)] = true
+	}
+	return engines
+}
+
+// doctorConfig 分层读取配置，没有项目配置文件时只使用默认值、用户配置文件、环境变量和 --set，
+// 仍然没有填写的程序路径使用 PATH 中的程序
+func (k *KYBNMR) doctorConfig(ctx context.Context) (*calc.Config, doctorCheck) {
+	check := doctorCheck{Name: "config", Status: doctorPass, Required: true}
+	configFile := k.config
+	if configFile == "" {
+		configFile = "config.ini"
+	}
+	exist, fullPath := utils.CheckFileCurrentExist(configFile)
+	if exist {
+		check.Path = fullPath
+	} else {
+		fullPath = ""
+		check.Status = doctorWarn
+		check.Detail = configFile + " not found, checking the other config layers and the programs on PATH (run kybnmr init)"
+	}
+
+	config, err := k.loadConfigWith(fullPath)
+	if err != nil {
+		var configErr *calc.ConfigError
+		if errors.As(err, &configErr) {
+			check.fail(fmt.Sprintf("%d problem(s), the first is %s", len(configErr.Issues), configErr.Issues[0]))
+		} else {
+			check.fail(err.Error())
+		}
+		return calc.DefaultConfig(), check
+	}
+	if !exist {
+		for _, name := range initPrograms {
+			if config.ProgramPath(name) != "" {
+				continue
+			}
+			if info := calc.FindProgram(ctx, name); info.Found() {
+				config.SetProgramPath(name, info.Path)
+			}
+		}
+	}
+	return config, check
+}
+
+// checkProgram 检查 path 处的程序 name，path 为空时说明配置文件中没有填写 key
+func checkProgram(ctx context.Context, name string, path string, key string, required bool, smoke bool) doctorCheck {
+	check := doctorCheck{Name: name, Required: required, Supported: calc.SupportedVersions[name]}
+	if path == "" {
+		detail := key + " is not set in the config file"
+		if info := calc.FindProgram(ctx, name); info.Found() {
+			detail += ", found " + info.Path
+		}
+		check.fail(detail)
+		return check
+	}
+
+	info := calc.InspectProgram(ctx, name, path)
+	if !info.Found() {
+		detail := path + " not found or not executable"
+		if info := calc.FindProgram(ctx, name); info.Found() && info.Path != path {
+			detail += ", found " + info.Path
+		}
+		check.fail(detail)
+		return check
+	}
+	check.Status = doctorPass
+	check.Path = info.Path
+	check.Version = info.Version
+	if info.Version == "" {
+		check.warn("could not read the version")
+	} else if !info.Supported() {
+		check.warn(fmt.Sprintf("version %s is not tested (tested: %s)", info.Version, strings.Join(check.Supported, ", ")))
+	}
+
+	if smoke {
+		err := calc.SmokeTest(ctx, name, info.Path)
+		switch {
+		case errors.Is(err, calc.ErrNoSmokeTest):
+		case err != nil:
+			check.Smoke = doctorFail
+			check.fail(err.Error())
+		default:
+			check.Smoke = doctorPass
+		}
+	}
+	return check
+}
+
+// checkGaussScrDir 检查 Gaussian 的临时文件目录 GAUSS_SCRDIR，没有设置时 Gaussian 使用当前目录
+func checkGaussScrDir(required bool) doctorCheck {
+	check := doctorCheck{Name: "GAUSS_SCRDIR", Status: doctorPass, Required: required}
+	dir := os.Getenv("GAUSS_SCRDIR")
+	if dir == "" {
+		check.Status = doctorWarn
+		check.Detail = "not set, Gaussian writes its scratch files into the job folder"
+		return check
+	}
+	check.Path = dir
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		check.fail("not a directory")
+		return check
+	}
+	file, err := os.CreateTemp(dir, "kybnmr-doctor-")
+	if err != nil {
+		check.fail("not writable")
+		return check
+	}
+	file.Close()
+	os.Remove(file.Name())
+	return check
+}
+
+// checkMPI 检查 ORCA 并行计算需要的 mpirun，nprocs 为 1 时不需要
+func checkMPI(ctx context.Context, nprocs int, required bool) doctorCheck {
+	check := doctorCheck{Name: "mpirun", Status: doctorPass, Required: required && nprocs > 1}
+	info := calc.FindProgram(ctx, "mpirun")
+	if !info.Found() {
+		check.fail(fmt.Sprintf("not found on PATH, ORCA needs MPI to run with nprocs = %d", nprocs))
+		return check
+	}
+	check.Path = info.Path
+	check.Version = info.Version
+	return check
+}
+
+// runDoctor 检查所有的外部程序，输出结果表或者 json
+func (k *KYBNMR) runDoctor(ctx context.Context, smoke bool, asJSON bool) error {
+	config, configCheck := k.doctorConfig(ctx)
+	engines := k.selectedEngines()
+	crestNeeded := k.pre == OpenTure || k.post == OpenTure
+
+	checks := []doctorCheck{
+		configCheck,
+		checkProgram(ctx, "xtb", config.OptConfig.XtbPath, calc.ProgramPathKey("xtb"), true, smoke),
+		checkProgram(ctx, "crest", calc.CrestPath, "", crestNeeded, smoke),
+		checkProgram(ctx, "gaussian", config.OptConfig.GauPath, calc.ProgramPathKey("gaussian"), engines["gaussian"], smoke),
+		checkGaussScrDir(engines["gaussian"]),
+		checkProgram(ctx, "orca", config.OptConfig.OrcaPath, calc.ProgramPathKey("orca"), engines["orca"], smoke),
+		checkMPI(ctx, config.ResourceConfig.NProcs, engines["orca"]),
+		checkProgram(ctx, "shermo", config.OptConfig.ShermoPath, calc.ProgramPathKey("shermo"), true, smoke),
+		checkProgram(ctx, "multiwfn", "Multiwfn", "", false, smoke),
+	}
+
+	report := doctorReport{Passed: true, Checks: checks}
+	failed := 0
+	for _, check := range checks {
+		if check.Status == doctorFail {
+			report.Passed = false
+			failed++
+		}
+	}
+
+	if asJSON {
+		contents, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(contents))
+	} else {
+		fmt.Printf(" %-13s %-6s %-10s %-6s %s\n", "Check", "Status", "Version", "Smoke", "Path / Detail")
+		for _, check := range checks {
+			detail := orDash(check.Path)
+			if check.Detail != "" {
+				detail = strings.TrimPrefix(detail+": ", "-: ") + check.Detail
+			}
+			fmt.Printf(" %-13s %-6s %-10s %-6s %s\n", check.Name, strings.ToUpper(check.Status),
+				orDash(check.Version), orDash(check.Smoke), detail)
+		}
+		fmt.Println()
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("error: %d of %d check(s) failed", failed, len(checks))
+	}
+	if !asJSON {
+		slog.Info("all required programs are available")
+	}
+	return nil
+}
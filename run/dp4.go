@@ -0,0 +1,107 @@
+package run
+
+import (
+	"context"
+	"fmt"
+	"kybnmr/calc"
+	"kybnmr/utils"
+	"log/slog"
+	"path/filepath"
+)
+
+/*
+* dp4.go
+* 该模块用来处理 kybnmr dp4 子命令：对多个候选异构体分别运行完整的 KYBNMR 流程，
+* 最后与同一组实验化学位移比较，计算 DP4/DP4+ 概率并排序
+*
+* 每一个异构体都以 isomers/<异构体名> 作为工作目录运行，
+* 如果其中已经存在 nmr_result.json，则直接读取而不重新计算
+*
+* @Author: Kimariyb
+* @Address: XiaMen University
+* @Data: 2023-09-22
+ */
+
+// runDP4 依次对 inputs 中的每一个异构体运行 KYBNMR，并根据 expFile 中的实验数据计算 DP4/DP4+ 概率
+func (k *KYBNMR) runDP4(ctx context.Context, expFile string, inputs []string) error {
+	if len(inputs) < 2 {
+		return fmt.Errorf("error: please provide at least two candidate isomers")
+	}
+
+	// 首先读取实验数据和配置文件，避免算完所有异构体之后才发现输入有误
+	peaks, err := calc.ParseExperimentalFile(expFile)
+	if err != nil {
+		return err
+	}
+	if err := k.checkConfigFile(); err != nil {
+		return err
+	}
+	config, err := k.loadConfig()
+	if err != nil {
+		return err
+	}
+	params, err := calc.NewDP4Params(&config.DP4Config)
+	if err != nil {
+		return err
+	}
+
+	// 异构体的名字不能重复，否则结果文件夹会互相覆盖
+	names := make(map[string]bool)
+	for _, input := range inputs {
+		name := moleculeName(input)
+		if names[name] {
+			return fmt.Errorf("error: duplicate isomer name: %s", name)
+		}
+		names[name] = true
+	}
+
+	var isomers []calc.IsomerNMR
+	for _, input := range inputs {
+		name := moleculeName(input)
+		isomerFolder := filepath.Join("isomers", name)
+		resultFile := filepath.Join(isomerFolder, "nmr_result.json")
+
+		// 如果已经算过这个异构体，则直接读取结果
+		if exist, _ := utils.CheckFileCurrentExist(resultFile); exist {
+			slog.Info("reuse the NMR result of isomer", "isomer", name, "file", resultFile)
+			result, err := calc.LoadNMRResult(resultFile)
+			if err != nil {
+				return err
+			}
+			isomers = append(isomers, calc.IsomerNMR{Name: name, Result: result})
+			continue
+		}
+
+		slog.Info("running KYBNMR for isomer", "isomer", name)
+		k.input = input
+		k.workdir = isomerFolder
+		if err := k.Run(ctx); err != nil {
+			return fmt.Errorf("error running isomer %s: %w", name, err)
+		}
+		isomers = append(isomers, calc.IsomerNMR{Name: name, Result: k.nmrResult})
+	}
+
+	results, err := calc.ComputeDP4(isomers, peaks, params)
+	if err != nil {
+		return err
+	}
+	calc.PrintDP4Results(results)
+	if err := calc.WriteDP4CSV(results, "dp4_results.csv"); err != nil {
+		return err
+	}
+	slog.Info("DP4 results written", "file", "dp4_results.csv")
+
+	// 每一个异构体的归属和误差保存在各自的文件夹中
+	for _, isomer := range isomers {
+		comparisons, _, err := calc.ComparePeaks(isomer.Result, peaks)
+		if err != nil {
+			return err
+		}
+		compareFile := filepath.Join("isomers", isomer.Name, "nmr_compare.csv")
+		if err := calc.WriteComparisonCSV(comparisons, compareFile); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,307 @@
+package run
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"kybnmr/calc"
+	"kybnmr/utils"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+/*
+* init.go
+* 该模块用来处理 kybnmr init 子命令：在当前目录中生成配置文件和模板文件
+*
+*	1. 在 PATH 中查找 xtb、crest、Gaussian、ORCA 和 Shermo，将路径写入配置文件，版本号写成注释
+*	2. 电荷、自旋多重度、溶剂、NMR 温度和计算方案 (preset) 可以由命令行参数给出，
+*	   没有给出并且标准输入是终端时逐一询问，否则使用默认值
+*	3. 写入配置文件（默认为 config.ini，可以由 --config 指定，扩展名为 .toml 或者 .yaml 时写成对应的格式）以及 preset 中每一个程序每一个步骤的模板
+*	   <preset>-<stage>.gjf/.inp，这些模板会优先于 preset 内置的模板使用，可以直接修改
+*	4. 写入之前检查配置文件和模板，已经存在的文件只有在使用 --force 时才会被覆盖
+*
+* @Author: Kimariyb
+* @Address: XiaMen University
+* @Data: 2023-09-26
+ */
+
+// initPrograms kybnmr init 查找的外部程序
+var initPrograms = []string{"xtb", "crest", "gaussian", "orca", "shermo"}
+
+// defaultInitPreset kybnmr init 默认的计算方案，Gaussian 和 ORCA 的三个步骤都有模板
+const defaultInitPreset = "b3lyp-mpw1pw91"
+
+// initOptions kybnmr init 的选项，没有在命令行中给出的选项为 nil
+type initOptions struct {
+	Charge       *int
+	Multiplicity *int
+	Solvent      *string
+	Temperature  *float64
+	Preset       *string
+	Force        bool
+	Interactive  bool
+}
+
+// initPrompter 在终端中询问 kybnmr init 的选项
+type initPrompter struct {
+	reader *bufio.Reader
+	out    io.Writer
+}
+
+// ask 输出 question 和默认值 def，返回输入的内容，直接回车时返回 def
+func (p *initPrompter) ask(question string, def string) (string, error) {
+	if def == "" {
+		fmt.Fprintf(p.out, "%s: ", question)
+	} else {
+		fmt.Fprintf(p.out, "%s [%s]: ", question, def)
+	}
+	line, err := p.reader.ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		return "", fmt.Errorf("error reading the answer: %w", err)
+	}
+	if answer := strings.TrimSpace(line); answer != "" {
+		return answer, nil
+	}
+	return def, nil
+}
+
+// askUntilValid 重复询问，直到 check 返回 nil
+func (p *initPrompter) askUntilValid(question string, def string, check func(string) error) (string, error) {
+	for {
+		answer, err := p.ask(question, def)
+		if err != nil {
+			return "", err
+		}
+		if err := check(answer); err != nil {
+			fmt.Fprintln(p.out, "Error:", err)
+			continue
+		}
+		return answer, nil
+	}
+}
+
+// isTerminal 判断 file 是否为终端
+func isTerminal(file *os.File) bool {
+	info, err := file.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// fillInitOptions 询问或者使用默认值填充 options 中没有给出的选项，返回对应的配置
+func fillInitOptions(options *initOptions, config *calc.Config) error {
+	prompter := &initPrompter{reader: bufio.NewReader(os.Stdin), out: os.Stdout}
+	checkInt := func(text string) error {
+		_, err := strconv.Atoi(text)
+		return err
+	}
+
+	if options.Charge != nil {
+		config.MoleculeConfig.Charge = *options.Charge
+	} else if options.Interactive {
+		answer, err := prompter.askUntilValid("Charge", "0", checkInt)
+		if err != nil {
+			return err
+		}
+		config.MoleculeConfig.Charge, _ = strconv.Atoi(answer)
+	}
+
+	if options.Multiplicity != nil {
+		config.MoleculeConfig.Multiplicity = *options.Multiplicity
+	} else if options.Interactive {
+		answer, err := prompter.askUntilValid("Spin multiplicity 2S+1", "1", func(text string) error {
+			if multiplicity, err := strconv.Atoi(text); err != nil || multiplicity < 1 {
+				return fmt.Errorf("the multiplicity must be a positive integer")
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		config.MoleculeConfig.Multiplicity, _ = strconv.Atoi(answer)
+	}
+
+	if options.Solvent != nil {
+		config.SolventConfig.Name = *options.Solvent
+	} else if options.Interactive {
+		answer, err := prompter.askUntilValid("Solvent (empty for gas phase)", "", func(text string) error {
+			if text == "" {
+				return nil
+			}
+			return (&calc.SolventConfig{Name: text, Model: "smd", XtbModel: "alpb"}).Validate()
+		})
+		if err != nil {
+			return err
+		}
+		config.SolventConfig.Name = answer
+	}
+
+	if options.Temperature != nil {
+		config.NMRConfig.Temperature = *options.Temperature
+	} else if options.Interactive {
+		answer, err := prompter.askUntilValid("Temperature of the Boltzmann distribution in K", "298.15", func(text string) error {
+			if temperature, err := strconv.ParseFloat(text, 64); err != nil || temperature <= 0 {
+				return fmt.Errorf("the temperature must be a positive number")
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		config.NMRConfig.Temperature, _ = strconv.ParseFloat(answer, 64)
+	}
+
+	config.OptConfig.Preset = defaultInitPreset
+	if options.Preset != nil {
+		config.OptConfig.Preset = *options.Preset
+	} else if options.Interactive {
+		fmt.Println()
+		for _, preset := range calc.Presets() {
+			fmt.Printf("  %-18s %s\n", preset.Name, preset.Description)
+		}
+		answer, err := prompter.askUntilValid("Method preset", defaultInitPreset, func(text string) error {
+			_, err := calc.LookupPreset(text)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		config.OptConfig.Preset = answer
+	}
+	if preset, err := calc.LookupPreset(config.OptConfig.Preset); err == nil {
+		config.OptConfig.Preset = preset.Name
+	}
+
+	return nil
+}
+
+// detectPrograms 在 PATH 中查找 initPrograms，将找到的路径写入 config，返回所有程序的查找结果
+func detectPrograms(ctx context.Context, config *calc.Config) map[string]calc.ProgramInfo {
+	programs := make(map[string]calc.ProgramInfo)
+	for _, name := range initPrograms {
+		info := calc.FindProgram(ctx, name)
+		programs[name] = info
+		if !info.Found() {
+			slog.Warn("program was not found on PATH", "program", name)
+			continue
+		}
+		slog.Info("found program", "program", name, "version", orDash(info.Version), "path", info.Path)
+		config.SetProgramPath(name, info.Path)
+	}
+	return programs
+}
+
+// programComment 返回写在配置文件中的程序查找结果
+func programComment(info calc.ProgramInfo) string {
+	if !info.Found() {
+		return fmt.Sprintf("%s was not found on PATH by kybnmr init", info.Name)
+	}
+	return fmt.Sprintf("%s %s found at %s by kybnmr init", info.Name, orDash(info.Version), info.Path)
+}
+
+// initTemplates 返回 config 中的 preset 每一个程序每一个步骤的模板
+func initTemplates(config *calc.Config) ([]calc.StageTemplate, map[string]calc.Stage, error) {
+	preset, err := calc.LookupPreset(config.OptConfig.Preset)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var templates []calc.StageTemplate
+	stages := make(map[string]calc.Stage)
+	for _, name := range preset.Engines() {
+		engine, err := calc.NewEngine(name, config)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, stage := range allStages {
+			content, ok := preset.Template(name, stage)
+			if !ok {
+				continue
+			}
+			file := calc.PresetTemplateFile(preset.Name, stage, filepath.Ext(engine.TemplateFile(stage)))
+			templates = append(templates, calc.StageTemplate{File: file, Content: content})
+			stages[file] = stage
+		}
+	}
+	return templates, stages, nil
+}
+
+// runInit 在当前目录中生成配置文件和模板文件
+func (k *KYBNMR) runInit(ctx context.Context, options *initOptions) error {
+	configFile := k.config
+	if configFile == "" {
+		configFile = "config.ini"
+	}
+	if exist, _ := utils.CheckFileCurrentExist(configFile); exist && !options.Force {
+		return fmt.Errorf("error: %s already exists, use --force to overwrite it", configFile)
+	}
+
+	config := calc.DefaultConfig()
+	programs := detectPrograms(ctx, config)
+	fmt.Println()
+	if err := fillInitOptions(options, config); err != nil {
+		return err
+	}
+
+	templates, stages, err := initTemplates(config)
+	if err != nil {
+		return err
+	}
+	var existing []string
+	for _, template := range templates {
+		if exist, _ := utils.CheckFileCurrentExist(template.File); exist {
+			existing = append(existing, template.File)
+		}
+	}
+	if len(existing) > 0 && !options.Force {
+		return fmt.Errorf("error: %s already exist(s), use --force to overwrite", strings.Join(existing, ", "))
+	}
+
+	// 写入之前检查配置文件和模板
+	iniFile := config.ToIni()
+	optimized := iniFile.Section("optimized")
+	optimized.Comment = programComment(programs["crest"]) + "\ncrest is run from bin/crest relative to the working directory"
+	for _, program := range []string{"xtb", "gaussian", "orca", "shermo"} {
+		key := calc.ProgramPathKey(program)
+		if optimized.HasKey(key) {
+			optimized.Key(key).Comment = programComment(programs[program])
+		} else {
+			optimized.Key(key).Comment = programComment(programs[program]) + ", please set " + key
+		}
+	}
+	tempFile, err := os.CreateTemp(filepath.Dir(configFile), ".kybnmr-init-*"+filepath.Ext(configFile))
+	if err != nil {
+		return err
+	}
+	tempFile.Close()
+	defer os.Remove(tempFile.Name())
+	if err := calc.SaveConfigDocument(iniFile, tempFile.Name()); err != nil {
+		return fmt.Errorf("error writing %s: %w", configFile, err)
+	}
+	if _, err := calc.ParseConfigFile(tempFile.Name()); err != nil {
+		return err
+	}
+	data := calc.NewTemplateData(config, "molecule")
+	for _, template := range templates {
+		if err := calc.CheckTemplate(stages[template.File], template, data); err != nil {
+			return err
+		}
+	}
+
+	if err := os.Rename(tempFile.Name(), configFile); err != nil {
+		return fmt.Errorf("error writing %s: %w", configFile, err)
+	}
+	slog.Info("config file written", "file", configFile)
+	for _, template := range templates {
+		if err := os.WriteFile(template.File, []byte(template.Content), 0644); err != nil {
+			return fmt.Errorf("error writing %s: %w", template.File, err)
+		}
+		slog.Info("template written", "file", template.File)
+	}
+	slog.Info("please check refShieldingC and refShieldingH in [nmr], they must be calculated at the level of the NMR template")
+
+	return nil
+}
@@ -0,0 +1,204 @@
+package run
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"kybnmr/calc"
+	"kybnmr/utils"
+	"log/slog"
+	"os"
+	"path/filepath"
+)
+
+/*
+* report.go
+* 该模块用来在运行中记录 report.json（见 calc/report.go）
+*
+*	Run 进入工作目录之后立即写入一次 report.json（状态为 running），每一个步骤开始时写入一次，
+*	结束时不管成功、失败还是被中断都再写入一次，因此工作目录中的 report.json 总是记录最近一次运行的结果和正在运行的步骤
+*
+*	kybnmr report [--html] [--exp exp.csv] [--output report.html] [--top 3] [workdir]
+*	读取工作目录（默认为当前目录）中的 report.json 和 nmr_result.json，不重新运行任何计算：
+*	不使用 --html 时输出每一个步骤的概况，使用 --html 时生成一个单独的 HTML 报告（见 calc/html.go）
+*
+* @Author: Kimariyb
+* @Address: XiaMen University
+* @Data: 2023-09-26
+ */
+
+// newReport 创建本次运行的 Report，记录配置快照、使用的程序和后端以及外部程序的版本
+func (k *KYBNMR) newReport(ctx context.Context, version string, config *calc.Config, engines map[calc.Stage]calc.Engine, backend calc.Backend) *calc.Report {
+	report := calc.NewReport(version, k.input, moleculeName(k.input))
+	report.Charge = config.MoleculeConfig.Charge
+	report.Multiplicity = config.MoleculeConfig.Multiplicity
+	for stage, engine := range engines {
+		report.Engines[string(stage)] = engine.Name()
+	}
+	report.Backend = backend.Name()
+	report.Config = config.Resolved()
+	report.Programs = k.reportPrograms(ctx, config, engines)
+	return report
+}
+
+// reportPrograms 返回本次运行用到的外部程序的路径和版本号，没有路径的程序（如 fake）不记录
+func (k *KYBNMR) reportPrograms(ctx context.Context, config *calc.Config, engines map[calc.Stage]calc.Engine) []calc.ProgramInfo {
+	var names []string
+	if k.md == OpenTure {
+		names = append(names, "xtb")
+	}
+	if k.pre == OpenTure || k.post == OpenTure {
+		names = append(names, "crest")
+	}
+	for _, stage := range []calc.Stage{calc.StageOpt, calc.StageSP, calc.StageNMR} {
+		names = append(names, engines[stage].Name())
+	}
+	names = append(names, "shermo")
+
+	programs := []calc.ProgramInfo{}
+	seen := make(map[string]bool)
+	for _, name := range names {
+		path := config.ProgramPath(name)
+		if name == "crest" {
+			path = calc.CrestPath
+		}
+		if path == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+		programs = append(programs, calc.InspectProgram(ctx, name, path))
+	}
+	return programs
+}
+
+// startStage 开始记录步骤 name 并写入 report.json，之后 kybnmr.log 中每一条记录的 stage 字段都为 name
+func startStage(report *calc.Report, name string, program string) *calc.StageReport {
+	utils.SetLogStage(name)
+	stage := report.StartStage(name, program)
+	saveReport(report)
+	return stage
+}
+
+// skipStage 记录被跳过的步骤 name 并写入 report.json
+func skipStage(report *calc.Report, name string) {
+	utils.SetLogStage(name)
+	report.SkipStage(name)
+	saveReport(report)
+}
+
+// saveReport 将 report 写入当前目录（即工作目录）中的 report.json，写入失败只输出错误，不影响运行
+func saveReport(report *calc.Report) {
+	if err := report.Save(calc.ReportFile); err != nil {
+		slog.Error("error writing run report", "error", err)
+	}
+}
+
+// recordDedup 读取 crest 输出的 xyzFile 并去重，结果写入 outFile，并在 stage 中记录构象数和去重结果
+func recordDedup(stage *calc.StageReport, xyzFile string, threshold string, outFile string) error {
+	clusters, err := calc.ParseXyzFile(xyzFile)
+	if err != nil {
+		slog.Error("error parsing xyz file", "file", xyzFile, "error", err)
+		return nil
+	}
+	stage.Input = len(clusters)
+	// 获取 doublecheck 阈值
+	thresholds := utils.SplitStringByComma(threshold)
+	// 进行 double check，同时得到 clusters
+	remain, decisions, err := calc.DoubleCheckWithDecisions(thresholds[0], thresholds[1], clusters)
+	if err != nil {
+		slog.Error("error running DoubleCheck", "error", err)
+		return nil
+	}
+	for _, decision := range decisions {
+		slog.Debug("double check", "conformer", decision.Conformer, "energy", decision.Energy,
+			"action", decision.Action, "cluster", decision.Cluster)
+	}
+	slog.Info("double check completed", "input", len(clusters), "kept", len(remain))
+	stage.Output = len(remain)
+	stage.Dedup = &calc.DedupReport{EnergyThreshold: thresholds[0], DistanceThreshold: thresholds[1], Decisions: decisions}
+	// 写入到新的 xyz 文件中
+	calc.WriteToXyzFile(remain, outFile)
+	return nil
+}
+
+// loadRunResults 读取工作目录 workDir 中的 report.json 和 nmr_result.json，不存在的文件返回 nil，两个都不存在时返回错误
+func loadRunResults(workDir string) (*calc.Report, *calc.NMRResult, error) {
+	var report *calc.Report
+	reportFile := filepath.Join(workDir, calc.ReportFile)
+	if _, err := os.Stat(reportFile); err == nil {
+		if report, err = calc.LoadReport(reportFile); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	var result *calc.NMRResult
+	resultFile := filepath.Join(workDir, "nmr_result.json")
+	if _, err := os.Stat(resultFile); err == nil {
+		if result, err = calc.LoadNMRResult(resultFile); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if report == nil && result == nil {
+		return nil, nil, fmt.Errorf("error: neither %s nor nmr_result.json found in %s, is it the work directory of a run?", calc.ReportFile, workDir)
+	}
+	return report, result, nil
+}
+
+// printReport 输出 report 中每一个步骤的概况
+func printReport(report *calc.Report) {
+	fmt.Printf("%s: %s", report.Input, report.Status)
+	if report.Error != "" {
+		fmt.Printf(" (%s)", report.Error)
+	}
+	fmt.Println()
+	fmt.Printf(" %-7s %-10s %-12s %6s %6s %6s %10s\n", "Step", "Program", "Status", "In", "Out", "Jobs", "Time (s)")
+	for _, stage := range report.Stages {
+		fmt.Printf(" %-7s %-10s %-12s %6d %6d %6d %10.1f\n", stage.Name, orDash(stage.Program), stage.Status,
+			stage.Input, stage.Output, len(stage.Jobs), stage.Seconds)
+	}
+	fmt.Println()
+}
+
+// runReport 读取工作目录 workDir 中已经记录的结果，html 为 true 时写入 HTML 报告 output（为空时为 workDir/report.html），
+// expFile 不为空时与实验数据比较，top 为 3D 结构查看器中显示的构象数
+func runReport(workDir string, html bool, expFile string, output string, top int) error {
+	report, result, err := loadRunResults(workDir)
+	if err != nil {
+		return err
+	}
+	if !html {
+		if report == nil {
+			return fmt.Errorf("error: no %s found in %s, use --html to write a report from nmr_result.json", calc.ReportFile, workDir)
+		}
+		printReport(report)
+		return nil
+	}
+	if top < 0 {
+		return errors.New("error: --top must not be negative")
+	}
+
+	htmlReport := calc.HTMLReport{Report: report, Result: result, Top: top}
+	if expFile != "" {
+		if result == nil {
+			return fmt.Errorf("error: no nmr_result.json found in %s to compare with %s", workDir, expFile)
+		}
+		peaks, err := calc.ParseExperimentalFile(expFile)
+		if err != nil {
+			return err
+		}
+		htmlReport.Comparisons, htmlReport.MAE, err = calc.ComparePeaks(result, peaks)
+		if err != nil {
+			return err
+		}
+	}
+
+	if output == "" {
+		output = filepath.Join(workDir, "report.html")
+	}
+	if err := calc.WriteHTMLReport(output, htmlReport); err != nil {
+		return fmt.Errorf("error writing %s: %w", output, err)
+	}
+	slog.Info("HTML report written", "file", output)
+	return nil
+}
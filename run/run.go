@@ -1,13 +1,18 @@
 package run
 
 import (
+	"context"
 	"fmt"
 	"github.com/urfave/cli/v2"
 	"kybnmr/calc"
 	"kybnmr/utils"
-	"log"
+	"log/slog"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
 	"time"
 )
 
@@ -28,8 +33,25 @@ type KYBNMR struct {
 	md      IsOpenOption
 	pre     IsOpenOption
 	post    IsOpenOption
-	opt     DFTOption
-	sp      DFTOption
+	opt     string
+	sp      string
+	nmr     string
+	// 工作目录，为空时使用 runs/<分子名>
+	workdir string
+	// 命令行中的电荷和自旋多重度，设置之后覆盖配置文件中的值
+	charge          int
+	multiplicity    int
+	chargeSet       bool
+	multiplicitySet bool
+	// 命令行中的 --set section.key=value，覆盖配置文件和环境变量中的值
+	sets []string
+	// 命令行中的 --verbose 和 --quiet，kybnmr batch 将它们传给每一个分子的进程
+	verbose bool
+	quiet   bool
+	// crest 程序的绝对路径，由 prepareWorkDir 根据启动目录得到
+	crestPath string
+	// 最近一次运行得到的 NMR 结果
+	nmrResult *calc.NMRResult
 }
 
 type IsOpenOption int
@@ -39,12 +61,31 @@ const (
 	OpenTure  IsOpenOption = 1
 )
 
-type DFTOption int
+// legacyEngineNames 旧版本中 --opt/--sp/--nmr 使用 0 和 1 选择程序，这里保持兼容
+var legacyEngineNames = map[string]string{
+	"0": "gaussian",
+	"1": "orca",
+}
 
-const (
-	DFTGaussian DFTOption = 0
-	DFTOrca     DFTOption = 1
-)
+// engineName 返回命令行中的程序 option 对应的 engine 名，旧的 0 和 1 分别为 gaussian 和 orca
+func engineName(option string) string {
+	if name, ok := legacyEngineNames[option]; ok {
+		return name
+	}
+	return strings.ToLower(option)
+}
+
+// newEngine 根据 --opt/--sp/--nmr 的值创建 stage 步骤使用的 calc.Engine
+func newEngine(option string, config *calc.Config, stage calc.Stage) (calc.Engine, error) {
+	engine, err := calc.NewEngine(engineName(option), config)
+	if err != nil {
+		return nil, err
+	}
+	if !calc.SupportsStage(engine, stage) {
+		return nil, fmt.Errorf("error: %s cannot be used for the %s step", engine.Name(), stage)
+	}
+	return engine, nil
+}
 
 func NewKYBNMR() *KYBNMR {
 	return &KYBNMR{}
@@ -68,7 +109,7 @@ func (k *KYBNMR) checkInputFile() error {
 		return fmt.Errorf("error: please enter an input file of type xyz")
 	}
 
-	fmt.Println("Hint: Successfully read the input file path: " + inputFullPath)
+	slog.Info("successfully read the input file", "path", inputFullPath)
 	return nil
 }
 
@@ -83,58 +124,160 @@ func (k *KYBNMR) checkConfigFile() error {
 			return fmt.Errorf("error: the default configuration file was not found in the current directory: config.ini")
 		}
 		k.config = configFullPath
-		fmt.Println("Hint: Successfully read the config file path: " + configFullPath)
+		slog.Info("successfully read the config file", "path", configFullPath)
 	}
 
 	return nil
 }
 
-func (k *KYBNMR) runPreOptimization(optConfig *calc.OptimizedConfig) error {
-	calc.XtbExecutePreOpt(optConfig, "dynamics.xyz")
-	// 对 crest 预优化产生的 pre-optimization 文件进行 DoubleCheck
-	// 读取生成的 pre_opt.xyz 文件
-	preClusters, err := calc.ParseXyzFile("pre_opt.xyz")
-	if err != nil {
-		fmt.Println("Error Parse xyz file:", err)
-		return nil
+// defaultConfigFile 返回启动目录中第一个存在的 calc.ConfigFileNames，都不存在时返回 config.ini
+func defaultConfigFile() string {
+	for _, name := range calc.ConfigFileNames {
+		if exist, _ := utils.CheckFileCurrentExist(name); exist {
+			return name
+		}
 	}
-	// 获取 doublecheck 阈值
-	preThreshold := utils.SplitStringByComma(optConfig.PreThreshold)
-	// 进行 double check，同时得到 clusters
-	preRemainClusters, err := calc.DoubleCheck(preThreshold[0], preThreshold[1], preClusters)
+	return calc.ConfigFileNames[0]
+}
+
+// loadConfig 分层读取配置：默认值、用户配置文件、k.config、KYBNMR_* 环境变量以及 --set，见 calc/layers.go
+func (k *KYBNMR) loadConfig() (*calc.Config, error) {
+	return k.loadConfigWith(k.config)
+}
+
+// loadConfigWith 与 loadConfig 相同，项目配置文件为 projectFile，为空时没有项目配置文件，
+// programs 为本次运行用到的程序，它们的路径与其它的配置一起检查
+func (k *KYBNMR) loadConfigWith(projectFile string, programs ...string) (*calc.Config, error) {
+	overrides, err := k.setOverrides()
 	if err != nil {
-		fmt.Println("Error Running DoubleCheck", err)
+		return nil, err
+	}
+	return loadConfigLayers(projectFile, overrides, programs...)
+}
+
+// setOverrides 解析命令行中所有的 --set
+func (k *KYBNMR) setOverrides() ([]calc.ConfigOverride, error) {
+	var overrides []calc.ConfigOverride
+	for _, text := range k.sets {
+		override, err := calc.ParseConfigOverride(text)
+		if err != nil {
+			return nil, fmt.Errorf("error: --set: %w", err)
+		}
+		overrides = append(overrides, override)
+	}
+	return overrides, nil
+}
+
+// loadConfigLayers 分层读取配置，项目配置文件为 projectFile，overrides 为最上层的 --set，programs 见 loadConfigWith
+func loadConfigLayers(projectFile string, overrides []calc.ConfigOverride, programs ...string) (*calc.Config, error) {
+	return calc.LoadConfig(calc.ConfigLayers{
+		UserFile:    calc.UserConfigFile(),
+		ProjectFile: projectFile,
+		Env:         os.Environ(),
+		Overrides:   overrides,
+		Programs:    programs,
+	})
+}
+
+// resolveTemplates 返回每一个步骤使用的模板（启动目录中的模板文件或者 [optimized] preset 中的模板），并检查它们能否渲染，
+// 启动目录中没有、也不来自 preset 的模板使用工作目录中原来的副本，不做检查
+func resolveTemplates(config *calc.Config, engines map[calc.Stage]calc.Engine, data calc.TemplateData) (map[calc.Stage]calc.StageTemplate, error) {
+	templates := make(map[calc.Stage]calc.StageTemplate)
+	for _, stage := range allStages {
+		engine := engines[stage]
+		if !calc.SupportsStage(engine, stage) {
+			continue
+		}
+		stageTemplate, err := calc.ResolveTemplate(engine, stage, config.OptConfig.Preset)
+		if err != nil {
+			return nil, err
+		}
+		templates[stage] = stageTemplate
+		if stageTemplate.File == "" {
+			continue
+		}
+		if stageTemplate.Content != "" {
+			slog.Info("using the template of preset", "program", engine.Name(), "step", stage, "preset", config.OptConfig.Preset)
+		} else if exist, _ := utils.CheckFileCurrentExist(stageTemplate.File); !exist {
+			continue
+		}
+		if err := calc.CheckTemplate(stage, stageTemplate, data); err != nil {
+			return nil, err
+		}
+	}
+	return templates, nil
+}
+
+// checkSolvent 检查配置文件中的溶剂是否可以用于 xtb 以及 engines 中的每一个程序
+func (k *KYBNMR) checkSolvent(config *calc.Config, engines []calc.Engine) error {
+	solvent := &config.SolventConfig
+	if solvent.Name == "" {
 		return nil
 	}
-	// 写入到新的 xyz 文件中
-	calc.WriteToXyzFile(preRemainClusters, "pre_clusters.xyz")
+	if err := solvent.Validate(); err != nil {
+		return err
+	}
+	if k.md == OpenTure || k.pre == OpenTure || k.post == OpenTure {
+		if err := solvent.CheckXtb(); err != nil {
+			return err
+		}
+	}
+	for _, engine := range engines {
+		if err := calc.CheckEngineSolvent(engine, solvent); err != nil {
+			return err
+		}
+	}
+
+	slog.Info("solvent", "name", solvent.Name, "model", solvent.Model)
 	return nil
 }
 
-func (k *KYBNMR) runFurtherOptimization(optConfig *calc.OptimizedConfig) error {
-	fmt.Println("Running crest for post-optimization...")
-	calc.XtbExecutePostOpt(optConfig, "pre_clusters.xyz")
-	// 对 crest 进一步产生的 post-optimization 文件进行 DoubleCheck
-	// 读取生成的 post_opt.xyz 文件
-	postClusters, err := calc.ParseXyzFile("post_opt.xyz")
-	if err != nil {
-		fmt.Println("Error Parse xyz file:", err)
-		return nil
+// applyMolecule 用命令行中的电荷和自旋多重度覆盖配置文件中的值，并检查它们与输入结构的电子数是否匹配
+func (k *KYBNMR) applyMolecule(config *calc.Config) error {
+	if k.chargeSet {
+		config.MoleculeConfig.Charge = k.charge
+	}
+	if k.multiplicitySet {
+		config.MoleculeConfig.Multiplicity = k.multiplicity
 	}
-	// 获取 doublecheck 阈值
-	postThreshold := utils.SplitStringByComma(optConfig.PostThreshold)
-	// 进行 double check，同时得到 clusters
-	postRemainClusters, err := calc.DoubleCheck(postThreshold[0], postThreshold[1], postClusters)
+
+	clusters, err := calc.ParseXyzFile(k.input)
 	if err != nil {
-		fmt.Println("Error Running DoubleCheck", err)
-		return nil
+		return fmt.Errorf("error parsing xyz file: %w", err)
 	}
-	// 写入到新的 xyz 文件中
-	calc.WriteToXyzFile(postRemainClusters, "post_clusters.xyz")
+	if len(clusters) == 0 {
+		return fmt.Errorf("error: no structure found in %s", k.input)
+	}
+	if err := config.MoleculeConfig.Validate(clusters[0]); err != nil {
+		return fmt.Errorf("error: %s: %w", k.input, err)
+	}
+
+	slog.Info("molecule", "charge", config.MoleculeConfig.Charge, "multiplicity", config.MoleculeConfig.Multiplicity)
 	return nil
 }
 
+func (k *KYBNMR) runPreOptimization(ctx context.Context, config *calc.Config, stage *calc.StageReport) error {
+	optConfig := &config.OptConfig
+	if err := calc.XtbExecutePreOpt(ctx, k.crestPath, optConfig, &config.MoleculeConfig, &config.SolventConfig, config.WallTimeConfig.Crest, filepath.Join("..", mdFolder, "dynamics.xyz")); err != nil {
+		return err
+	}
+	// 对 crest 预优化产生的 pre_opt.xyz 文件进行 DoubleCheck，写入到新的 xyz 文件中
+	return recordDedup(stage, "pre_opt.xyz", optConfig.PreThreshold, "pre_clusters.xyz")
+}
+
+func (k *KYBNMR) runFurtherOptimization(ctx context.Context, config *calc.Config, stage *calc.StageReport) error {
+	optConfig := &config.OptConfig
+	if err := calc.XtbExecutePostOpt(ctx, k.crestPath, optConfig, &config.MoleculeConfig, &config.SolventConfig, config.WallTimeConfig.Crest, filepath.Join("..", preFolder, "pre_clusters.xyz")); err != nil {
+		return err
+	}
+	// 对 crest 进一步产生的 post_opt.xyz 文件进行 DoubleCheck，写入到新的 xyz 文件中
+	return recordDedup(stage, "post_opt.xyz", optConfig.PostThreshold, "post_clusters.xyz")
+}
+
 func (k *KYBNMR) ParseArgsToRun() {
+	// 在解析命令行参数之前使用默认的日志级别，--verbose 和 --quiet 在 Before 中设置
+	utils.SetupLogger(false, false)
+
 	// EXAMPLE: Override a template
 	cli.AppHelpTemplate = `NAME:
    {{.Name}} - {{.Usage}}
@@ -170,27 +313,89 @@ VERSION:
 		Name:    "kybnmr",
 		Usage:   "A scripting program for fully automated calculation of NMR of large molecules",
 		Version: "v1.0.0(dev)",
+		Before: func(c *cli.Context) error {
+			// 没有指定 --config 并且没有 config.ini 时，使用启动目录中的 config.toml 或者 config.yaml
+			if !c.IsSet("config") {
+				k.config = defaultConfigFile()
+			}
+			if c.Bool("verbose") && c.Bool("quiet") {
+				return fmt.Errorf("error: --verbose and --quiet cannot be used together")
+			}
+			k.verbose, k.quiet = c.Bool("verbose"), c.Bool("quiet")
+			utils.SetupLogger(k.verbose, k.quiet)
+			return nil
+		},
 		Flags: []cli.Flag{
 			&cli.StringFlag{
 				Name:        "config",
 				Aliases:     []string{"c"},
 				Value:       "config.ini",
-				Usage:       "Load configuration from `FILE`",
+				Usage:       "Load configuration from `FILE` (ini, toml or yaml)",
 				Destination: &k.config,
 			},
-			&cli.IntFlag{
+			&cli.StringSliceFlag{
+				Name:  "set",
+				Usage: "override `SECTION.KEY=VALUE` of the config file, can be repeated",
+				Action: func(c *cli.Context, sets []string) error {
+					k.sets = sets
+					return nil
+				},
+			},
+			&cli.BoolFlag{
+				Name:    "verbose",
+				Aliases: []string{"V"},
+				Usage:   "show debug messages and the output of the external programs on the terminal",
+			},
+			&cli.BoolFlag{
+				Name:    "quiet",
+				Aliases: []string{"q"},
+				Usage:   "show only warnings and errors on the terminal",
+			},
+			&cli.StringFlag{
 				Name:        "opt",
-				Usage:       "DFT optimization and vibration procedure",
+				Usage:       "DFT optimization and vibration procedure `PROGRAM` (" + strings.Join(calc.EngineNames(), ", ") + ")",
 				Aliases:     []string{"o"},
-				Destination: (*int)(&k.opt),
-				Value:       int(DFTGaussian),
+				Destination: &k.opt,
+				Value:       "gaussian",
 			},
-			&cli.IntFlag{
+			&cli.StringFlag{
 				Name:        "sp",
-				Usage:       "DFT single point procedure",
+				Usage:       "DFT single point procedure `PROGRAM` (" + strings.Join(calc.EngineNames(), ", ") + ")",
 				Aliases:     []string{"s"},
-				Destination: (*int)(&k.sp),
-				Value:       int(DFTOrca),
+				Destination: &k.sp,
+				Value:       "orca",
+			},
+			&cli.StringFlag{
+				Name:        "nmr",
+				Usage:       "DFT NMR shielding procedure `PROGRAM` (" + strings.Join(calc.EngineNames(), ", ") + ")",
+				Aliases:     []string{"n"},
+				Destination: &k.nmr,
+				Value:       "gaussian",
+			},
+			&cli.StringFlag{
+				Name:        "workdir",
+				Aliases:     []string{"w"},
+				Usage:       "write all files of the run into `DIR` (default: runs/<input name>)",
+				Destination: &k.workdir,
+			},
+			&cli.IntFlag{
+				Name:        "charge",
+				Usage:       "total `CHARGE` of the molecule (default: [molecule] charge of the config file)",
+				Destination: &k.charge,
+				Action: func(c *cli.Context, charge int) error {
+					k.chargeSet = true
+					return nil
+				},
+			},
+			&cli.IntFlag{
+				Name:        "multiplicity",
+				Aliases:     []string{"mult"},
+				Usage:       "spin `MULTIPLICITY` 2S+1 of the molecule (default: [molecule] multiplicity of the config file)",
+				Destination: &k.multiplicity,
+				Action: func(c *cli.Context, multiplicity int) error {
+					k.multiplicitySet = true
+					return nil
+				},
 			},
 			&cli.IntFlag{
 				Name:        "md",
@@ -220,11 +425,308 @@ VERSION:
 			}
 			k.input = c.Args().Get(0)
 			// Run the workflow
-			if err := k.Run(); err != nil {
-				log.Fatal(err)
+			if err := k.Run(c.Context); err != nil {
+				fatal(err)
 			}
 			return nil
 		},
+		Commands: []*cli.Command{
+			{
+				Name:  "init",
+				Usage: "detect the installed programs and write a config file and the templates of a method preset",
+				Flags: []cli.Flag{
+					&cli.IntFlag{
+						Name:  "charge",
+						Usage: "total `CHARGE` of the molecule (default: 0)",
+					},
+					&cli.IntFlag{
+						Name:    "multiplicity",
+						Aliases: []string{"mult"},
+						Usage:   "spin `MULTIPLICITY` 2S+1 of the molecule (default: 1)",
+					},
+					&cli.StringFlag{
+						Name:  "solvent",
+						Usage: "implicit `SOLVENT` of all calculations (default: gas phase)",
+					},
+					&cli.Float64Flag{
+						Name:  "temperature",
+						Usage: "`TEMPERATURE` of the Boltzmann distribution in K (default: 298.15)",
+					},
+					&cli.StringFlag{
+						Name:  "preset",
+						Usage: "method `PRESET` (" + strings.Join(calc.PresetNames(), ", ") + ") (default: " + defaultInitPreset + ")",
+					},
+					&cli.BoolFlag{
+						Name:    "force",
+						Aliases: []string{"f"},
+						Usage:   "overwrite the existing config file and templates",
+					},
+					&cli.BoolFlag{
+						Name:    "yes",
+						Aliases: []string{"y"},
+						Usage:   "do not ask, use the defaults for the settings not given",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					options := &initOptions{
+						Force:       c.Bool("force"),
+						Interactive: !c.Bool("yes") && isTerminal(os.Stdin),
+					}
+					if c.IsSet("charge") {
+						charge := c.Int("charge")
+						options.Charge = &charge
+					}
+					if c.IsSet("multiplicity") {
+						multiplicity := c.Int("multiplicity")
+						options.Multiplicity = &multiplicity
+					}
+					if c.IsSet("solvent") {
+						solvent := c.String("solvent")
+						options.Solvent = &solvent
+					}
+					if c.IsSet("temperature") {
+						temperature := c.Float64("temperature")
+						options.Temperature = &temperature
+					}
+					if c.IsSet("preset") {
+						preset := c.String("preset")
+						options.Preset = &preset
+					}
+					return k.runInit(c.Context, options)
+				},
+			},
+			{
+				Name:  "doctor",
+				Usage: "check the external programs, their versions and the environment needed by KYBNMR",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "smoke",
+						Usage: "run a tiny test calculation with xtb, Gaussian and ORCA",
+					},
+					&cli.BoolFlag{
+						Name:  "json",
+						Usage: "print the result as JSON",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					return k.runDoctor(c.Context, c.Bool("smoke"), c.Bool("json"))
+				},
+			},
+			{
+				Name:      "dp4",
+				Usage:     "run KYBNMR for several candidate isomers and rank them by DP4/DP4+ probability",
+				ArgsUsage: "<isomer.xyz> <isomer.xyz> ...",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "exp",
+						Aliases:  []string{"e"},
+						Usage:    "Load experimental chemical shifts from `FILE` (csv)",
+						Required: true,
+					},
+				},
+				Action: func(c *cli.Context) error {
+					return k.runDP4(c.Context, c.String("exp"), c.Args().Slice())
+				},
+			},
+			{
+				Name:      "batch",
+				Usage:     "run KYBNMR for every molecule of a manifest file and write a combined summary",
+				ArgsUsage: "<manifest.csv>",
+				Flags: []cli.Flag{
+					&cli.IntFlag{
+						Name:    "jobs",
+						Aliases: []string{"j"},
+						Usage:   "run at most `N` molecules at the same time",
+						Value:   1,
+					},
+				},
+				Action: func(c *cli.Context) error {
+					if c.NArg() == 0 {
+						return fmt.Errorf("missing required argument: <manifest.csv>")
+					}
+					return k.runBatch(c.Context, c.Args().Get(0), c.Int("jobs"))
+				},
+			},
+			{
+				Name:  "config",
+				Usage: "show the merged configuration or convert a config file between ini, TOML and YAML",
+				Subcommands: []*cli.Command{
+					{
+						Name:      "convert",
+						Usage:     "convert a config file between the ini, TOML and YAML formats, chosen by the file extensions",
+						ArgsUsage: "<input> <output>",
+						Flags: []cli.Flag{
+							&cli.BoolFlag{
+								Name:    "force",
+								Aliases: []string{"f"},
+								Usage:   "overwrite an existing output file",
+							},
+						},
+						Action: func(c *cli.Context) error {
+							if c.NArg() != 2 {
+								return fmt.Errorf("expected two arguments: <input> <output>")
+							}
+							return runConfigConvert(c.Args().Get(0), c.Args().Get(1), c.Bool("force"))
+						},
+					},
+					{
+						Name:  "show",
+						Usage: "show the values set by the config files, KYBNMR_* variables and --set with their source",
+						Flags: []cli.Flag{
+							&cli.BoolFlag{
+								Name:  "resolved",
+								Usage: "show every value used by the run, including the built-in defaults",
+							},
+						},
+						Action: func(c *cli.Context) error {
+							return k.runConfigShow(c.Bool("resolved"))
+						},
+					},
+				},
+			},
+			{
+				Name:  "templates",
+				Usage: "list the built-in method presets and show their templates",
+				Subcommands: []*cli.Command{
+					{
+						Name:  "list",
+						Usage: "list the built-in method presets",
+						Action: func(c *cli.Context) error {
+							return runTemplatesList()
+						},
+					},
+					{
+						Name:      "show",
+						Usage:     "show the templates of a preset",
+						ArgsUsage: "<preset>",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:  "engine",
+								Usage: "only show the templates of `PROGRAM` (gaussian or orca)",
+							},
+							&cli.StringFlag{
+								Name:  "stage",
+								Usage: "only show the template of `STAGE` (opt, sp or nmr)",
+							},
+						},
+						Action: func(c *cli.Context) error {
+							if c.NArg() == 0 {
+								return fmt.Errorf("missing required argument: <preset>")
+							}
+							return runTemplatesShow(c.Args().Get(0), c.String("engine"), c.String("stage"))
+						},
+					},
+				},
+			},
+			{
+				Name:      "compare",
+				Usage:     "compare the calculated shifts with experimental data, assigning unassigned peaks automatically",
+				ArgsUsage: "[nmr_result.json | workdir]",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "exp",
+						Aliases:  []string{"e"},
+						Usage:    "Load experimental chemical shifts from `FILE` (csv)",
+						Required: true,
+					},
+				},
+				Action: func(c *cli.Context) error {
+					resultFile := "nmr_result.json"
+					if c.NArg() > 0 {
+						resultFile = c.Args().Get(0)
+					}
+					return k.runCompare(c.String("exp"), resultFile)
+				},
+			},
+			{
+				Name:      "breakdown",
+				Usage:     "print the per-conformer contributions to every averaged shift and write them next to nmr_result.json (of a work directory)",
+				ArgsUsage: "[nmr_result.json | workdir]",
+				Flags: []cli.Flag{
+					&cli.Float64Flag{
+						Name:  "perturbation",
+						Usage: "free energy perturbation of each conformer in kcal/mol",
+						Value: defaultPerturbation,
+					},
+				},
+				Action: func(c *cli.Context) error {
+					resultFile := "nmr_result.json"
+					if c.NArg() > 0 {
+						resultFile = c.Args().Get(0)
+					}
+					return k.runBreakdown(resultFile, c.Float64("perturbation"))
+				},
+			},
+			{
+				Name:      "report",
+				Usage:     "summarize the recorded results of a run, or write them as a self-contained HTML report with plots",
+				ArgsUsage: "[workdir]",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "html",
+						Usage: "write an HTML report with the energy histograms, populations, spectra and 3D structures",
+					},
+					&cli.StringFlag{
+						Name:    "exp",
+						Aliases: []string{"e"},
+						Usage:   "add calculated vs experimental plots for the shifts in `FILE` (csv)",
+					},
+					&cli.StringFlag{
+						Name:    "output",
+						Aliases: []string{"o"},
+						Usage:   "write the HTML report to `FILE` (default: report.html in the work directory)",
+					},
+					&cli.IntFlag{
+						Name:  "top",
+						Usage: "show the 3D structures of the `N` most populated conformers",
+						Value: 3,
+					},
+				},
+				Action: func(c *cli.Context) error {
+					workDir := "."
+					if c.NArg() > 0 {
+						workDir = c.Args().Get(0)
+					}
+					return runReport(workDir, c.Bool("html"), c.String("exp"), c.String("output"), c.Int("top"))
+				},
+			},
+			{
+				Name:      "status",
+				Usage:     "show the current step, the state of every DFT job and the time spent of a running or finished run",
+				ArgsUsage: "[workdir]",
+				Action: func(c *cli.Context) error {
+					workDir := "."
+					if c.NArg() > 0 {
+						workDir = c.Args().Get(0)
+					}
+					return runStatus(workDir)
+				},
+			},
+			{
+				Name:  "serve",
+				Usage: "serve a local HTTP API that queues the submitted runs and runs them within a core budget",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "listen",
+						Usage: "listen on `ADDRESS`",
+						Value: defaultServeListen,
+					},
+					&cli.StringFlag{
+						Name:  "store",
+						Usage: "keep the submitted runs in `DIR`",
+						Value: defaultServeStore,
+					},
+					&cli.IntFlag{
+						Name:  "cores",
+						Usage: "run at most `N` cores ([resources] nprocs of every run) at the same time",
+						Value: runtime.NumCPU(),
+					},
+				},
+				Action: func(c *cli.Context) error {
+					return k.runServe(c.Context, c.String("listen"), c.String("store"), c.Int("cores"))
+				},
+			},
+		},
 		Authors: []*cli.Author{
 			{
 				Name:  "Kimari Y.B.",
@@ -233,18 +735,30 @@ VERSION:
 		},
 	}
 
-	if err := app.Run(os.Args); err != nil {
-		log.Fatal(err)
+	// 收到 Ctrl-C 或者 SIGTERM 时取消 ctx，结束正在运行的外部程序，并将未完成的任务标记为中断
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := app.RunContext(ctx, os.Args); err != nil {
+		stop()
+		fatal(err)
 	}
 }
 
+// fatal 输出 err 并以状态码 1 退出
+func fatal(err error) {
+	slog.Error(strings.TrimPrefix(err.Error(), "error: "))
+	os.Exit(1)
+}
+
 // Run 起到通过命令行执行整个任务流程的作用
-func (k *KYBNMR) Run() error {
+// ctx 被取消时结束正在运行的外部程序，并且不再运行之后的步骤
+func (k *KYBNMR) Run(ctx context.Context) (runErr error) {
 	// 记录起始时间
 	start := time.Now()
 
 	// 展示程序的基础信息、版本信息以及作者信息
-	utils.ShowHead()
+	version, _ := utils.ShowHead()
 
 	if err := k.checkInputFile(); err != nil {
 		return err
@@ -254,110 +768,243 @@ func (k *KYBNMR) Run() error {
 		return err
 	}
 
-	// 获取配置信息
-	optConfig := calc.ParseConfigFile(k.config).OptConfig
-	dyConfig := calc.ParseConfigFile(k.config).DyConfig
+	// 获取配置信息，程序的路径与配置文件中的其它问题一起报告，动力学模拟使用 xtbPath
+	programs := []string{engineName(k.opt), engineName(k.sp), engineName(k.nmr), "shermo"}
+	if k.md == OpenTure {
+		programs = append(programs, "xtb")
+	}
+	config, err := k.loadConfigWith(k.config, programs...)
+	if err != nil {
+		return err
+	}
+	optConfig := config.OptConfig
+	dyConfig := config.DyConfig
+	nmrConfig := config.NMRConfig
+	wallTime := config.WallTimeConfig
+	if err := k.applyMolecule(config); err != nil {
+		return err
+	}
+
+	// 在运行任何计算之前创建 Engine，避免程序名写错时白白跑完动力学模拟
+	optEngine, err := newEngine(k.opt, config, calc.StageOpt)
+	if err != nil {
+		return err
+	}
+	spEngine, err := newEngine(k.sp, config, calc.StageSP)
+	if err != nil {
+		return err
+	}
+	nmrEngine, err := newEngine(k.nmr, config, calc.StageNMR)
+	if err != nil {
+		return err
+	}
+	backend, err := calc.NewBackend(config)
+	if err != nil {
+		return err
+	}
+	if err := k.checkSolvent(config, []calc.Engine{optEngine, spEngine, nmrEngine}); err != nil {
+		return err
+	}
+	engines := map[calc.Stage]calc.Engine{calc.StageOpt: optEngine, calc.StageSP: spEngine, calc.StageNMR: nmrEngine}
+	templateData := calc.NewTemplateData(config, moleculeName(k.input))
+	templates, err := resolveTemplates(config, engines, templateData)
+	if err != nil {
+		return err
+	}
+
+	// 在工作目录中运行之后所有的步骤，不会修改工作目录之外的任何文件
+	workDir, input, err := k.prepareWorkDir(config, templates)
+	if err != nil {
+		return err
+	}
+	leave, err := enterFolder(workDir)
+	if err != nil {
+		return err
+	}
+	defer leave()
+
+	// 本次运行的日志写入工作目录中的 kybnmr.log
+	closeLog, err := utils.OpenRunLog(".")
+	if err != nil {
+		return fmt.Errorf("error opening %s: %w", utils.LogFile, err)
+	}
+	defer closeLog()
+	slog.Info("running in the work directory", "dir", workDir, "input", k.input, "version", version)
+
+	// 记录本次运行的 report.json，不管运行是否成功，结束时都写入工作目录
+	report := k.newReport(ctx, version, config, engines, backend)
+	saveReport(report)
+	defer func() {
+		report.Finish(runErr)
+		saveReport(report)
+		// 错误由 ParseArgsToRun 输出到终端，这里只记录到 kybnmr.log 中
+		utils.SetLogStage("main")
+		slog.Debug("run finished", "status", report.Status, "error", report.Error, "seconds", report.Seconds)
+	}()
+
 	// ----------------------------------------------------------------
 	// 开始运行 xtb 程序做动力学模拟
 	// ----------------------------------------------------------------
-	fmt.Println()
 	if k.md == OpenTure {
-		fmt.Println("Running xtb for dynamics simulation...")
-		if err := calc.XtbExecuteMD(&dyConfig, k.input); err != nil {
+		stage := startStage(report, "md", "xtb")
+		slog.Info("running xtb for dynamics simulation")
+		stage.Input = 1
+		err := inFolder(mdFolder, func() error {
+			return calc.XtbExecuteMD(ctx, optConfig.XtbPath, &dyConfig, &config.MoleculeConfig, &config.SolventConfig, wallTime.MD, input)
+		})
+		if frames, err := calc.ParseXyzFile(filepath.Join(mdFolder, "dynamics.xyz")); err == nil {
+			stage.Output = len(frames)
+		}
+		stage.Finish(err)
+		if err != nil {
 			return err
 		}
 	} else if k.md == OpenFalse {
-		fmt.Println("Skipped dynamics simulation")
+		skipStage(report, "md")
+		slog.Info("skipped dynamics simulation")
 	}
 	// ----------------------------------------------------------------
 	// 开始运行 crest 程序做预优化
 	// ----------------------------------------------------------------
-	fmt.Println()
 	if k.pre == OpenTure {
-		fmt.Println("Running crest for pre-optimization...")
-		if err := k.runPreOptimization(&optConfig); err != nil {
+		stage := startStage(report, "pre", "crest")
+		slog.Info("running crest for pre-optimization")
+		err := inFolder(preFolder, func() error {
+			return k.runPreOptimization(ctx, config, stage)
+		})
+		stage.Finish(err)
+		if err != nil {
 			return err
 		}
 	} else if k.pre == OpenFalse {
-		fmt.Println("Skipped pre-optimization")
+		skipStage(report, "pre")
+		slog.Info("skipped pre-optimization")
 	}
 	// ----------------------------------------------------------------
 	// 开始运行 crest 程序做进一步优化
 	// ----------------------------------------------------------------
-	fmt.Println()
 	if k.post == OpenTure {
-		fmt.Println("Running crest for post-optimization...")
-		if err := k.runFurtherOptimization(&optConfig); err != nil {
+		stage := startStage(report, "post", "crest")
+		slog.Info("running crest for post-optimization")
+		err := inFolder(postFolder, func() error {
+			return k.runFurtherOptimization(ctx, config, stage)
+		})
+		stage.Finish(err)
+		if err != nil {
 			return err
 		}
 	} else if k.post == OpenFalse {
-		fmt.Println("Skipped post-optimization")
+		skipStage(report, "post")
+		slog.Info("skipped post-optimization")
 	}
 
-	postRemainClusters, err := calc.ParseXyzFile("post_clusters.xyz")
+	postRemainClusters, err := calc.ParseXyzFile(filepath.Join(postFolder, "post_clusters.xyz"))
 	if err != nil {
 		return fmt.Errorf("error parsing xyz file: %w", err)
 	}
 
 	// ----------------------------------------------------------------
-	// 开始运行 gaussian/orca 程序做 DFT 优化
+	// 开始运行量子化学程序做 DFT 优化
 	// ----------------------------------------------------------------
-	// 执行 DFT 步骤
-	fmt.Println()
-	spClusters := calc.ClusterList{}
-
-	fmt.Println("Running Gaussian/Orca for DFT Optimization Calculating...")
-	if k.opt == DFTGaussian {
-		err = calc.RunDFTOptimization(optConfig.GauPath, "GauTemplate.gjf", postRemainClusters, "gaussian")
-		// 获取 thermo/opt 文件夹下所有 out 文件，并且调用 ParseOutFile 将所有的 cluster 组合成 ClusterList
-		spClusters, err = calc.ReadClusterListFromOut("gaussian")
-	} else if k.opt == DFTOrca {
-		err = calc.RunDFTOptimization(optConfig.OrcaPath, "OrcaTemplate.inp", postRemainClusters, "orca")
-		// 获取 thermo/opt 文件夹下所有 out 文件，并且调用 ParseOutFile 将所有的 cluster 组合成 ClusterList
-		spClusters, err = calc.ReadClusterListFromOut("orca")
+	stage := startStage(report, string(calc.StageOpt), optEngine.Name())
+	slog.Info("running DFT optimization", "program", optEngine.Name(), "conformers", len(postRemainClusters))
+	stage.Input = len(postRemainClusters)
+	stage.Jobs, err = calc.RunDFTStage(ctx, optEngine, backend, calc.StageOpt, templates[calc.StageOpt].File, templateData, postRemainClusters)
+	if err != nil {
+		err = fmt.Errorf("error running DFT optimization: %w", err)
+		stage.Finish(err)
+		return err
 	}
+	// 获取 thermo/opt 文件夹下所有 out 文件，并且将所有的 cluster 组合成 ClusterList
+	spClusters, err := calc.ReadClusterListFromOut(optEngine)
 	if err != nil {
-		return fmt.Errorf("error running DFT optimization: %w", err)
+		err = fmt.Errorf("error reading optimized structures: %w", err)
+		stage.Finish(err)
+		return err
 	}
+	stage.Output = len(spClusters)
+	stage.Finish(nil)
 
 	// ----------------------------------------------------------------
-	// 开始运行 gaussian/orca 程序做 DFT 单点能计算
+	// 开始运行量子化学程序做 DFT 单点能计算
 	// ----------------------------------------------------------------
-	fmt.Println()
-	fmt.Println("Running Gaussian/Orca for DFT Single Point Energy Calculating...")
-	if k.sp == DFTGaussian {
-		// 执行 DFT 步骤，调用 Gaussian 计算能量
-		err = calc.RunDFTSinglePoint(optConfig.GauPath, "GauTemplate.gjf", spClusters, "gaussian")
-	} else if k.sp == DFTOrca {
-		// 执行 DFT 步骤，调用 Orca 计算能量
-		err = calc.RunDFTSinglePoint(optConfig.OrcaPath, "OrcaTemplate.inp", spClusters, "orca")
+	stage = startStage(report, string(calc.StageSP), spEngine.Name())
+	slog.Info("running DFT single point energy", "program", spEngine.Name(), "conformers", len(spClusters))
+	stage.Input = len(spClusters)
+	stage.Jobs, err = calc.RunDFTStage(ctx, spEngine, backend, calc.StageSP, templates[calc.StageSP].File, templateData, spClusters)
+	if err != nil {
+		err = fmt.Errorf("error running DFT single point: %w", err)
+		stage.Finish(err)
+		return err
 	}
+	stage.Output = len(spClusters)
+	stage.Finish(nil)
+
+	// ----------------------------------------------------------------
+	// 开始运行量子化学程序做 NMR 计算
+	// ----------------------------------------------------------------
+	stage = startStage(report, string(calc.StageNMR), nmrEngine.Name())
+	slog.Info("running DFT NMR", "program", nmrEngine.Name(), "conformers", len(spClusters))
+	stage.Input = len(spClusters)
+	stage.Jobs, err = calc.RunDFTStage(ctx, nmrEngine, backend, calc.StageNMR, templates[calc.StageNMR].File, templateData, spClusters)
 	if err != nil {
-		return fmt.Errorf("error running DFT single point: %w", err)
+		err = fmt.Errorf("error running DFT NMR: %w", err)
+		stage.Finish(err)
+		return err
 	}
+	stage.Output = len(spClusters)
+	stage.Finish(nil)
 
-	// 删除 opt 和 sp 文件夹中的所有除了 out 文件之外的文件
-	utils.DeleteAllFileButKeepType(".out")
+	// 删除 opt、sp 和 nmr 文件夹中的所有除了输入文件、out 文件和程序的 log 文件之外的文件，
+	// 再次运行时 RunDFTStage 比较输入文件来判断任务是否可以跳过
+	keepTypes := []string{".out", ".log"}
+	for _, stage := range []calc.Stage{calc.StageOpt, calc.StageSP, calc.StageNMR} {
+		keepTypes = append(keepTypes, calc.InputExt(templates[stage].File))
+	}
+	utils.DeleteAllFileButKeepType(keepTypes...)
 	// ----------------------------------------------------------------
 	// 最后调用 Shermo 计算 Bolzmann 分布
 	// ----------------------------------------------------------------
-	fmt.Println()
-	fmt.Println("Running Shermo for Calculating Bolzmann distribution...")
-	var resultCollection []calc.ShermoResult
-
-	if k.sp == DFTGaussian {
-		// 调用 Gaussian 的输出文件
-		resultCollection = calc.GetGaussianEnergy()
-	} else if k.sp == DFTOrca {
-		// 调用 Orca 的输出文件
-		resultCollection = calc.GetOrcaEnergy()
+	stage = startStage(report, "shermo", "shermo")
+	slog.Info("running Shermo for calculating Boltzmann distribution")
+	resultCollection, err := calc.CollectSinglePointEnergies(spEngine)
+	if err != nil {
+		err = fmt.Errorf("error reading single point energies: %w", err)
+		stage.Finish(err)
+		return err
 	}
+	stage.Input = len(resultCollection)
 	// 运行 shermo 对 bolzmann 分布计算
-	err = calc.RunShermoToBolzmann(resultCollection, optConfig.ShermoPath)
+	err = calc.RunShermoToBolzmann(ctx, resultCollection, optConfig.ShermoPath, wallTime.Shermo)
+	if err == nil {
+		stage.Output = len(resultCollection)
+	}
+	stage.Finish(err)
 	if err != nil {
 		return err
 	}
 
+	// ----------------------------------------------------------------
+	// 根据 Boltzmann 分布计算平均化学位移
+	// ----------------------------------------------------------------
+	utils.SetLogStage("main")
+	slog.Info("calculating Boltzmann averaged chemical shifts")
+	k.nmrResult, err = calc.CollectNMRResult(optEngine, spEngine, nmrEngine, &nmrConfig)
+	if err != nil {
+		return fmt.Errorf("error collecting NMR result: %w", err)
+	}
+	report.SetNMRResult(k.nmrResult)
+	k.nmrResult.PrintNMRResult()
+	if err := k.nmrResult.WriteShiftsCSV("nmr_shifts.csv"); err != nil {
+		return err
+	}
+	if err := k.nmrResult.SaveJSON("nmr_result.json"); err != nil {
+		return err
+	}
+	if _, err := writeBreakdown(k.nmrResult, defaultPerturbation, "."); err != nil {
+		return err
+	}
+
 	// 输出时间差以及当前时间
 	utils.FormatDuration(time.Since(start))
 
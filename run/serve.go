@@ -0,0 +1,759 @@
+package run
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"kybnmr/calc"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+* serve.go
+* 该模块用来处理 kybnmr serve 子命令：在本机上提供一个 HTTP API，排队运行提交的 KYBNMR 运行，
+* 多人共用一台工作站时不需要每个人都在 tmux 中启动 kybnmr，网页前端和脚本都可以通过它提交计算
+*
+*	1. 每一次提交的运行都保存在任务仓库 (--store，默认为 kybnmr-serve) 的 <id> 文件夹中：
+*		<store>/<id>/
+*			job.json        运行的状态、需要的核数和时间，服务重启之后从这里恢复
+*			<name>.xyz      提交的结构
+*			config.<后缀>    提交的配置文件（没有时为服务的 --config），已经依次应用了服务的 --set 和提交的 set
+*			kybnmr.out      KYBNMR 子进程的输出
+*			run/            运行的工作目录，见 workdir.go
+*	2. 与 batch 相同，每一次运行都在单独的 KYBNMR 进程中运行，命令行中的 --opt、--sp、--nmr 等参数会传给每一个进程
+*	   [optimized] 中的程序路径 (*Path) 和 [batch] 中的配置会被服务运行，只能使用服务自己的值：
+*	   提交的配置文件和 set 中不能有这些 key，服务的值最后写入每一次运行的配置文件
+*	3. 每一次运行需要 [resources] nprocs 个核，所有正在运行的运行使用的核数不超过 --cores，
+*	   排队的运行按照提交的顺序开始，排在最前面的运行放不下时，后面的运行也等待
+*	4. 服务停止时中断所有正在运行的运行（状态为 interrupted），排队的运行在下一次启动服务之后继续
+*
+*	API（请求和返回都为 json，出错时返回 {"error": "..."}）：
+*		POST /runs                提交一次运行：{"name", "xyz", "config", "configFormat", "set"}
+*		GET  /runs                所有的运行
+*		GET  /runs/{id}           一次运行
+*		GET  /runs/{id}/status    运行以及 kybnmr status 的结果
+*		GET  /runs/{id}/report    工作目录中的 report.json
+*		GET  /runs/{id}/log       KYBNMR 子进程的输出
+*		POST /runs/{id}/cancel    取消排队或者正在运行的运行
+*
+* @Author: Kimariyb
+* @Address: XiaMen University
+* @Data: 2023-09-26
+ */
+
+// 运行在 kybnmr serve 中的状态
+const (
+	serveQueued      = "queued"
+	serveRunning     = "running"
+	serveCompleted   = "completed"
+	serveFailed      = "failed"
+	serveCancelled   = "cancelled"
+	serveInterrupted = "interrupted"
+)
+
+// 任务仓库中每一次运行的文件
+const (
+	serveJobFile    = "job.json"
+	serveOutputFile = "kybnmr.out"
+	serveRunFolder  = "run"
+)
+
+// kybnmr serve 默认监听的地址和任务仓库，默认只接受本机的请求
+const (
+	defaultServeListen = "127.0.0.1:8642"
+	defaultServeStore  = "kybnmr-serve"
+)
+
+// serveMaxBody 提交的请求的最大字节数
+const serveMaxBody = 32 << 20
+
+// serveNameRegex 提交的分子名，也是 xyz 文件的名字
+var serveNameRegex = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]{0,63}$`)
+
+// serveJob kybnmr serve 中的一次运行，写入 <store>/<id>/job.json
+//   - Cores: 运行需要的核数，即配置中的 [resources] nprocs
+//   - Input、Config、WorkDir: 结构、配置文件和工作目录的绝对路径
+//   - CreatedAt、StartedAt、FinishedAt: 提交、开始和结束的时间，RFC 3339 格式
+type serveJob struct {
+	ID         string `json:"id"`
+	Name       string `json:"name"`
+	Status     string `json:"status"`
+	Cores      int    `json:"cores"`
+	Input      string `json:"input"`
+	Config     string `json:"config"`
+	WorkDir    string `json:"workDir"`
+	CreatedAt  string `json:"createdAt"`
+	StartedAt  string `json:"startedAt,omitempty"`
+	FinishedAt string `json:"finishedAt,omitempty"`
+	Error      string `json:"error,omitempty"`
+
+	dir       string
+	cancel    context.CancelFunc
+	cancelled bool
+}
+
+// setDir 将 job 的文件夹设为 dir，结构、配置文件和工作目录都在这个文件夹中
+func (job *serveJob) setDir(dir string) {
+	job.dir = dir
+	job.Input = filepath.Join(dir, filepath.Base(job.Input))
+	job.Config = filepath.Join(dir, filepath.Base(job.Config))
+	job.WorkDir = filepath.Join(dir, serveRunFolder)
+}
+
+// serveSubmit POST /runs 的请求
+//   - Name: 分子名，默认为 molecule
+//   - XYZ: xyz 文件的内容
+//   - Config: 配置文件的内容，为空时使用服务的 --config
+//   - ConfigFormat: Config 的格式，ini（默认）、toml 或者 yaml
+//   - Set: 与 --set 相同的 section.key=value，应用到配置文件中
+type serveSubmit struct {
+	Name         string   `json:"name"`
+	XYZ          string   `json:"xyz"`
+	Config       string   `json:"config"`
+	ConfigFormat string   `json:"configFormat"`
+	Set          []string `json:"set"`
+}
+
+// serveStatus GET /runs/{id}/status 的结果，还没有 report.json 时 Run 为 null
+type serveStatus struct {
+	Job *serveJob         `json:"job"`
+	Run *runStatusSummary `json:"run"`
+}
+
+// server kybnmr serve 的任务仓库和调度，实现了 http.Handler
+//   - cores、used: 核数的上限和正在运行的运行使用的核数
+//   - defaultConfig: 没有提交配置文件时使用的配置文件，为空时每一次提交都必须包括配置文件
+//   - sets: 服务的 --set，在提交的 set 之前写入每一次运行的配置文件
+//   - fixed: 服务自己的程序路径、xtb 和 crest 的参数以及 [batch] 配置，最后写入每一次运行的配置文件，见 serverOnlyKey
+//   - loadConfig: 读取一次运行的配置文件，得到它需要的核数，并在提交时检查配置
+//   - command: 返回运行一次运行的 KYBNMR 子进程，输出写入 output
+type server struct {
+	mu            sync.Mutex
+	dir           string
+	cores         int
+	used          int
+	defaultConfig string
+	sets          []calc.ConfigOverride
+	fixed         []calc.ConfigOverride
+	loadConfig    func(configFile string) (*calc.Config, error)
+	command       func(ctx context.Context, job *serveJob, output io.Writer) *exec.Cmd
+	jobs          map[string]*serveJob
+	nextID        int
+	ctx           context.Context
+	stop          context.CancelFunc
+	closing       bool
+	running       sync.WaitGroup
+}
+
+// runServe 在 listen 上提供 HTTP API，任务仓库为 storeDir，同时运行的运行使用的核数不超过 cores，直到 ctx 被取消
+func (k *KYBNMR) runServe(ctx context.Context, listen string, storeDir string, cores int) error {
+	if cores < 1 {
+		return fmt.Errorf("error: --cores must be at least 1")
+	}
+
+	// 服务的配置文件是可选的，存在时先检查一次，避免每一次运行都因为同一个问题失败
+	defaultConfig := ""
+	if _, err := os.Stat(k.config); err == nil {
+		if defaultConfig, err = filepath.Abs(k.config); err != nil {
+			return err
+		}
+	} else {
+		slog.Warn("no config file found, every submitted run must include its config", "file", k.config)
+	}
+	serverConfig, err := k.loadConfigWith(defaultConfig)
+	if err != nil {
+		return err
+	}
+	fixed := serverOnlyValues(serverConfig)
+	executable, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("error locating the kybnmr executable: %w", err)
+	}
+
+	sets, err := k.setOverrides()
+	if err != nil {
+		return err
+	}
+	// --set 已经写入每一次运行的配置文件，子进程读取配置时没有 --set
+	loadConfig := func(configFile string) (*calc.Config, error) {
+		return loadConfigLayers(configFile, nil)
+	}
+	command := func(ctx context.Context, job *serveJob, output io.Writer) *exec.Cmd {
+		return childCommand(ctx, executable, k.childArgs(job.Config, job.WorkDir, job.Input), output)
+	}
+	s, err := newServer(storeDir, cores, defaultConfig, sets, fixed, loadConfig, command)
+	if err != nil {
+		return err
+	}
+
+	listener, err := net.Listen("tcp", listen)
+	if err != nil {
+		s.Close()
+		return fmt.Errorf("error listening on %s: %w", listen, err)
+	}
+	if host, _, err := net.SplitHostPort(listen); err == nil {
+		if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+			slog.Warn("the API has no authentication, everyone who can reach this address can submit and cancel runs", "listen", listen)
+		}
+	}
+	httpServer := &http.Server{Handler: s, ReadHeaderTimeout: 10 * time.Second}
+	slog.Info("serving the KYBNMR API", "address", "http://"+listener.Addr().String(), "store", s.dir, "cores", cores)
+	s.Start()
+
+	served := make(chan error, 1)
+	go func() {
+		served <- httpServer.Serve(listener)
+	}()
+	select {
+	case err = <-served:
+	case <-ctx.Done():
+		slog.Info("stopping the server, running runs are interrupted")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		err = httpServer.Shutdown(shutdownCtx)
+		cancel()
+	}
+	s.Close()
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("error serving the API: %w", err)
+	}
+	return nil
+}
+
+// newServer 打开（没有时创建）任务仓库 storeDir，恢复其中的运行，调用 Start 之后才开始运行排队的运行
+// 上一次服务停止时还在运行的运行被标记为 interrupted
+func newServer(storeDir string, cores int, defaultConfig string, sets []calc.ConfigOverride, fixed []calc.ConfigOverride,
+	loadConfig func(configFile string) (*calc.Config, error),
+	command func(ctx context.Context, job *serveJob, output io.Writer) *exec.Cmd) (*server, error) {
+	dir, err := filepath.Abs(storeDir)
+	if err != nil {
+		return nil, fmt.Errorf("error getting absolute path: %w", err)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("error creating the store: %w", err)
+	}
+
+	ctx, stop := context.WithCancel(context.Background())
+	s := &server{
+		dir:           dir,
+		cores:         cores,
+		defaultConfig: defaultConfig,
+		sets:          sets,
+		fixed:         fixed,
+		loadConfig:    loadConfig,
+		command:       command,
+		jobs:          make(map[string]*serveJob),
+		nextID:        1,
+		ctx:           ctx,
+		stop:          stop,
+	}
+	if err := s.load(); err != nil {
+		stop()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Start 开始运行任务仓库中排队的运行
+func (s *server) Start() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.schedule()
+}
+
+// load 读取任务仓库中所有的 job.json
+func (s *server) load() error {
+	entries, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return fmt.Errorf("error reading the store: %w", err)
+	}
+
+	for _, entry := range entries {
+		id, err := strconv.Atoi(entry.Name())
+		if !entry.IsDir() || err != nil {
+			continue
+		}
+		if id >= s.nextID {
+			s.nextID = id + 1
+		}
+		jobDir := filepath.Join(s.dir, entry.Name())
+		contents, err := ioutil.ReadFile(filepath.Join(jobDir, serveJobFile))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		job := &serveJob{}
+		if err := json.Unmarshal(contents, job); err != nil {
+			return fmt.Errorf("error parsing %s: %w", filepath.Join(jobDir, serveJobFile), err)
+		}
+
+		// 任务仓库被移动之后，路径仍然指向任务仓库中的文件
+		job.setDir(jobDir)
+		if job.Status == serveRunning {
+			job.Status = serveInterrupted
+			job.Error = "the server stopped during the run"
+			if err := s.save(job); err != nil {
+				return err
+			}
+		}
+		s.jobs[job.ID] = job
+	}
+
+	return nil
+}
+
+// Close 中断所有正在运行的运行并等待它们结束，之后不再开始排队的运行
+func (s *server) Close() {
+	s.mu.Lock()
+	s.closing = true
+	s.mu.Unlock()
+	s.stop()
+	s.running.Wait()
+}
+
+// save 写入 job 的 job.json，先写入临时文件再重命名，读取的一方不会读到写了一半的文件
+func (s *server) save(job *serveJob) error {
+	contents, err := json.MarshalIndent(job, "", "  ")
+	if err != nil {
+		return err
+	}
+	fileName := filepath.Join(job.dir, serveJobFile)
+	if err := ioutil.WriteFile(fileName+".tmp", append(contents, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(fileName+".tmp", fileName)
+}
+
+// saveLogged 与 save 相同，出错时只输出错误，运行的状态仍然保存在内存中
+func (s *server) saveLogged(job *serveJob) {
+	if err := s.save(job); err != nil {
+		slog.Error("error saving the run", "run", job.ID, "error", err)
+	}
+}
+
+// sortedJobs 按照提交的顺序返回所有的运行
+func (s *server) sortedJobs() []*serveJob {
+	jobs := make([]*serveJob, 0, len(s.jobs))
+	for _, job := range s.jobs {
+		jobs = append(jobs, job)
+	}
+	sort.Slice(jobs, func(i, j int) bool {
+		left, _ := strconv.Atoi(jobs[i].ID)
+		right, _ := strconv.Atoi(jobs[j].ID)
+		return left < right
+	})
+	return jobs
+}
+
+// snapshot 返回 job 当前的副本，返回给客户端时不需要持有 s.mu
+func (s *server) snapshot(job *serveJob) serveJob {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return *job
+}
+
+// snapshots 按照提交的顺序返回所有运行当前的副本
+func (s *server) snapshots() []serveJob {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	jobs := s.sortedJobs()
+	values := make([]serveJob, len(jobs))
+	for i, job := range jobs {
+		values[i] = *job
+	}
+	return values
+}
+
+// schedule 按照提交的顺序开始排队的运行，直到核数不够为止，调用时必须持有 s.mu
+func (s *server) schedule() {
+	if s.closing {
+		return
+	}
+	for _, job := range s.sortedJobs() {
+		if job.Status != serveQueued {
+			continue
+		}
+		if job.Cores > s.cores-s.used {
+			return
+		}
+		s.start(job)
+	}
+}
+
+// start 在单独的 KYBNMR 进程中开始运行 job，调用时必须持有 s.mu
+func (s *server) start(job *serveJob) {
+	ctx, cancel := context.WithCancel(s.ctx)
+	job.cancel = cancel
+	job.Status = serveRunning
+	job.StartedAt = time.Now().Format(time.RFC3339)
+	s.used += job.Cores
+	s.saveLogged(job)
+	slog.Info("started run", "run", job.ID, "molecule", job.Name, "cores", job.Cores, "used", s.used, "budget", s.cores)
+
+	s.running.Add(1)
+	go func() {
+		defer s.running.Done()
+		err := s.execute(ctx, job)
+		cancel()
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.used -= job.Cores
+		job.cancel = nil
+		job.FinishedAt = time.Now().Format(time.RFC3339)
+		switch {
+		case err == nil:
+			job.Status = serveCompleted
+		case job.cancelled:
+			job.Status = serveCancelled
+		case s.ctx.Err() != nil:
+			job.Status = serveInterrupted
+			job.Error = "the server stopped during the run"
+		default:
+			job.Status = serveFailed
+			job.Error = err.Error()
+		}
+		s.saveLogged(job)
+		if job.Status == serveFailed {
+			slog.Error("run failed", "run", job.ID, "molecule", job.Name, "error", job.Error)
+		} else {
+			slog.Info("finished run", "run", job.ID, "molecule", job.Name, "status", job.Status)
+		}
+		s.schedule()
+	}()
+}
+
+// execute 运行 job 的 KYBNMR 子进程，输出写入 kybnmr.out
+func (s *server) execute(ctx context.Context, job *serveJob) error {
+	output, err := os.Create(filepath.Join(job.dir, serveOutputFile))
+	if err != nil {
+		return err
+	}
+	defer output.Close()
+
+	if err := s.command(ctx, job, output).Run(); err != nil {
+		return fmt.Errorf("%w, see %s", err, output.Name())
+	}
+	return nil
+}
+
+// submit 将 request 保存到任务仓库中并排队，请求有问题时返回的 error 为 requestError
+func (s *server) submit(request *serveSubmit) (*serveJob, error) {
+	if request.Name == "" {
+		request.Name = "molecule"
+	}
+	if !serveNameRegex.MatchString(request.Name) {
+		return nil, requestError("invalid name %q: use at most 64 letters, digits, '_', '-' and '.'", request.Name)
+	}
+	if strings.TrimSpace(request.XYZ) == "" {
+		return nil, requestError("missing xyz")
+	}
+	var overrides []calc.ConfigOverride
+	for _, text := range request.Set {
+		override, err := calc.ParseConfigOverride(text)
+		if err != nil {
+			return nil, requestError("set: %v", err)
+		}
+		if serverOnlyKey(override.Section, override.Key) {
+			return nil, requestError("set: %s.%s cannot be set by a submitted run, the server uses its own value", override.Section, override.Key)
+		}
+		overrides = append(overrides, override)
+	}
+	configName := "config" + filepath.Ext(s.defaultConfig)
+	if request.Config != "" {
+		switch calc.ConfigFormat(strings.ToLower(request.ConfigFormat)) {
+		case "", calc.FormatINI:
+			configName = "config.ini"
+		case calc.FormatTOML:
+			configName = "config.toml"
+		case calc.FormatYAML:
+			configName = "config.yaml"
+		default:
+			return nil, requestError("unknown configFormat %q (available: ini, toml, yaml)", request.ConfigFormat)
+		}
+	} else if s.defaultConfig == "" {
+		return nil, requestError("missing config: the server has no config file")
+	}
+
+	// 先在临时文件夹中准备好，被拒绝的提交不占用编号
+	tempDir, err := ioutil.TempDir(s.dir, ".submit-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tempDir)
+	if err := os.Chmod(tempDir, 0755); err != nil {
+		return nil, err
+	}
+	job := &serveJob{
+		Name:      request.Name,
+		Status:    serveQueued,
+		Input:     request.Name + ".xyz",
+		Config:    configName,
+		CreatedAt: time.Now().Format(time.RFC3339),
+	}
+	job.setDir(tempDir)
+	if err := s.prepare(job, request, overrides); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closing {
+		return nil, fmt.Errorf("the server is stopping")
+	}
+	job.ID = fmt.Sprintf("%06d", s.nextID)
+	jobDir := filepath.Join(s.dir, job.ID)
+	if err := os.Rename(tempDir, jobDir); err != nil {
+		return nil, err
+	}
+	s.nextID++
+	job.setDir(jobDir)
+	s.jobs[job.ID] = job
+	s.saveLogged(job)
+	slog.Info("queued run", "run", job.ID, "molecule", job.Name, "cores", job.Cores)
+	s.schedule()
+	return job, nil
+}
+
+// prepare 写入 job 的结构和配置文件，并读取配置得到需要的核数
+func (s *server) prepare(job *serveJob, request *serveSubmit, overrides []calc.ConfigOverride) error {
+	if err := ioutil.WriteFile(job.Input, []byte(request.XYZ), 0644); err != nil {
+		return err
+	}
+	source := s.defaultConfig
+	if request.Config != "" {
+		if err := ioutil.WriteFile(job.Config, []byte(request.Config), 0644); err != nil {
+			return err
+		}
+		values, err := calc.ConfigFileValues(job.Config)
+		if err != nil {
+			return requestError("%v", err)
+		}
+		for _, value := range values {
+			if serverOnlyKey(value.Section, value.Key) {
+				return requestError("config: [%s] %s cannot be set by a submitted run, the server uses its own value", value.Section, value.Key)
+			}
+		}
+		source = job.Config
+	}
+	// 服务的 --set、提交的 set，最后是服务自己的程序路径、xtb 和 crest 的参数以及 [batch] 配置
+	all := append(append(append([]calc.ConfigOverride{}, s.sets...), overrides...), s.fixed...)
+	if err := calc.WriteConfigWithOverrides(source, all, job.Config); err != nil {
+		return requestError("%v", err)
+	}
+
+	config, err := s.loadConfig(job.Config)
+	if err != nil {
+		return requestError("%v", err)
+	}
+	job.Cores = config.ResourceConfig.NProcs
+	if job.Cores > s.cores {
+		return requestError("the run needs %d cores ([resources] nprocs), but the server runs at most %d", job.Cores, s.cores)
+	}
+	return nil
+}
+
+// serverOnlyKey 判断 section.key 是否只能使用服务自己的值，
+// [optimized] 中的程序路径和 [batch] 中的命令都会被服务运行，提交的运行修改它们就可以运行任意命令；
+// xtb 和 crest 的参数（[optimized] 中的 xxxArgs 和 [dynamics] dynamicsArgs）也是如此，例如 crest 的 --xnam 选择运行的程序
+func serverOnlyKey(section string, key string) bool {
+	section, key = strings.ToLower(section), strings.ToLower(key)
+	switch section {
+	case "batch":
+		return true
+	case "optimized":
+		return strings.HasSuffix(key, "path") || strings.HasSuffix(key, "args")
+	case "dynamics":
+		return strings.HasSuffix(key, "args")
+	}
+	return false
+}
+
+// serverOnlyValues 返回 config 中不是默认值的、只能使用服务自己的值的配置，见 serverOnlyKey
+func serverOnlyValues(config *calc.Config) []calc.ConfigOverride {
+	var values []calc.ConfigOverride
+	for _, value := range config.Resolved() {
+		if value.Source != "default" && serverOnlyKey(value.Section, value.Key) {
+			values = append(values, calc.ConfigOverride{Section: value.Section, Key: value.Key, Value: value.Value})
+		}
+	}
+	return values
+}
+
+// cancel 取消排队的运行，或者中断正在运行的运行，已经结束的运行返回 false
+func (s *server) cancel(job *serveJob) bool {
+	switch job.Status {
+	case serveQueued:
+		job.Status = serveCancelled
+		job.FinishedAt = time.Now().Format(time.RFC3339)
+		s.saveLogged(job)
+		slog.Info("cancelled run", "run", job.ID, "molecule", job.Name)
+	case serveRunning:
+		job.cancelled = true
+		if job.cancel != nil {
+			job.cancel()
+		}
+		slog.Info("cancelling run", "run", job.ID, "molecule", job.Name)
+	default:
+		return false
+	}
+	return true
+}
+
+// requestErr 请求有问题时的错误，返回 400
+type requestErr struct {
+	message string
+}
+
+func (e *requestErr) Error() string {
+	return e.message
+}
+
+// requestError 返回一个 requestErr
+func requestError(format string, args ...any) error {
+	return &requestErr{message: fmt.Sprintf(format, args...)}
+}
+
+// ServeHTTP 处理 API 的请求
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if parts[0] != "runs" || len(parts) > 3 {
+		writeAPIError(w, http.StatusNotFound, "not found: %s", r.URL.Path)
+		return
+	}
+
+	if len(parts) == 1 {
+		switch r.Method {
+		case http.MethodGet:
+			writeAPIJSON(w, http.StatusOK, s.snapshots())
+		case http.MethodPost:
+			s.handleSubmit(w, r)
+		default:
+			writeAPIError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+		}
+		return
+	}
+
+	s.mu.Lock()
+	job, ok := s.jobs[parts[1]]
+	s.mu.Unlock()
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, "no run %s", parts[1])
+		return
+	}
+	action := ""
+	if len(parts) == 3 {
+		action = parts[2]
+	}
+	method := http.MethodGet
+	if action == "cancel" {
+		method = http.MethodPost
+	}
+	if r.Method != method {
+		writeAPIError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+		return
+	}
+
+	switch action {
+	case "":
+		writeAPIJSON(w, http.StatusOK, s.snapshot(job))
+	case "status":
+		s.handleStatus(w, job)
+	case "report":
+		writeJobFile(w, filepath.Join(job.WorkDir, calc.ReportFile), "application/json")
+	case "log":
+		writeJobFile(w, filepath.Join(job.dir, serveOutputFile), "text/plain; charset=utf-8")
+	case "cancel":
+		s.mu.Lock()
+		cancelled := s.cancel(job)
+		value := *job
+		s.mu.Unlock()
+		if !cancelled {
+			writeAPIError(w, http.StatusConflict, "run %s already %s", value.ID, value.Status)
+			return
+		}
+		writeAPIJSON(w, http.StatusAccepted, value)
+	default:
+		writeAPIError(w, http.StatusNotFound, "not found: %s", r.URL.Path)
+	}
+}
+
+// handleSubmit 处理 POST /runs
+func (s *server) handleSubmit(w http.ResponseWriter, r *http.Request) {
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, serveMaxBody))
+	decoder.DisallowUnknownFields()
+	request := &serveSubmit{}
+	if err := decoder.Decode(request); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "error parsing the request: %v", err)
+		return
+	}
+
+	job, err := s.submit(request)
+	var badRequest *requestErr
+	switch {
+	case errors.As(err, &badRequest):
+		writeAPIError(w, http.StatusBadRequest, "%v", err)
+	case err != nil:
+		writeAPIError(w, http.StatusInternalServerError, "%v", err)
+	default:
+		writeAPIJSON(w, http.StatusCreated, s.snapshot(job))
+	}
+}
+
+// handleStatus 处理 GET /runs/{id}/status，运行还没有写入 report.json 时只返回运行本身
+func (s *server) handleStatus(w http.ResponseWriter, job *serveJob) {
+	var summary *runStatusSummary
+	if _, err := os.Stat(filepath.Join(job.WorkDir, calc.ReportFile)); err == nil {
+		if summary, err = readRunStatus(job.WorkDir, time.Now()); err != nil {
+			writeAPIError(w, http.StatusInternalServerError, "%v", err)
+			return
+		}
+	}
+
+	value := s.snapshot(job)
+	writeAPIJSON(w, http.StatusOK, serveStatus{Job: &value, Run: summary})
+}
+
+// writeJobFile 返回运行的文件 fileName，不存在时返回 404
+func writeJobFile(w http.ResponseWriter, fileName string, contentType string) {
+	contents, err := ioutil.ReadFile(fileName)
+	if os.IsNotExist(err) {
+		writeAPIError(w, http.StatusNotFound, "%s not written yet", filepath.Base(fileName))
+		return
+	}
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "%v", err)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	_, _ = w.Write(contents)
+}
+
+// writeAPIJSON 以 json 返回 value
+func writeAPIJSON(w http.ResponseWriter, code int, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	_ = encoder.Encode(value)
+}
+
+// writeAPIError 返回 {"error": "..."}
+func writeAPIError(w http.ResponseWriter, code int, format string, args ...any) {
+	writeAPIJSON(w, code, map[string]string{"error": fmt.Sprintf(format, args...)})
+}
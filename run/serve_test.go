@@ -0,0 +1,255 @@
+package run
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"kybnmr/calc"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testXYZ 提交的结构
+const testXYZ = "2\n\nH 0 0 0\nH 0 0 0.74\n"
+
+// releaseFile 测试中的运行在它所在的文件夹中出现这个文件之后才结束
+const releaseFile = "release"
+
+// standInCommand 代替 KYBNMR 子进程，等到 job 的文件夹中出现 release 文件之后正常结束
+func standInCommand(ctx context.Context, job *serveJob, output io.Writer) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, "sh", "-c", `while [ ! -e "$1/`+releaseFile+`" ]; do sleep 0.02; done; echo done`, "sh", job.dir)
+	cmd.Stdout = output
+	cmd.Stderr = output
+	return cmd
+}
+
+// newTestServer 在临时文件夹中启动使用 standInCommand 的服务，服务的配置文件中 [resources] nprocs 为 nprocs
+func newTestServer(t *testing.T, cores int, nprocs int, fixed []calc.ConfigOverride) (*server, *httptest.Server) {
+	t.Helper()
+	dir := t.TempDir()
+	configFile := filepath.Join(dir, "config.ini")
+	contents := "[resources]\nnprocs = " + strconv.Itoa(nprocs) + "\nmemory = 1000\n"
+	if err := ioutil.WriteFile(configFile, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	loadConfig := func(configFile string) (*calc.Config, error) {
+		return calc.LoadConfig(calc.ConfigLayers{ProjectFile: configFile})
+	}
+
+	s, err := newServer(filepath.Join(dir, "store"), cores, configFile, nil, fixed, loadConfig, standInCommand)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Start()
+	httpServer := httptest.NewServer(s)
+	t.Cleanup(func() {
+		httpServer.Close()
+		s.Close()
+	})
+	return s, httpServer
+}
+
+// request 发送请求，并将返回的 json 解析到 value 中（value 为 nil 时不解析），返回状态码
+func request(t *testing.T, method string, url string, body any, value any) int {
+	t.Helper()
+	var reader io.Reader
+	if body != nil {
+		contents, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader = bytes.NewReader(contents)
+	}
+	req, err := http.NewRequest(method, url, reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if value != nil {
+		if err := json.NewDecoder(resp.Body).Decode(value); err != nil {
+			t.Fatalf("%s %s: error decoding the response: %v", method, url, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+// submit 提交一次运行，返回服务返回的运行
+func submit(t *testing.T, url string, body serveSubmit) serveJob {
+	t.Helper()
+	var job serveJob
+	if code := request(t, http.MethodPost, url+"/runs", body, &job); code != http.StatusCreated {
+		t.Fatalf("POST /runs: status %d, want %d", code, http.StatusCreated)
+	}
+	return job
+}
+
+// release 让运行 job 结束
+func release(t *testing.T, s *server, id string) {
+	t.Helper()
+	if err := ioutil.WriteFile(filepath.Join(s.dir, id, releaseFile), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// waitForStatus 等待运行 id 的状态变为 want
+func waitForStatus(t *testing.T, url string, id string, want string) serveJob {
+	t.Helper()
+	var job serveJob
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		request(t, http.MethodGet, url+"/runs/"+id, nil, &job)
+		if job.Status == want {
+			return job
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("run %s: status %q, want %q", id, job.Status, want)
+	return job
+}
+
+func TestServeSubmitListStatusCancel(t *testing.T) {
+	s, httpServer := newTestServer(t, 4, 2, nil)
+	url := httpServer.URL
+
+	first := submit(t, url, serveSubmit{Name: "first", XYZ: testXYZ})
+	if first.ID != "000001" || first.Status != serveRunning || first.Cores != 2 {
+		t.Errorf("first run: %+v", first)
+	}
+	submit(t, url, serveSubmit{Name: "second", XYZ: testXYZ})
+	third := submit(t, url, serveSubmit{Name: "third", XYZ: testXYZ})
+	if third.Status != serveQueued {
+		t.Errorf("third run: status %q, want %q", third.Status, serveQueued)
+	}
+
+	var jobs []serveJob
+	if code := request(t, http.MethodGet, url+"/runs", nil, &jobs); code != http.StatusOK {
+		t.Fatalf("GET /runs: status %d", code)
+	}
+	var statuses []string
+	for _, job := range jobs {
+		statuses = append(statuses, job.ID+"="+job.Status)
+	}
+	if got, want := strings.Join(statuses, " "), "000001=running 000002=running 000003=queued"; got != want {
+		t.Errorf("GET /runs: %s, want %s", got, want)
+	}
+
+	var status serveStatus
+	if code := request(t, http.MethodGet, url+"/runs/000003/status", nil, &status); code != http.StatusOK {
+		t.Fatalf("GET /runs/000003/status: status %d", code)
+	}
+	if status.Job == nil || status.Job.Status != serveQueued || status.Run != nil {
+		t.Errorf("GET /runs/000003/status: %+v", status)
+	}
+
+	var cancelled serveJob
+	if code := request(t, http.MethodPost, url+"/runs/000003/cancel", nil, &cancelled); code != http.StatusAccepted {
+		t.Errorf("cancel queued run: status %d, want %d", code, http.StatusAccepted)
+	}
+	if cancelled.Status != serveCancelled {
+		t.Errorf("cancelled run: status %q, want %q", cancelled.Status, serveCancelled)
+	}
+	if code := request(t, http.MethodPost, url+"/runs/000003/cancel", nil, nil); code != http.StatusConflict {
+		t.Errorf("cancel cancelled run: status %d, want %d", code, http.StatusConflict)
+	}
+
+	release(t, s, "000001")
+	waitForStatus(t, url, "000001", serveCompleted)
+	if code := request(t, http.MethodPost, url+"/runs/000002/cancel", nil, nil); code != http.StatusAccepted {
+		t.Errorf("cancel running run: status %d, want %d", code, http.StatusAccepted)
+	}
+	waitForStatus(t, url, "000002", serveCancelled)
+
+	if code := request(t, http.MethodGet, url+"/runs/000009", nil, nil); code != http.StatusNotFound {
+		t.Errorf("GET unknown run: status %d, want %d", code, http.StatusNotFound)
+	}
+	if code := request(t, http.MethodPost, url+"/runs", serveSubmit{Name: "../evil", XYZ: testXYZ}, nil); code != http.StatusBadRequest {
+		t.Errorf("POST invalid name: status %d, want %d", code, http.StatusBadRequest)
+	}
+}
+
+func TestServeQueuesUnderCoreBudget(t *testing.T) {
+	s, httpServer := newTestServer(t, 3, 2, nil)
+	url := httpServer.URL
+
+	submit(t, url, serveSubmit{Name: "first", XYZ: testXYZ})
+	// 第二次运行需要 2 个核，第三次只需要 1 个核，但是排在后面的运行不能越过第二次运行
+	second := submit(t, url, serveSubmit{Name: "second", XYZ: testXYZ})
+	third := submit(t, url, serveSubmit{Name: "third", XYZ: testXYZ, Set: []string{"resources.nprocs=1"}})
+	if second.Status != serveQueued || third.Status != serveQueued {
+		t.Fatalf("second and third runs: %q and %q, want both queued", second.Status, third.Status)
+	}
+
+	release(t, s, "000001")
+	waitForStatus(t, url, "000002", serveRunning)
+	waitForStatus(t, url, "000003", serveRunning)
+	release(t, s, "000002")
+	release(t, s, "000003")
+	waitForStatus(t, url, "000002", serveCompleted)
+	waitForStatus(t, url, "000003", serveCompleted)
+
+	var response map[string]string
+	code := request(t, http.MethodPost, url+"/runs", serveSubmit{XYZ: testXYZ, Set: []string{"resources.nprocs=4"}}, &response)
+	if code != http.StatusBadRequest || !strings.Contains(response["error"], "at most 3") {
+		t.Errorf("POST run larger than the budget: status %d %v", code, response)
+	}
+}
+
+func TestServeRejectsServerOnlyKeys(t *testing.T) {
+	fixed := []calc.ConfigOverride{{Section: "optimized", Key: "shermoPath", Value: "/opt/shermo/Shermo"}}
+	s, httpServer := newTestServer(t, 4, 2, fixed)
+	url := httpServer.URL
+
+	rejected := []serveSubmit{
+		{XYZ: testXYZ, Set: []string{"optimized.gauPath=/tmp/evil.sh"}},
+		{XYZ: testXYZ, Set: []string{"batch.submitCommand=sh"}},
+		{XYZ: testXYZ, Set: []string{"optimized.postOptArgs=--gfn2 --xnam /tmp/evil.sh"}},
+		{XYZ: testXYZ, Set: []string{"dynamics.dynamicsArgs=--omd --gfn 0"}},
+		{XYZ: testXYZ, Config: "[optimized]\npreOptArgs = \"--xnam /tmp/evil.sh\"\n"},
+		{XYZ: testXYZ, Config: "[optimized]\nxtbArgs = \"--gfn2\"\n"},
+		{XYZ: testXYZ, Config: "[optimized]\nshermoPath = /tmp/evil.sh\n"},
+		{XYZ: testXYZ, Config: "[batch]\nscheduler = slurm\nsubmitCommand = sh\n"},
+		{XYZ: testXYZ, Config: "[batch]\nscheduler = \"slurm\"\n", ConfigFormat: "toml"},
+	}
+	for _, body := range rejected {
+		var response map[string]string
+		if code := request(t, http.MethodPost, url+"/runs", body, &response); code != http.StatusBadRequest {
+			t.Errorf("POST %+v: status %d, want %d", body, code, http.StatusBadRequest)
+		} else if !strings.Contains(response["error"], "server uses its own value") {
+			t.Errorf("POST %+v: error %q", body, response["error"])
+		}
+	}
+
+	job := submit(t, url, serveSubmit{XYZ: testXYZ, Config: "[resources]\nnprocs = 1\n"})
+	values, err := calc.ConfigFileValues(filepath.Join(s.dir, job.ID, "config.ini"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, value := range values {
+		if value.Section == "optimized" && value.Key == "shermoPath" {
+			found = value.Value == "/opt/shermo/Shermo"
+		}
+	}
+	if !found {
+		t.Errorf("the config of the run does not use the server's shermoPath: %v", values)
+	}
+	release(t, s, job.ID)
+	waitForStatus(t, url, job.ID, serveCompleted)
+
+	if _, err := os.Stat(filepath.Join(s.dir, job.ID, serveOutputFile)); err != nil {
+		t.Errorf("output of the run was not written: %v", err)
+	}
+}
@@ -0,0 +1,241 @@
+package run
+
+import (
+	"fmt"
+	"kybnmr/calc"
+	"kybnmr/utils"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+* status.go
+* 该模块用来实现 kybnmr status [workdir]，查看一个正在运行或者已经结束的运行进行到了哪一步
+*
+*	读取工作目录（默认为当前目录）中的 report.json、kybnmr.log 和 thermo 文件夹，不修改任何文件，
+*	因此可以在另一个终端中（如 ssh 到计算节点上）随时运行，不需要再 grep out 文件：
+*		1. 运行的状态、当前的步骤、已经运行的时间以及 kybnmr.log 中最后一条记录的时间
+*		2. 每一个步骤的状态、输入和输出的构象数以及运行时间
+*		3. opt、sp 和 nmr 中每一个任务的状态 (pending/running/done/failed)、能量、运行时间，
+*		   以及正在运行的 Gaussian/ORCA 任务的优化步数和 SCF 循环数（见 calc/status.go）
+*	kybnmr serve 使用同样的 readRunStatus 返回 json 格式的状态
+*
+* @Author: Kimariyb
+* @Address: XiaMen University
+* @Data: 2023-09-26
+ */
+
+// runStatusSummary 一个运行的状态，kybnmr status 输出它，kybnmr serve 的 GET /runs/{id}/status 返回它的 json
+//   - Seconds: 运行的时间，正在运行时为到现在为止的时间
+//   - Stage、Program: 正在运行的步骤和使用的程序
+//   - LastLog: kybnmr.log 中最后一条记录的时间，RFC 3339 格式
+//   - Stages: 每一个步骤的状态
+//   - Jobs: opt、sp 和 nmr 中每一个任务的状态
+type runStatusSummary struct {
+	WorkDir string        `json:"workDir"`
+	Input   string        `json:"input"`
+	Status  string        `json:"status"`
+	Error   string        `json:"error,omitempty"`
+	Seconds float64       `json:"seconds"`
+	Stage   string        `json:"stage,omitempty"`
+	Program string        `json:"program,omitempty"`
+	LastLog string        `json:"lastLog,omitempty"`
+	Stages  []stageStatus `json:"stages"`
+	Jobs    []stageJobs   `json:"jobs"`
+
+	lastLog time.Time
+}
+
+// stageStatus 一个步骤的状态，正在运行的步骤的 Seconds 为到现在为止的时间
+type stageStatus struct {
+	Name    string  `json:"name"`
+	Program string  `json:"program,omitempty"`
+	Status  string  `json:"status"`
+	Input   int     `json:"input"`
+	Output  int     `json:"output"`
+	Seconds float64 `json:"seconds"`
+}
+
+// stageJobs 一个 DFT 步骤中每一个任务的状态
+type stageJobs struct {
+	Stage   calc.Stage       `json:"stage"`
+	Program string           `json:"program"`
+	Jobs    []calc.JobStatus `json:"jobs"`
+}
+
+// readRunStatus 读取工作目录 workDir 中的 report.json、kybnmr.log 和 thermo 文件夹，返回运行在 now 时的状态
+func readRunStatus(workDir string, now time.Time) (*runStatusSummary, error) {
+	reportFile := filepath.Join(workDir, calc.ReportFile)
+	if _, err := os.Stat(reportFile); err != nil {
+		return nil, fmt.Errorf("error: no %s found in %s, is it the work directory of a run?", calc.ReportFile, workDir)
+	}
+	report, err := calc.LoadReport(reportFile)
+	if err != nil {
+		return nil, err
+	}
+	times, lastRecord, err := calc.ReadJobTimes(filepath.Join(workDir, utils.LogFile))
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %w", utils.LogFile, err)
+	}
+	running := report.Status == calc.ReportRunning
+
+	summary := &runStatusSummary{
+		WorkDir: workDir,
+		Input:   report.Input,
+		Status:  report.Status,
+		Error:   report.Error,
+		Seconds: report.Seconds,
+		Stages:  []stageStatus{},
+		Jobs:    []stageJobs{},
+		lastLog: lastRecord,
+	}
+	if running {
+		summary.Seconds = secondsSince(report.StartedAt, now)
+		if current := currentStage(report); current != nil {
+			summary.Stage, summary.Program = current.Name, current.Program
+		}
+	}
+	if !lastRecord.IsZero() {
+		summary.LastLog = lastRecord.Format(time.RFC3339)
+	}
+
+	// 每一个步骤
+	for _, stage := range report.Stages {
+		status := stageStatus{
+			Name:    stage.Name,
+			Program: stage.Program,
+			Status:  stage.Status,
+			Input:   stage.Input,
+			Output:  stage.Output,
+			Seconds: stage.Seconds,
+		}
+		if stage.Status == calc.ReportRunning {
+			status.Seconds = secondsSince(stage.StartedAt, now)
+		}
+		summary.Stages = append(summary.Stages, status)
+	}
+
+	// opt、sp 和 nmr 中的每一个任务
+	for _, dftStage := range allStages {
+		stage := findStage(report, string(dftStage))
+		if stage == nil || stage.Status == calc.ReportSkipped {
+			continue
+		}
+		engine, err := calc.NewEngine(stage.Program, calc.DefaultConfig())
+		if err != nil {
+			return nil, err
+		}
+		active := running && stage.Status == calc.ReportRunning
+		jobs, err := calc.ScanStageJobs(workDir, dftStage, engine, active, times[dftStage], now)
+		if err != nil {
+			return nil, fmt.Errorf("error reading the %s jobs: %w", dftStage, err)
+		}
+		if len(jobs) > 0 {
+			summary.Jobs = append(summary.Jobs, stageJobs{Stage: dftStage, Program: engine.Name(), Jobs: jobs})
+		}
+	}
+
+	return summary, nil
+}
+
+// runStatus 输出工作目录 workDir 中的运行的状态
+func runStatus(workDir string) error {
+	now := time.Now()
+	summary, err := readRunStatus(workDir, now)
+	if err != nil {
+		return err
+	}
+
+	// 运行的概况
+	fmt.Printf("Run:      %s (%s)\n", summary.WorkDir, summary.Input)
+	fmt.Printf("Status:   %s, %s elapsed\n", summary.Status, formatSeconds(summary.Seconds))
+	if summary.Error != "" {
+		fmt.Printf("Error:    %s\n", summary.Error)
+	}
+	if summary.Stage != "" {
+		fmt.Printf("Step:     %s (%s)\n", summary.Stage, orDash(summary.Program))
+	}
+	if !summary.lastLog.IsZero() {
+		fmt.Printf("Last log: %s (%s ago)\n", summary.lastLog.Local().Format("2006-01-02 15:04:05"), formatSeconds(now.Sub(summary.lastLog).Seconds()))
+	}
+	fmt.Println()
+
+	// 每一个步骤
+	fmt.Printf(" %-7s %-10s %-12s %6s %6s %10s\n", "Step", "Program", "Status", "In", "Out", "Time")
+	for _, stage := range summary.Stages {
+		// 正在运行的步骤的构象数在步骤结束时才写入 report.json
+		input, output := strconv.Itoa(stage.Input), strconv.Itoa(stage.Output)
+		if stage.Status == calc.ReportRunning {
+			input, output = "-", "-"
+		}
+		fmt.Printf(" %-7s %-10s %-12s %6s %6s %10s\n", stage.Name, orDash(stage.Program), stage.Status,
+			input, output, formatSeconds(stage.Seconds))
+	}
+	fmt.Println()
+
+	// opt、sp 和 nmr 中的每一个任务
+	for _, stage := range summary.Jobs {
+		printJobStatuses(stage.Stage, stage.Program, stage.Jobs)
+	}
+
+	return nil
+}
+
+// printJobStatuses 输出一个步骤的每一个任务的状态
+func printJobStatuses(stage calc.Stage, program string, jobs []calc.JobStatus) {
+	counts := calc.CountJobStates(jobs)
+	fmt.Printf("%s (%s): %d jobs, %d done, %d running, %d failed, %d pending\n", stage, program, len(jobs),
+		counts[calc.JobDone], counts[calc.JobRunning], counts[calc.JobFailed], counts[calc.JobPending])
+	fmt.Printf(" %-4s %-16s %-8s %16s %10s  %s\n", "#", "Job", "State", "Energy (a.u.)", "Time", "Progress")
+	for _, job := range jobs {
+		energy := "-"
+		if job.Energy != nil {
+			energy = fmt.Sprintf("%.8f", *job.Energy)
+		}
+		line := fmt.Sprintf(" %-4d %-16s %-8s %16s %10s  %s", job.Index, job.Name, job.State, energy,
+			formatSeconds(job.Seconds), job.Progress)
+		fmt.Println(strings.TrimRight(line, " "))
+	}
+	fmt.Println()
+}
+
+// currentStage 返回 report 中正在运行的步骤，没有时返回 nil
+func currentStage(report *calc.Report) *calc.StageReport {
+	for i := len(report.Stages) - 1; i >= 0; i-- {
+		if report.Stages[i].Status == calc.ReportRunning {
+			return report.Stages[i]
+		}
+	}
+	return nil
+}
+
+// findStage 返回 report 中最后一个名为 name 的步骤，没有时返回 nil
+func findStage(report *calc.Report, name string) *calc.StageReport {
+	for i := len(report.Stages) - 1; i >= 0; i-- {
+		if report.Stages[i].Name == name {
+			return report.Stages[i]
+		}
+	}
+	return nil
+}
+
+// secondsSince 返回从 RFC 3339 格式的时间 startedAt 到 now 的秒数，无法解析时返回 0
+func secondsSince(startedAt string, now time.Time) float64 {
+	started, err := time.Parse(time.RFC3339, startedAt)
+	if err != nil {
+		return 0
+	}
+	return math.Round(now.Sub(started).Seconds()*100) / 100
+}
+
+// formatSeconds 将秒数格式化为如 1h2m13s 的字符串，0 为 -
+func formatSeconds(seconds float64) string {
+	if seconds <= 0 {
+		return "-"
+	}
+	return (time.Duration(seconds * float64(time.Second))).Round(time.Second).String()
+}
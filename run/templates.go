@@ -0,0 +1,79 @@
+package run
+
+import (
+	"fmt"
+	"kybnmr/calc"
+	"log/slog"
+	"strings"
+)
+
+/*
+* templates.go
+* 该模块用来处理 kybnmr templates 子命令：列出内置的计算方案 (preset)，以及输出 preset 的模板
+*
+*	kybnmr templates list  列出所有的 preset，以及每一个程序在哪些步骤有模板
+*	kybnmr templates show [--engine orca] [--stage nmr] <preset>  输出 preset 的模板
+*
+* @Author: Kimariyb
+* @Address: XiaMen University
+* @Data: 2023-09-26
+ */
+
+// allStages DFT 计算的三个步骤，按照运行的顺序
+var allStages = []calc.Stage{calc.StageOpt, calc.StageSP, calc.StageNMR}
+
+// runTemplatesList 列出所有的 preset
+func runTemplatesList() error {
+	fmt.Printf(" %-18s %-36s %s\n", "Preset", "Templates", "Description")
+	for _, preset := range calc.Presets() {
+		var templates []string
+		for _, engine := range preset.Engines() {
+			var stages []string
+			for _, stage := range allStages {
+				if _, ok := preset.Template(engine, stage); ok {
+					stages = append(stages, string(stage))
+				}
+			}
+			templates = append(templates, fmt.Sprintf("%s(%s)", engine, strings.Join(stages, ",")))
+		}
+		fmt.Printf(" %-18s %-36s %s\n", preset.Name, strings.Join(templates, " "), preset.Description)
+	}
+	fmt.Println()
+	slog.Info("select a preset with [optimized] preset = <name> in the config file")
+
+	return nil
+}
+
+// runTemplatesShow 输出 preset 中的模板，engine 和 stage 不为空时只输出对应的程序和步骤
+func runTemplatesShow(name string, engine string, stage string) error {
+	preset, err := calc.LookupPreset(name)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%s: %s\n", preset.Name, preset.Description)
+	found := false
+	for _, presetEngine := range preset.Engines() {
+		if engine != "" && !strings.EqualFold(engine, presetEngine) {
+			continue
+		}
+		for _, presetStage := range allStages {
+			if stage != "" && !strings.EqualFold(stage, string(presetStage)) {
+				continue
+			}
+			template, ok := preset.Template(presetEngine, presetStage)
+			if !ok {
+				continue
+			}
+			found = true
+			fmt.Println()
+			fmt.Printf("----- %s %s -----\n", presetEngine, presetStage)
+			fmt.Print(template)
+		}
+	}
+	if !found {
+		return fmt.Errorf("preset %s has no template for engine %q and stage %q", preset.Name, engine, stage)
+	}
+
+	return nil
+}
@@ -0,0 +1,187 @@
+package run
+
+import (
+	"fmt"
+	"kybnmr/calc"
+	"kybnmr/utils"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+/*
+* workdir.go
+* 该模块用来准备 KYBNMR 每一次运行的工作目录 (--workdir)
+*
+*	每一次运行的所有文件都只写在工作目录中，默认为 runs/<分子名>，目录结构为：
+*		<workdir>/
+*			xxx.xyz、config.ini、模板文件   从启动目录复制进来的输入文件，以及 preset 的模板 <preset>-<stage>.<后缀>
+*			md/                             xtb 动力学模拟，dynamics.xyz
+*			pre/                            crest 预优化，pre_opt.xyz、pre_clusters.xyz
+*			post/                           crest 进一步优化，post_opt.xyz、post_clusters.xyz
+*			thermo/opt、thermo/sp、thermo/nmr   DFT 计算
+*			nmr_result.json、nmr_shifts.csv ...  最终结果
+*	每一个步骤都在自己的文件夹中运行，整理文件时只会把该文件夹中的文件移动到该文件夹的 temp 中，
+*	不会移动启动目录以及工作目录之外的任何文件
+*
+* @Author: Kimariyb
+* @Address: XiaMen University
+* @Data: 2023-09-26
+ */
+
+// 工作目录中每一个步骤的文件夹
+const (
+	mdFolder   = "md"
+	preFolder  = "pre"
+	postFolder = "post"
+)
+
+// skippedStageFiles 跳过某一个步骤时，下一个步骤需要的文件，以及该文件在工作目录中所在的文件夹
+// 如果启动目录中有这个文件（例如之前手动运行得到的 post_clusters.xyz），会被复制到工作目录中
+var skippedStageFiles = []struct {
+	file   string
+	folder string
+}{
+	{"dynamics.xyz", mdFolder},
+	{"pre_clusters.xyz", preFolder},
+	{"post_clusters.xyz", postFolder},
+}
+
+// stageOutputFiles 每一个步骤输出的文件，步骤运行之前删除上一次运行留下的这些文件，
+// 否则程序运行失败（只输出错误）时会读到上一次运行的结果
+var stageOutputFiles = map[string][]string{
+	mdFolder:   {"xtb.trj", "dynamics.xyz"},
+	preFolder:  {"crest_ensemble.xyz", "pre_opt.xyz", "pre_clusters.xyz"},
+	postFolder: {"crest_ensemble.xyz", "post_opt.xyz", "post_clusters.xyz"},
+}
+
+// moleculeName 返回输入文件对应的分子名，即不含后缀的文件名
+func moleculeName(input string) string {
+	base := filepath.Base(input)
+	return strings.TrimSuffix(base, filepath.Ext(base))
+}
+
+// defaultWorkDir 返回 input 默认的工作目录 runs/<分子名>
+func defaultWorkDir(input string) string {
+	return filepath.Join("runs", moleculeName(input))
+}
+
+// prepareWorkDir 创建工作目录以及每一个步骤的文件夹，将输入文件、配置文件和 templates 中的模板文件复制进来，
+// 返回工作目录和其中输入文件副本的绝对路径。上一次运行留下的 thermo 文件夹会被保留，
+// RunDFTStage 据此跳过已经正常结束的任务。配置文件中的相对路径都是相对于启动目录的，
+// 因此在切换到工作目录之前，将 crest 和 [batch] header 的路径转化为绝对路径
+func (k *KYBNMR) prepareWorkDir(config *calc.Config, templates map[calc.Stage]calc.StageTemplate) (string, string, error) {
+	workDir := k.workdir
+	if workDir == "" {
+		workDir = defaultWorkDir(k.input)
+	}
+	workDir, err := filepath.Abs(workDir)
+	if err != nil {
+		return "", "", fmt.Errorf("error getting absolute path: %w", err)
+	}
+
+	skipped := map[string]bool{mdFolder: k.md != OpenTure, preFolder: k.pre != OpenTure, postFolder: k.post != OpenTure}
+	for _, folder := range []string{mdFolder, preFolder, postFolder} {
+		if err := os.MkdirAll(filepath.Join(workDir, folder), 0755); err != nil {
+			return "", "", fmt.Errorf("error creating work directory: %w", err)
+		}
+		if skipped[folder] {
+			continue
+		}
+		for _, file := range stageOutputFiles[folder] {
+			if err := os.Remove(filepath.Join(workDir, folder, file)); err != nil && !os.IsNotExist(err) {
+				return "", "", fmt.Errorf("error removing the results of the previous run: %w", err)
+			}
+		}
+	}
+
+	// 输入文件和配置文件
+	copies := map[string]string{
+		k.input:  filepath.Join(workDir, filepath.Base(k.input)),
+		k.config: filepath.Join(workDir, filepath.Base(k.config)),
+	}
+	// 模板文件，工作目录中已经有的模板在启动目录中不存在时保留原来的副本，preset 的模板直接写入工作目录
+	for _, template := range templates {
+		if template.File == "" {
+			continue
+		}
+		target := filepath.Join(workDir, filepath.Base(template.File))
+		if template.Content != "" {
+			if err := os.WriteFile(target, []byte(template.Content), 0644); err != nil {
+				return "", "", fmt.Errorf("error writing %s into the work directory: %w", template.File, err)
+			}
+			continue
+		}
+		if exist, _ := utils.CheckFileCurrentExist(template.File); exist {
+			copies[template.File] = target
+		}
+	}
+	// 跳过的步骤所需要的文件
+	for _, stageFile := range skippedStageFiles {
+		target := filepath.Join(workDir, stageFile.folder, stageFile.file)
+		if !skipped[stageFile.folder] {
+			continue
+		}
+		if exist, _ := utils.CheckFileCurrentExist(stageFile.file); exist {
+			copies[stageFile.file] = target
+		}
+	}
+
+	for source, target := range copies {
+		sourcePath, err := filepath.Abs(source)
+		if err != nil {
+			return "", "", err
+		}
+		if sourcePath == target {
+			continue
+		}
+		if err := utils.CopyFile(sourcePath, target); err != nil {
+			return "", "", fmt.Errorf("error copying %s into the work directory: %w", source, err)
+		}
+	}
+
+	k.crestPath, err = filepath.Abs(calc.CrestPath)
+	if err != nil {
+		return "", "", err
+	}
+	if config.BatchConfig.HeaderFile != "" {
+		config.BatchConfig.HeaderFile, err = filepath.Abs(config.BatchConfig.HeaderFile)
+		if err != nil {
+			return "", "", err
+		}
+	}
+
+	return workDir, filepath.Join(workDir, filepath.Base(k.input)), nil
+}
+
+// enterFolder 切换到 folder 中（如果不存在则创建），返回切换回原来目录的函数
+func enterFolder(folder string) (func(), error) {
+	currentDir, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(folder, 0755); err != nil {
+		return nil, err
+	}
+	if err := os.Chdir(folder); err != nil {
+		return nil, err
+	}
+
+	return func() {
+		if err := os.Chdir(currentDir); err != nil {
+			slog.Error("error changing back to directory", "dir", currentDir, "error", err)
+		}
+	}, nil
+}
+
+// inFolder 切换到 folder 中运行 fn，结束之后切换回原来的目录
+func inFolder(folder string, fn func() error) error {
+	leave, err := enterFolder(folder)
+	if err != nil {
+		return err
+	}
+	defer leave()
+
+	return fn()
+}
@@ -3,6 +3,7 @@ package utils
 import (
 	"fmt"
 	"io/fs"
+	"log/slog"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -64,7 +65,7 @@ func FormatDuration(duration time.Duration) {
 func CheckFileCurrentExist(filename string) (bool, string) {
 	absPath, err := filepath.Abs(filename)
 	if err != nil {
-		fmt.Println("Error getting absolute path:", err)
+		slog.Error("error getting absolute path", "file", filename, "error", err)
 		return false, ""
 	}
 
@@ -84,26 +85,26 @@ func CheckFileType(filename, fileType string) bool {
 	// 打开文件
 	file, err := os.Open(filename)
 	if err != nil {
-		fmt.Println("Error opening file:", err)
+		slog.Error("error opening file", "file", filename, "error", err)
 		return false
 	}
 	defer file.Close()
 
 	fileInfo, err := file.Stat()
 	if err != nil {
-		fmt.Println("Error getting file info:", err)
+		slog.Error("error getting file info", "file", filename, "error", err)
 		return false
 	}
 
 	if fileInfo.IsDir() {
-		fmt.Println("Error: Input is a directory, not a file")
+		slog.Error("input is a directory, not a file", "file", filename)
 		return false
 	}
 
 	// 拿到文件的扩展名
 	extension := strings.ToLower(fileInfo.Name()[strings.LastIndex(fileInfo.Name(), "."):])
 	if extension != fileType {
-		fmt.Println("Error: File type is not", fileType)
+		slog.Error("file type is not "+fileType, "file", filename)
 		return false
 	}
 
@@ -126,6 +127,26 @@ func MoveFile(sourcePath, destPath string) error {
 	return nil
 }
 
+// CopyFile 复制文件
+// 将源文件复制到目标路径，目标文件已经存在时会被覆盖，文件权限与源文件相同
+// 参数：
+//   - sourcePath：源文件路径
+//   - destPath：目标文件路径
+//
+// 返回值：
+//   - error：如果复制文件过程中发生错误，则返回相应的错误信息；否则返回 nil
+func CopyFile(sourcePath, destPath string) error {
+	info, err := os.Stat(sourcePath)
+	if err != nil {
+		return err
+	}
+	contents, err := os.ReadFile(sourcePath)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(destPath, contents, info.Mode().Perm())
+}
+
 // MoveFileForType 移动当前文件夹下的所有某一类型的文件至指定文件夹
 // 不移动目录下的任何文件夹，以及文件夹中的文件
 // 可以选择不移动指定的某一文件或多个文件
@@ -133,7 +154,7 @@ func MoveFileForType(fileType string, targetFolder string, excludeFiles ...strin
 	// 获取当前目录
 	currentDir, err := os.Getwd()
 	if err != nil {
-		fmt.Printf("Error getting current directory: %v\n", err)
+		slog.Error("error getting current directory", "error", err)
 		return
 	}
 
@@ -162,9 +183,9 @@ func MoveFileForType(fileType string, targetFolder string, excludeFiles ...strin
 			// 移动文件
 			err := MoveFile(path, destPath)
 			if err != nil {
-				fmt.Printf("Failed to move file: %s\n", err)
+				slog.Error("failed to move file", "error", err)
 			} else {
-				fmt.Printf("Move file successfully: %s\n", path)
+				slog.Debug("moved file", "file", path, "to", destPath)
 			}
 		}
 
@@ -172,10 +193,20 @@ func MoveFileForType(fileType string, targetFolder string, excludeFiles ...strin
 	})
 
 	if err != nil {
-		fmt.Printf("Error walking directory: %s\n", err)
+		slog.Error("error walking directory", "error", err)
 	}
 }
 
+// 辅助函数：检查 name 是否以 suffixes 中的某一个后缀结尾
+func hasAnySuffix(name string, suffixes []string) bool {
+	for _, suffix := range suffixes {
+		if strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
 // 辅助函数：检查字符串切片中是否包含指定的字符串
 func contains(slice []string, str string) bool {
 	for _, s := range slice {
@@ -193,7 +224,7 @@ func MoveAllFileButKeepFile(keepFiles []string, targetFolder string) {
 	// 获取当前目录文件夹
 	dir, err := os.Getwd()
 	if err != nil {
-		fmt.Println("Error getting current directory:", err)
+		slog.Error("error getting current directory", "error", err)
 		return
 	}
 
@@ -231,9 +262,9 @@ func MoveAllFileButKeepFile(keepFiles []string, targetFolder string) {
 			newPath := filepath.Join(targetFolder, d.Name())
 			err := MoveFile(path, newPath)
 			if err != nil {
-				fmt.Printf("Failed to move file: %s\n", err)
+				slog.Error("failed to move file", "error", err)
 			} else {
-				fmt.Printf("Move file successfully: %s\n", path)
+				slog.Debug("moved file", "file", path, "to", newPath)
 			}
 		}
 
@@ -241,7 +272,7 @@ func MoveAllFileButKeepFile(keepFiles []string, targetFolder string) {
 	})
 
 	if err != nil {
-		fmt.Println("Error walking directory:", err)
+		slog.Error("error walking directory", "error", err)
 		return
 	}
 }
@@ -252,10 +283,10 @@ func MoveAllFileButKeepFile(keepFiles []string, targetFolder string) {
 func RenameFile(olderFileName string, newFileName string) {
 	err := os.Rename(olderFileName, newFileName)
 	if err != nil {
-		fmt.Println("Error renaming file:", err)
+		slog.Error("error renaming file", "error", err)
 		return
 	}
-	fmt.Println("File renamed successfully.")
+	slog.Debug("renamed file", "file", olderFileName, "to", newFileName)
 }
 
 // SplitStringBySpace 根据一段字符串的空格，切割字符串，并存在一个 string[] 中，同时返回
@@ -275,13 +306,13 @@ func SplitStringByComma(str string) []float64 {
 }
 
 // DeleteAllFileButKeepType
-// 删除当前运行文件夹的 thermo/opt 和 thermo/sp 文件夹中的
-// 除指定文件类型 keepType 之外的所有文件
-// 不删除 thermo/opt 和 thermo/sp 中的文件夹
-func DeleteAllFileButKeepType(keepType string) {
+// 删除当前运行文件夹的 thermo/opt、thermo/sp 和 thermo/nmr 文件夹中的
+// 除指定文件类型 keepTypes 之外的所有文件
+// 不删除这些文件夹中的子文件夹
+func DeleteAllFileButKeepType(keepTypes ...string) {
 	currentDir, err := os.Getwd()
 	if err != nil {
-		fmt.Println("Failed to get current working directory:", err)
+		slog.Error("failed to get current working directory", "error", err)
 		return
 	}
 
@@ -289,6 +320,7 @@ func DeleteAllFileButKeepType(keepType string) {
 	folders := []string{
 		filepath.Join(currentDir, "thermo", "opt"),
 		filepath.Join(currentDir, "thermo", "sp"),
+		filepath.Join(currentDir, "thermo", "nmr"),
 	}
 
 	// 遍历文件夹
@@ -296,7 +328,7 @@ func DeleteAllFileButKeepType(keepType string) {
 		// 打开文件夹
 		dir, err := os.Open(folder)
 		if err != nil {
-			fmt.Println("Failed to open folder:", folder, err)
+			slog.Error("failed to open folder", "folder", folder, "error", err)
 			continue
 		}
 		defer dir.Close()
@@ -304,7 +336,7 @@ func DeleteAllFileButKeepType(keepType string) {
 		// 读取文件夹中的文件
 		files, err := dir.Readdir(-1)
 		if err != nil {
-			fmt.Println("Failed to read folder contents:", folder, err)
+			slog.Error("failed to read folder contents", "folder", folder, "error", err)
 			continue
 		}
 
@@ -316,14 +348,14 @@ func DeleteAllFileButKeepType(keepType string) {
 			}
 
 			// 检查文件类型是否匹配指定类型
-			if !strings.HasSuffix(file.Name(), keepType) {
+			if !hasAnySuffix(file.Name(), keepTypes) {
 				// 删除文件
 				filePath := filepath.Join(folder, file.Name())
 				err := os.Remove(filePath)
 				if err != nil {
-					fmt.Println("Failed to delete file:", filePath, err)
+					slog.Error("failed to delete file", "file", filePath, "error", err)
 				} else {
-					fmt.Println("Deleted file:", filePath)
+					slog.Debug("deleted file", "file", filePath)
 				}
 			}
 		}
@@ -0,0 +1,242 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/*
+* logging.go
+* 该模块用来设置 KYBNMR 的日志，所有的提示、警告和错误都通过 log/slog 输出到两个地方：
+*
+*	1. 终端（标准错误输出）：便于阅读的格式，如 "Hint: job completed program=gaussian conformer=3"，
+*	   默认输出 INFO 及以上的记录，--verbose 时也输出 DEBUG，--quiet 时只输出 WARN 和 ERROR
+*	2. 运行的工作目录中的 kybnmr.log：每一条记录为一行 json，总是包括 DEBUG 在内的所有记录，
+*	   每一条记录都有 stage（当前的步骤，不在任何步骤中时为 main）和 conformer（不针对某一个构象时为 null）字段
+*
+*	计算结果（如 Boltzmann 分布、化学位移、DP4 表格）和 --json 等输出仍然写到标准输出，不受 --quiet 影响。
+*	外部程序的输出写入每一个任务自己的 log 文件，--verbose 时同时显示在终端上，见 ProgramOutput
+*
+*	标准输出为终端时，长时间运行的步骤可以在终端的最后一行显示一个不断刷新的状态行（见 SetStatusLine），
+*	输出每一条记录之前先清除状态行，输出之后再重新显示，避免两者混在一起
+*
+* @Author: Kimariyb
+* @Address: XiaMen University
+* @Data: 2023-09-26
+ */
+
+// LogFile 每一次运行在工作目录中写入的日志文件
+const LogFile = "kybnmr.log"
+
+// 每一条记录都有的字段
+const (
+	LogStageKey     = "stage"
+	LogConformerKey = "conformer"
+)
+
+// logState 日志的全局状态，由 logHandler 共享
+//   - console: 终端的最低级别
+//   - verbose: 是否在终端上显示外部程序的输出
+//   - stage: 当前的步骤
+//   - file: kybnmr.log 的 json handler，没有打开日志文件时为 nil
+//   - status: 当前显示在标准输出最后一行的状态行，没有时为空
+type logState struct {
+	mu      sync.Mutex
+	console slog.Level
+	verbose bool
+	stage   string
+	file    slog.Handler
+	out     io.Writer
+	status  string
+}
+
+var logging = &logState{console: slog.LevelInfo, stage: "main", out: os.Stderr}
+
+// clearLine 将光标移到行首并清除这一行的 ANSI 控制序列
+const clearLine = "\r\033[K"
+
+// consolePrefix 终端上每一个级别的前缀
+var consolePrefix = map[slog.Level]string{
+	slog.LevelDebug: "Debug: ",
+	slog.LevelInfo:  "Hint: ",
+	slog.LevelWarn:  "Warning: ",
+	slog.LevelError: "Error: ",
+}
+
+// logHandler 同时写入终端和 kybnmr.log 的 slog.Handler，attrs 为 With 添加的字段
+type logHandler struct {
+	attrs []slog.Attr
+}
+
+// SetupLogger 将 KYBNMR 的日志设置为 slog 的默认 logger，verbose 和 quiet 为 --verbose 和 --quiet
+func SetupLogger(verbose bool, quiet bool) {
+	logging.mu.Lock()
+	switch {
+	case verbose:
+		logging.console = slog.LevelDebug
+	case quiet:
+		logging.console = slog.LevelWarn
+	default:
+		logging.console = slog.LevelInfo
+	}
+	logging.verbose = verbose
+	logging.mu.Unlock()
+	slog.SetDefault(slog.New(&logHandler{}))
+}
+
+// OpenRunLog 在 dir 中打开（追加）kybnmr.log，之后的记录都写入这个文件，返回关闭日志文件的函数
+func OpenRunLog(dir string) (func(), error) {
+	file, err := os.OpenFile(filepath.Join(dir, LogFile), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	logging.mu.Lock()
+	logging.file = slog.NewJSONHandler(file, &slog.HandlerOptions{Level: slog.LevelDebug})
+	logging.mu.Unlock()
+
+	return func() {
+		logging.mu.Lock()
+		logging.file = nil
+		logging.stage = "main"
+		logging.mu.Unlock()
+		file.Close()
+	}, nil
+}
+
+// SetLogStage 设置当前的步骤，之后的每一条记录的 stage 字段都为 stage
+func SetLogStage(stage string) {
+	logging.mu.Lock()
+	logging.stage = stage
+	logging.mu.Unlock()
+}
+
+// ProgramOutput 返回外部程序的输出应该写入的 Writer：写入 file，--verbose 时同时写到终端
+func ProgramOutput(file io.Writer) io.Writer {
+	logging.mu.Lock()
+	defer logging.mu.Unlock()
+	if logging.verbose {
+		return io.MultiWriter(file, logging.out)
+	}
+	return file
+}
+
+// IsTerminal file 是终端（字符设备）时返回 true，标准输出被重定向到文件或者管道时返回 false
+func IsTerminal(file *os.File) bool {
+	info, err := file.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
+
+// StatusLineEnabled 可以使用 SetStatusLine 时返回 true：标准输出是终端，并且没有使用 --verbose（外部程序的输出会打乱状态行）
+// 或者 --quiet
+func StatusLineEnabled() bool {
+	logging.mu.Lock()
+	defer logging.mu.Unlock()
+	return logging.console == slog.LevelInfo && !logging.verbose && IsTerminal(os.Stdout)
+}
+
+// SetStatusLine 在标准输出的最后一行显示 line，代替之前的状态行，line 超过终端宽度（COLUMNS，默认为 80）时被截断
+func SetStatusLine(line string) {
+	logging.mu.Lock()
+	defer logging.mu.Unlock()
+	width := 80
+	if columns, err := strconv.Atoi(os.Getenv("COLUMNS")); err == nil && columns > 0 {
+		width = columns
+	}
+	if runes := []rune(line); len(runes) >= width {
+		line = string(runes[:width-1])
+	}
+	logging.status = line
+	fmt.Fprint(os.Stdout, clearLine+line)
+}
+
+// ClearStatusLine 清除 SetStatusLine 显示的状态行
+func ClearStatusLine() {
+	logging.mu.Lock()
+	defer logging.mu.Unlock()
+	if logging.status != "" {
+		fmt.Fprint(os.Stdout, clearLine)
+		logging.status = ""
+	}
+}
+
+// Enabled 终端或者 kybnmr.log 需要这个级别的记录时返回 true
+func (h *logHandler) Enabled(_ context.Context, level slog.Level) bool {
+	logging.mu.Lock()
+	defer logging.mu.Unlock()
+	return level >= logging.console || logging.file != nil
+}
+
+// Handle 为记录加上 stage 和 conformer 字段，写入 kybnmr.log，并按照终端的级别输出到终端
+func (h *logHandler) Handle(ctx context.Context, record slog.Record) error {
+	logging.mu.Lock()
+	defer logging.mu.Unlock()
+
+	record = record.Clone()
+	record.AddAttrs(h.attrs...)
+	var attrs []slog.Attr
+	conformer := slog.Any(LogConformerKey, nil)
+	record.Attrs(func(attr slog.Attr) bool {
+		if attr.Key == LogConformerKey {
+			conformer = attr
+		}
+		if attr.Key != LogStageKey {
+			attrs = append(attrs, attr)
+		}
+		return true
+	})
+
+	if logging.file != nil {
+		// kybnmr.log 中 stage 和 conformer 总是前两个字段
+		fileRecord := slog.NewRecord(record.Time, record.Level, record.Message, record.PC)
+		fileRecord.AddAttrs(slog.String(LogStageKey, logging.stage), conformer)
+		for _, attr := range attrs {
+			if attr.Key != LogConformerKey {
+				fileRecord.AddAttrs(attr)
+			}
+		}
+		if err := logging.file.Handle(ctx, fileRecord); err != nil {
+			return err
+		}
+	}
+
+	if record.Level < logging.console {
+		return nil
+	}
+	var sb strings.Builder
+	sb.WriteString(consolePrefix[record.Level])
+	sb.WriteString(record.Message)
+	for _, attr := range attrs {
+		value := attr.Value.Resolve().String()
+		if strings.ContainsAny(value, " \t\n\"") {
+			value = fmt.Sprintf("%q", value)
+		}
+		sb.WriteString(" " + attr.Key + "=" + value)
+	}
+	sb.WriteString("\n")
+	if logging.status != "" {
+		fmt.Fprint(os.Stdout, clearLine)
+		defer fmt.Fprint(os.Stdout, logging.status)
+	}
+	_, err := io.WriteString(logging.out, sb.String())
+	return err
+}
+
+// WithAttrs 返回带有 attrs 字段的 logHandler
+func (h *logHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &logHandler{attrs: append(append([]slog.Attr{}, h.attrs...), attrs...)}
+}
+
+// WithGroup KYBNMR 的日志不使用分组，直接返回 h
+func (h *logHandler) WithGroup(string) slog.Handler {
+	return h
+}